@@ -0,0 +1,331 @@
+// Package aggregator merges the Go code of model responses into a single test file.
+package aggregator
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func isGPTAddedCodeBlockDelimeter(line string) bool {
+	return strings.HasPrefix(line, "```")
+}
+
+// stripCodeFences removes the markdown code fence lines models wrap their code in.
+func stripCodeFences(response string) string {
+	lines := strings.Split(response, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !isGPTAddedCodeBlockDelimeter(strings.TrimSpace(line)) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// parseResponse parses a response as a Go file, adding a package clause when it has none.
+func parseResponse(fset *token.FileSet, src string) (*ast.File, error) {
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err == nil {
+		return f, nil
+	}
+	// Snippets often come without a package clause.
+	if f2, err2 := parser.ParseFile(fset, "", "package p\n"+src, parser.ParseComments); err2 == nil {
+		return f2, nil
+	}
+	return nil, err
+}
+
+type importKey struct {
+	name string
+	path string
+}
+
+// aggregator merges the declarations of parsed responses.
+type aggregator struct {
+	pkgName    string
+	importSeen map[importKey]bool
+	imports    []importKey
+	chunks     []string
+}
+
+func (a *aggregator) addImports(f *ast.File) {
+	for _, imp := range f.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		k := importKey{path: path}
+		if imp.Name != nil {
+			k.name = imp.Name.Name
+		}
+		if a.importSeen[k] {
+			continue
+		}
+		a.importSeen[k] = true
+		a.imports = append(a.imports, k)
+	}
+}
+
+// addDecls prints every non-import declaration of the file together with its comments.
+// Comments outside of declarations are kept in place.
+// The dropped declarations are left out, comments included.
+func (a *aggregator) addDecls(fset *token.FileSet, f *ast.File, dropped map[ast.Decl]bool) {
+	type item struct {
+		pos  token.Pos
+		text string
+	}
+	var items []item
+	type span struct{ beg, end token.Pos }
+	var covered []span
+
+	for _, decl := range f.Decls {
+		beg := decl.Pos()
+		switch d := decl.(type) {
+		case *ast.GenDecl:
+			if d.Doc != nil {
+				beg = d.Doc.Pos()
+			}
+			if d.Tok == token.IMPORT {
+				covered = append(covered, span{beg, d.End()})
+				continue
+			}
+		case *ast.FuncDecl:
+			if d.Doc != nil {
+				beg = d.Doc.Pos()
+			}
+		}
+		covered = append(covered, span{beg, decl.End()})
+		if dropped[decl] {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, fset, &printer.CommentedNode{Node: decl, Comments: f.Comments}); err != nil {
+			continue
+		}
+		items = append(items, item{beg, buf.String()})
+	}
+
+	for _, cg := range f.Comments {
+		inDecl := false
+		for _, s := range covered {
+			if cg.Pos() >= s.beg && cg.End() <= s.end {
+				inDecl = true
+				break
+			}
+		}
+		if inDecl {
+			continue
+		}
+		var lines []string
+		for _, c := range cg.List {
+			lines = append(lines, c.Text)
+		}
+		items = append(items, item{cg.Pos(), strings.Join(lines, "\n")})
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return items[i].pos < items[j].pos })
+	for _, it := range items {
+		a.chunks = append(a.chunks, it.text)
+	}
+}
+
+// addUnparseable adds the part of a response that does not parse commented out, what names
+// the part.
+func (a *aggregator) addUnparseable(what string, response string) {
+	a.chunks = append(a.chunks, "// goptest: this "+what+" could not be parsed as Go code and is kept commented out.\n"+
+		strings.TrimSuffix(trimTrailingSpace(commentLines(strings.TrimSpace(response))), "\n"))
+}
+
+func (a *aggregator) render(comment bool) string {
+	var b strings.Builder
+	if a.pkgName != "" {
+		b.WriteString("package " + a.pkgName + "\n\n")
+	}
+	if len(a.imports) > 0 {
+		// Standard library imports first, then a separate group for everything else.
+		var std, other []importKey
+		for _, imp := range a.imports {
+			if IsStdlibImport(imp.path) {
+				std = append(std, imp)
+			} else {
+				other = append(other, imp)
+			}
+		}
+		// Sorted, so the order the responses import in does not change the file.
+		for _, group := range [][]importKey{std, other} {
+			sort.Slice(group, func(i, j int) bool {
+				if group[i].path != group[j].path {
+					return group[i].path < group[j].path
+				}
+				return group[i].name < group[j].name
+			})
+		}
+		b.WriteString("import (\n")
+		for i, group := range [][]importKey{std, other} {
+			if i > 0 && len(std) > 0 && len(other) > 0 {
+				b.WriteString("\n")
+			}
+			for _, imp := range group {
+				b.WriteString("\t")
+				if imp.name != "" {
+					b.WriteString(imp.name + " ")
+				}
+				b.WriteString(strconv.Quote(imp.path) + "\n")
+			}
+		}
+		b.WriteString(")\n\n")
+	}
+	body := strings.Join(a.chunks, "\n\n")
+	if comment && body != "" {
+		body = strings.TrimSuffix(commentLines(body), "\n")
+	}
+	b.WriteString(body)
+	b.WriteString("\n")
+
+	formatted, err := format.Source([]byte(b.String()))
+	if err != nil {
+		return trimTrailingSpace(b.String())
+	}
+	return string(formatted)
+}
+
+// normalizeNewlines turns the CRLF and CR line endings of a response into LF and drops its
+// byte order mark, so the same code gives the same file whatever platform it came through.
+func normalizeNewlines(response string) string {
+	response = strings.TrimPrefix(response, "\ufeff")
+	response = strings.ReplaceAll(response, "\r\n", "\n")
+	return strings.ReplaceAll(response, "\r", "\n")
+}
+
+// trimTrailingSpace removes the spaces and tabs at the end of the lines, which gofmt removes
+// from the files it can format.
+func trimTrailingSpace(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Aggregate combines the responses into a single gofmt'd Go tests file of package pkgName, or
+// of the first response when empty, with every declaration commented out when comment is
+// true. The same responses always give the same bytes, see the fixtures in testdata.
+func Aggregate(pkgName string, fs []string, comment bool) string {
+	return aggregate(pkgName, fs, comment, nil)
+}
+
+func aggregate(pkgName string, fs []string, comment bool, reg *Registry) string {
+	a := &aggregator{
+		pkgName:    pkgName,
+		importSeen: make(map[importKey]bool),
+	}
+	for _, response := range fs {
+		src := ExtractCode(normalizeNewlines(response))
+		if strings.TrimSpace(src) == "" {
+			continue
+		}
+		fset := token.NewFileSet()
+		if f, err := parseResponse(fset, src); err == nil {
+			a.add(fset, f, reg)
+			continue
+		}
+		// Keep the declarations that parse on their own, only the broken ones are commented out.
+		chunks := splitDecls(src)
+		files := make([]*ast.File, len(chunks))
+		parsed := false
+		for i, chunk := range chunks {
+			files[i], _ = parseResponse(fset, chunk)
+			parsed = parsed || files[i] != nil
+		}
+		if !parsed {
+			a.addUnparseable("response", src)
+			continue
+		}
+		var unparseable []string
+		for i, f := range files {
+			if f == nil {
+				unparseable = append(unparseable, chunks[i])
+				continue
+			}
+			if len(unparseable) > 0 {
+				a.addUnparseable("part of the response", strings.Join(unparseable, "\n"))
+				unparseable = nil
+			}
+			a.add(fset, f, reg)
+		}
+		if len(unparseable) > 0 {
+			a.addUnparseable("part of the response", strings.Join(unparseable, "\n"))
+		}
+	}
+	return a.render(comment)
+}
+
+func (a *aggregator) add(fset *token.FileSet, f *ast.File, reg *Registry) {
+	if a.pkgName == "" && f.Name.Name != "p" {
+		a.pkgName = f.Name.Name
+	}
+	var dropped map[ast.Decl]bool
+	if reg != nil {
+		dropped = reg.resolve(fset, f)
+	}
+	normalizeMocks(fset, f)
+	a.addImports(f)
+	a.addDecls(fset, f, dropped)
+}
+
+// declKeywords start the lines of top-level declarations.
+var declKeywords = []string{"package ", "import ", "func ", "type ", "var ", "const "}
+
+// splitDecls splits source that does not parse into its top-level declarations: every line
+// starting with a declaration keyword starts a chunk, together with the comment lines right
+// above it. Text before the first declaration is a chunk of its own.
+func splitDecls(src string) []string {
+	lines := strings.Split(src, "\n")
+	var chunks []string
+	start := 0
+	for i, line := range lines {
+		isDecl := false
+		for _, kw := range declKeywords {
+			isDecl = isDecl || strings.HasPrefix(line, kw)
+		}
+		if !isDecl {
+			continue
+		}
+		at := i
+		for at > start && strings.HasPrefix(lines[at-1], "//") {
+			at--
+		}
+		if at > start {
+			chunks = append(chunks, strings.Join(lines[start:at], "\n"))
+		}
+		start = at
+	}
+	return append(chunks, strings.Join(lines[start:], "\n"))
+}
+
+// IsStdlibImport reports whether the import path belongs to the standard library.
+// Standard library paths never have a dot in their first element.
+func IsStdlibImport(path string) bool {
+	first, _, _ := strings.Cut(path, "/")
+	return !strings.Contains(first, ".")
+}
+
+func commentLines(text string) string {
+	lines := strings.Split(text, "\n")
+	commentedText := ""
+
+	for _, line := range lines {
+		commentedLine := "// " + line
+		commentedText += commentedLine + "\n"
+	}
+
+	return commentedText
+}
@@ -0,0 +1,231 @@
+package aggregator
+
+import (
+	"flag"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+func TestAggregate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		pkgName string
+		comment bool
+	}{
+		{name: "different_imports", pkgName: "main"},
+		{name: "common_imports", pkgName: "main"},
+		{name: "import_block_and_fences", pkgName: "calc"},
+		{name: "commented", pkgName: "calc", comment: true},
+		{name: "aliased_imports_and_blocks", pkgName: "calc"},
+		{name: "unparseable", pkgName: "calc"},
+		{name: "partially_parseable", pkgName: "calc"},
+		{name: "indented_fences_and_prose", pkgName: "calc"},
+		{name: "crlf_and_unsorted_imports", pkgName: "calc"},
+		{name: "mock_setup", pkgName: "calc"},
+		{name: "mock_helpers", pkgName: "calc"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join("testdata", tc.name)
+			paths, err := filepath.Glob(filepath.Join(dir, "response_*.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(paths) == 0 {
+				t.Fatalf("no responses in %s", dir)
+			}
+			var responses []string
+			for _, p := range paths {
+				content, err := os.ReadFile(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				responses = append(responses, string(content))
+			}
+
+			output := Aggregate(tc.pkgName, responses, tc.comment)
+
+			goldenPath := filepath.Join(dir, "output.golden")
+			if *update {
+				if err := os.WriteFile(goldenPath, []byte(output), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != string(want) {
+				t.Errorf("output mismatch\ngot:\n%s\nwant:\n%s", output, want)
+			}
+		})
+	}
+}
+
+func TestAggregateDeterministic(t *testing.T) {
+	a := "import (\n\t\"strings\"\n\t\"bytes\"\n)\n\nfunc TestA(t *testing.T) { _ = strings.ToUpper; _ = bytes.ToUpper }\n"
+	b := "import \"testing\"\n\nfunc TestB(t *testing.T) {}\n"
+	want := Aggregate("calc", []string{a, b}, false)
+	for _, responses := range [][]string{
+		{strings.ReplaceAll(a, "\n", "\r\n"), b},
+		{strings.ReplaceAll(a, "\n", " \n"), "\ufeff" + b},
+		{strings.Replace(a, "\t\"strings\"\n\t\"bytes\"", "\t\"bytes\"\n\t\"strings\"", 1), b},
+	} {
+		if got := Aggregate("calc", responses, false); got != want {
+			t.Errorf("got\n%s\nwant\n%s", got, want)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	dir := t.TempDir()
+	existing := "package calc\n\ntype MockStore struct{ n int }\n\nfunc (m *MockStore) Get() int { return m.n }\n"
+	if err := os.WriteFile(filepath.Join(dir, "mocks_test.go"), []byte(existing), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	other := "package other\n\nfunc newCalc() {}\n"
+	if err := os.WriteFile(filepath.Join(dir, "other.go"), []byte(other), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := NewRegistry()
+	if err := reg.AddDir(dir, "calc"); err != nil {
+		t.Fatal(err)
+	}
+	responses := []string{
+		// The same mock as the existing one, with another comment and method order.
+		"// MockStore is a fake store.\ntype MockStore struct{ n int }\n\nfunc (m *MockStore) Get() int { return m.n }\n\n" +
+			"func newCalc() *Calc { return &Calc{} }\n\nfunc TestAdd(t *testing.T) { _ = newCalc() }\n",
+		// Another mock with the same name and a helper repeating the first response's name.
+		"type MockStore struct{ err error }\n\nfunc (m *MockStore) Get() int { return 0 }\n\n" +
+			"func newCalc() *Calc { return &Calc{store: &MockStore{}} }\n\nfunc TestSub(t *testing.T) { _ = newCalc() }\n",
+	}
+	got := reg.Aggregate("calc", responses, false)
+
+	for _, want := range []string{
+		"type MockStore2 struct{ err error }",
+		"func (m *MockStore2) Get() int",
+		"func newCalc2() *Calc { return &Calc{store: &MockStore2{}} }",
+		"func TestSub(t *testing.T) { _ = newCalc2() }",
+		"func TestAdd(t *testing.T) { _ = newCalc() }",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output misses %q:\n%s", want, got)
+		}
+	}
+	if n := strings.Count(got, "type MockStore struct"); n != 0 {
+		t.Errorf("the mock identical to the existing one is declared %d times:\n%s", n, got)
+	}
+	if strings.Contains(got, "fake store") {
+		t.Errorf("the comment of the dropped mock is kept:\n%s", got)
+	}
+	wantRenamed := []Rename{{From: "MockStore", To: "MockStore2"}, {From: "newCalc", To: "newCalc2"}}
+	if renamed := reg.Renamed(); !reflect.DeepEqual(renamed, wantRenamed) {
+		t.Errorf("Renamed() = %+v, want %+v", renamed, wantRenamed)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	existing := "package calc\n\nimport (\n\t\"testing\"\n)\n\n// TestAdd is written by hand.\nfunc TestAdd(t *testing.T) {\n\tif Add(1, 1) != 2 {\n\t\tt.Fail()\n\t}\n}\n\nvar cases = 1\n"
+	code := "```go\npackage calc\n\nimport (\n\t\"testing\"\n\n\t\"github.com/google/go-cmp/cmp\"\n)\n\n" +
+		"func TestAdd(t *testing.T) {}\n\n// TestSub checks Sub.\nfunc TestSub(t *testing.T) { _ = cmp.Diff(1, 2) }\n\nvar (\n\tcases = 2\n\tlimit = 3\n)\n```"
+
+	got, added, skipped, err := Merge(existing, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\t\"testing\"\n\t\"github.com/google/go-cmp/cmp\"\n)",
+		existing[strings.Index(existing, "// TestAdd"):],
+		"// TestSub checks Sub.\nfunc TestSub(t *testing.T) { _ = cmp.Diff(1, 2) }",
+		"var limit = 3",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("merged file misses %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "func TestAdd(t *testing.T) {}") || strings.Contains(got, "cases = 2") {
+		t.Errorf("declarations of the existing file are added again:\n%s", got)
+	}
+	if want := []string{"TestSub", "limit"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("added = %v, want %v", added, want)
+	}
+	if want := []string{"TestAdd", "cases"}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("skipped = %v, want %v", skipped, want)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "", got, 0); err != nil {
+		t.Errorf("merged file does not parse: %v\n%s", err, got)
+	}
+
+	got, _, _, err = Merge("package calc\n", "func TestSub(t *testing.T) { _ = cmp.Diff(1, 2) }\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "package calc\n\nfunc TestSub(t *testing.T) { _ = cmp.Diff(1, 2) }\n"; got != want {
+		t.Errorf("Merge into an empty file = %q, want %q", got, want)
+	}
+}
+
+func TestRegistryTests(t *testing.T) {
+	dir := t.TempDir()
+	existing := "package calc\n\nfunc TestAdd(t *testing.T) { t.Log(\"hand-written\") }\n"
+	if err := os.WriteFile(filepath.Join(dir, "calc_test.go"), []byte(existing), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reg := NewRegistry()
+	if err := reg.AddDir(dir, "calc"); err != nil {
+		t.Fatal(err)
+	}
+	responses := []string{
+		"func TestAdd(t *testing.T) { t.Log(\"generated\") }\n\nfunc TestSub(t *testing.T) {}\n",
+		// The same TestSub again, and two different tests with one name in a response.
+		"func TestSub(t *testing.T) {}\n\nfunc TestMul(t *testing.T) { t.Log(1) }\n\nfunc TestMul(t *testing.T) { t.Log(2) }\n",
+	}
+	got := reg.Aggregate("calc", responses, false)
+
+	for _, want := range []string{
+		"func TestAdd2(t *testing.T) { t.Log(\"generated\") }",
+		"func TestMul(t *testing.T) { t.Log(1) }",
+		"func TestMul2(t *testing.T) { t.Log(2) }",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output misses %q:\n%s", want, got)
+		}
+	}
+	if n := strings.Count(got, "func TestSub("); n != 1 {
+		t.Errorf("the identical TestSub is declared %d times:\n%s", n, got)
+	}
+	want := []Rename{{From: "TestAdd", To: "TestAdd2"}, {From: "TestMul", To: "TestMul2"}}
+	if renamed := reg.Renamed(); !reflect.DeepEqual(renamed, want) {
+		t.Errorf("Renamed() = %v, want %v", renamed, want)
+	}
+}
+
+func TestExtractCode(t *testing.T) {
+	testCases := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{name: "plain code", response: "func TestA(t *testing.T) {}\n", want: "func TestA(t *testing.T) {}\n"},
+		{name: "unclosed fence", response: "Here:\n```golang\nfunc TestA(t *testing.T) {}\n", want: "func TestA(t *testing.T) {}\n"},
+		{name: "go and yaml blocks", response: "```yaml\nname: a\n```\n  ```go\n  func TestA(t *testing.T) {}\n  ```\n", want: "func TestA(t *testing.T) {}"},
+		{name: "prose around code", response: "The test:\nfunc TestA(t *testing.T) {\n}\nThat's it.", want: "func TestA(t *testing.T) {\n}"},
+		{name: "unparseable", response: "Sorry:\nfunc TestA(t *testing.T) {\n", want: "Sorry:\nfunc TestA(t *testing.T) {\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ExtractCode(tc.response); got != tc.want {
+				t.Errorf("ExtractCode() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package aggregator
+
+import (
+	"go/token"
+	"strings"
+)
+
+// goFenceTags are the info strings of the fences around Go code, lowercased.
+var goFenceTags = map[string]bool{"": true, "go": true, "golang": true}
+
+// ExtractCode returns the Go code of a model response. The contents of the fenced code blocks
+// tagged go, golang or nothing are joined, whatever their indentation and the prose around
+// them, and an unclosed fence runs to the end of the response. Without such blocks, the prose
+// before the first and after the last top-level declaration is dropped when the rest parses.
+// Responses that still do not parse are returned with their fence lines removed.
+func ExtractCode(response string) string {
+	if blocks := goBlocks(response); len(blocks) > 0 {
+		return strings.Join(blocks, "\n\n")
+	}
+	src := stripCodeFences(response)
+	if _, err := parseResponse(token.NewFileSet(), src); err == nil {
+		return src
+	}
+	if trimmed := trimProse(src); trimmed != src {
+		if _, err := parseResponse(token.NewFileSet(), trimmed); err == nil {
+			return trimmed
+		}
+	}
+	return src
+}
+
+// goBlocks returns the contents of the Go code blocks of a markdown text, with the indentation
+// of their fences removed.
+func goBlocks(text string) []string {
+	var blocks []string
+	var block []string
+	inBlock, isGo := false, false
+	indent := ""
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !inBlock {
+			if isGPTAddedCodeBlockDelimeter(trimmed) {
+				inBlock = true
+				tag := strings.ToLower(strings.TrimSpace(strings.TrimLeft(trimmed, "`")))
+				isGo = goFenceTags[tag]
+				indent = line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+				block = nil
+			}
+			continue
+		}
+		if trimmed == strings.Repeat("`", len(trimmed)) && len(trimmed) >= 3 {
+			inBlock = false
+			if isGo {
+				blocks = append(blocks, strings.Join(block, "\n"))
+			}
+			continue
+		}
+		block = append(block, strings.TrimPrefix(line, indent))
+	}
+	if inBlock && isGo {
+		blocks = append(blocks, strings.Join(block, "\n"))
+	}
+	return blocks
+}
+
+// trimProse drops the lines before the first top-level declaration, with its doc comment, and
+// the lines after the last closing brace or parenthesis of a top-level declaration.
+func trimProse(src string) string {
+	lines := strings.Split(src, "\n")
+	first := -1
+	for i, line := range lines {
+		if isDeclLine(line) {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return src
+	}
+	for first > 0 && strings.HasPrefix(lines[first-1], "//") {
+		first--
+	}
+	last := len(lines) - 1
+	for last > first && !isDeclEnd(lines[last]) {
+		last--
+	}
+	return strings.Join(lines[first:last+1], "\n")
+}
+
+func isDeclLine(line string) bool {
+	for _, kw := range declKeywords {
+		if strings.HasPrefix(line, kw) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeclEnd reports whether the line can end a top-level declaration.
+func isDeclEnd(line string) bool {
+	line = strings.TrimRight(line, " \t")
+	return line == "}" || line == ")" || isDeclLine(line) && !strings.HasSuffix(line, "{") && !strings.HasSuffix(line, "(")
+}
@@ -0,0 +1,202 @@
+package aggregator
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Merge adds the declarations of the generated code to the existing Go file, keeping its
+// content as is. Declarations whose name the file already declares are skipped, so
+// hand-written tests and helpers win over generated ones, and the imports of the generated
+// code are added to the file's import block. It returns the merged source with the names of
+// the added and skipped declarations. The result should be run through goimports to drop
+// the imports only the skipped declarations used.
+func Merge(existing string, code string) (merged string, added []string, skipped []string, err error) {
+	fset := token.NewFileSet()
+	ef, err := parser.ParseFile(fset, "", existing, parser.ParseComments)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	code = ExtractCode(code)
+	gf, err := parser.ParseFile(fset, "", code, parser.ParseComments)
+	if err != nil {
+		code = "package p\n" + code
+		if gf, err = parser.ParseFile(fset, "", code, parser.ParseComments); err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	declared := make(map[string]bool)
+	for _, decl := range ef.Decls {
+		for _, name := range declNames(decl) {
+			declared[name] = true
+		}
+	}
+	offset := func(pos token.Pos) int { return fset.Position(pos).Offset }
+
+	// claim declares the names of a generated declaration, unless one is declared already.
+	claim := func(names []string) bool {
+		for _, name := range names {
+			if declared[name] {
+				skipped = append(skipped, names...)
+				return false
+			}
+		}
+		for _, name := range names {
+			declared[name] = true
+		}
+		added = append(added, names...)
+		return true
+	}
+	source := func(node ast.Node, doc *ast.CommentGroup) string {
+		start := node.Pos()
+		if doc != nil {
+			start = doc.Pos()
+		}
+		return code[offset(start):offset(node.End())]
+	}
+
+	var decls []string
+	for _, decl := range gf.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if claim(declNames(decl)) {
+				decls = append(decls, source(decl, decl.Doc))
+			}
+		case *ast.GenDecl:
+			switch {
+			case decl.Tok == token.IMPORT:
+			case decl.Tok == token.CONST && decl.Lparen.IsValid():
+				// Constant groups may repeat the values of their previous specs and are kept whole.
+				if claim(declNames(decl)) {
+					decls = append(decls, source(decl, decl.Doc))
+				}
+			default:
+				// Every spec is added as its own declaration, so the new ones of a group are kept.
+				for _, spec := range decl.Specs {
+					if !claim(specNames(spec)) {
+						continue
+					}
+					doc := specDoc(spec)
+					if doc == nil && !decl.Lparen.IsValid() {
+						doc = decl.Doc
+					}
+					text := decl.Tok.String() + " " + source(spec, nil)
+					if doc != nil {
+						text = source(doc, nil) + "\n" + text
+					}
+					decls = append(decls, text)
+				}
+			}
+		}
+	}
+
+	// Edits are applied from the end of the file, so the offsets of the earlier ones stay valid.
+	type edit struct {
+		at   int
+		text string
+	}
+	var edits []edit
+	if len(decls) > 0 {
+		edits = append(edits, edit{at: len(existing), text: "\n" + strings.Join(decls, "\n\n") + "\n"})
+	}
+	if imports := missingImports(ef, gf); len(imports) > 0 {
+		var block *ast.GenDecl
+		for _, decl := range ef.Decls {
+			if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.IMPORT && gd.Lparen.IsValid() {
+				block = gd
+				break
+			}
+		}
+		switch {
+		case block != nil:
+			edits = append(edits, edit{at: offset(block.Rparen), text: "\t" + strings.Join(imports, "\n\t") + "\n"})
+		default:
+			at := offset(ef.Name.End())
+			if n := len(ef.Imports); n > 0 {
+				at = offset(ef.Imports[n-1].End())
+			}
+			edits = append(edits, edit{at: at, text: "\n\nimport (\n\t" + strings.Join(imports, "\n\t") + "\n)"})
+		}
+	}
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].at > edits[j].at })
+	merged = existing
+	for _, e := range edits {
+		merged = merged[:e.at] + e.text + merged[e.at:]
+	}
+	return merged, added, skipped, nil
+}
+
+// missingImports returns the import specs of gf whose path ef does not import.
+func missingImports(ef *ast.File, gf *ast.File) []string {
+	seen := make(map[string]bool)
+	for _, imp := range ef.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		seen[path] = true
+	}
+	var res []string
+	for _, imp := range gf.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		spec := imp.Path.Value
+		if imp.Name != nil {
+			spec = imp.Name.Name + " " + spec
+		}
+		res = append(res, spec)
+	}
+	return res
+}
+
+// declNames returns the names a declaration adds to the package scope, methods as
+// Type.Method. Blank names and init functions never conflict and are left out.
+func declNames(decl ast.Decl) []string {
+	switch decl := decl.(type) {
+	case *ast.FuncDecl:
+		if decl.Recv == nil && decl.Name.Name == "init" {
+			return nil
+		}
+		if decl.Recv != nil {
+			return []string{receiverType(decl) + "." + decl.Name.Name}
+		}
+		return []string{decl.Name.Name}
+	case *ast.GenDecl:
+		var names []string
+		for _, spec := range decl.Specs {
+			names = append(names, specNames(spec)...)
+		}
+		return names
+	}
+	return nil
+}
+
+func specNames(spec ast.Spec) []string {
+	var names []string
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		names = append(names, spec.Name.Name)
+	case *ast.ValueSpec:
+		for _, name := range spec.Names {
+			if name.Name != "_" {
+				names = append(names, name.Name)
+			}
+		}
+	}
+	return names
+}
+
+func specDoc(spec ast.Spec) *ast.CommentGroup {
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		return spec.Doc
+	case *ast.ValueSpec:
+		return spec.Doc
+	}
+	return nil
+}
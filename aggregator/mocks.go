@@ -0,0 +1,343 @@
+package aggregator
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// gomockPaths are the import paths of gomock.
+var gomockPaths = map[string]bool{
+	"github.com/golang/mock/gomock": true,
+	"go.uber.org/mock/gomock":       true,
+}
+
+const testifyMockPath = "github.com/stretchr/testify/mock"
+
+// normalizeMocks fixes the mock setup models get wrong in every function of f: a second
+// gomock controller created with the same arguments in the same block reuses the first, every
+// controller is finished and every testify mock set up with On is asserted. The missing calls
+// are deferred right after the controller or mock is declared, only in the tests and only for
+// the ones the test keeps to itself, not for those returned or stored by helpers. Aggregate
+// applies it to every response.
+func normalizeMocks(fset *token.FileSet, f *ast.File) {
+	gomockName, testify := "gomock", false
+	for _, imp := range f.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		if gomockPaths[path] && imp.Name != nil {
+			gomockName = imp.Name.Name
+		}
+		testify = testify || path == testifyMockPath
+	}
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Body != nil {
+			reuseControllers(fset, fn.Body, gomockName)
+			if isTest(fn) {
+				finishControllers(fn, gomockName)
+				assertMocks(fset, fn, testify)
+			}
+		}
+	}
+}
+
+// controllerVar returns the variable the statement assigns a new gomock controller to.
+func controllerVar(stmt ast.Stmt, gomockName string) (*ast.Ident, *ast.CallExpr) {
+	assign, ok := stmt.(*ast.AssignStmt)
+	if !ok || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+		return nil, nil
+	}
+	id, ok := assign.Lhs[0].(*ast.Ident)
+	if !ok || id.Obj == nil {
+		return nil, nil
+	}
+	call, ok := assign.Rhs[0].(*ast.CallExpr)
+	if !ok || !isSelector(call.Fun, gomockName, "NewController") {
+		return nil, nil
+	}
+	return id, call
+}
+
+// reuseControllers drops the controllers created with the same arguments as an earlier one of
+// their block, and their Finish calls, and has their mocks use the earlier one.
+func reuseControllers(fset *token.FileSet, body *ast.BlockStmt, gomockName string) {
+	renames := make(map[*ast.Object]string)
+	ast.Inspect(body, func(n ast.Node) bool {
+		block, ok := n.(*ast.BlockStmt)
+		if !ok {
+			return true
+		}
+		first := make(map[string]*ast.Ident)
+		var dropped []*ast.Object
+		kept := block.List[:0]
+		for _, stmt := range block.List {
+			if id, call := controllerVar(stmt, gomockName); id != nil {
+				key := nodeSource(fset, call)
+				if prev, ok := first[key]; ok {
+					renames[id.Obj] = prev.Name
+					dropped = append(dropped, id.Obj)
+					continue
+				}
+				first[key] = id
+			}
+			kept = append(kept, stmt)
+		}
+		block.List = kept
+		if len(dropped) > 0 {
+			block.List = dropCalls(block.List, dropped, "Finish")
+		}
+		return true
+	})
+	if len(renames) == 0 {
+		return
+	}
+	ast.Inspect(body, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Obj != nil {
+			if to, ok := renames[id.Obj]; ok {
+				id.Name = to
+			}
+		}
+		return true
+	})
+}
+
+// dropCalls removes the statements calling or deferring method on one of objs.
+func dropCalls(list []ast.Stmt, objs []*ast.Object, method string) []ast.Stmt {
+	kept := list[:0]
+	for _, stmt := range list {
+		var call *ast.CallExpr
+		switch s := stmt.(type) {
+		case *ast.DeferStmt:
+			call = s.Call
+		case *ast.ExprStmt:
+			call, _ = s.X.(*ast.CallExpr)
+		}
+		drop := false
+		for _, obj := range objs {
+			drop = drop || (call != nil && isMethodCall(call, obj, method))
+		}
+		if !drop {
+			kept = append(kept, stmt)
+		}
+	}
+	return kept
+}
+
+// isTest reports whether fn is a test function taking a *testing.T.
+func isTest(fn *ast.FuncDecl) bool {
+	return fn.Recv == nil && strings.HasPrefix(fn.Name.Name, "Test") && testingT(fn.Type) != ""
+}
+
+// escapes reports whether the variable obj outlives the block of fn it is declared in: when
+// it is declared elsewhere, returned, assigned to a field or a variable declared elsewhere,
+// or used by a closure it is not declared in.
+func escapes(fn *ast.FuncDecl, obj *ast.Object) bool {
+	if !declaredIn(fn.Body, obj) {
+		return true
+	}
+	found := false
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		switch s := n.(type) {
+		case *ast.ReturnStmt:
+			found = uses(s, obj)
+		case *ast.AssignStmt:
+			for _, rhs := range s.Rhs {
+				if !uses(rhs, obj) {
+					continue
+				}
+				for _, lhs := range s.Lhs {
+					id, ok := lhs.(*ast.Ident)
+					found = found || !ok || (id.Name != "_" && !declaredIn(fn.Body, id.Obj))
+				}
+			}
+		case *ast.FuncLit:
+			found = !declaredIn(s, obj) && uses(s.Body, obj)
+		}
+		return !found
+	})
+	return found
+}
+
+// declaredIn reports whether the declaration of obj is in node.
+func declaredIn(node ast.Node, obj *ast.Object) bool {
+	if obj == nil {
+		return false
+	}
+	decl, ok := obj.Decl.(ast.Node)
+	return ok && decl.Pos() >= node.Pos() && decl.End() <= node.End()
+}
+
+// uses reports whether node refers to obj.
+func uses(node ast.Node, obj *ast.Object) bool {
+	found := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Obj == obj {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// finishControllers defers Finish after the controllers of the test never finished.
+func finishControllers(fn *ast.FuncDecl, gomockName string) {
+	insertAfter(fn.Body, func(stmt ast.Stmt) ast.Stmt {
+		id, _ := controllerVar(stmt, gomockName)
+		if id == nil || callsMethod(fn.Body, id.Obj, "Finish") || escapes(fn, id.Obj) {
+			return nil
+		}
+		return deferCall(id.Name, "Finish")
+	})
+}
+
+// assertMocks defers AssertExpectations after the testify mocks of the test that have
+// expectations set with On but are never asserted. Only mocks created with new(T) or &T{} are
+// considered, and only with the testify mock package imported or T named like a mock.
+func assertMocks(fset *token.FileSet, fn *ast.FuncDecl, testify bool) {
+	insertAfter(fn.Body, func(stmt ast.Stmt) ast.Stmt {
+		assign, ok := stmt.(*ast.AssignStmt)
+		if !ok || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+			return nil
+		}
+		id, ok := assign.Lhs[0].(*ast.Ident)
+		if !ok || id.Obj == nil || !isNewMock(fset, assign.Rhs[0], testify) {
+			return nil
+		}
+		if !callsMethod(fn.Body, id.Obj, "On") || callsMethod(fn.Body, id.Obj, "AssertExpectations") ||
+			assertedForObjects(fn.Body, id.Obj) || escapes(fn, id.Obj) {
+			return nil
+		}
+		t := testingParam(fn, stmt)
+		if t == "" {
+			return nil
+		}
+		s := deferCall(id.Name, "AssertExpectations")
+		s.Call.Args = []ast.Expr{ast.NewIdent(t)}
+		return s
+	})
+}
+
+// isNewMock reports whether expr creates a mock with new(T) or &T{}.
+func isNewMock(fset *token.FileSet, expr ast.Expr, testify bool) bool {
+	var typ ast.Expr
+	switch e := expr.(type) {
+	case *ast.CallExpr:
+		if id, ok := e.Fun.(*ast.Ident); ok && id.Name == "new" && len(e.Args) == 1 {
+			typ = e.Args[0]
+		}
+	case *ast.UnaryExpr:
+		if lit, ok := e.X.(*ast.CompositeLit); ok && e.Op == token.AND {
+			typ = lit.Type
+		}
+	}
+	if typ == nil {
+		return false
+	}
+	return testify || strings.Contains(strings.ToLower(nodeSource(fset, typ)), "mock")
+}
+
+// assertedForObjects reports whether body passes obj to mock.AssertExpectationsForObjects.
+func assertedForObjects(body ast.Node, obj *ast.Object) bool {
+	found := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || found {
+			return !found
+		}
+		if sel, ok := call.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "AssertExpectationsForObjects" {
+			for _, arg := range call.Args {
+				if id, ok := arg.(*ast.Ident); ok && id.Obj == obj {
+					found = true
+				}
+			}
+		}
+		return true
+	})
+	return found
+}
+
+// testingParam returns the name of the *testing.T parameter of the innermost function of fn
+// enclosing stmt, "" when it has none.
+func testingParam(fn *ast.FuncDecl, stmt ast.Stmt) string {
+	name := testingT(fn.Type)
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		lit, ok := n.(*ast.FuncLit)
+		if !ok || stmt.Pos() < lit.Pos() || stmt.End() > lit.End() {
+			return true
+		}
+		name = testingT(lit.Type)
+		return true
+	})
+	return name
+}
+
+// testingT returns the name of the *testing.T parameter of the function type.
+func testingT(ft *ast.FuncType) string {
+	for _, field := range ft.Params.List {
+		star, ok := field.Type.(*ast.StarExpr)
+		if !ok || !isSelector(star.X, "testing", "T") || len(field.Names) == 0 {
+			continue
+		}
+		return field.Names[0].Name
+	}
+	return ""
+}
+
+// insertAfter walks the blocks of body and inserts the statement stmtAfter returns after
+// every statement it returns one for.
+func insertAfter(body *ast.BlockStmt, stmtAfter func(ast.Stmt) ast.Stmt) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		block, ok := n.(*ast.BlockStmt)
+		if !ok {
+			return true
+		}
+		var list []ast.Stmt
+		for _, stmt := range block.List {
+			list = append(list, stmt)
+			if s := stmtAfter(stmt); s != nil {
+				list = append(list, s)
+			}
+		}
+		block.List = list
+		return true
+	})
+}
+
+// callsMethod reports whether node calls method on obj.
+func callsMethod(node ast.Node, obj *ast.Object, method string) bool {
+	found := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok && isMethodCall(call, obj, method) {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+func isMethodCall(call *ast.CallExpr, obj *ast.Object, method string) bool {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != method {
+		return false
+	}
+	id, ok := sel.X.(*ast.Ident)
+	return ok && id.Obj == obj
+}
+
+func isSelector(expr ast.Expr, x string, sel string) bool {
+	s, ok := expr.(*ast.SelectorExpr)
+	if !ok || s.Sel.Name != sel {
+		return false
+	}
+	id, ok := s.X.(*ast.Ident)
+	return ok && id.Name == x
+}
+
+func deferCall(recv string, method string) *ast.DeferStmt {
+	return &ast.DeferStmt{Call: &ast.CallExpr{
+		Fun: &ast.SelectorExpr{X: ast.NewIdent(recv), Sel: ast.NewIdent(method)},
+	}}
+}
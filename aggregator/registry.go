@@ -0,0 +1,303 @@
+package aggregator
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Rename records a declaration renamed because another declaration of the package had its name.
+type Rename struct {
+	From string
+	To   string
+}
+
+// Registry keeps the top-level names declared in a package across the aggregations of a run,
+// so the types, mocks, helpers and tests models declare in several responses, e.g. a MockStore
+// for every target or a TestParse for two specs, do not collide. A declaration identical to the
+// registered one is dropped and a different one is renamed, together with its references in
+// its response. Aggregate, without a Registry, keeps repeated declarations as they are.
+//
+// A Registry is safe for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	decls   map[string]string
+	renamed []Rename
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{decls: make(map[string]string)}
+}
+
+// AddDir registers the declarations of the Go files of package pkgName in dir, drafts
+// included, except the files in skip.
+func (r *Registry) AddDir(dir string, pkgName string, skip ...string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return err
+	}
+	skipped := make(map[string]bool)
+	for _, p := range skip {
+		if abs, err := filepath.Abs(p); err == nil {
+			skipped[abs] = true
+		}
+	}
+	for _, p := range paths {
+		if abs, err := filepath.Abs(p); err == nil && skipped[abs] {
+			continue
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, p, content, 0)
+		if err != nil || f.Name.Name != pkgName {
+			continue
+		}
+		r.mu.Lock()
+		for _, g := range declGroups(fset, f) {
+			for _, name := range g.names {
+				if _, ok := r.decls[name]; !ok {
+					r.decls[name] = g.src
+				}
+			}
+		}
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// Renamed returns the declarations renamed so far, in order.
+func (r *Registry) Renamed() []Rename {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Rename(nil), r.renamed...)
+}
+
+// Aggregate combines the responses like Aggregate, resolving the conflicts of their
+// declarations with the ones registered before and registering them.
+func (r *Registry) Aggregate(pkgName string, fs []string, comment bool) string {
+	return aggregate(pkgName, fs, comment, r)
+}
+
+// declGroup is a top-level declaration with the names it declares: a type with its methods,
+// a function or a var or const spec.
+type declGroup struct {
+	names []string
+	src   string
+	// spec is the type or value spec of the group, nil for functions.
+	spec  ast.Spec
+	decls []ast.Decl
+}
+
+// declGroups returns the top-level declarations of f that can collide with other files of
+// the package. Example functions, whose names must match what they document, and init are
+// left out.
+func declGroups(fset *token.FileSet, f *ast.File) []*declGroup {
+	var groups []*declGroup
+	types := make(map[string]*declGroup)
+	var methods []*ast.FuncDecl
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.GenDecl:
+			for _, s := range d.Specs {
+				switch s := s.(type) {
+				case *ast.TypeSpec:
+					g := &declGroup{names: []string{s.Name.Name}, spec: s, decls: []ast.Decl{d}}
+					types[s.Name.Name] = g
+					groups = append(groups, g)
+				case *ast.ValueSpec:
+					g := &declGroup{spec: s, decls: []ast.Decl{d}}
+					for _, n := range s.Names {
+						if n.Name != "_" {
+							g.names = append(g.names, n.Name)
+						}
+					}
+					if len(g.names) > 0 {
+						groups = append(groups, g)
+					}
+				}
+			}
+		case *ast.FuncDecl:
+			if d.Recv != nil {
+				methods = append(methods, d)
+			} else if !isExampleOrInit(d.Name.Name) {
+				groups = append(groups, &declGroup{names: []string{d.Name.Name}, decls: []ast.Decl{d}})
+			}
+		}
+	}
+	for _, m := range methods {
+		if g := types[receiverType(m)]; g != nil {
+			g.decls = append(g.decls, m)
+		}
+	}
+	for _, g := range groups {
+		var parts []string
+		if g.spec != nil {
+			parts = append(parts, nodeSource(fset, g.spec))
+		}
+		for _, d := range g.decls {
+			if _, ok := d.(*ast.FuncDecl); ok {
+				parts = append(parts, nodeSource(fset, d))
+			}
+		}
+		// Methods in any order declare the same type.
+		if len(parts) > 1 {
+			sort.Strings(parts[1:])
+		}
+		g.src = strings.Join(parts, "\n")
+	}
+	return groups
+}
+
+// resolve drops the declarations of f identical to registered ones, renames the ones
+// conflicting with them and registers the others. It returns the dropped declarations.
+func (r *Registry) resolve(fset *token.FileSet, f *ast.File) map[ast.Decl]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dropped := make(map[ast.Decl]bool)
+	renames := make(map[*ast.Object]string)
+	for _, g := range declGroups(fset, f) {
+		identical, conflict := true, false
+		for _, name := range g.names {
+			src, ok := r.decls[name]
+			identical = identical && ok && src == g.src
+			conflict = conflict || ok
+		}
+		switch {
+		case identical:
+			r.drop(g, dropped)
+		case conflict:
+			for _, name := range g.names {
+				if _, ok := r.decls[name]; !ok {
+					r.decls[name] = g.src
+					continue
+				}
+				to := r.freeName(f, name)
+				r.decls[to] = g.src
+				r.renamed = append(r.renamed, Rename{From: name, To: to})
+				obj := f.Scope.Lookup(name)
+				if fn, ok := g.decls[0].(*ast.FuncDecl); ok {
+					// A function declared twice in the response is not the one in its scope.
+					obj = fn.Name.Obj
+					fn.Name.Name = to
+				}
+				if obj != nil {
+					renames[obj] = to
+				}
+			}
+		default:
+			for _, name := range g.names {
+				r.decls[name] = g.src
+			}
+		}
+	}
+	if len(renames) > 0 {
+		ast.Inspect(f, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok && id.Obj != nil {
+				if to, ok := renames[id.Obj]; ok {
+					id.Name = to
+				}
+			}
+			return true
+		})
+	}
+	return dropped
+}
+
+// drop removes the declarations of the group, and the enclosing declaration once its last
+// spec is removed.
+func (r *Registry) drop(g *declGroup, dropped map[ast.Decl]bool) {
+	for _, d := range g.decls {
+		gen, ok := d.(*ast.GenDecl)
+		if !ok {
+			dropped[d] = true
+			continue
+		}
+		specs := gen.Specs[:0]
+		for _, s := range gen.Specs {
+			if s != g.spec {
+				specs = append(specs, s)
+			}
+		}
+		if len(specs) == 0 {
+			dropped[d] = true
+			continue
+		}
+		gen.Specs = specs
+	}
+}
+
+// freeName returns the first of name2, name3, ... neither registered nor declared in f.
+// Names ending with a digit are numbered after an underscore.
+func (r *Registry) freeName(f *ast.File, name string) string {
+	sep := ""
+	if last := name[len(name)-1]; unicode.IsDigit(rune(last)) {
+		sep = "_"
+	}
+	for n := 2; ; n++ {
+		to := name + sep + strconv.Itoa(n)
+		if _, ok := r.decls[to]; !ok && f.Scope.Lookup(to) == nil {
+			return to
+		}
+	}
+}
+
+func isExampleOrInit(name string) bool {
+	return name == "init" || name == "_" || strings.HasPrefix(name, "Example")
+}
+
+// receiverType returns the name of the type of the method's receiver.
+func receiverType(fn *ast.FuncDecl) string {
+	expr := fn.Recv.List[0].Type
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// nodeSource prints the node without its comments, to compare declarations.
+func nodeSource(fset *token.FileSet, node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.FuncDecl:
+		c := *n
+		c.Doc = nil
+		node = &c
+	case *ast.TypeSpec:
+		c := *n
+		c.Doc, c.Comment = nil, nil
+		node = &c
+	case *ast.ValueSpec:
+		c := *n
+		c.Doc, c.Comment = nil, nil
+		node = &c
+	}
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, node); err != nil {
+		return ""
+	}
+	return buf.String()
+}
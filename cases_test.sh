@@ -1,4 +1,4 @@
 #!/bin/bash
 
-go build main.go
-./main -cases=true -what="Add function" -spec-file=specs.yaml -code-files=testcode.go
+go build -o main ./cmd/goptest
+./main cases -what="Add function" -spec-file=specs.yaml -code-files=testdata/testcode.go
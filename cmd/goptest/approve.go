@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// ANSI colors of the highlighted Go code.
+const (
+	ansiReset   = "\x1b[0m"
+	ansiKeyword = "\x1b[1;34m"
+	ansiString  = "\x1b[32m"
+	ansiNumber  = "\x1b[35m"
+	ansiComment = "\x1b[90m"
+)
+
+// highlightGo colors the keywords, literals and comments of Go source for the terminal.
+// Source that does not scan is returned as is.
+func highlightGo(src string) string {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var s scanner.Scanner
+	failed := false
+	s.Init(file, []byte(src), func(token.Position, string) { failed = true }, scanner.ScanComments)
+
+	var b strings.Builder
+	last := 0
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		color := ""
+		switch {
+		case tok.IsKeyword():
+			color = ansiKeyword
+		case tok == token.STRING || tok == token.CHAR:
+			color = ansiString
+		case tok == token.INT || tok == token.FLOAT || tok == token.IMAG:
+			color = ansiNumber
+		case tok == token.COMMENT:
+			color = ansiComment
+		}
+		if color == "" {
+			continue
+		}
+		// The literal of keywords is the keyword.
+		offset := file.Offset(pos)
+		end := offset + len(lit)
+		b.WriteString(src[last:offset])
+		b.WriteString(color + src[offset:end] + ansiReset)
+		last = end
+	}
+	if failed {
+		return src
+	}
+	b.WriteString(src[last:])
+	return b.String()
+}
+
+// approver shows every generated test before it is drafted and lets the user accept, reject,
+// regenerate or edit it.
+type approver struct {
+	in    *bufio.Reader
+	out   io.Writer
+	color bool
+	// edit opens the file at path in the user's editor and returns once it is closed.
+	edit func(path string) error
+}
+
+// newApprover returns an approver reading the answers from stdin. The code is highlighted when
+// stdout is a terminal and $NO_COLOR is not set.
+func newApprover(stdin *bufio.Reader) *approver {
+	color := false
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		color = os.Getenv("NO_COLOR") == ""
+	}
+	return &approver{in: stdin, out: os.Stdout, color: color, edit: editFile}
+}
+
+// editFile opens the file in $EDITOR, vi by default.
+func editFile(path string) error {
+	args := strings.Fields(os.Getenv("EDITOR"))
+	if len(args) == 0 {
+		args = []string{"vi"}
+	}
+	cmd := exec.Command(args[0], append(args[1:], path)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// review shows the test code generated for spec and asks what to do with it until it is
+// accepted or rejected. regenerate asks the model for new code with additional instructions.
+// It returns the code to draft and false when the test was rejected. The remaining tests are
+// accepted once the input ends.
+func (a *approver) review(spec llm.Spec, code string, regenerate func(instructions string) (string, error)) (string, bool) {
+	for {
+		shown := code
+		if a.color {
+			shown = highlightGo(code)
+		}
+		fmt.Fprintf(a.out, "\n=== %s ===\n%s\n", spec.Name, strings.TrimRight(shown, "\n"))
+		fmt.Fprint(a.out, "[a]ccept, [r]eject, [g]enerate again with instructions or [e]dit? ")
+		answer, err := a.in.ReadString('\n')
+		if err != nil && answer == "" {
+			fmt.Fprintln(a.out, "\nNo more input, accepting")
+			return code, true
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "a", "accept", "":
+			return code, true
+		case "r", "reject":
+			return "", false
+		case "g", "generate":
+			fmt.Fprint(a.out, "Instructions: ")
+			instructions, _ := a.in.ReadString('\n')
+			regenerated, err := regenerate(strings.TrimSpace(instructions))
+			if err != nil {
+				fmt.Fprintf(a.out, "Failed to generate the test again: %v\n", err)
+				continue
+			}
+			code = regenerated
+		case "e", "edit":
+			edited, err := a.editCode(spec, code)
+			if err != nil {
+				fmt.Fprintf(a.out, "Failed to edit the test: %v\n", err)
+				continue
+			}
+			code = edited
+		default:
+			fmt.Fprintf(a.out, "Unknown answer %q\n", strings.TrimSpace(answer))
+		}
+	}
+}
+
+// editCode lets the user edit the code in a temporary file and returns the edited code.
+func (a *approver) editCode(spec llm.Spec, code string) (string, error) {
+	file, err := os.CreateTemp("", "goptest-"+spec.Name+"-*.go")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(code); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := a.edit(file.Name()); err != nil {
+		return "", err
+	}
+	edited, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", err
+	}
+	return string(edited), nil
+}
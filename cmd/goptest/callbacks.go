@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/sentiens/goptest/llm"
+	"github.com/sentiens/goptest/pipeline"
+)
+
+// cliCallbacks prints streamed output the way the command line always did and records
+// stage results in the run report.
+type cliCallbacks struct {
+	out    io.Writer
+	report *pipeline.RunReport
+}
+
+func (cb *cliCallbacks) OnStageStart(stage llm.Stage, target string) {
+	if stage == llm.StageCases {
+		fmt.Fprintln(cb.out, "Generating test cases")
+	}
+}
+
+func (cb *cliCallbacks) OnDelta(_ llm.Stage, _ string, delta string) {
+	fmt.Fprint(cb.out, delta)
+}
+
+func (cb *cliCallbacks) OnStageEnd(result llm.StageResult) {
+	cb.report.Add(result)
+}
+
+func (cb *cliCallbacks) OnRetry(event llm.RetryEvent) {
+	if event.Restart {
+		fmt.Fprintf(cb.out, "\nStream interrupted, restarting in %s...\n", event.Wait)
+		return
+	}
+	fmt.Fprintf(cb.out, "Request failed with status %d, retrying in %s...\n", event.StatusCode, event.Wait)
+}
@@ -0,0 +1,1548 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"go/token"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sentiens/goptest/aggregator"
+	"github.com/sentiens/goptest/llm"
+	"github.com/sentiens/goptest/pipeline"
+	"github.com/sentiens/goptest/spec"
+	"golang.org/x/tools/cover"
+)
+
+// command is a goptest subcommand with its own flags.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
+
+func commands() []command {
+	return []command{
+		{"cases", "Generate the YAML test cases (the spec file) for -what", runCases},
+		{"code", "Generate draft tests from the spec file", runCode},
+		{"all", "Run spec, test list, test cases and code generation in one go", runAll},
+		{"mocks", "Generate mocks for the dependencies of -what", runMocks},
+		{"rows", "Add cases to the table of an existing table-driven test", runRows},
+		{"fix", "Compile-check and run a test file and let the model fix it", runFix},
+		{"regression", "Generate a regression test for a fixed bug", runRegression},
+		{"characterize", "Generate tests pinning the current behavior of legacy code", runCharacterize},
+		{"coverage", "Generate tests for the code of a package its tests do not cover", runCoverage},
+		{"contract", "Generate a conformance suite for an interface and run it for its implementations", runContract},
+		{"differential", "Generate tests asserting two implementations agree", runDifferential},
+		{"import-feature", "Convert a Gherkin .feature file into a spec file", runImportFeature},
+		{"import-logs", "Convert function calls recorded in JSON lines logs or traces into a spec file", runImportLogs},
+		{"export-specs", "Export a spec file for test-management tools", runExportSpecs},
+		{"prompt", "Print the exact prompt a stage would send, without sending it", runPrompt},
+		{"daemon", "Keep an index of the module in memory to assemble the context of other invocations fast", runDaemon},
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: goptest <command> [flags]\n\nCommands:")
+	for _, cmd := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-15s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun goptest <command> -h for the flags of a command.")
+}
+
+// commandArgs splits the command line into the subcommand and its flags. Invocations without
+// a subcommand are still understood: -cases=true selects cases, anything else code.
+func commandArgs(args []string) (name string, rest []string, legacy bool) {
+	if !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:], false
+	}
+	name = "code"
+	for _, arg := range args {
+		switch strings.TrimLeft(arg, "-") {
+		case "cases", "cases=true":
+			name = "cases"
+		case "cases=false":
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return name, rest, true
+}
+
+// runCommand dispatches the command line to its subcommand.
+func runCommand(args []string) {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		usage()
+		os.Exit(2)
+	}
+	name, rest, legacy := commandArgs(args)
+	if legacy {
+		fmt.Fprintf(os.Stderr, "goptest: flags without a command are deprecated, use goptest %s\n", name)
+	}
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			cmd.run(rest)
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "goptest: unknown command %q\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func newFlagSet(name string, summary string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	addLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: goptest %s [flags]\n\n%s.\n\nFlags:\n", name, summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func summaryOf(name string) string {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd.summary
+		}
+	}
+	return ""
+}
+
+// clientFlags configure the API client.
+type clientFlags struct {
+	model          *string
+	maxTokens      *int
+	providerName   *string
+	apiBase        *string
+	parallel       *int
+	corpusDir      *string
+	maxAttempts    *int
+	specRetries    *int
+	format         *string
+	debugHTTP      *string
+	models         *string
+	modelStats     *string
+	distill        *bool
+	maxCost        *float64
+	usage          *bool
+	timeout        *time.Duration
+	requestTimeout *time.Duration
+	record         *string
+	replay         *string
+	artifacts      *string
+	// dryRun makes no API calls, set by -dry-run.
+	dryRun bool
+	// depPolicy restricts the imports of the generated code, set by the code flags.
+	depPolicy *llm.DependencyPolicy
+}
+
+func addClientFlags(fs *flag.FlagSet) *clientFlags {
+	f := &clientFlags{
+		model:        fs.String("model", "gpt-4", "Model to use"),
+		maxTokens:    fs.Int("max-tokens", 4000, "Maximum tokens for output"),
+		providerName: fs.String("provider", "openai", "LLM provider: openai or ollama"),
+		apiBase:      fs.String("api-base", "", "Base URL of an OpenAI compatible API, defaults to OPENAI_API_BASE"),
+		parallel:     fs.Int("parallel", 2, "Maximum number of concurrent API requests"),
+		corpusDir:    fs.String("prompt-corpus", "", "Directory to store sent prompts content-addressed and report re-sent context"),
+		maxAttempts:  fs.Int("max-attempts", llm.DefaultRetryPolicy.MaxAttempts, "Attempts per request when rate limited or on server errors, with exponential backoff"),
+		specRetries:  fs.Int("spec-retries", 2, "Times to request invalid test cases again with their validation errors, 0 to fail at once"),
+	}
+	f.format = fs.String("response-format", llm.FormatAuto, "Format of the test cases: auto tries JSON through function calling and falls back to YAML text, json or text")
+	f.debugHTTP = fs.String("debug-http", "", "Directory to record the status, latency, rate limit headers and request IDs of the API requests in, without prompts or credentials")
+	f.models = fs.String("models", "", "Comma-separated models from the cheapest to the strongest: every request goes to the cheapest one likely to succeed for its stage and is escalated on failure")
+	f.modelStats = fs.String("model-stats", llm.DefaultModelStatsPath(), "File keeping the per-stage success rates of the -models across runs")
+	f.distill = fs.Bool("distill", false, "Show the test code written by the stronger -models for the package to the cheaper ones as examples, kept in "+llm.ExamplesFileName)
+	f.maxCost = fs.Float64("max-cost", 0, "Estimated spend in USD not to exceed: requests that could exceed it are not sent. 0 for no limit")
+	f.usage = fs.Bool("usage", true, "Print the tokens and estimated cost per stage at the end of the run")
+	f.timeout = fs.Duration("timeout", 0, "Deadline of the whole run, e.g. 30m; the tests generated by then are still written. 0 for no deadline")
+	f.requestTimeout = fs.Duration("request-timeout", 5*time.Minute, "Deadline of every API request attempt, timed out attempts are retried. 0 for no deadline")
+	f.record = fs.String("record", "", "Directory to save every completed prompt and its response in, to replay them with -replay")
+	f.replay = fs.String("replay", "", "Directory of responses saved with -record to serve instead of calling the model, making no API calls")
+	f.artifacts = fs.String("artifacts", "", "Directory to keep every prompt attempt of the run in, with its raw response, in a run directory; the drafted tests link to their trace directory")
+	fs.IntVar(f.parallel, "concurrency", 2, "Alias of -parallel")
+	return f
+}
+
+// context returns the context of the run, canceled on interrupts and after -timeout.
+func (f *clientFlags) context() (context.Context, context.CancelFunc) {
+	ctx := interruptContext()
+	if *f.timeout > 0 {
+		return context.WithTimeout(ctx, *f.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// embedder returns the embeddings API of the provider.
+func (f *clientFlags) embedder() (llm.Embedder, error) {
+	if f.dryRun {
+		return nil, errors.New("no API calls in a dry run")
+	}
+	if *f.replay != "" {
+		return nil, errors.New("embeddings are not recorded, no API calls when replaying")
+	}
+	if *f.providerName != "openai" {
+		return nil, fmt.Errorf("embeddings are not supported with the %s provider", *f.providerName)
+	}
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		return nil, errors.New("no OpenAI API key provided")
+	}
+	config := openai.DefaultConfig(apiKey)
+	if base := *f.apiBase; base != "" {
+		config.BaseURL = base
+	} else if base := os.Getenv("OPENAI_API_BASE"); base != "" {
+		config.BaseURL = base
+	}
+	return llm.NewOpenAIProvider(openai.NewClientWithConfig(config), *f.model), nil
+}
+
+// client creates the API client reporting into report for the package in pkgDir, opts
+// override the flags. The returned function must be called once the command is done. The
+// client of a dry run writes no files: no prompt corpus, HTTP log, artifacts, recordings or
+// model stats.
+func (f *clientFlags) client(report *pipeline.RunReport, pkgDir string, opts ...llm.Option) (*llm.Client, func()) {
+	if f.dryRun {
+		*f.corpusDir, *f.debugHTTP, *f.artifacts, *f.record, *f.modelStats = "", "", "", "", ""
+	}
+	var corpus *llm.PromptCorpus
+	done := func() {}
+	if *f.corpusDir != "" {
+		var err error
+		corpus, err = llm.OpenPromptCorpus(*f.corpusDir)
+		if err != nil {
+			fatalf("Failed to open prompt corpus: %v", err)
+		}
+		done = func() { reportPromptCorpus(corpus) }
+	}
+	var debugLog io.Writer
+	if *f.debugHTTP != "" {
+		file, err := llm.OpenHTTPDebugLog(*f.debugHTTP)
+		if err != nil {
+			fatalf("Failed to open the HTTP debug log: %v", err)
+		}
+		debugLog = file
+		corpusDone := done
+		done = func() {
+			corpusDone()
+			file.Close()
+			fmt.Println("HTTP exchanges recorded in " + file.Name())
+		}
+	}
+
+	var artifacts *llm.ArtifactStore
+	if *f.artifacts != "" {
+		var err error
+		artifacts, err = llm.NewArtifactStore(*f.artifacts)
+		if err != nil {
+			fatalf("Failed to open the artifacts: %v", err)
+		}
+		debugDone := done
+		done = func() {
+			debugDone()
+			fmt.Println("Prompt attempts of the run kept in " + artifacts.Dir())
+		}
+	}
+
+	clientOpts := []llm.Option{
+		llm.WithModel(*f.model),
+		llm.WithMaxTokens(*f.maxTokens),
+		llm.WithPromptCorpus(corpus),
+		llm.WithCallbacks(&cliCallbacks{out: os.Stdout, report: report}),
+		llm.WithParallel(*f.parallel),
+		llm.WithResponseFormat(*f.format),
+		llm.WithHTTPDebugLog(debugLog),
+		llm.WithRequestTimeout(*f.requestTimeout),
+		llm.WithMaxCost(*f.maxCost),
+		llm.WithRunLog(runLog),
+		llm.WithRecorder(*f.record),
+		llm.WithReplay(*f.replay),
+		llm.WithArtifacts(artifacts),
+		llm.WithDependencyPolicy(f.depPolicy),
+	}
+	retry := llm.DefaultRetryPolicy
+	retry.MaxAttempts = *f.maxAttempts
+	clientOpts = append(clientOpts, llm.WithRetryPolicy(retry))
+	// WithSpecRetries(0) keeps the default.
+	if *f.specRetries > 0 {
+		clientOpts = append(clientOpts, llm.WithSpecRetries(*f.specRetries))
+	} else {
+		clientOpts = append(clientOpts, llm.WithSpecRetries(-1))
+	}
+	if *f.apiBase != "" {
+		clientOpts = append(clientOpts, llm.WithAPIBase(*f.apiBase))
+	}
+	if projectConfig != nil && len(projectConfig.Prompts) > 0 {
+		clientOpts = append(clientOpts, llm.WithPromptOverrides(projectConfig.Prompts))
+	}
+	if *f.models != "" {
+		scheduler, err := llm.LoadModelScheduler(strings.Split(*f.models, ","), *f.modelStats)
+		if err != nil {
+			fatalf("Failed to load the model stats: %v", err)
+		}
+		clientOpts = append(clientOpts, llm.WithModelScheduler(scheduler))
+		if *f.distill {
+			examples, err := llm.LoadExamples(pkgDir)
+			if err != nil {
+				fatalf("Failed to load the examples: %v", err)
+			}
+			clientOpts = append(clientOpts, llm.WithExamples(examples))
+		}
+	} else if *f.distill {
+		fatalf("-distill needs -models")
+	}
+	switch *f.format {
+	case llm.FormatAuto, llm.FormatJSON, llm.FormatText:
+	default:
+		fatalf("Unknown response format %q", *f.format)
+	}
+	switch *f.providerName {
+	case "openai":
+	case "ollama":
+		if *f.replay != "" {
+			break
+		}
+		clientOpts = append(clientOpts, llm.WithProvider(llm.NewOllamaProvider(*f.apiBase, *f.model, llm.NewHTTPClient(*f.parallel, debugLog))))
+	default:
+		fatalf("Unknown provider %q", *f.providerName)
+	}
+	clientOpts = append(append(clientOpts, opts...), llm.WithProgress(progress))
+	apiClient, err := llm.NewClient(clientOpts...)
+	if err != nil {
+		fatalf("Failed to initialize OpenAI API client: %v", err)
+	}
+	if *f.usage {
+		runDone := done
+		done = func() {
+			runDone()
+			llm.WriteUsage(os.Stdout, apiClient.Usage())
+		}
+	}
+	return apiClient, done
+}
+
+// codeFlags select the code under test.
+type codeFlags struct {
+	codeFiles    *string
+	pkg          *string
+	extra        *string
+	strict       *bool
+	uncommented  *bool
+	reuseHelpers *bool
+	publicAPI    *bool
+	codeBudget   *int
+	retrieve     *bool
+	wholeModule  *bool
+	funcs        *string
+	daemon       *string
+	owner        *string
+	stdlibOnly   *bool
+	allowDeps    *string
+}
+
+func addCodeFlags(fs *flag.FlagSet) *codeFlags {
+	return &codeFlags{
+		codeFiles:    fs.String("code-files", "", "Comma-separated paths to code files"),
+		pkg:          fs.String("pkg", "", "Directory of the package under test, e.g. ./pkg/foo, whose Go files are the code files when -code-files is not given"),
+		extra:        fs.String("extra", "", "Extra instructions for the model"),
+		strict:       fs.Bool("strict", false, "Fail instead of heuristically cleaning up model responses"),
+		uncommented:  fs.Bool("uncommented", true, "Draft the generated tests as code, commenting out only the declarations that do not parse; false comments out the whole draft"),
+		reuseHelpers: fs.Bool("reuse-helpers", true, "Include the module's shared test helpers (testutil, mocks, ...) in prompts"),
+		publicAPI:    fs.Bool("public-api", false, "Show the model only the exported API and generate black-box tests in the external _test package"),
+		retrieve:     fs.Bool("retrieve", false, "Over the code budget, keep the declarations most relevant to -what by embeddings similarity instead of summarizing whole files"),
+		wholeModule:  fs.Bool("whole-module", false, "Include the exported API of every package of the module, for models with large context windows"),
+		funcs:        fs.String("func", "", "Comma-separated functions, methods or types to test, e.g. Parse,Store.Get: the prompts get only their code and direct dependencies, and -what defaults to them"),
+		daemon:       fs.String("daemon", os.Getenv("GOPTEST_DAEMON"), "Address of a running goptest daemon to assemble the module context with, defaults to GOPTEST_DAEMON"),
+		owner:        fs.String("owner", "", "Team owning the generated tests, e.g. @org/payments, annotated in the draft header and the run report. Defaults to the owners rules of "+ConfigFile),
+		stdlibOnly:   fs.Bool("stdlib-only", false, "Only let the generated tests import the standard library and the module under test, generating tests importing other libraries again"),
+		allowDeps:    fs.String("allow-deps", "", "Comma-separated import paths the generated tests may use besides the standard library and the module under test, e.g. github.com/google/go-cmp; others are generated again"),
+		codeBudget:   fs.Int("code-budget", 0, "Token budget of the code files, files beyond it are reduced to exported signatures (0 derives it from the model's context window, -1 for no limit)"),
+	}
+}
+
+// defaultWhat sets what, the target of -what, to the -func symbols when it is empty.
+func (f *codeFlags) defaultWhat(what *string) {
+	if *what == "" && *f.funcs != "" {
+		*what = strings.ReplaceAll(*f.funcs, ",", ", ")
+	}
+}
+
+// dependencyPolicy returns the policy of -stdlib-only, which ignores -allow-deps, or
+// -allow-deps for the module of dir, nil when neither is set.
+func (f *codeFlags) dependencyPolicy(dir string) *llm.DependencyPolicy {
+	if !*f.stdlibOnly && *f.allowDeps == "" {
+		return nil
+	}
+	_, modulePath, err := llm.FindModuleRoot(dir)
+	if err != nil {
+		fatalf("Failed to find the module of the code files: %v", err)
+	}
+	policy := &llm.DependencyPolicy{ModulePath: modulePath}
+	if *f.stdlibOnly {
+		return policy
+	}
+	for _, path := range strings.Split(*f.allowDeps, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			policy.Allowed = append(policy.Allowed, path)
+		}
+	}
+	return policy
+}
+
+// paths returns the code files of -code-files or -pkg.
+func (f *codeFlags) paths() []string {
+	if *f.codeFiles == "" && *f.pkg != "" {
+		files, err := pipeline.PackageFiles(*f.pkg)
+		if err != nil {
+			fatalf("Failed to list the files of %s: %v", *f.pkg, err)
+		}
+		*f.codeFiles = strings.Join(files, ",")
+	}
+	if *f.codeFiles == "" {
+		fatalf("code-files or pkg must be provided")
+	}
+	return strings.Split(*f.codeFiles, ",")
+}
+
+// load reads the code files of -code-files or -pkg, see pipeline.Load.
+func (f *codeFlags) load(ctx context.Context, cl *clientFlags, whatToTest string) pipeline.Input {
+	paths := f.paths()
+	owner := *f.owner
+	if owner == "" && projectConfig != nil {
+		owner = projectConfig.OwnerOf(paths[0])
+	}
+	cl.depPolicy = f.dependencyPolicy(filepath.Dir(paths[0]))
+	opts := pipeline.LoadOptions{
+		Model:        *cl.model,
+		MaxTokens:    *cl.maxTokens,
+		CodeBudget:   *f.codeBudget,
+		Retrieve:     *f.retrieve,
+		Embedder:     cl.embedder,
+		ReuseHelpers: *f.reuseHelpers,
+		WholeModule:  *f.wholeModule,
+		PublicAPI:    *f.publicAPI,
+		Extra:        *f.extra,
+		Strict:       *f.strict,
+		Commented:    !*f.uncommented,
+		Owner:        owner,
+		Daemon:       *f.daemon,
+	}
+	if *f.funcs != "" {
+		opts.Funcs = strings.Split(*f.funcs, ",")
+	}
+	in, err := pipeline.Load(ctx, paths, whatToTest, opts)
+	if err != nil {
+		fatalf("Failed to load the code files: %v", err)
+	}
+	return in
+}
+
+// checkFlags configure the compile check and test run of generated files.
+type checkFlags struct {
+	repair       *int
+	verify       *int
+	testBudget   *time.Duration
+	blockNetwork *bool
+}
+
+func addCheckFlags(fs *flag.FlagSet, defaultVerify int) *checkFlags {
+	return &checkFlags{
+		repair:       fs.Int("repair", 2, "Compile-check the output and let the model fix compile errors up to N times, 0 disables"),
+		verify:       fs.Int("verify", defaultVerify, "Run the generated tests and let the model fix failing ones up to N times, 0 disables"),
+		testBudget:   fs.Duration("test-budget", 2*time.Second, "Time every generated test must complete in: prompts forbid real sleeps and polling, and -verify has the model rewrite tests that sleep, poll or run longer. 0 disables"),
+		blockNetwork: fs.Bool("block-network", true, "Fail the network calls of the tests run by -verify to anything but loopback addresses and have the model replace them with fakes"),
+	}
+}
+
+// options returns the client options of the checks.
+func (f *checkFlags) options() []llm.Option {
+	return []llm.Option{llm.WithTestTimeBudget(*f.testBudget), llm.WithNetworkBlocked(*f.blockNetwork)}
+}
+
+// checkTestFile checks the test file like pipeline.CheckTestFile with the iterations of the
+// flags.
+func checkTestFile(ctx context.Context, c *llm.Client, path string, in pipeline.Input, chk *checkFlags) {
+	if err := pipeline.CheckTestFile(ctx, c, path, in, *chk.repair, *chk.verify); err != nil {
+		fatalf("Failed to check %s: %v", path, err)
+	}
+}
+
+// writeDraft drafts the generated tests next to outputFilePath like pipeline.WriteDraft and
+// returns the draft path.
+func writeDraft(ctx context.Context, c *llm.Client, in pipeline.Input, chk *checkFlags, outputFilePath string, specs []llm.Spec, responses []string) string {
+	draftFilePath, err := pipeline.WriteDraft(ctx, c, in, outputFilePath, specs, responses, *chk.repair, *chk.verify)
+	if err != nil {
+		fatalf("Failed to draft the tests: %v", err)
+	}
+	return draftFilePath
+}
+
+// casesFlags select what the test cases are generated for and ground them.
+type casesFlags struct {
+	whatToTest *string
+	issueFile  *string
+	issueRef   *string
+	gitLog     *int
+	callSites  *bool
+	mapReduce  *bool
+	candidates *int
+	force      *bool
+}
+
+func addCasesFlags(fs *flag.FlagSet) *casesFlags {
+	return &casesFlags{
+		whatToTest: fs.String("what", "", "What to test"),
+		issueFile:  fs.String("issue-file", "", "File with the issue text whose acceptance criteria the tests must cover"),
+		issueRef:   fs.String("issue", "", "GitHub issue (owner/repo#number) whose acceptance criteria the tests must cover"),
+		gitLog:     fs.Int("git-log", 0, "Include messages of the last N commits touching the code files in the prompts"),
+		mapReduce:  fs.Bool("map-reduce", false, "When the code exceeds the code budget, generate the cases for every chunk of it and merge them"),
+		candidates: fs.Int("candidates", 1, "Generate the test cases N times and report the cases the candidates expect different behavior of as ambiguous"),
+		callSites:  fs.Bool("call-sites", true, "Include how other packages of the module call the target in the prompts"),
+		force:      fs.Bool("force", false, "List tests for the exported functions the package's tests already test by name too, instead of skipping them"),
+	}
+}
+
+// generateFlags configure the test code generation from a spec file.
+type generateFlags struct {
+	outputFilePath   *string
+	learnConventions *bool
+	updateDeps       *bool
+	fakes            *bool
+	resume           *bool
+	tui              *bool
+	interactive      *bool
+	maxTestLines     *int
+	simplify         *bool
+	merge            *bool
+	warmStart        *string
+	styleFrom        *string
+	// ui shows the progress of the specs when -tui is set, see enableTUI.
+	ui *tui
+}
+
+func addGenerateFlags(fs *flag.FlagSet) *generateFlags {
+	return &generateFlags{
+		outputFilePath:   fs.String("output-file", "", "Path to output file, the tests are drafted next to it"),
+		learnConventions: fs.Bool("learn", true, "Learn conventions from accepted generated tests and reuse them in prompts"),
+		updateDeps:       fs.Bool("update-deps", false, "Run go get and go mod tidy for new test dependencies of the output"),
+		fakes:            fs.Bool("fakes", true, "Write fake data builder helpers for the target's struct inputs to "+pipeline.FakesFile+" and have tests use them"),
+		resume:           fs.Bool("resume", false, "Skip the specs whose test code an interrupted or failed run saved in "+pipeline.CheckpointFileName),
+		interactive:      fs.Bool("interactive", false, "Show every generated test before drafting it to accept, reject, regenerate with instructions or edit it in $EDITOR"),
+		maxTestLines:     fs.Int("max-test-lines", 150, "Warn about generated test functions longer than this many lines, 0 disables the check"),
+		simplify:         fs.Bool("simplify", false, "Ask the model to shorten the generated tests longer than -max-test-lines"),
+		warmStart:        fs.String("warm-start", "", "Partially written test file, e.g. the -output-file with a few hand-written tests, whose helpers, naming and setup the generated tests reuse"),
+		styleFrom:        fs.String("style-from", "auto", "Comma-separated test files whose style the generated tests mimic, shown to the model as a sample: auto takes the package's _test.go files, none disables"),
+		merge:            fs.Bool("merge", false, "Merge the drafted tests into -output-file, keeping its tests and helpers, instead of leaving them in the draft file"),
+		tui:              fs.Bool("tui", false, "Show the progress and streamed code of every spec on a full screen, where specs can be canceled, retried or skipped"),
+	}
+}
+
+// enableTUI returns the client options showing the progress of the specs on the TUI when
+// -tui is set. The usage of the client must be set on gf.ui once it is created.
+func (gf *generateFlags) enableTUI(report *pipeline.RunReport) []llm.Option {
+	if !*gf.tui {
+		return nil
+	}
+	gf.ui = newTUI(os.Stdout, os.Stdin, report)
+	return []llm.Option{llm.WithCallbacks(gf.ui), llm.WithCodeStreaming()}
+}
+
+// options returns the pipeline options of the flags.
+func (f *casesFlags) options(mineInputs bool) pipeline.CasesOptions {
+	return pipeline.CasesOptions{
+		WhatToTest: *f.whatToTest,
+		IssueFile:  *f.issueFile,
+		IssueRef:   *f.issueRef,
+		GitLog:     *f.gitLog,
+		CallSites:  *f.callSites,
+		MapReduce:  *f.mapReduce,
+		Candidates: *f.candidates,
+		Force:      *f.force,
+		MineInputs: mineInputs,
+	}
+}
+
+// options returns the pipeline options of the flags, with the checks of chk when it is not
+// nil.
+func (gf *generateFlags) options(chk *checkFlags, mineInputs bool) pipeline.CodeOptions {
+	opts := pipeline.CodeOptions{
+		OutputFilePath:   *gf.outputFilePath,
+		LearnConventions: *gf.learnConventions,
+		UpdateDeps:       *gf.updateDeps,
+		Fakes:            *gf.fakes,
+		Resume:           *gf.resume,
+		MaxTestLines:     *gf.maxTestLines,
+		Simplify:         *gf.simplify,
+		Merge:            *gf.merge,
+		WarmStart:        *gf.warmStart,
+		StyleFrom:        *gf.styleFrom,
+		MineInputs:       mineInputs,
+		Progress:         progress,
+	}
+	if chk != nil {
+		opts.Repair, opts.Verify = *chk.repair, *chk.verify
+	}
+	if gf.ui != nil {
+		opts.RunSpecs = gf.ui.runSpecs
+	}
+	if *gf.interactive {
+		opts.Review = newApprover(bufio.NewReader(os.Stdin)).review
+	}
+	return opts
+}
+
+// pauseForEdits writes the stage output to a file next to basePath, waits for the user to
+// edit it and press Enter, and reads it back.
+func pauseForEdits(basePath string, stdin *bufio.Reader) pipeline.PauseFunc {
+	return func(stage llm.Stage, content string) (string, error) {
+		path := strings.TrimSuffix(basePath, filepath.Ext(basePath)) + "." + string(stage) + ".md"
+		if err := llm.WriteToFile(content, path); err != nil {
+			return "", fmt.Errorf("failed to write %s: %v", path, err)
+		}
+		fmt.Printf("\nThe %s is in %s. Edit it if needed and press Enter to continue.", stage, path)
+		if _, err := stdin.ReadString('\n'); err != nil && err != io.EOF {
+			return "", fmt.Errorf("failed to read from stdin: %v", err)
+		}
+		edited, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		return string(edited), nil
+	}
+}
+
+// casesInstructions returns the instructions of the test list and cases stages, see
+// pipeline.CasesInstructions.
+func casesInstructions(ctx context.Context, in pipeline.Input, csf *casesFlags, spec string, mineInputs bool) string {
+	instructions, err := pipeline.CasesInstructions(ctx, in, csf.options(mineInputs), spec)
+	if err != nil {
+		fatalf("Failed to ground the test cases: %v", err)
+	}
+	return instructions
+}
+
+// listInstructions returns the instructions of the test list stage, see
+// pipeline.ListInstructions.
+func listInstructions(in pipeline.Input, whatToTest string, casesInstructions string, force bool) string {
+	instructions, err := pipeline.ListInstructions(in, whatToTest, casesInstructions, force)
+	if err != nil {
+		fatalf("%v; pass -force to generate their tests again", err)
+	}
+	return instructions
+}
+
+// generateCases runs the test list and test cases stages, see pipeline.GenerateCases.
+func generateCases(ctx context.Context, c *llm.Client, report *pipeline.RunReport, in pipeline.Input, csf *casesFlags, spec string, mineInputs bool, pause pipeline.PauseFunc) string {
+	s, err := pipeline.GenerateCases(ctx, c, report, in, csf.options(mineInputs), spec, pause)
+	if errors.Is(err, pipeline.ErrAlreadyTested) {
+		fatalf("%v; pass -force to generate their tests again", err)
+	}
+	if err != nil {
+		fatalf("Failed to generate test cases: %v", err)
+	}
+	return s
+}
+
+// codeExtra adds the conventions and style of the package to the extra instructions of in,
+// like pipeline.GenerateCode does.
+func codeExtra(in *pipeline.Input, gf *generateFlags) {
+	if _, err := pipeline.CodeConventions(in, *gf.learnConventions); err != nil {
+		fatalf("%v", err)
+	}
+	if err := pipeline.CodeStyle(in, *gf.styleFrom); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// targetCodeInstructions returns the instructions of the code stage for target, see
+// pipeline.TargetCodeInstructions, without writing any helper.
+func targetCodeInstructions(in pipeline.Input, gf *generateFlags, target string, mineInputs bool) string {
+	instructions, err := pipeline.TargetCodeInstructions(in, gf.options(nil, mineInputs), target, false)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	return instructions
+}
+
+// generateCode generates the test code of the specs of the spec file, see
+// pipeline.GenerateCode. It exits when no test was left to draft.
+func generateCode(ctx context.Context, c *llm.Client, report *pipeline.RunReport, in pipeline.Input, gf *generateFlags, chk *checkFlags, specFilePath string, mineInputs bool) (string, []pipeline.SpecFailure) {
+	if *gf.merge && in.Commented {
+		fatalf("-merge needs -uncommented, a commented out draft has no tests to merge")
+	}
+	draftFilePath, failed, err := pipeline.GenerateCode(ctx, c, report, in, gf.options(chk, mineInputs), specFilePath)
+	if errors.Is(err, pipeline.ErrNothingToDraft) {
+		exitOnFailedSpecs(ctx, failed, specFilePath, *gf.outputFilePath, func() {})
+	}
+	if err != nil {
+		fatalf("Failed to generate test code: %v", err)
+	}
+	return draftFilePath, failed
+}
+
+// exitOnFailedSpecs summarizes the failed specs and exits, with status 130 when the run was
+// interrupted and 1 otherwise, once done is called. It returns when no spec failed.
+func exitOnFailedSpecs(ctx context.Context, failed []pipeline.SpecFailure, specFilePath string, outputFilePath string, done func()) {
+	if len(failed) == 0 {
+		return
+	}
+	printSpecFailures(failed, specFilePath, outputFilePath)
+	done()
+	if errors.Is(ctx.Err(), context.Canceled) {
+		os.Exit(130)
+	}
+	os.Exit(1)
+}
+
+// printSpecFailures summarizes the specs whose test code could not be generated and how to
+// re-run only those.
+func printSpecFailures(failed []pipeline.SpecFailure, specFilePath string, outputFilePath string) {
+	fmt.Printf("\nFailed to generate test code for %d specs:\n", len(failed))
+	for _, f := range failed {
+		fmt.Printf("  %s (%s): %v\n", f.Spec.Name, f.Testing, f.Err)
+	}
+	retryOutput := strings.TrimSuffix(outputFilePath, "_test.go") + "_failed_test.go"
+	fmt.Println("Re-run only the failed specs with the same flags and -resume, or with:")
+	fmt.Printf("  goptest code -spec-file=%s -output-file=%s\n", pipeline.FailedSpecsPath(specFilePath), retryOutput)
+}
+
+// interruptContext returns a context canceled on SIGINT or SIGTERM, so that the requests in
+// flight are canceled and the tests generated so far are still written. A second signal
+// kills the process as usual.
+func interruptContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		fmt.Println("\nInterrupted, writing the tests generated so far. Interrupt again to quit immediately.")
+	}()
+	return ctx
+}
+
+func printDraftDone(report *pipeline.RunReport, draftFilePath string, outputFilePath string, failed []pipeline.SpecFailure) {
+	report.OutputPath = draftFilePath
+	progress.Emit(llm.ProgressEvent{Event: llm.ProgressDone, Output: draftFilePath})
+	report.WriteSummary(os.Stdout)
+	if draftFilePath == outputFilePath {
+		// Merged with -merge.
+		fmt.Println("Review the tests marked with REVIEW in " + outputFilePath)
+		return
+	}
+	if len(failed) > 0 {
+		fmt.Println("Test generation partially succeeded. Review the drafted tests and move them to " + outputFilePath + ":")
+	} else {
+		fmt.Println("Test generation succeeded. Review the drafted tests and move them to " + outputFilePath + ":")
+	}
+	fmt.Println(draftFilePath)
+	fmt.Printf("Run the drafts with: go test -tags %s\n", pipeline.DraftBuildTag)
+}
+
+func runCases(args []string) {
+	fs := newFlagSet("cases", summaryOf("cases"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	csf := addCasesFlags(fs)
+	specFilePath := fs.String("spec-file", "", "Path to write the spec file to")
+	mineInputs := fs.Bool("mine-inputs", true, "Include realistic inputs of the target found in the module's tests, usages and fixtures in prompts")
+	dryRun := addDryRunFlag(fs)
+	parseFlags(fs, args)
+
+	cf.defaultWhat(csf.whatToTest)
+	if *csf.whatToTest == "" {
+		fatalf("Must provide what to test with -what or -func")
+	}
+	if *specFilePath == "" && !*dryRun {
+		fatalf("spec-file must be provided")
+	}
+	cl.dryRun = *dryRun
+	ctx, cancel := cl.context()
+	defer cancel()
+	in := cf.load(ctx, cl, *csf.whatToTest)
+	if *dryRun {
+		runDryRun(ctx, cl, in, csf, nil, *csf.whatToTest, "", *mineInputs, []llm.Stage{llm.StageList, llm.StageCases})
+		return
+	}
+	report := &pipeline.RunReport{}
+	apiClient, done := cl.client(report, in.Dir)
+	defer done()
+
+	s := generateCases(ctx, apiClient, report, in, csf, "", *mineInputs, pipeline.NoPause)
+	if err := llm.WriteToFile(s, *specFilePath); err != nil {
+		fatalf("Failed to write test cases to file: %v", err)
+	}
+	report.OutputPath = *specFilePath
+	progress.Emit(llm.ProgressEvent{Event: llm.ProgressDone, Output: *specFilePath})
+	fmt.Println("Done generating test cases")
+	report.WriteSummary(os.Stdout)
+	fmt.Printf("Test cases written to %s\n", *specFilePath)
+	fmt.Println("Command to generate test code:")
+	fmt.Println("goptest code -spec-file=" + *specFilePath + " -code-files=" + *cf.codeFiles + " -output-file=" + "generated_test.go")
+	fmt.Println("Next time run both in one go, pausing to review the cases, with: goptest all -pause -what=... -pkg=...")
+}
+
+func runCode(args []string) {
+	fs := newFlagSet("code", summaryOf("code"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	chk := addCheckFlags(fs, 0)
+	gf := addGenerateFlags(fs)
+	specFilePath := fs.String("spec-file", "", "Path to the spec file")
+	mineInputs := fs.Bool("mine-inputs", true, "Include realistic inputs of the target found in the module's tests, usages and fixtures in prompts")
+	dryRun := addDryRunFlag(fs)
+	parseFlags(fs, args)
+
+	if *specFilePath == "" {
+		fatalf("spec-file must be provided")
+	}
+	if *gf.outputFilePath == "" && !*dryRun {
+		fatalf("Must provide output file path")
+	}
+	cl.dryRun = *dryRun
+	ctx, cancel := cl.context()
+	defer cancel()
+	routes, err := pipeline.RoutePackages(cf.paths(), *specFilePath)
+	if err != nil {
+		fatalf("Failed to route the targets to their packages: %v", err)
+	}
+	if routes != nil {
+		if *dryRun {
+			fatalf("-dry-run takes the code files of a single package")
+		}
+		runRoutedCode(ctx, cf, cl, chk, gf, routes, *specFilePath, *mineInputs)
+		return
+	}
+	in := cf.load(ctx, cl, "")
+	if *dryRun {
+		runDryRun(ctx, cl, in, nil, gf, "", *specFilePath, *mineInputs, []llm.Stage{llm.StageCode}, chk.options()...)
+		return
+	}
+	report := &pipeline.RunReport{Owner: in.Owner}
+	apiClient, done := cl.client(report, in.Dir, append(chk.options(), gf.enableTUI(report)...)...)
+	defer done()
+	if gf.ui != nil {
+		gf.ui.usage = apiClient.Usage
+	}
+
+	draftFilePath, failed := generateCode(ctx, apiClient, report, in, gf, chk, *specFilePath, *mineInputs)
+	printDraftDone(report, draftFilePath, *gf.outputFilePath, failed)
+	exitOnFailedSpecs(ctx, failed, *specFilePath, *gf.outputFilePath, done)
+}
+
+// runRoutedCode drafts the tests of every route in its package directory, next to a file
+// named like -output-file, and exits once every package is done when a spec failed.
+func runRoutedCode(ctx context.Context, cf *codeFlags, cl *clientFlags, chk *checkFlags, gf *generateFlags, routes []pipeline.PackageRoute, specFilePath string, mineInputs bool) {
+	var failed []pipeline.SpecFailure
+	for _, r := range routes {
+		*cf.codeFiles = strings.Join(r.Paths, ",")
+		in := cf.load(ctx, cl, "")
+		if *gf.merge && in.Commented {
+			fatalf("-merge needs -uncommented, a commented out draft has no tests to merge")
+		}
+		report := &pipeline.RunReport{Owner: in.Owner}
+		apiClient, done := cl.client(report, in.Dir, append(chk.options(), gf.enableTUI(report)...)...)
+		if gf.ui != nil {
+			gf.ui.usage = apiClient.Usage
+		}
+		opts := gf.options(chk, mineInputs)
+		opts.OutputFilePath = filepath.Join(r.Dir, filepath.Base(*gf.outputFilePath))
+		opts.Targets = r.Targets
+		fmt.Printf("Generating the tests of %s in %s\n", strings.Join(r.Targets, ", "), r.Dir)
+		draftFilePath, routeFailed, err := pipeline.GenerateCode(ctx, apiClient, report, in, opts, specFilePath)
+		failed = append(failed, routeFailed...)
+		switch {
+		case errors.Is(err, pipeline.ErrNothingToDraft):
+			fmt.Printf("No test of %s was drafted\n", r.Dir)
+		case err != nil:
+			fatalf("Failed to generate test code: %v", err)
+		default:
+			printDraftDone(report, draftFilePath, opts.OutputFilePath, routeFailed)
+		}
+		done()
+	}
+	// Every route wrote its own failures over the others'.
+	if len(failed) > 0 {
+		if err := pipeline.WriteFailedSpecs(failed, specFilePath); err != nil {
+			fmt.Printf("Failed to write the failed specs: %v\n", err)
+		}
+	}
+	exitOnFailedSpecs(ctx, failed, specFilePath, *gf.outputFilePath, func() {})
+}
+
+func runAll(args []string) {
+	fs := newFlagSet("all", summaryOf("all"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	csf := addCasesFlags(fs)
+	chk := addCheckFlags(fs, 2)
+	gf := addGenerateFlags(fs)
+	specFilePath := fs.String("spec-file", "", "Path to write the spec file to, defaults to goptest-specs.yaml next to the output file")
+	mineInputs := fs.Bool("mine-inputs", true, "Include realistic inputs of the target found in the module's tests, usages and fixtures in prompts")
+	pause := fs.Bool("pause", false, "Pause after the spec, test list and test cases stages to let you edit their output")
+	dryRun := addDryRunFlag(fs)
+	parseFlags(fs, args)
+
+	cf.defaultWhat(csf.whatToTest)
+	if *csf.whatToTest == "" {
+		fatalf("Must provide what to test with -what or -func")
+	}
+	if *gf.outputFilePath == "" && *cf.pkg != "" {
+		*gf.outputFilePath = filepath.Join(*cf.pkg, "generated_test.go")
+	}
+	if *gf.outputFilePath == "" && !*dryRun {
+		fatalf("Must provide output file path")
+	}
+	if *specFilePath == "" {
+		*specFilePath = filepath.Join(filepath.Dir(*gf.outputFilePath), "goptest-specs.yaml")
+	}
+	cl.dryRun = *dryRun
+	ctx, cancel := cl.context()
+	defer cancel()
+	in := cf.load(ctx, cl, *csf.whatToTest)
+	if *dryRun {
+		runDryRun(ctx, cl, in, csf, gf, *csf.whatToTest, "", *mineInputs, []llm.Stage{llm.StageSpec, llm.StageList, llm.StageCases, llm.StageCode}, chk.options()...)
+		return
+	}
+	report := &pipeline.RunReport{Owner: in.Owner}
+	apiClient, done := cl.client(report, in.Dir, append(chk.options(), gf.enableTUI(report)...)...)
+	defer done()
+	if gf.ui != nil {
+		gf.ui.usage = apiClient.Usage
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	pauseFn := pipeline.NoPause
+	if *pause {
+		pauseFn = pauseForEdits(*specFilePath, stdin)
+	}
+
+	spec, err := apiClient.GenerateSpec(ctx, *csf.whatToTest, in.Code, in.Extra)
+	if err != nil {
+		fatalf("Failed to generate spec: %v", err)
+	}
+	if spec, err = pauseFn(llm.StageSpec, spec); err != nil {
+		fatalf("Failed to pause after the spec: %v", err)
+	}
+
+	cases := generateCases(ctx, apiClient, report, in, csf, spec, *mineInputs, pauseFn)
+	if err := llm.WriteToFile(cases, *specFilePath); err != nil {
+		fatalf("Failed to write test cases to file: %v", err)
+	}
+	fmt.Printf("\nTest cases written to %s\n", *specFilePath)
+	if *pause {
+		fmt.Print("Edit them if needed and press Enter to generate the tests.")
+		if _, err := stdin.ReadString('\n'); err != nil && err != io.EOF {
+			fatalf("Failed to read from stdin: %v", err)
+		}
+	}
+
+	draftFilePath, failed := generateCode(ctx, apiClient, report, in, gf, chk, *specFilePath, *mineInputs)
+	printDraftDone(report, draftFilePath, *gf.outputFilePath, failed)
+	exitOnFailedSpecs(ctx, failed, *specFilePath, *gf.outputFilePath, done)
+}
+
+func runMocks(args []string) {
+	fs := newFlagSet("mocks", summaryOf("mocks"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	whatToTest := fs.String("what", "", "What to test")
+	outputFilePath := fs.String("output-file", "", "Path to write the mocks to, e.g. mocks_test.go")
+	dryRun := addDryRunFlag(fs)
+	parseFlags(fs, args)
+
+	cf.defaultWhat(whatToTest)
+	if *whatToTest == "" {
+		fatalf("Must provide what to test with -what or -func")
+	}
+	if *outputFilePath == "" && !*dryRun {
+		fatalf("Must provide output file path")
+	}
+	cl.dryRun = *dryRun
+	ctx, cancel := cl.context()
+	defer cancel()
+	in := cf.load(ctx, cl, *whatToTest)
+	if *dryRun {
+		runDryRun(ctx, cl, in, nil, nil, *whatToTest, "", false, []llm.Stage{llm.StageMocks})
+		return
+	}
+	apiClient, done := cl.client(&pipeline.RunReport{}, in.Dir)
+	defer done()
+
+	fmt.Println("Generating mocks code")
+	mocksCode, err := apiClient.GenerateMocks(ctx, *whatToTest, in.Code, in.Extra)
+	if err != nil {
+		fatalf("Failed to generate mocks code: %v", err)
+	}
+	if in.Strict {
+		if err := pipeline.StrictCheckCode(mocksCode); err != nil {
+			fatalf("Strict mode: %v", err)
+		}
+	}
+	reg := aggregator.NewRegistry()
+	if err := reg.AddDir(in.Dir, in.PkgName, *outputFilePath); err != nil {
+		fatalf("Failed to read the declarations of the package: %v", err)
+	}
+	// Mocks are merged into an existing file, keeping the mocks and tests written by hand.
+	_, skipped, err := pipeline.MergeGoFile(reg.Aggregate(in.PkgName, []string{mocksCode}, false), in.PkgName, *outputFilePath)
+	if err != nil {
+		fatalf("Failed to write output to file: %v", err)
+	}
+	for _, name := range skipped {
+		fmt.Printf("Kept the existing %s of %s\n", name, *outputFilePath)
+	}
+	pipeline.PrintRenamed(reg)
+	fmt.Println("Mocks written to", *outputFilePath)
+}
+
+func runFix(args []string) {
+	fs := newFlagSet("fix", summaryOf("fix"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	chk := addCheckFlags(fs, 2)
+	testFile := fs.String("file", "", "Test file to fix, draft files are run with the draft build tag")
+	parseFlags(fs, args)
+
+	if *testFile == "" {
+		fatalf("file must be provided")
+	}
+	ctx, cancel := cl.context()
+	defer cancel()
+	in := cf.load(ctx, cl, "")
+	report := &pipeline.RunReport{}
+	apiClient, done := cl.client(report, in.Dir, chk.options()...)
+	defer done()
+
+	checkTestFile(ctx, apiClient, *testFile, in, chk)
+	report.OutputPath = *testFile
+	report.WriteSummary(os.Stdout)
+}
+
+func runRows(args []string) {
+	fs := newFlagSet("rows", summaryOf("rows"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	chk := addCheckFlags(fs, 0)
+	testFile := fs.String("file", "", "Test file with the table-driven test")
+	testName := fs.String("test", "", "Table-driven test to add cases to, e.g. TestParse")
+	whatToTest := fs.String("what", "", "What the test tests, optional")
+	count := fs.Int("count", 5, "Number of cases to add")
+	parseFlags(fs, args)
+
+	if *testFile == "" || *testName == "" {
+		fatalf("file and test must be provided")
+	}
+	src, err := os.ReadFile(*testFile)
+	if err != nil {
+		fatalf("Failed to read the test file: %v", err)
+	}
+	fset := token.NewFileSet()
+	table, err := llm.FindCaseTable(fset, src, *testName)
+	if err != nil {
+		fatalf("Failed to find the table of %s: %v", *testName, err)
+	}
+	ctx, cancel := cl.context()
+	defer cancel()
+	in := cf.load(ctx, cl, *whatToTest)
+	report := &pipeline.RunReport{}
+	apiClient, done := cl.client(report, in.Dir, chk.options()...)
+	defer done()
+
+	fmt.Printf("Generating %d cases for %s\n", *count, *testName)
+	rows, err := apiClient.GenerateTableRows(ctx, table, *count, *testName, in.Code, in.Extra)
+	if err != nil {
+		fatalf("Failed to generate the cases: %v", err)
+	}
+	out, err := llm.AddTableRows(fset, src, table, rows)
+	if err != nil {
+		fatalf("Failed to add the cases: %v", err)
+	}
+	if err := llm.WriteToFile(string(out), *testFile); err != nil {
+		fatalf("Failed to write the test file: %v", err)
+	}
+	fmt.Printf("Added %d cases to %s in %s, review them\n", len(rows), *testName, *testFile)
+	checkTestFile(ctx, apiClient, *testFile, in, chk)
+	report.OutputPath = *testFile
+	report.WriteSummary(os.Stdout)
+}
+
+func runRegression(args []string) {
+	fs := newFlagSet("regression", summaryOf("regression"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	chk := addCheckFlags(fs, 0)
+	bugFile := fs.String("bug-file", "", "File describing the bug, the code files contain the fix")
+	whatToTest := fs.String("what", "", "What the bug was in, optional")
+	outputFilePath := fs.String("output-file", "", "Path to output file, the test is drafted next to it")
+	parseFlags(fs, args)
+
+	if *bugFile == "" {
+		fatalf("bug-file must be provided")
+	}
+	if *outputFilePath == "" {
+		fatalf("Must provide output file path")
+	}
+	ctx, cancel := cl.context()
+	defer cancel()
+	in := cf.load(ctx, cl, *whatToTest)
+	apiClient, done := cl.client(&pipeline.RunReport{}, in.Dir, chk.options()...)
+	defer done()
+
+	spec, code, err := apiClient.GenerateRegressionTest(ctx, *bugFile, in.Paths, *whatToTest, in.Code, in.PkgName, in.Extra)
+	if err != nil {
+		fatalf("Failed to generate regression test: %v", err)
+	}
+	draftFilePath := writeDraft(ctx, apiClient, in, chk, *outputFilePath, []llm.Spec{spec}, []string{code})
+	fmt.Println("Regression test drafted in", draftFilePath)
+	fmt.Println("Review it, move it to " + *outputFilePath + " and commit it together with the fix")
+}
+
+func runCharacterize(args []string) {
+	fs := newFlagSet("characterize", summaryOf("characterize"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	chk := addCheckFlags(fs, 0)
+	whatToTest := fs.String("what", "", "What to test")
+	outputFilePath := fs.String("output-file", "", "Path to output file, the tests are drafted next to it")
+	parseFlags(fs, args)
+
+	cf.defaultWhat(whatToTest)
+	if *whatToTest == "" {
+		fatalf("Must provide what to test with -what or -func")
+	}
+	if *outputFilePath == "" {
+		fatalf("Must provide output file path")
+	}
+	ctx, cancel := cl.context()
+	defer cancel()
+	in := cf.load(ctx, cl, *whatToTest)
+	apiClient, done := cl.client(&pipeline.RunReport{}, in.Dir, chk.options()...)
+	defer done()
+
+	spec, code, err := apiClient.GenerateCharacterizationTest(ctx, *whatToTest, in.Code, in.PkgName, in.Dir, in.Extra)
+	if err != nil {
+		fatalf("Failed to generate characterization test: %v", err)
+	}
+	draftFilePath := writeDraft(ctx, apiClient, in, chk, *outputFilePath, []llm.Spec{spec}, []string{code})
+	fmt.Println("Characterization test drafted in", draftFilePath)
+}
+
+func runCoverage(args []string) {
+	fs := newFlagSet("coverage", summaryOf("coverage"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	csf := addCasesFlags(fs)
+	chk := addCheckFlags(fs, 0)
+	gf := addGenerateFlags(fs)
+	specFilePath := fs.String("spec-file", "", "Path to write the spec file to, defaults to goptest-specs.yaml next to the output file")
+	mineInputs := fs.Bool("mine-inputs", true, "Include realistic inputs of the target found in the module's tests, usages and fixtures in prompts")
+	profilePath := fs.String("coverprofile", "", "Coverage profile of the package's tests to use instead of running them")
+	maxFuncs := fs.Int("max-funcs", 5, "Generate tests for at most N of the least covered functions, 0 for all")
+	skipTrivial := fs.Bool("skip-trivial", true, "Leave out generated code, getters and one-line wrappers unless -func names them")
+	parseFlags(fs, args)
+
+	dir := *cf.pkg
+	if dir == "" && *cf.codeFiles != "" {
+		dir = filepath.Dir(strings.Split(*cf.codeFiles, ",")[0])
+	}
+	if dir == "" {
+		fatalf("pkg or code-files must be provided")
+	}
+	if *gf.outputFilePath == "" {
+		*gf.outputFilePath = filepath.Join(dir, "generated_test.go")
+	}
+	if *specFilePath == "" {
+		*specFilePath = filepath.Join(filepath.Dir(*gf.outputFilePath), "goptest-specs.yaml")
+	}
+	ctx, cancel := cl.context()
+	defer cancel()
+
+	var profiles []*cover.Profile
+	var err error
+	if *profilePath != "" {
+		profiles, err = cover.ParseProfiles(*profilePath)
+	} else {
+		fmt.Println("Running the tests of", dir, "with coverage")
+		profiles, err = pipeline.RunCoverage(ctx, dir)
+	}
+	if err != nil {
+		fatalf("Failed to get the coverage of %s: %v", dir, err)
+	}
+	var funcs []string
+	if *cf.funcs != "" {
+		funcs = strings.Split(*cf.funcs, ",")
+	}
+	gaps, err := pipeline.CoverageGaps(dir, profiles, funcs)
+	if err != nil {
+		fatalf("Failed to find the coverage gaps: %v", err)
+	}
+	if *skipTrivial && len(funcs) == 0 {
+		var kept []pipeline.CoverageGap
+		for _, gap := range gaps {
+			if gap.Trivial != "" {
+				fmt.Printf("Skipping %s (%s:%d): %s\n", gap.Func, gap.File, gap.Line, gap.Trivial)
+				continue
+			}
+			kept = append(kept, gap)
+		}
+		gaps = kept
+	}
+	if len(gaps) == 0 {
+		fmt.Println("The tests cover every statement, nothing to generate")
+		return
+	}
+	if *maxFuncs > 0 && len(gaps) > *maxFuncs {
+		gaps = gaps[:*maxFuncs]
+	}
+	for _, gap := range gaps {
+		fmt.Printf("%s (%s:%d): %d of %d statements covered\n", gap.Func, gap.File, gap.Line, gap.Covered, gap.Statements)
+	}
+	// The prompts get the code of the gaps, the target and the lines to run.
+	names := make([]string, len(gaps))
+	for i, gap := range gaps {
+		names[i] = gap.Func
+	}
+	*cf.funcs = strings.Join(names, ",")
+	*csf.whatToTest = pipeline.CoverageTarget(gaps)
+	// The gaps are in functions that have tests already.
+	*csf.force = true
+	*cf.extra = strings.TrimSpace(*cf.extra + "\n" + pipeline.CoverageInstructions(gaps))
+
+	in := cf.load(ctx, cl, *csf.whatToTest)
+	report := &pipeline.RunReport{Owner: in.Owner}
+	apiClient, done := cl.client(report, in.Dir, append(chk.options(), gf.enableTUI(report)...)...)
+	defer done()
+	if gf.ui != nil {
+		gf.ui.usage = apiClient.Usage
+	}
+
+	cases := generateCases(ctx, apiClient, report, in, csf, "", *mineInputs, pipeline.NoPause)
+	if err := llm.WriteToFile(cases, *specFilePath); err != nil {
+		fatalf("Failed to write test cases to file: %v", err)
+	}
+	fmt.Printf("\nTest cases written to %s\n", *specFilePath)
+
+	draftFilePath, failed := generateCode(ctx, apiClient, report, in, gf, chk, *specFilePath, *mineInputs)
+	printDraftDone(report, draftFilePath, *gf.outputFilePath, failed)
+	exitOnFailedSpecs(ctx, failed, *specFilePath, *gf.outputFilePath, done)
+}
+
+func runContract(args []string) {
+	fs := newFlagSet("contract", summaryOf("contract"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	chk := addCheckFlags(fs, 0)
+	iface := fs.String("interface", "", "Name of the interface")
+	outputFilePath := fs.String("output-file", "", "Path to output file, the tests are drafted next to it")
+	parseFlags(fs, args)
+
+	if *iface == "" {
+		fatalf("interface must be provided")
+	}
+	if *outputFilePath == "" {
+		fatalf("Must provide output file path")
+	}
+	ctx, cancel := cl.context()
+	defer cancel()
+	in := cf.load(ctx, cl, "")
+	apiClient, done := cl.client(&pipeline.RunReport{}, in.Dir, chk.options()...)
+	defer done()
+
+	specs, code, err := apiClient.GenerateContractSuite(ctx, *iface, in.Code, in.PkgName, in.Extra)
+	if err != nil {
+		fatalf("Failed to generate contract suite: %v", err)
+	}
+	draftFilePath := writeDraft(ctx, apiClient, in, chk, *outputFilePath, specs, code)
+	fmt.Printf("Contract suite %s drafted in %s, run for %d implementations\n", llm.SuiteFuncName(*iface), draftFilePath, len(specs)-1)
+}
+
+func runDifferential(args []string) {
+	fs := newFlagSet("differential", summaryOf("differential"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	chk := addCheckFlags(fs, 0)
+	pair := fs.String("impls", "", "The two implementations: Reference,Candidate")
+	outputFilePath := fs.String("output-file", "", "Path to output file, the tests are drafted next to it")
+	parseFlags(fs, args)
+
+	reference, candidate, err := llm.ParseDifferentialPair(*pair)
+	if err != nil {
+		fatalf("Invalid -impls: %v", err)
+	}
+	if *outputFilePath == "" {
+		fatalf("Must provide output file path")
+	}
+	ctx, cancel := cl.context()
+	defer cancel()
+	in := cf.load(ctx, cl, "")
+	apiClient, done := cl.client(&pipeline.RunReport{}, in.Dir, chk.options()...)
+	defer done()
+
+	spec, code, err := apiClient.GenerateDifferentialTest(ctx, reference, candidate, in.Code, in.PkgName, in.Extra)
+	if err != nil {
+		fatalf("Failed to generate differential test: %v", err)
+	}
+	draftFilePath := writeDraft(ctx, apiClient, in, chk, *outputFilePath, []llm.Spec{spec}, []string{code})
+	fmt.Println("Differential test drafted in", draftFilePath)
+}
+
+func runImportFeature(args []string) {
+	fs := newFlagSet("import-feature", summaryOf("import-feature"))
+	featurePath := fs.String("feature", "", "Gherkin .feature file to convert")
+	specFilePath := fs.String("spec-file", "", "Path to write the spec file to")
+	parseFlags(fs, args)
+
+	if *featurePath == "" || *specFilePath == "" {
+		fatalf("feature and spec-file must be provided")
+	}
+	if err := pipeline.ImportFeatureFile(*featurePath, *specFilePath); err != nil {
+		fatalf("Failed to import feature file: %v", err)
+	}
+	fmt.Printf("Test cases written to %s\n", *specFilePath)
+}
+
+func runImportLogs(args []string) {
+	fs := newFlagSet("import-logs", summaryOf("import-logs"))
+	logsPath := fs.String("logs", "", "JSON lines file with the recorded calls")
+	function := fs.String("func", "", "Only import the calls of this function")
+	maxCases := fs.Int("max-cases", 20, "Maximum number of cases per function, 0 for no limit")
+	specFilePath := fs.String("spec-file", "", "Path to write the spec file to")
+	parseFlags(fs, args)
+
+	if *logsPath == "" || *specFilePath == "" {
+		fatalf("logs and spec-file must be provided")
+	}
+	n, err := pipeline.ImportLogsFile(*logsPath, *function, *maxCases, *specFilePath)
+	if err != nil {
+		fatalf("Failed to import logs: %v", err)
+	}
+	fmt.Printf("%d test cases written to %s\n", n, *specFilePath)
+}
+
+func runExportSpecs(args []string) {
+	fs := newFlagSet("export-specs", summaryOf("export-specs"))
+	specFilePath := fs.String("spec-file", "", "Path to the spec file")
+	exportPath := fs.String("output-file", "", "Path to write the export to")
+	exportFormat := fs.String("format", pipeline.ExportCSV, "Spec export format: csv, xray or testrail")
+	parseFlags(fs, args)
+
+	if *specFilePath == "" || *exportPath == "" {
+		fatalf("spec-file and output-file must be provided")
+	}
+	if err := pipeline.ExportSpecFile(*specFilePath, *exportPath, *exportFormat); err != nil {
+		fatalf("Failed to export specs: %v", err)
+	}
+	fmt.Printf("Specs exported to %s\n", *exportPath)
+}
+
+// readOptionalFile returns the content of the file, empty when no path is given.
+func readOptionalFile(path string) string {
+	if path == "" {
+		return ""
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		fatalf("Failed to read %s: %v", path, err)
+	}
+	return string(content)
+}
+
+// findSpec returns the spec named name in the spec file and its target.
+func findSpec(specFilePath string, name string) (llm.Spec, string) {
+	specLists, err := spec.Load(specFilePath)
+	if err != nil {
+		fatalf("Failed to load test specs: %v", err)
+	}
+	for _, r := range spec.Normalize(specLists) {
+		if r.From == name {
+			name = r.To
+		}
+	}
+	for _, l := range specLists {
+		for _, spec := range l.Specs {
+			if spec.Name == name {
+				return spec, l.Testing
+			}
+		}
+	}
+	fatalf("No spec %q in %s", name, specFilePath)
+	return llm.Spec{}, ""
+}
+
+func runPrompt(args []string) {
+	fs := newFlagSet("prompt", summaryOf("prompt"))
+	cf := addCodeFlags(fs)
+	cl := addClientFlags(fs)
+	csf := addCasesFlags(fs)
+	gf := addGenerateFlags(fs)
+	stage := fs.String("stage", string(llm.StageCode), "Stage to print the prompt of: spec, list, cases, mocks or code")
+	specFilePath := fs.String("spec-file", "", "Path to the spec file, for the code stage")
+	specName := fs.String("spec", "", "Name of the test case in the spec file, for the code stage")
+	specText := fs.String("spec-text", "", "File with the output of the spec stage, for the list and cases stages")
+	listFile := fs.String("list", "", "File with the test list, for the cases stage")
+	mineInputs := fs.Bool("mine-inputs", true, "Include realistic inputs of the target found in the module's tests, usages and fixtures in prompts")
+	testBudget := fs.Duration("test-budget", 2*time.Second, "Time every generated test must complete in, stated in the code prompt. 0 for none")
+	parseFlags(fs, args)
+
+	cf.defaultWhat(csf.whatToTest)
+	whatToTest := *csf.whatToTest
+	var spec llm.Spec
+	if llm.Stage(*stage) == llm.StageCode {
+		if *specFilePath == "" || *specName == "" {
+			fatalf("spec-file and spec must be provided for the code stage")
+		}
+		spec, whatToTest = findSpec(*specFilePath, *specName)
+		*csf.whatToTest = whatToTest
+	}
+	if whatToTest == "" {
+		fatalf("Must provide what to test with -what or -func")
+	}
+	ctx, cancel := cl.context()
+	defer cancel()
+	in := cf.load(ctx, cl, whatToTest)
+	provider := &captureProvider{}
+	apiClient, done := cl.client(&pipeline.RunReport{}, in.Dir, llm.WithProvider(provider), llm.WithCallbacks(llm.NopCallbacks{}), llm.WithTestTimeBudget(*testBudget))
+	defer done()
+
+	prompt, err := provider.capture(func() error {
+		var err error
+		switch llm.Stage(*stage) {
+		case llm.StageSpec:
+			_, err = apiClient.GenerateSpec(ctx, whatToTest, in.Code, in.Extra)
+		case llm.StageList:
+			instructions := casesInstructions(ctx, in, csf, readOptionalFile(*specText), *mineInputs)
+			_, err = apiClient.GenerateTestsList(ctx, whatToTest, in.Code, listInstructions(in, whatToTest, instructions, *csf.force))
+		case llm.StageCases:
+			instructions := casesInstructions(ctx, in, csf, readOptionalFile(*specText), *mineInputs)
+			_, err = apiClient.GenerateTestCases(ctx, whatToTest, in.Code, readOptionalFile(*listFile), instructions)
+		case llm.StageMocks:
+			_, err = apiClient.GenerateMocks(ctx, whatToTest, in.Code, in.Extra)
+		case llm.StageCode:
+			codeExtra(&in, gf)
+			extra := strings.TrimSpace(in.Extra + "\n" + targetCodeInstructions(in, gf, whatToTest, *mineInputs))
+			_, err = apiClient.GenerateTestCode(ctx, spec, whatToTest, in.Code, in.PkgName, extra)
+		default:
+			fatalf("Unknown stage %q", *stage)
+		}
+		return err
+	})
+	if err != nil {
+		fatalf("Failed to build the %s prompt: %v", *stage, err)
+	}
+	writePrompt(os.Stdout, *stage, *cl.model, prompt)
+}
+
+func runDaemon(args []string) {
+	fs := newFlagSet("daemon", summaryOf("daemon"))
+	dir := fs.String("dir", ".", "Directory in the module to index")
+	addr := fs.String("addr", pipeline.DefaultDaemonAddr, "Address to listen on, pass it to other invocations with -daemon or GOPTEST_DAEMON")
+	poll := fs.Duration("poll", 2*time.Second, "How often to look for changed files")
+	parseFlags(fs, args)
+
+	root, modulePath, err := llm.FindModuleRoot(*dir)
+	if err != nil {
+		fatalf("Failed to find the module of %s: %v", *dir, err)
+	}
+	ix, err := pipeline.NewModuleIndex(root, modulePath)
+	if err != nil {
+		fatalf("Failed to index %s: %v", root, err)
+	}
+	start := time.Now()
+	n, err := ix.Refresh()
+	if err != nil {
+		fatalf("Failed to index %s: %v", root, err)
+	}
+	fmt.Printf("Indexed %d files of %s in %v\n", n, modulePath, time.Since(start).Round(time.Millisecond))
+	go pipeline.WatchModule(ix, *poll, nil)
+	fmt.Printf("Listening on %s\n", *addr)
+	if err := http.ListenAndServe(*addr, pipeline.DaemonHandler(ix)); err != nil {
+		fatalf("Daemon stopped: %v", err)
+	}
+}
+
+// addDryRunFlag adds -dry-run to the commands running the generation stages.
+func addDryRunFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("dry-run", false, "Print every prompt the command would send with its estimated tokens and cost, making no API calls and writing no files")
+}
+
+// runDryRun prints the prompts of the stages for the target with their estimated tokens and
+// cost. The code prompts are built from the test cases of the spec file, so they are only
+// printed when it is given, not when the run would generate it.
+func runDryRun(ctx context.Context, cl *clientFlags, in pipeline.Input, csf *casesFlags, gf *generateFlags, target string, specFilePath string, mineInputs bool, stages []llm.Stage, opts ...llm.Option) {
+	d := &dryRun{w: os.Stdout, model: *cl.model, provider: &captureProvider{}}
+	apiClient, done := cl.client(&pipeline.RunReport{}, in.Dir, append(opts, llm.WithProvider(d.provider), llm.WithCallbacks(llm.NopCallbacks{}))...)
+	defer done()
+	specText := ""
+	for _, stage := range stages {
+		switch stage {
+		case llm.StageSpec:
+			d.show("spec", func() error {
+				_, err := apiClient.GenerateSpec(ctx, target, in.Code, in.Extra)
+				return err
+			})
+			specText = placeholder(llm.StageSpec)
+		case llm.StageList:
+			instructions := casesInstructions(ctx, in, csf, specText, mineInputs)
+			d.show("list", func() error {
+				_, err := apiClient.GenerateTestsList(ctx, target, in.Code, listInstructions(in, target, instructions, *csf.force))
+				return err
+			})
+		case llm.StageCases:
+			instructions := casesInstructions(ctx, in, csf, specText, mineInputs)
+			chunks := []string{in.Code}
+			if *csf.mapReduce && in.Full != "" {
+				var err error
+				if chunks, err = pipeline.ChunkCode(in.Full, in.Budget); err != nil {
+					fatalf("Failed to split the code: %v", err)
+				}
+			}
+			for i, chunk := range chunks {
+				title := "cases"
+				if len(chunks) > 1 {
+					title = fmt.Sprintf("cases, part %d of %d", i+1, len(chunks))
+				}
+				d.show(title, func() error {
+					_, err := apiClient.GenerateTestCases(ctx, target, chunk, placeholder(llm.StageList), instructions)
+					return err
+				})
+			}
+			if len(chunks) > 1 {
+				fmt.Println("The prompt merging the test cases of the parts is built from their outputs and not shown")
+			}
+		case llm.StageMocks:
+			d.show("mocks", func() error {
+				_, err := apiClient.GenerateMocks(ctx, target, in.Code, in.Extra)
+				return err
+			})
+		case llm.StageCode:
+			if specFilePath == "" {
+				fmt.Print("The code prompts are built from the generated test cases, run goptest code -dry-run with the spec file after generating them\n\n")
+				continue
+			}
+			specLists, err := spec.Load(specFilePath)
+			if err != nil {
+				fatalf("Failed to load test specs: %v", err)
+			}
+			spec.Normalize(specLists)
+			codeExtra(&in, gf)
+			for _, l := range specLists {
+				extra := strings.TrimSpace(in.Extra + "\n" + targetCodeInstructions(in, gf, l.Testing, mineInputs))
+				for _, s := range l.Specs {
+					d.show("code for "+s.Name, func() error {
+						_, err := apiClient.GenerateTestCode(ctx, s, l.Testing, in.Code, in.PkgName, extra)
+						return err
+					})
+				}
+			}
+		}
+	}
+	d.summary()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigFile is the project configuration file with defaults for the command line flags.
+const ConfigFile = ".goptest.yaml"
+
+// Config holds project defaults loaded from ConfigFile. Flags given on the command line take
+// precedence over it.
+type Config struct {
+	Model     string `yaml:"model"`
+	MaxTokens int    `yaml:"max_tokens"`
+	// Parallel limits the number of concurrent API requests.
+	Parallel int    `yaml:"parallel"`
+	Provider string `yaml:"provider"`
+	APIBase  string `yaml:"api_base"`
+	// CodeFiles are glob patterns relative to the configuration file, test files are skipped.
+	CodeFiles []string `yaml:"code_files"`
+	Extra     string   `yaml:"extra"`
+	// Prompts replace the system instructions of the named stages.
+	Prompts map[llm.Stage]string `yaml:"prompts"`
+	// Owners assign the tests generated for the code files to teams, the last matching
+	// rule wins like in CODEOWNERS.
+	Owners []OwnerRule `yaml:"owners"`
+	// StdlibOnly and AllowedDeps restrict the imports of the generated tests, see the
+	// -stdlib-only and -allow-deps flags.
+	StdlibOnly  bool     `yaml:"stdlib_only"`
+	AllowedDeps []string `yaml:"allowed_deps"`
+
+	dir string
+}
+
+// projectConfig is the configuration loaded for the running command, if any.
+var projectConfig *Config
+
+// knownStages are the stages whose prompts can be overridden.
+var knownStages = []llm.Stage{llm.StageSpec, llm.StageList, llm.StageCases, llm.StageMocks, llm.StageCode, llm.StageRepair, llm.StageCapture, llm.StageVerify, llm.StageMerge, llm.StageSimplify, llm.StageRows, llm.StageCompare}
+
+// FindConfig looks for ConfigFile in dir and its parents, stopping at the module or
+// repository root. It returns "" when there is none.
+func FindConfig(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, ConfigFile)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+		for _, root := range []string{"go.mod", ".git"} {
+			if _, err := os.Stat(filepath.Join(dir, root)); err == nil {
+				return "", nil
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// LoadConfig reads and validates the configuration file.
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{dir: filepath.Dir(path)}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for stage := range cfg.Prompts {
+		known := false
+		for _, s := range knownStages {
+			known = known || s == stage
+		}
+		if !known {
+			return nil, fmt.Errorf("%s: unknown stage %q in prompts", path, stage)
+		}
+	}
+	return cfg, nil
+}
+
+// OwnerRule assigns the code files matching Path to Team.
+type OwnerRule struct {
+	// Path is a glob pattern relative to the configuration file, matching the code files
+	// or their directories. A trailing slash matches everything below a directory.
+	Path string `yaml:"path"`
+	Team string `yaml:"team"`
+}
+
+// OwnerOf returns the team owning the tests of the code file, "" when no rule matches.
+func (cfg *Config) OwnerOf(codeFile string) string {
+	abs, err := filepath.Abs(codeFile)
+	if err != nil {
+		return ""
+	}
+	dir, err := filepath.Abs(cfg.dir)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	rel = filepath.ToSlash(rel)
+	owner := ""
+	for _, r := range cfg.Owners {
+		if ownerRuleMatches(strings.TrimPrefix(r.Path, "/"), rel) {
+			owner = r.Team
+		}
+	}
+	return owner
+}
+
+func ownerRuleMatches(pattern string, rel string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(rel, pattern)
+	}
+	for p := rel; p != "."; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// codeFiles expands the code file patterns.
+func (cfg *Config) codeFiles() ([]string, error) {
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range cfg.CodeFiles {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(cfg.dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid code_files pattern %q: %v", pattern, err)
+		}
+		for _, m := range matches {
+			if strings.HasSuffix(m, "_test.go") || seen[m] {
+				continue
+			}
+			seen[m] = true
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// flagValues returns the configured defaults keyed by flag name.
+func (cfg *Config) flagValues() (map[string]string, error) {
+	values := map[string]string{
+		"model":    cfg.Model,
+		"provider": cfg.Provider,
+		"api-base": cfg.APIBase,
+		"extra":    cfg.Extra,
+	}
+	if cfg.MaxTokens > 0 {
+		values["max-tokens"] = strconv.Itoa(cfg.MaxTokens)
+	}
+	if cfg.Parallel > 0 {
+		values["parallel"] = strconv.Itoa(cfg.Parallel)
+	}
+	if cfg.StdlibOnly {
+		values["stdlib-only"] = "true"
+	}
+	values["allow-deps"] = strings.Join(cfg.AllowedDeps, ",")
+	files, err := cfg.codeFiles()
+	if err != nil {
+		return nil, err
+	}
+	values["code-files"] = strings.Join(files, ",")
+	return values, nil
+}
+
+// flagAliases maps the alias flags to the flag they set, which counts as given on the
+// command line when its alias is.
+var flagAliases = map[string]string{
+	"concurrency": "parallel",
+}
+
+// flagAlternatives maps the configured flags to the flags selecting the same thing another
+// way: the configured value is not applied when one of them is given on the command line.
+var flagAlternatives = map[string][]string{
+	"code-files": {"pkg"},
+}
+
+// applyConfig sets the flags of fs that were not given on the command line, directly, through
+// an alias or through an alternative, to the configured defaults.
+func applyConfig(fs *flag.FlagSet, cfg *Config) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+		if name, ok := flagAliases[f.Name]; ok {
+			set[name] = true
+		}
+	})
+	values, err := cfg.flagValues()
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		if set[name] || alternativeSet(set, name) || value == "" || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// alternativeSet reports whether one of the flagAlternatives of name is in set.
+func alternativeSet(set map[string]bool, name string) bool {
+	for _, alt := range flagAlternatives[name] {
+		if set[alt] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFlags parses the command's flags, fills the ones not given from the project
+// configuration file and opens the run log and the progress events.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	applyProjectConfig(fs)
+	openRunLog(fs)
+	openProgress(fs)
+}
+
+func applyProjectConfig(fs *flag.FlagSet) {
+	path, err := FindConfig(".")
+	if err != nil {
+		fatalf("Failed to look for %s: %v", ConfigFile, err)
+	}
+	if path == "" {
+		return
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		fatalf("Failed to load config: %v", err)
+	}
+	if err := applyConfig(fs, cfg); err != nil {
+		fatalf("Failed to apply %s: %v", path, err)
+	}
+	projectConfig = cfg
+}
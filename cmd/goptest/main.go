@@ -0,0 +1,27 @@
+// Command goptest generates Go tests with language models. Run goptest without arguments
+// for its commands.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+func fatalf(msg string, a ...any) {
+	fmt.Fprintf(os.Stderr, msg, a...)
+	os.Exit(1)
+
+}
+
+func reportPromptCorpus(pc *llm.PromptCorpus) {
+	if err := pc.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save prompt corpus: %v\n", err)
+	}
+	pc.WriteReport(os.Stdout)
+}
+
+func main() {
+	runCommand(os.Args[1:])
+}
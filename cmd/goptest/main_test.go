@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sentiens/goptest/llm"
+	"github.com/sentiens/goptest/pipeline"
+)
+
+type fakeProvider struct {
+	prompts []llm.Prompt
+	reply   string
+}
+
+func (p *fakeProvider) Complete(_ context.Context, prompt llm.Prompt) (string, error) {
+	p.prompts = append(p.prompts, prompt)
+	return p.reply, nil
+}
+
+func (p *fakeProvider) Stream(ctx context.Context, prompt llm.Prompt, onDelta func(string)) (string, error) {
+	out, err := p.Complete(ctx, prompt)
+	onDelta(out)
+	return out, err
+}
+
+func TestClientWithProvider(t *testing.T) {
+	provider := &fakeProvider{reply: "func TestAdd(t *testing.T) {}"}
+	report := &pipeline.RunReport{}
+	client, err := llm.NewClient(llm.WithProvider(provider), llm.WithAPIKey(""), llm.WithCallbacks(&cliCallbacks{out: io.Discard, report: report}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := client.GenerateTestCode(context.Background(), llm.Spec{Name: "TestAdd"}, "Add", "package calc", "calc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != provider.reply {
+		t.Errorf("got code %q, want %q", code, provider.reply)
+	}
+	if len(provider.prompts) != 1 || !strings.Contains(provider.prompts[0].Messages[0].Content, "TestAdd") {
+		t.Errorf("unexpected prompts %+v", provider.prompts)
+	}
+	if len(report.Stages) != 1 || report.Stages[0].Stage != llm.StageCode || report.Stages[0].Target != "TestAdd" {
+		t.Errorf("unexpected report %+v", report.Stages)
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	testCases := []struct {
+		args       []string
+		wantName   string
+		wantRest   []string
+		wantLegacy bool
+	}{
+		{[]string{"code", "-spec-file=s.yaml"}, "code", []string{"-spec-file=s.yaml"}, false},
+		{[]string{"-cases=true", "-what=Add"}, "cases", []string{"-what=Add"}, true},
+		{[]string{"-what=Add", "--cases"}, "cases", []string{"-what=Add"}, true},
+		{[]string{"-spec-file=s.yaml", "-cases=false"}, "code", []string{"-spec-file=s.yaml"}, true},
+	}
+	for _, tc := range testCases {
+		name, rest, legacy := commandArgs(tc.args)
+		if name != tc.wantName || !reflect.DeepEqual(rest, tc.wantRest) || legacy != tc.wantLegacy {
+			t.Errorf("commandArgs(%q) = %q, %q, %v, want %q, %q, %v",
+				tc.args, name, rest, legacy, tc.wantName, tc.wantRest, tc.wantLegacy)
+		}
+	}
+}
+
+func TestPauseForEdits(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "specs.yaml")
+	pause := pauseForEdits(base, bufio.NewReader(strings.NewReader("\n")))
+	if got, err := pause(llm.StageList, "1. adds numbers\n"); err != nil || got != "1. adds numbers\n" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(base), "specs.list.md")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go", "a_test.go"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("package p\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := "model: gpt-3.5-turbo\nparallel: 4\ncode_files: [\"*.go\"]\nextra: Use testify.\nprompts:\n  list: Be brief.\n"
+	if err := os.WriteFile(filepath.Join(dir, ConfigFile), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path, err := FindConfig(sub)
+	if err != nil || path != filepath.Join(dir, ConfigFile) {
+		t.Fatalf("FindConfig = %q, %v", path, err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cl := addClientFlags(fs)
+	cf := addCodeFlags(fs)
+	if err := fs.Parse([]string{"-model=gpt-4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if *cl.model != "gpt-4" || *cl.parallel != 4 || *cf.extra != "Use testify." {
+		t.Errorf("got model %q parallel %d extra %q", *cl.model, *cl.parallel, *cf.extra)
+	}
+	if want := filepath.Join(dir, "a.go") + "," + filepath.Join(dir, "b.go"); *cf.codeFiles != want {
+		t.Errorf("got code files %q, want %q", *cf.codeFiles, want)
+	}
+
+	// An alias given on the command line beats the configured value of its flag.
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	cl = addClientFlags(fs)
+	if err := fs.Parse([]string{"-concurrency=8"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if *cl.parallel != 8 {
+		t.Errorf("got parallel %d with -concurrency=8, want the flag over the config", *cl.parallel)
+	}
+
+	// -pkg selects the code files instead of the configured ones.
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	cf = addCodeFlags(fs)
+	if err := fs.Parse([]string{"-pkg=" + sub}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if *cf.codeFiles != "" || *cf.pkg != sub {
+		t.Errorf("got code files %q and pkg %q with -pkg, want the package over the config", *cf.codeFiles, *cf.pkg)
+	}
+
+	provider := &captureProvider{}
+	client, err := llm.NewClient(llm.WithProvider(provider), llm.WithPromptOverrides(cfg.Prompts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt, err := provider.capture(func() error {
+		_, err := client.GenerateTestsList(context.Background(), "Add", "package calc", "")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages := prompt.Messages; messages[0].Content != "Be brief." || !strings.Contains(messages[len(messages)-1].Content, "package calc") {
+		t.Errorf("unexpected messages %+v", messages)
+	}
+
+	if err := os.WriteFile(path, []byte("prompts:\n  lists: x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("expected an error for an unknown stage")
+	}
+}
+
+func TestCapturePrompt(t *testing.T) {
+	provider := &captureProvider{}
+	c, err := llm.NewClient(llm.WithProvider(provider), llm.WithPromptOverrides(map[llm.Stage]string{llm.StageCode: "Write table tests."}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := llm.Spec{Name: "TestAdd_Positive", Description: "Add 1 and 2, expect 3"}
+	prompt, err := provider.capture(func() error {
+		_, err := c.GenerateTestCode(context.Background(), spec, "Add", "package calc\n\nfunc Add(a, b int) int { return a + b }\n", "calc", "")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt.Stage != llm.StageCode || !strings.Contains(prompt.Messages[0].Content, "Write table tests.") {
+		t.Errorf("unexpected prompt %+v", prompt)
+	}
+
+	var out strings.Builder
+	writePrompt(&out, "code", "gpt-4", prompt)
+	if !strings.HasPrefix(out.String(), "=== code: gpt-4, ") || !strings.Contains(out.String(), "--- system ---\nWrite table tests.") {
+		t.Errorf("unexpected preview:\n%s", out.String())
+	}
+
+	if _, err := provider.capture(func() error { return errors.New("no code") }); err == nil || err.Error() != "no code" {
+		t.Errorf("expected the error of a generation sending no prompt, got %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	provider := &captureProvider{}
+	c, err := llm.NewClient(llm.WithProvider(provider), llm.WithModel("gpt-4"), llm.WithMaxTokens(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	d := &dryRun{w: &out, model: "gpt-4", provider: provider}
+	code := "package calc\n\nfunc Add(a, b int) int { return a + b }\n"
+	d.show("spec", func() error {
+		_, err := c.GenerateSpec(context.Background(), "Add", code, "")
+		return err
+	})
+	d.show("mocks", func() error { return errors.New("no dependencies") })
+	d.summary()
+
+	if d.total.Requests != 1 || d.total.PromptTokens == 0 || d.total.CompletionTokens != 1000 {
+		t.Errorf("unexpected totals %+v", d.total)
+	}
+	want, _ := llm.RequestCost("gpt-4", d.total.PromptTokens, 1000)
+	if d.total.Cost != want {
+		t.Errorf("cost %f, want %f", d.total.Cost, want)
+	}
+	for _, s := range []string{"=== spec: gpt-4, ", "=== mocks: not built: no dependencies ===", "Dry run: 1 requests, "} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("missing %q in:\n%s", s, out.String())
+		}
+	}
+}
+
+func TestDryRunWritesNoFiles(t *testing.T) {
+	dir := t.TempDir()
+	fs := flag.NewFlagSet("cases", flag.ContinueOnError)
+	cl := addClientFlags(fs)
+	addLogFlags(fs)
+	addDryRunFlag(fs)
+	err := fs.Parse([]string{
+		"-dry-run", "-usage=false",
+		"-log-file=" + filepath.Join(dir, "run.log"),
+		"-prompt-corpus=" + filepath.Join(dir, "corpus"),
+		"-debug-http=" + filepath.Join(dir, "http"),
+		"-artifacts=" + filepath.Join(dir, "artifacts"),
+		"-record=" + filepath.Join(dir, "record"),
+		"-models=gpt-3.5-turbo,gpt-4", "-model-stats=" + filepath.Join(dir, "stats.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(out io.Writer) { log.SetOutput(out) }(log.Writer())
+	openRunLog(fs)
+	cl.dryRun = true
+
+	provider := &captureProvider{}
+	c, done := cl.client(&pipeline.RunReport{}, dir, llm.WithProvider(provider), llm.WithCallbacks(llm.NopCallbacks{}))
+	if _, err := provider.capture(func() error {
+		_, err := c.GenerateSpec(context.Background(), "Add", "package calc\n\nfunc Add(a, b int) int { return a + b }\n", "")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	done()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("dry run wrote %s", e.Name())
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	dir := t.TempDir()
+	config := "owners:\n  - path: \"*\"\n    team: \"@org/platform\"\n  - path: payments/\n    team: \"@org/payments\"\n  - path: \"internal/*/ledger.go\"\n    team: \"@org/ledger\"\n"
+	path := filepath.Join(dir, ConfigFile)
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		file string
+		want string
+	}{
+		{file: "main.go", want: "@org/platform"},
+		{file: "payments/card/charge.go", want: "@org/payments"},
+		{file: "internal/books/ledger.go", want: "@org/ledger"},
+		{file: "internal/books/journal.go", want: "@org/platform"},
+		{file: "../outside.go", want: ""},
+	}
+	for _, tc := range testCases {
+		if got := cfg.OwnerOf(filepath.Join(dir, tc.file)); got != tc.want {
+			t.Errorf("OwnerOf(%s) = %q, want %q", tc.file, got, tc.want)
+		}
+	}
+}
+
+func TestTUI(t *testing.T) {
+	run := func(t *testing.T, names []string, generate func(ui *tui, ctx context.Context, i int) error, commands ...string) ([]error, string) {
+		in, w := io.Pipe()
+		var out bytes.Buffer
+		ui := newTUI(&out, in, &pipeline.RunReport{})
+		result := make(chan []error)
+		go func() {
+			result <- ui.runSpecs(context.Background(), names, func(ctx context.Context, i int) error {
+				return generate(ui, ctx, i)
+			})
+		}()
+		go func() {
+			for _, cmd := range commands {
+				io.WriteString(w, cmd+"\n")
+			}
+		}()
+		select {
+		case errs := <-result:
+			return errs, out.String()
+		case <-time.After(10 * time.Second):
+			t.Fatal("runSpecs did not return")
+			return nil, ""
+		}
+	}
+
+	t.Run("cancel and retry", func(t *testing.T) {
+		var attempts int32
+		errs, out := run(t, []string{"TestA", "TestB", "TestC"}, func(ui *tui, ctx context.Context, i int) error {
+			switch i {
+			case 0:
+				ui.OnDelta(llm.StageCode, "TestA", "package calc\n\nfunc TestA(t *testing.T) {\n")
+				return nil
+			case 1:
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				return errors.New("boom")
+			}
+			return nil
+		}, "c 2", "r 3", "")
+		if errs[0] != nil || !errors.Is(errs[1], errSpecCanceled) || errs[2] != nil {
+			t.Errorf("got errors %v, want TestB canceled and the others generated", errs)
+		}
+		if n := atomic.LoadInt32(&attempts); n != 2 {
+			t.Errorf("TestC was generated %d times, want 2", n)
+		}
+		for _, want := range []string{"func TestA(t *testing.T) {", "canceled", "Retrying TestC"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("the screen misses %q:\n%s", want, out)
+			}
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		errs, out := run(t, []string{"TestX"}, func(_ *tui, ctx context.Context, _ int) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, "s 1")
+		if !errors.Is(errs[0], pipeline.ErrSpecSkipped) {
+			t.Errorf("got error %v, want the spec skipped", errs[0])
+		}
+		if !strings.Contains(out, "Skipped TestX") {
+			t.Errorf("the screen misses the skip:\n%s", out)
+		}
+	})
+}
+
+func TestInteractiveApproval(t *testing.T) {
+	var out bytes.Buffer
+	a := &approver{
+		in:  bufio.NewReader(strings.NewReader("g\nuse a table\ne\na\nx\nr\n")),
+		out: &out,
+		edit: func(path string) error {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(path, append(content, "// edited\n"...), 0o644)
+		},
+	}
+	var instructions []string
+	regenerate := func(extra string) (string, error) {
+		instructions = append(instructions, extra)
+		return "func TestAdd(t *testing.T) { /* table */ }\n", nil
+	}
+
+	code, ok := a.review(llm.Spec{Name: "TestAdd"}, "func TestAdd(t *testing.T) {}\n", regenerate)
+	if !ok || code != "func TestAdd(t *testing.T) { /* table */ }\n// edited\n" {
+		t.Errorf("got %q, %v, want the regenerated and edited test accepted", code, ok)
+	}
+	if !reflect.DeepEqual(instructions, []string{"use a table"}) {
+		t.Errorf("regenerated with %q, want the typed instructions", instructions)
+	}
+	if _, ok := a.review(llm.Spec{Name: "TestSub"}, "func TestSub(t *testing.T) {}\n", regenerate); ok {
+		t.Error("the rejected test was accepted")
+	}
+	if !strings.Contains(out.String(), `Unknown answer "x"`) {
+		t.Errorf("the unknown answer was not reported:\n%s", out.String())
+	}
+	if _, ok := a.review(llm.Spec{Name: "TestMul"}, "func TestMul(t *testing.T) {}\n", regenerate); !ok {
+		t.Error("the test was not accepted once the input ended")
+	}
+
+	highlighted := highlightGo("func f() string { return \"x\" } // done\n")
+	for _, want := range []string{ansiKeyword + "func" + ansiReset, ansiString + `"x"` + ansiReset, ansiComment + "// done" + ansiReset} {
+		if !strings.Contains(highlighted, want) {
+			t.Errorf("highlighted code misses %q: %q", want, highlighted)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// captureProvider records the final prompts instead of sending them, to preview what would
+// be sent to the model.
+type captureProvider struct {
+	mu      sync.Mutex
+	prompts []llm.Prompt
+}
+
+func (p *captureProvider) Complete(_ context.Context, prompt llm.Prompt) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prompts = append(p.prompts, prompt)
+	return "", llm.ErrPromptCaptured
+}
+
+func (p *captureProvider) Stream(ctx context.Context, prompt llm.Prompt, _ func(delta string)) (string, error) {
+	return p.Complete(ctx, prompt)
+}
+
+// capture calls generate, which sends one prompt, and returns the prompt sent. The error of
+// generate is returned unless the prompt was captured.
+func (p *captureProvider) capture(generate func() error) (llm.Prompt, error) {
+	p.mu.Lock()
+	before := len(p.prompts)
+	p.mu.Unlock()
+	err := generate()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.prompts) == before {
+		if err == nil {
+			err = errors.New("no prompt was sent")
+		}
+		return llm.Prompt{}, err
+	}
+	return p.prompts[len(p.prompts)-1], nil
+}
+
+// writePrompt prints the prompt as it would be sent to the model with its token count.
+func writePrompt(w io.Writer, title string, model string, prompt llm.Prompt) {
+	if prompt.Model != "" {
+		model = prompt.Model
+	}
+	fmt.Fprintf(w, "=== %s: %s, %d prompt tokens, at most %d completion tokens", title, model,
+		llm.PromptTokens(model, prompt.Messages), prompt.MaxTokens)
+	if prompt.JSON {
+		fmt.Fprint(w, ", JSON mode")
+	}
+	if prompt.Schema != nil {
+		fmt.Fprintf(w, ", calling %s", prompt.Schema.Name)
+	}
+	fmt.Fprintln(w, " ===")
+	for _, m := range prompt.Messages {
+		fmt.Fprintf(w, "--- %s ---\n%s\n", m.Role, strings.TrimRight(m.Content, "\n"))
+	}
+	fmt.Fprintln(w)
+}
+
+// dryRun prints the prompts of a run instead of sending them and totals their estimated
+// usage. Nothing is generated, so the later stages are built from placeholder outputs of the
+// earlier ones.
+type dryRun struct {
+	w        io.Writer
+	model    string
+	provider *captureProvider
+	total    llm.StageUsage
+}
+
+// show prints the prompt sent by generate, or why it could not be built.
+func (d *dryRun) show(title string, generate func() error) {
+	prompt, err := d.provider.capture(generate)
+	if err != nil {
+		fmt.Fprintf(d.w, "=== %s: not built: %v ===\n\n", title, err)
+		return
+	}
+	writePrompt(d.w, title, d.model, prompt)
+	model := d.model
+	if prompt.Model != "" {
+		model = prompt.Model
+	}
+	tokens := llm.PromptTokens(model, prompt.Messages)
+	cost, priced := llm.RequestCost(model, tokens, prompt.MaxTokens)
+	d.total.Add(llm.StageUsage{Requests: 1, PromptTokens: tokens, CompletionTokens: prompt.MaxTokens, Cost: cost})
+	if !priced {
+		d.total.UnpricedRequests++
+	}
+}
+
+// placeholder stands for the output of a stage in the prompts of the later stages.
+func placeholder(stage llm.Stage) string {
+	return fmt.Sprintf("<output of the %s stage>", stage)
+}
+
+// summary prints the totals of the prompts shown. Completions are counted at their maximum
+// tokens, retries and model escalations are not counted.
+func (d *dryRun) summary() {
+	fmt.Fprintf(d.w, "Dry run: %d requests, %d prompt tokens, at most %d completion tokens, at most $%.4f\n",
+		d.total.Requests, d.total.PromptTokens, d.total.CompletionTokens, d.total.Cost)
+	if d.total.UnpricedRequests > 0 {
+		fmt.Fprintf(d.w, "%d requests go to models of unknown prices and are not in the cost\n", d.total.UnpricedRequests)
+	}
+}
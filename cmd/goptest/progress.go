@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// progress receives the progress events of the command, nil without -progress-fd.
+var progress *llm.ProgressWriter
+
+// openProgress opens the file descriptor of -progress-fd of the parsed flags of fs.
+func openProgress(fs *flag.FlagSet) {
+	fd, err := strconv.Atoi(fs.Lookup("progress-fd").Value.String())
+	if err != nil {
+		fatalf("Invalid -progress-fd: %v", err)
+	}
+	if fd <= 0 {
+		return
+	}
+	progress = llm.NewProgressWriter(os.NewFile(uintptr(fd), "progress"))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// runLog is the log of the running command, configured by its -log-file and -log-level flags.
+var runLog *llm.RunLog
+
+// addLogFlags adds the run log and progress flags every command has.
+func addLogFlags(fs *flag.FlagSet) {
+	fs.String("log-file", "goptest-debug.log", "File to append the JSON lines run log of requests, stages and messages to, empty to disable it")
+	fs.String("log-level", "debug", "Level of the run log: debug logs truncated prompts and responses, info, warn or error")
+	fs.Int("progress-fd", 0, "File descriptor to write JSON lines progress events to, e.g. 3 with 3>progress.jsonl, 0 to disable them")
+}
+
+// openRunLog opens the run log selected by the parsed flags of fs and sends the standard
+// logger's output to it. Dry runs write no run log.
+func openRunLog(fs *flag.FlagSet) {
+	level, err := llm.ParseLogLevel(fs.Lookup("log-level").Value.String())
+	if err != nil {
+		fatalf("Invalid -log-level: %v", err)
+	}
+	path := fs.Lookup("log-file").Value.String()
+	if dryRun := fs.Lookup("dry-run"); dryRun != nil && dryRun.Value.String() == "true" {
+		path = ""
+	}
+	if path == "" {
+		log.SetOutput(io.Discard)
+		return
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		fatalf("Failed to open the run log: %v", err)
+	}
+	runLog = llm.NewRunLog(file, level)
+	log.SetOutput(runLog)
+	log.SetFlags(log.Lshortfile)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sentiens/goptest/llm"
+	"github.com/sentiens/goptest/pipeline"
+)
+
+// errSpecCanceled is the error of the specs canceled from the TUI.
+var errSpecCanceled = errors.New("canceled from the TUI")
+
+// tuiRedrawInterval is how often the TUI redraws the screen.
+const tuiRedrawInterval = 200 * time.Millisecond
+
+type specState string
+
+const (
+	specRunning  specState = "running"
+	specDone     specState = "done"
+	specFailed   specState = "failed"
+	specCanceled specState = "canceled"
+	specSkipped  specState = "skipped"
+)
+
+// tuiRow is the progress of a spec on the TUI.
+type tuiRow struct {
+	name  string
+	state specState
+	start time.Time
+	end   time.Time
+	err   error
+	// output is the streamed test code of the running attempt.
+	output strings.Builder
+	// attempt counts the launches of the spec, results of earlier attempts are ignored.
+	attempt  int
+	cancel   context.CancelFunc
+	canceled bool
+}
+
+// tui shows the progress of every spec of the code stage on a redrawn screen and reads
+// commands to cancel, retry or skip specs, one per line. Outside of runSpecs it prints
+// like the plain command line.
+type tui struct {
+	out   io.Writer
+	in    io.Reader
+	width int
+	// usage returns the usage of the client, for the token and cost totals.
+	usage func() []llm.StageUsage
+	cli   *cliCallbacks
+
+	readOnce sync.Once
+	commands chan string
+
+	mu      sync.Mutex
+	active  bool
+	rows    []*tuiRow
+	byName  map[string]*tuiRow
+	message string
+}
+
+// newTUI returns a TUI drawing to out and reading commands from in. The width of the screen
+// is taken from $COLUMNS, 100 columns by default.
+func newTUI(out io.Writer, in io.Reader, report *pipeline.RunReport) *tui {
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width < 40 {
+		width = 100
+	}
+	return &tui{out: out, in: in, width: width, cli: &cliCallbacks{out: out, report: report}}
+}
+
+func (t *tui) OnStageStart(stage llm.Stage, target string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.active {
+		t.cli.OnStageStart(stage, target)
+	}
+}
+
+func (t *tui) OnDelta(stage llm.Stage, target string, delta string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.active {
+		t.cli.OnDelta(stage, target, delta)
+		return
+	}
+	if row := t.byName[target]; row != nil && stage == llm.StageCode {
+		row.output.WriteString(delta)
+	}
+}
+
+func (t *tui) OnStageEnd(result llm.StageResult) {
+	t.cli.OnStageEnd(result)
+}
+
+func (t *tui) OnRetry(event llm.RetryEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.active {
+		t.cli.OnRetry(event)
+		return
+	}
+	if event.Restart {
+		t.message = fmt.Sprintf("A stream was interrupted, restarting in %s", event.Wait)
+		return
+	}
+	t.message = fmt.Sprintf("A request failed with status %d, retrying in %s", event.StatusCode, event.Wait)
+}
+
+// specResult is the outcome of an attempt of a spec.
+type specResult struct {
+	i       int
+	attempt int
+	err     error
+}
+
+// runSpecs runs generate for every spec in parallel while showing their progress. The user
+// can cancel a spec, recording it as failed, skip it, leaving it out of the run, or retry it,
+// running or not. Once every spec finished runSpecs returns, after the user confirmed with
+// an empty line when some failed or were canceled. It returns the error of every spec,
+// ErrSpecSkipped for the skipped ones.
+func (t *tui) runSpecs(ctx context.Context, names []string, generate func(ctx context.Context, i int) error) []error {
+	t.readOnce.Do(func() {
+		t.commands = make(chan string)
+		go func() {
+			scanner := bufio.NewScanner(t.in)
+			for scanner.Scan() {
+				t.commands <- strings.TrimSpace(scanner.Text())
+			}
+			close(t.commands)
+		}()
+	})
+
+	t.mu.Lock()
+	t.active = true
+	t.rows = make([]*tuiRow, len(names))
+	t.byName = make(map[string]*tuiRow)
+	for i, name := range names {
+		t.rows[i] = &tuiRow{name: name}
+		t.byName[name] = t.rows[i]
+	}
+	t.message = ""
+	t.mu.Unlock()
+
+	results := make(chan specResult)
+	var wg sync.WaitGroup
+	// launch starts a new attempt of the spec, t.mu must be held.
+	launch := func(i int) {
+		row := t.rows[i]
+		if row.cancel != nil {
+			row.cancel()
+		}
+		specCtx, cancel := context.WithCancel(ctx)
+		row.attempt++
+		row.state, row.start, row.err, row.cancel, row.canceled = specRunning, time.Now(), nil, cancel, false
+		row.output.Reset()
+		wg.Add(1)
+		go func(attempt int) {
+			defer wg.Done()
+			err := generate(specCtx, i)
+			cancel()
+			results <- specResult{i: i, attempt: attempt, err: err}
+		}(row.attempt)
+	}
+
+	t.mu.Lock()
+	for i := range names {
+		launch(i)
+	}
+	t.mu.Unlock()
+
+	ticker := time.NewTicker(tuiRedrawInterval)
+	defer ticker.Stop()
+	commands := t.commands
+	confirmed, interrupted := false, false
+	done := ctx.Done()
+	for {
+		t.redraw()
+		if t.finished(confirmed || interrupted || commands == nil) {
+			break
+		}
+		select {
+		case r := <-results:
+			t.settle(r)
+		case cmd, ok := <-commands:
+			if !ok {
+				commands = nil
+				continue
+			}
+			if cmd == "" {
+				confirmed = true
+				continue
+			}
+			t.command(cmd, launch)
+		case <-done:
+			// Every attempt returns with the context's error.
+			interrupted, done = true, nil
+		case <-ticker.C:
+		}
+	}
+
+	t.mu.Lock()
+	t.active = false
+	errs := make([]error, len(names))
+	for i, row := range t.rows {
+		switch row.state {
+		case specFailed:
+			errs[i] = row.err
+		case specCanceled:
+			errs[i] = errSpecCanceled
+		case specSkipped:
+			errs[i] = pipeline.ErrSpecSkipped
+		}
+	}
+	t.mu.Unlock()
+	// Drain the results of the skipped specs' canceled attempts.
+	go func() {
+		for range results {
+		}
+	}()
+	wg.Wait()
+	close(results)
+	fmt.Fprintln(t.out)
+	return errs
+}
+
+// finished reports whether every spec finished, and none failed or was canceled unless
+// confirmed is set.
+func (t *tui) finished(confirmed bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, row := range t.rows {
+		switch row.state {
+		case specRunning:
+			return false
+		case specFailed, specCanceled:
+			if !confirmed {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// settle records the result of an attempt, unless it was superseded by a retry.
+func (t *tui) settle(r specResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	row := t.rows[r.i]
+	if r.attempt != row.attempt || row.state != specRunning {
+		return
+	}
+	row.end = time.Now()
+	row.cancel = nil
+	switch {
+	case r.err == nil:
+		row.state = specDone
+	case row.canceled:
+		row.state = specCanceled
+	default:
+		row.state, row.err = specFailed, r.err
+	}
+}
+
+// command runs a command of the user: c N cancels, r N retries and s N skips the Nth spec.
+func (t *tui) command(cmd string, launch func(i int)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	verb, arg, _ := strings.Cut(cmd, " ")
+	n, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || n < 1 || n > len(t.rows) {
+		t.message = fmt.Sprintf("Unknown command %q, want c N, r N or s N with N from 1 to %d", cmd, len(t.rows))
+		return
+	}
+	row := t.rows[n-1]
+	switch verb {
+	case "c":
+		if row.state != specRunning {
+			t.message = fmt.Sprintf("%s is not running", row.name)
+			return
+		}
+		row.canceled = true
+		row.cancel()
+		t.message = "Canceling " + row.name
+	case "r":
+		launch(n - 1)
+		t.message = "Retrying " + row.name
+	case "s":
+		if row.cancel != nil {
+			row.cancel()
+			row.cancel = nil
+		}
+		row.state, row.end = specSkipped, time.Now()
+		t.message = "Skipped " + row.name
+	default:
+		t.message = fmt.Sprintf("Unknown command %q, want c N, r N or s N", cmd)
+	}
+}
+
+// redraw clears the screen and draws the table of the specs, the usage and the commands.
+func (t *tui) redraw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+
+	counts := make(map[specState]int)
+	for _, row := range t.rows {
+		counts[row.state]++
+	}
+	fmt.Fprintf(&b, "goptest: %d of %d specs done", counts[specDone], len(t.rows))
+	for _, state := range []specState{specRunning, specFailed, specCanceled, specSkipped} {
+		if counts[state] > 0 {
+			fmt.Fprintf(&b, ", %d %s", counts[state], state)
+		}
+	}
+	if t.usage != nil {
+		var total llm.StageUsage
+		for _, u := range t.usage() {
+			total.PromptTokens += u.PromptTokens
+			total.CompletionTokens += u.CompletionTokens
+			total.Cost += u.Cost
+		}
+		fmt.Fprintf(&b, " | %d prompt + %d completion tokens, $%.2f", total.PromptTokens, total.CompletionTokens, total.Cost)
+	}
+	b.WriteString("\n\n")
+
+	nameWidth := 4
+	for _, row := range t.rows {
+		if len(row.name) > nameWidth {
+			nameWidth = len(row.name)
+		}
+	}
+	if nameWidth > t.width/3 {
+		nameWidth = t.width / 3
+	}
+	fmt.Fprintf(&b, "%3s  %-*s  %-8s  %6s  %s\n", "#", nameWidth, "SPEC", "STATE", "TIME", "OUTPUT")
+	for i, row := range t.rows {
+		elapsed := row.end.Sub(row.start)
+		if row.state == specRunning {
+			elapsed = time.Since(row.start)
+		}
+		detail := lastLine(row.output.String())
+		if row.state == specFailed {
+			detail = row.err.Error()
+		}
+		line := fmt.Sprintf("%3d  %-*s  %-8s  %5.1fs  %s", i+1, nameWidth, truncate(row.name, nameWidth), row.state, elapsed.Seconds(), detail)
+		b.WriteString(truncate(line, t.width) + "\n")
+	}
+
+	b.WriteString("\n")
+	if t.message != "" {
+		b.WriteString(t.message + "\n")
+	}
+	b.WriteString("Commands: c N cancels, r N retries and s N skips spec N, Enter drafts the tests once no spec runs\n")
+	fmt.Fprint(t.out, b.String())
+}
+
+// lastLine returns the last non-empty line of s, with its indentation removed.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimRight(s, " \t\n"), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// truncate cuts s to width bytes, ending with ... when cut.
+func truncate(s string, width int) string {
+	if len(s) <= width {
+		return s
+	}
+	if width <= 3 {
+		return s[:width]
+	}
+	return s[:width-3] + "..."
+}
@@ -1,4 +1,4 @@
 #!/bin/bash
 
-go build main.go
-./main -spec-file=specs.yaml -code-files=testcode.go -output-file=generated_test.go
+go build -o main ./cmd/goptest
+./main code -spec-file=specs.yaml -code-files=testdata/testcode.go -output-file=generated_test.go
@@ -3,6 +3,15 @@ module github.com/sentiens/goptest
 go 1.20
 
 require (
-	github.com/sashabaranov/go-openai v1.10.0
+	github.com/pkoukk/tiktoken-go v0.1.8
+	github.com/pkoukk/tiktoken-go-loader v0.0.2
+	github.com/sashabaranov/go-openai v1.20.2
+	golang.org/x/tools v0.17.0
 	gopkg.in/yaml.v2 v2.4.0
 )
+
+require (
+	github.com/dlclark/regexp2 v1.10.0 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	golang.org/x/mod v0.14.0 // indirect
+)
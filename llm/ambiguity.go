@@ -0,0 +1,70 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// AmbiguousCase is a test case the candidate case lists expect different behavior of, which
+// often points at a bug or an underspecified behavior of the target.
+type AmbiguousCase struct {
+	Target string `yaml:"-"`
+	Name   string `yaml:"name"`
+	// Behavior is the input or scenario the candidates disagree on.
+	Behavior string `yaml:"behavior"`
+	// Expectations are the differing expected outputs, one per candidate or group of them.
+	Expectations []string `yaml:"expectations"`
+}
+
+func comparePrompt(allCode string, candidates []string) []Message {
+	systemContent := "Acting as a senior QA engineer you should compare test case lists written independently " +
+		"for the same code and find the cases whose expected behavior differs: for the same input or scenario, " +
+		"the lists expect different outputs, errors, side effects or mock calls. " +
+		"Ignore differences in wording, naming, order and cases only some lists have. " +
+		"Answer in YAML with an `ambiguous` list of objects with `name` (the case name of the first list having it), " +
+		"`behavior` (the input or scenario) and `expectations` (the differing expectations) fields, " +
+		"and an empty list when every list expects the same behavior."
+	var b strings.Builder
+	fmt.Fprintf(&b, "The code is: \n```go\n%s```\n", allCode)
+	for i, candidate := range candidates {
+		fmt.Fprintf(&b, "Case list %d: \n```yaml\n%s\n```\n", i+1, strings.TrimSpace(RemoveYAMLLines(candidate)))
+	}
+	return []Message{
+		{Role: RoleSystem, Content: systemContent},
+		{Role: RoleUser, Content: b.String()},
+	}
+}
+
+// CompareCandidates asks the model which cases of the candidate case lists of the target
+// expect different behavior.
+func (c *Client) CompareCandidates(ctx context.Context, whatToTest string, allCode string, candidates []string) ([]AmbiguousCase, error) {
+	prompt := c.BasicPrompt()
+	prompt.Temperature = 0
+	prompt.TopP = 1
+	prompt.Messages = c.withOverride(StageCompare, comparePrompt(allCode, candidates))
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return nil, err
+	}
+
+	prompt.Stage = StageCompare
+	prompt.Target = whatToTest
+	out, err := c.runStage(StageCompare, whatToTest, func() (string, error) {
+		return c.Complete(ctx, prompt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Ambiguous []AmbiguousCase `yaml:"ambiguous"`
+	}
+	if err := yaml.Unmarshal([]byte(RemoveYAMLLines(out)), &res); err != nil {
+		return nil, fmt.Errorf("failed to parse the comparison: %v", err)
+	}
+	for i := range res.Ambiguous {
+		res.Ambiguous[i].Target = whatToTest
+	}
+	return res.Ambiguous, nil
+}
@@ -0,0 +1,155 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// traceAnnotation links a generated test to the artifacts of its generation.
+const traceAnnotation = "// goptest:trace "
+
+// Artifact is an attempt of a prompt, saved as a JSON file of the trace directory of its target.
+type Artifact struct {
+	Time     time.Time `json:"time"`
+	Stage    Stage     `json:"stage"`
+	Target   string    `json:"target,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Messages []Message `json:"messages"`
+	// Response is the raw response of the model, before any cleanup.
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ArtifactStore keeps every attempt of the prompts of a run, in a run directory with a trace
+// directory per target, e.g. the test of a spec. Tests annotated with their trace can be
+// debugged long after the run without generating them again.
+//
+// An ArtifactStore is safe for concurrent use.
+type ArtifactStore struct {
+	dir string
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+// NewArtifactStore creates the run directory of a new run in root, named after the current
+// time.
+func NewArtifactStore(root string) (*ArtifactStore, error) {
+	dir := filepath.Join(root, time.Now().Format("20060102-150405.000"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create the run directory: %v", err)
+	}
+	return &ArtifactStore{dir: dir, attempts: make(map[string]int)}, nil
+}
+
+// Dir returns the run directory.
+func (s *ArtifactStore) Dir() string {
+	return s.dir
+}
+
+// TraceID returns the trace of the target, unique across runs.
+func (s *ArtifactStore) TraceID(target string) string {
+	sum := sha256.Sum256([]byte(s.dir + "\x00" + target))
+	return hex.EncodeToString(sum[:4])
+}
+
+// TraceDir returns the directory of the artifacts of the target.
+func (s *ArtifactStore) TraceDir(target string) string {
+	return filepath.Join(s.dir, s.TraceID(target))
+}
+
+// Trace returns the trace annotation of the test generated for target, "" when no attempt
+// of it was saved.
+func (s *ArtifactStore) Trace(target string) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attempts[target] == 0 {
+		return ""
+	}
+	return traceAnnotation + s.TraceID(target) + " " + filepath.ToSlash(s.TraceDir(target)) + "\n"
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// save writes the attempt as the next artifact of the trace of its target, the prompts
+// without a target to the run directory.
+func (s *ArtifactStore) save(prompt Prompt, model string, resp string, err error) error {
+	if prompt.Model != "" {
+		model = prompt.Model
+	}
+	a := Artifact{Time: time.Now(), Stage: prompt.Stage, Target: prompt.Target, Model: model, Messages: prompt.Messages, Response: resp}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	content, jsonErr := json.MarshalIndent(a, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	dir := s.dir
+	if prompt.Target != "" {
+		dir = s.TraceDir(prompt.Target)
+	}
+	s.mu.Lock()
+	s.attempts[prompt.Target]++
+	n := s.attempts[prompt.Target]
+	s.mu.Unlock()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to save the artifact: %v", err)
+	}
+	name := fmt.Sprintf("%02d-%s.json", n, unsafeFileChars.ReplaceAllString(string(prompt.Stage), "_"))
+	if err := WriteToFile(string(content), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("failed to save the artifact: %v", err)
+	}
+	return nil
+}
+
+// WithArtifacts saves every attempt of the prompts, with the raw response or the error, to
+// the store.
+func WithArtifacts(s *ArtifactStore) Option {
+	return func(o *GeneratorOptions) {
+		o.Artifacts = s
+	}
+}
+
+// artifactProvider saves the attempts of its provider.
+type artifactProvider struct {
+	Provider
+	store *ArtifactStore
+	model string
+}
+
+func (p *artifactProvider) Complete(ctx context.Context, prompt Prompt) (string, error) {
+	resp, err := p.Provider.Complete(ctx, prompt)
+	// The artifacts are for debugging, the run goes on without them.
+	if saveErr := p.store.save(prompt, p.model, resp, err); saveErr != nil {
+		log.Print(saveErr)
+	}
+	return resp, err
+}
+
+func (p *artifactProvider) Stream(ctx context.Context, prompt Prompt, onDelta func(delta string)) (string, error) {
+	resp, err := p.Provider.Stream(ctx, prompt, onDelta)
+	// The artifacts are for debugging, the run goes on without them.
+	if saveErr := p.store.save(prompt, p.model, resp, err); saveErr != nil {
+		log.Print(saveErr)
+	}
+	return resp, err
+}
+
+// Trace returns the trace annotation of the test the client generated for target, "" when
+// the client saves no artifacts.
+func (c *Client) Trace(target string) string {
+	return c.artifacts.Trace(target)
+}
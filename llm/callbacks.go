@@ -0,0 +1,100 @@
+package llm
+
+import (
+	"errors"
+	"time"
+)
+
+// Callbacks receives progress of the generation stages. Methods may be called concurrently
+// for different targets, implementations must be safe for concurrent use.
+type Callbacks interface {
+	// OnStageStart is called before a stage sends its request.
+	OnStageStart(stage Stage, target string)
+	// OnDelta is called for every streamed chunk of a stage's output.
+	OnDelta(stage Stage, target string, delta string)
+	// OnStageEnd is called once the stage finished, successfully or not.
+	OnStageEnd(result StageResult)
+}
+
+// RetryCallbacks is implemented by Callbacks that also want to know about retried requests.
+// It is separate from Callbacks so that implementations written before retries were
+// reported keep compiling.
+type RetryCallbacks interface {
+	// OnRetry is called before the client waits to retry a failed request.
+	OnRetry(event RetryEvent)
+}
+
+// onRetry reports event to cb when it implements RetryCallbacks.
+func onRetry(cb Callbacks, event RetryEvent) {
+	if rc, ok := cb.(RetryCallbacks); ok {
+		rc.OnRetry(event)
+	}
+}
+
+// RetryEvent describes a failed request that is about to be retried.
+type RetryEvent struct {
+	// StatusCode is the HTTP status code of the failed request, 0 for interrupted streams
+	// without one.
+	StatusCode int
+	// Attempt is the number of the attempt that failed, starting at 1.
+	Attempt int
+	// Wait is how long the client waits before the next attempt.
+	Wait time.Duration
+	// Err is the error returned by the failed attempt.
+	Err error
+	// Restart is set when a stream failed after some of its deltas were reported. The
+	// stream starts over, its new deltas replace the reported ones.
+	Restart bool
+}
+
+// NopCallbacks ignores all events. Embed it to implement only some of the callbacks.
+type NopCallbacks struct{}
+
+func (NopCallbacks) OnStageStart(Stage, string) {}
+
+func (NopCallbacks) OnDelta(Stage, string, string) {}
+
+func (NopCallbacks) OnStageEnd(StageResult) {}
+
+func (NopCallbacks) OnRetry(RetryEvent) {}
+
+// WithCallbacks sets the callbacks notified about stage progress.
+func WithCallbacks(cb Callbacks) Option {
+	return func(o *GeneratorOptions) {
+		o.Callbacks = cb
+	}
+}
+
+// logStage records a finished stage in the run log.
+func (c *Client) logStage(r StageResult) {
+	event := LogEvent{Event: "stage", Stage: r.Stage, Target: r.Target, LatencyMS: r.Duration.Milliseconds(), Response: r.Output}
+	level := LevelInfo
+	if r.Err != nil {
+		if errors.Is(r.Err, ErrPromptCaptured) {
+			return
+		}
+		level = LevelError
+		event.Error = r.Err.Error()
+	}
+	c.runLog.Log(level, event)
+}
+
+// runStage wraps a stage with the start and end callbacks and records it in the run log.
+func (c *Client) runStage(stage Stage, target string, fn func() (string, error)) (string, error) {
+	c.callbacks.OnStageStart(stage, target)
+	start := time.Now()
+	out, err := fn()
+	result := StageResult{
+		Stage:    stage,
+		Target:   target,
+		Output:   out,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	c.callbacks.OnStageEnd(result)
+	c.logStage(result)
+	return out, err
+}
+
+// ErrPromptCaptured fails the requests of a captureProvider once their prompt is captured.
+var ErrPromptCaptured = errors.New("prompt captured, not sent")
@@ -0,0 +1,136 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sentiens/goptest/aggregator"
+	"github.com/sentiens/goptest/spec"
+)
+
+const (
+	captureTestName = "TestGoptestCapture"
+	capturePrefix   = "goptest-capture: "
+	captureTimeout  = time.Minute
+)
+
+func capturePrompt(whatToTest string, allCode string, pkg string) []Message {
+	systemContent := "Acting as a senior Go developer you should write a program that records how the code behaves today. " +
+		fmt.Sprintf("Write a single test function %s(t *testing.T) in package %s. ", captureTestName, pkg) +
+		"It calls the target with 10 to 20 varied, realistic inputs including boundaries, empty and invalid values. " +
+		fmt.Sprintf("For every call print exactly one line with fmt.Printf(%q, input, output), ", capturePrefix+"%s => %#v\n") +
+		"where input is a short Go expression of the arguments and output all return values. " +
+		"Recover panics per call and print the panic value as output. Never call t.Fatal or t.Error, " +
+		"do not touch the network or files outside of t.TempDir(). Return only Go code with all imports."
+	userContent := fmt.Sprintf("Code: \n```go\n%s```\nTarget: %s\n", allCode, whatToTest)
+	return []Message{
+		{Role: RoleSystem, Content: systemContent},
+		{Role: RoleUser, Content: userContent},
+	}
+}
+
+// captureLines extracts the observations printed by the capture program.
+func captureLines(output string) []string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		if i := strings.Index(line, capturePrefix); i >= 0 {
+			lines = append(lines, strings.TrimSpace(line[i+len(capturePrefix):]))
+		}
+	}
+	return lines
+}
+
+// CaptureBehavior runs the capture program as a test of the package in dir and returns the
+// observed input/output lines. The program is added with a go build overlay, so the package
+// directory is never modified, and the run is bounded by a timeout.
+func CaptureBehavior(ctx context.Context, dir string, program string) ([]string, error) {
+	tmp, err := os.MkdirTemp("", "goptest-capture")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	overlayPath, err := writeOverlay(tmp, absDir, map[string]string{"goptest_capture_test.go": program})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, captureTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "go", "test", "-overlay", overlayPath, "-count=1", "-v",
+		"-run", "^"+captureTestName+"$", ".")
+	cmd.Dir = absDir
+	out, err := cmd.CombinedOutput()
+	lines := captureLines(string(out))
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || len(lines) == 0 {
+			return nil, fmt.Errorf("failed to run the capture program: %v\n%s", err, out)
+		}
+		log.Printf("Capture program failed after %d observations: %s", len(lines), out)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("the capture program printed no observations:\n%s", out)
+	}
+	return lines, nil
+}
+
+// CharacterizationSpec describes a test pinning the observed behavior of the target.
+func CharacterizationSpec(whatToTest string, observations []string) Spec {
+	return Spec{
+		Name: "Test" + spec.Identifier(whatToTest) + "_Characterization",
+		Description: "These outputs were observed by running the current code, input => output:\n" +
+			strings.Join(observations, "\n") + "\n" +
+			"1. Write a table test with exactly these inputs\n" +
+			"2. Expect exactly the observed outputs, including errors and panics, even where they look wrong\n" +
+			"3. Mark outputs that look like bugs with a comment instead of changing the expectation",
+	}
+}
+
+// GenerateCharacterizationTest generates tests asserting the current behavior of the target
+// rather than its intended behavior, to pin legacy code before refactoring. The target is
+// executed by a model written capture program in the package directory dir.
+func (c *Client) GenerateCharacterizationTest(
+	ctx context.Context,
+	whatToTest string,
+	allCode string,
+	pkg string,
+	dir string,
+	extraInstructions string,
+) (Spec, string, error) {
+	prompt := c.BasicPrompt()
+	prompt.Temperature = 0
+	prompt.TopP = 1
+	prompt.Messages = c.withOverride(StageCapture, capturePrompt(whatToTest, allCode, pkg))
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return Spec{}, "", err
+	}
+	prompt.Stage = StageCapture
+	prompt.Target = whatToTest
+	program, err := c.runStage(StageCapture, whatToTest, func() (string, error) {
+		return c.Complete(ctx, prompt)
+	})
+	if err != nil {
+		return Spec{}, "", err
+	}
+
+	observations, err := CaptureBehavior(ctx, dir, aggregator.Aggregate(pkg, []string{program}, false))
+	if err != nil {
+		return Spec{}, "", err
+	}
+	spec := CharacterizationSpec(whatToTest, observations)
+	log.Println("Characterization test spec:", spec.Description)
+	code, err := c.GenerateTestCode(ctx, spec, whatToTest, allCode, pkg, extraInstructions)
+	return spec, code, err
+}
@@ -0,0 +1,648 @@
+// Package llm is the client of the models goptest generates tests with: the providers, the
+// prompts of every stage and the retries, throttling, cost limits and logs of their requests.
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sentiens/goptest/spec"
+	"golang.org/x/tools/imports"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Spec, SpecList and SpecError are the types of the spec package, kept under their
+// historical names.
+type (
+	Spec      = spec.Spec
+	SpecList  = spec.List
+	SpecError = spec.Error
+)
+
+// estimateTokens approximates the number of tokens of Go source, about four bytes each.
+func estimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
+
+// Client generates tests by sending prompts to a Provider, the OpenAI API by default.
+//
+// A Client is safe for concurrent use by multiple goroutines. Its configuration is immutable
+// after NewClient, all requests share one HTTP transport and at most GeneratorOptions.Parallel
+// requests are in flight at the same time; additional calls wait for a free slot. Rate limited
+// requests halve the number of slots, which grows back with successful requests.
+type Client struct {
+	model     string
+	maxTokens uint
+	provider  Provider
+	corpus    *PromptCorpus
+	callbacks Callbacks
+	slots     *limiter
+	overrides map[Stage]string
+	retry     RetryPolicy
+	// responseFormat of the test cases, jsonUnsupported is set once JSON mode failed.
+	responseFormat  string
+	jsonUnsupported atomic.Bool
+	// specRetries is how many times invalid test cases are requested again.
+	specRetries    int
+	scheduler      *ModelScheduler
+	requestTimeout time.Duration
+	examples       *ExampleStore
+	costs          *costTracker
+	testBudget     time.Duration
+	blockNetwork   bool
+	streamCode     bool
+	depPolicy      *DependencyPolicy
+	runLog         *RunLog
+	artifacts      *ArtifactStore
+}
+
+// NewHTTPClient returns an HTTP client whose transport keeps enough idle connections
+// around to reuse them between the parallel requests.
+func NewHTTPClient(parallel int, debugLog io.Writer) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ForceAttemptHTTP2 = true
+	t.MaxIdleConns = parallel * 2
+	t.MaxIdleConnsPerHost = parallel
+	t.IdleConnTimeout = 90 * time.Second
+	var rt http.RoundTripper = t
+	if debugLog != nil {
+		rt = &httpDebugTransport{RoundTripper: t, w: debugLog}
+	}
+	return &http.Client{Transport: retryAfterTransport{rateLimitTransport{rt}}}
+}
+
+// NewClient initializes a new client, using the OpenAI API unless a provider or recordings to
+// replay are given.
+func NewClient(opts ...Option) (*Client, error) {
+	o := GeneratorOptions{
+		Model:   openai.GPT4,
+		APIKey:  os.Getenv("OPENAI_API_KEY"),
+		APIBase: os.Getenv("OPENAI_API_BASE"),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.Callbacks == nil {
+		o.Callbacks = NopCallbacks{}
+	}
+	if o.Parallel <= 0 {
+		o.Parallel = 2
+	}
+	retry := DefaultRetryPolicy
+	if o.RetryPolicy != nil {
+		retry = *o.RetryPolicy
+	}
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+	if o.Examples != nil && o.Scheduler == nil {
+		return nil, errors.New("examples need a model scheduler")
+	}
+	if o.Provider == nil && o.ReplayDir != "" {
+		o.Provider = &replayProvider{dir: o.ReplayDir, model: o.Model}
+	}
+	if o.Provider == nil {
+		if o.APIKey == "" {
+			return nil, errors.New("no OpenAI API key provided")
+		}
+		config := openai.DefaultConfig(o.APIKey)
+		if o.APIBase != "" {
+			config.BaseURL = o.APIBase
+		}
+		config.HTTPClient = NewHTTPClient(o.Parallel, o.HTTPDebugLog)
+		o.Provider = NewOpenAIProvider(openai.NewClientWithConfig(config), o.Model)
+	}
+	if o.RecordDir != "" {
+		o.Provider = &recordingProvider{Provider: o.Provider, dir: o.RecordDir, model: o.Model}
+	}
+	if o.Artifacts != nil {
+		o.Provider = &artifactProvider{Provider: o.Provider, store: o.Artifacts, model: o.Model}
+	}
+	specRetries := o.SpecRetries
+	if specRetries == 0 {
+		specRetries = 2
+	} else if specRetries < 0 {
+		specRetries = 0
+	}
+	maxTokens := o.MaxTokens
+	if maxTokens == 0 {
+		if o.Model == openai.GPT4 {
+			maxTokens = 4000
+		} else {
+			maxTokens = 2048
+		}
+	}
+
+	return &Client{
+		model:     o.Model,
+		maxTokens: uint(maxTokens),
+		provider:  o.Provider,
+		corpus:    o.PromptCorpus,
+		callbacks: o.Callbacks,
+		slots:     newLimiter(o.Parallel),
+		overrides: o.PromptOverrides,
+		retry:     retry,
+
+		responseFormat: o.ResponseFormat,
+		specRetries:    specRetries,
+		scheduler:      o.Scheduler,
+		requestTimeout: o.RequestTimeout,
+		examples:       o.Examples,
+		costs:          newCostTracker(o.MaxCost),
+		testBudget:     o.TestTimeBudget,
+		blockNetwork:   o.BlockNetwork,
+		streamCode:     o.StreamCode,
+		depPolicy:      o.DependencyPolicy,
+		runLog:         o.RunLog,
+		artifacts:      o.Artifacts,
+	}, nil
+}
+
+// BasicPrompt returns an empty prompt with the client's completion limits.
+func (c *Client) BasicPrompt() Prompt {
+	return Prompt{
+		MaxTokens: int(c.maxTokens),
+	}
+}
+
+// withOverride replaces the system instructions of the stage's messages when the client has
+// an override for it. Single message prompts get the override in front of their content.
+func (c *Client) withOverride(stage Stage, messages []Message) []Message {
+	override, ok := c.overrides[stage]
+	if !ok || len(messages) == 0 || messages[0].Role != RoleSystem {
+		return messages
+	}
+	res := append([]Message(nil), messages...)
+	if len(res) == 1 {
+		res[0].Content = override + "\n" + res[0].Content
+	} else {
+		res[0].Content = override
+	}
+	return res
+}
+
+// Complete sends the prompt to the provider, retrying rate limited requests and server errors
+// as the client's RetryPolicy allows. Prompts too large for the model's context window fail
+// with a ContextWindowError before they are sent.
+func (c *Client) Complete(ctx context.Context, prompt Prompt) (string, error) {
+	return c.withModels(ctx, prompt, func(prompt Prompt) (string, error) {
+		prompt, err := c.fitContextWindow(prompt)
+		if err != nil {
+			return "", err
+		}
+		return c.metered(prompt, func() (string, error) {
+			return c.withRetries(ctx, func(ctx context.Context) (string, error) {
+				return c.provider.Complete(ctx, prompt)
+			})
+		})
+	})
+}
+
+// StreamInterruptedError is returned for streams failing after some output was received.
+// They are restarted from the beginning like failed requests.
+type StreamInterruptedError struct {
+	Err error
+}
+
+func (e *StreamInterruptedError) Error() string {
+	return "stream interrupted: " + e.Err.Error()
+}
+
+func (e *StreamInterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// streamCompletion streams the prompt and reports every delta to the callbacks. Failed
+// requests are retried like in Complete, and streams interrupted midway are restarted: the
+// callbacks get a RetryEvent with Restart set, the deltas of the new attempt replace the
+// ones already reported.
+func (c *Client) streamCompletion(
+	ctx context.Context,
+	stage Stage,
+	target string,
+	prompt Prompt,
+) (string, error) {
+	prompt.Stage = stage
+	prompt.Target = target
+	return c.withModels(ctx, prompt, func(prompt Prompt) (string, error) {
+		prompt, err := c.fitContextWindow(prompt)
+		if err != nil {
+			return "", err
+		}
+		return c.metered(prompt, func() (string, error) {
+			return c.withRetries(ctx, func(ctx context.Context) (string, error) {
+				streamed := false
+				resp, err := c.provider.Stream(ctx, prompt, func(delta string) {
+					streamed = true
+					c.callbacks.OnDelta(stage, target, delta)
+				})
+				if err != nil && streamed && ctx.Err() == nil {
+					return "", &StreamInterruptedError{Err: err}
+				}
+				return resp, err
+			})
+		})
+	})
+}
+
+func promptForSpec(whatToTest string, allCode string, extraInstructions string) []Message {
+	systemContent := "Acting as a senior software engineer you should make a step-by-step description for the user's code focusing on the specified part."
+
+	systemMsg := Message{
+		Role:    RoleSystem,
+		Content: systemContent,
+	}
+
+	userContent := fmt.Sprintf(
+		"Based on the provided code write a specification for the `%s` part.\n"+
+			"The code is: \n```go\n%s```\n",
+		whatToTest,
+		allCode,
+	)
+	if extraInstructions != "" {
+		userContent += "\n" + extraInstructions
+	}
+	userMsg := Message{
+		Role:    RoleUser,
+		Content: userContent,
+	}
+	return []Message{
+		systemMsg,
+		userMsg,
+	}
+}
+
+func (c *Client) GenerateSpec(ctx context.Context, whatToTest string, allCode string, extraInstructions string) (string, error) {
+	log.Println("Generating spec for", whatToTest)
+	prompt := c.BasicPrompt()
+	// prompt.Temperature = 0.8
+	// prompt.TopP = 1
+	prompt.Messages = c.withOverride(StageSpec, promptForSpec(whatToTest, allCode, extraInstructions))
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return "", err
+	}
+
+	return c.runStage(StageSpec, whatToTest, func() (string, error) {
+		return c.streamCompletion(ctx, StageSpec, whatToTest, prompt)
+	})
+}
+
+func promptTestsList(whatToTest string, allCode string, extraInstructions string) []Message {
+	systemContent := "Acting as a senior software engineer " +
+		"you should create an exhaustive and comprehensive list of tests to implement " +
+		"that would do full code coverage for the specified part of the code.\n" +
+		"Each test case should test only one concrete case. Return the list of descriptive test names."
+
+	userContent := fmt.Sprintf(
+		"I want to test '%s'.\n"+
+			"The code is: \n```go\n%s```\n",
+		whatToTest,
+		allCode,
+	)
+	if extraInstructions != "" {
+		userContent += "\n" + extraInstructions
+	}
+
+	systemMsg := Message{
+		Role:    RoleSystem,
+		Content: systemContent,
+	}
+
+	userMsg := Message{
+		Role:    RoleUser,
+		Content: userContent,
+	}
+	log.Println("Generatin list of tests")
+	return []Message{
+		systemMsg,
+		userMsg,
+	}
+}
+
+func (c *Client) GenerateTestsList(ctx context.Context, whatToTest string, allCode string, extraInstructions string) (string, error) {
+	log.Println("Generating tests list for ", whatToTest)
+	prompt := c.BasicPrompt()
+	// prompt.Temperature = 0.8
+	// prompt.TopP = 1
+	prompt.Messages = c.withOverride(StageList, promptTestsList(whatToTest, allCode, extraInstructions))
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return "", err
+	}
+
+	return c.runStage(StageList, whatToTest, func() (string, error) {
+		return c.streamCompletion(ctx, StageList, whatToTest, prompt)
+	})
+}
+
+const yamlExample = `cases:
+  - 
+    name: TestThing_Condition1
+    instructions: |
+      1. Intialize mocks or input data
+      2. Execute the tested method
+      3. Expect the result to be equal to the expected value and all other expectations are met
+  
+  - 
+    name: TestThing_Condition2
+    instructions: TODO
+  
+  - 
+    name: TestThing_Action3_WhenSomething
+    instructions: TODO
+
+`
+
+func promptForTestCases(_ string, allCode string, list string, extraInstructions string) []Message {
+	systemContent := fmt.Sprintf("Acting as a seniour developer "+
+		"you should read given code and create instructions to implement the tests.\n"+
+		"Using YAML format you should only write `cases` list with the `name` and `instructions` fields.\n"+
+		"`instructions` field should contain precise input description and output and/or mock expectations based on the provided code.\n"+
+		"Example schema: \n```yaml\n%s\n```\n", yamlExample)
+
+	systemMsg := Message{
+		Role:    RoleSystem,
+		Content: systemContent,
+	}
+
+	userContent := fmt.Sprintf(
+		"Here is my code: \n```go\n%s```\n"+
+			"Refine these tests: \n\"\"\"%s\"\"\"\n",
+		allCode,
+		list,
+	)
+	if extraInstructions != "" {
+		userContent += "\n" + extraInstructions
+	}
+	userMsg := Message{
+		Role:    RoleUser,
+		Content: userContent,
+	}
+	return []Message{
+		systemMsg,
+		userMsg,
+	}
+}
+
+// GenerateTestCases generates the YAML `cases` list for the tests of the list. The cases are
+// requested in JSON mode first unless the client uses FormatText, and as YAML text when the
+// provider or model turns out not to support JSON mode.
+func (c *Client) GenerateTestCases(ctx context.Context, whatToTest string, allCode string, testList string, extraInstructions string) (string, error) {
+	log.Println("Generating test cases for", whatToTest)
+
+	if c.useJSON() {
+		cases, err := c.generateTestCasesJSON(ctx, whatToTest, allCode, testList, extraInstructions)
+		if err == nil {
+			log.Printf("Test cases for %s generated in JSON mode", whatToTest)
+			return cases, nil
+		}
+		if !errors.Is(err, errJSONUnsupported) || c.responseFormat == FormatJSON {
+			return "", err
+		}
+		c.jsonUnsupported.Store(true)
+		log.Printf("Falling back to YAML text for %s: %v", c.model, err)
+	}
+	log.Printf("Test cases for %s generated as YAML text", whatToTest)
+
+	// TODO: First generate just the text from multiple perspectives and merge it and then map it to yaml format
+	prompt := c.BasicPrompt()
+	// prompt.Temperature = 0.8
+	// prompt.TopP = 1
+	prompt.Messages = c.withOverride(StageCases, promptForTestCases(whatToTest, allCode, testList, extraInstructions))
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return "", err
+	}
+
+	for i := 0; ; i++ {
+		resp, err := c.runStage(StageCases, whatToTest, func() (string, error) {
+			return c.streamCompletion(ctx, StageCases, whatToTest, prompt)
+		})
+		if err != nil {
+			return "", err
+		}
+		err = ValidateCasesYAML(resp)
+		if err == nil {
+			return resp, nil
+		}
+		if i >= c.specRetries {
+			return "", fmt.Errorf("invalid test cases after %d attempts: %v", i+1, err)
+		}
+		log.Printf("Test cases for %s are invalid, requesting them again: %v", whatToTest, err)
+		messages := append([]Message(nil), prompt.Messages...)
+		prompt.Messages = append(messages,
+			Message{Role: RoleAssistant, Content: resp},
+			Message{Role: RoleUser, Content: fmt.Sprintf("These test cases are invalid: %v. Fix them and write the complete YAML again.", err)},
+		)
+	}
+}
+
+// ValidateCasesYAML checks the `cases` list of a test cases response, see spec.Validate.
+func ValidateCasesYAML(resp string) error {
+	var l SpecList
+	if err := yaml.Unmarshal([]byte(RemoveYAMLLines(resp)), &l); err != nil {
+		return fmt.Errorf("the response is not valid YAML: %v", err)
+	}
+	return spec.Validate(&l)
+}
+
+func mocksGenerationPromptSystem() string {
+	return "Acting as a senior software engineer should implement mocks to test the specific part of the code." +
+		"You may use github.com/stretchr/testify/mock. You should not write the tests itself, " +
+		"only implement mocks for dependencies of the code that needs to be tested, " +
+		"not the mock of the target method/struct but the mocks of the input/dependencies."
+}
+
+func mocksGenerationPromptUser(whatToTest string, allTheCode string) string {
+	return fmt.Sprintf(
+		"We want to test the '%s' part that so please create mocks for the future tests.\n"+
+			"Here is the original code: ```go\n%s```\n",
+		whatToTest,
+		allTheCode,
+	)
+}
+
+func (c *Client) GenerateMocks(
+	ctx context.Context,
+	whatToTest string,
+	allCode string,
+	extraInstructions string,
+) (string, error) {
+	systemContent := mocksGenerationPromptSystem()
+	userContent := mocksGenerationPromptUser(whatToTest, allCode)
+
+	if extraInstructions != "" {
+		userContent += "\n" + extraInstructions
+	}
+	if c.depPolicy != nil {
+		userContent += "\n" + c.depPolicy.instructions()
+	}
+	prompt := c.BasicPrompt()
+	prompt.Temperature = 0
+	prompt.TopP = 1
+	prompt.Messages = c.withOverride(StageMocks, []Message{
+		{
+			Role:    RoleSystem,
+			Content: systemContent,
+		},
+		{
+			Role:    RoleUser,
+			Content: userContent,
+		},
+	})
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return "", err
+	}
+
+	prompt.Stage = StageMocks
+	prompt.Target = whatToTest
+	return c.runStage(StageMocks, whatToTest, func() (string, error) {
+		return c.auditDependencies(prompt, func(prompt Prompt) (string, error) {
+			return c.Complete(ctx, prompt)
+		})
+	})
+}
+
+const codeTemplate = `package %s
+
+%sfunc %s(t *testing.T) {
+}
+`
+
+// templateLibraries are the test libraries the code template suggests.
+var templateLibraries = []string{
+	"github.com/golang/mock/gomock",
+	"github.com/stretchr/testify/assert",
+	"github.com/stretchr/testify/require",
+}
+
+// templateImports renders the import block of the suggested libraries the policy allows,
+// all of them when policy is nil.
+func templateImports(policy *DependencyPolicy) string {
+	var b strings.Builder
+	for _, lib := range templateLibraries {
+		if policy == nil || policy.allows(lib) {
+			b.WriteString("\t" + strconv.Quote(lib) + "\n")
+		}
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return "// Use this libs if needed\nimport (\n" + b.String() + ")\n\n"
+}
+
+func codeHeader(pkgName string) string {
+	return fmt.Sprintf("package %s\n\n", pkgName)
+}
+
+// TODO: Extract the code an polish it with gpt3.5
+func codeGenerationPrompt(_ string, spec Spec, allTheCode string, pkg string, policy *DependencyPolicy) string {
+	return fmt.Sprintf(
+		"Act as a senior developer.\n"+
+			"Based on this code: ```go\n%s```\nHelp me to implement a test function, replace the comments with your own code in this snippet: \n```go\n%s\n```",
+		allTheCode,
+		fmt.Sprintf(codeTemplate, pkg, templateImports(policy), spec.Name),
+	)
+}
+
+// GenerateTestCode generates test code for a single spec.
+func (c *Client) GenerateTestCode(
+	ctx context.Context,
+	spec Spec,
+	whatToTest string,
+	allCode string,
+	pkg string,
+	extraInstructions string,
+) (string, error) {
+	content := codeGenerationPrompt(whatToTest, spec, allCode, pkg, c.depPolicy)
+	if extraInstructions != "" {
+		content += "\n" + extraInstructions
+	}
+	if c.testBudget > 0 {
+		content += "\n" + testTimeInstructions(c.testBudget)
+	}
+	if c.depPolicy != nil {
+		content += "\n" + c.depPolicy.instructions()
+	}
+
+	msg := Message{
+		Role:    RoleSystem,
+		Content: content,
+	}
+
+	prompt := c.BasicPrompt()
+	prompt.Temperature = 0
+	prompt.TopP = 1
+	prompt.Messages = c.withOverride(StageCode, []Message{
+		msg,
+	})
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return "", err
+	}
+
+	prompt.Stage = StageCode
+	prompt.Target = spec.Name
+	prompt.ExampleInput = fmt.Sprintf("Write the test %s for %s:\n%s", spec.Name, whatToTest, spec.Description)
+	return c.runStage(StageCode, spec.Name, func() (string, error) {
+		return c.auditDependencies(prompt, func(prompt Prompt) (string, error) {
+			if c.streamCode {
+				return c.streamCompletion(ctx, StageCode, spec.Name, prompt)
+			}
+			return c.Complete(ctx, prompt)
+		})
+	})
+}
+
+// WriteGoFile runs goimports on the Go source, adding missing and removing unused imports
+// and normalizing the formatting, and writes it to the file.
+func WriteGoFile(src string, fPath string) error {
+	out, err := imports.Process(fPath, []byte(src), nil)
+	if err != nil {
+		// Keep the output as is, the repair loop and the reviewer deal with broken code.
+		log.Printf("goimports failed for %s: %v", fPath, err)
+		out = []byte(src)
+	}
+	return WriteToFile(string(out), fPath)
+}
+
+// WriteToFile writes the combined responses into a file.
+func WriteToFile(out string, fPath string) error {
+	file, err := os.OpenFile(fPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open file for writing: %v", err)
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(out)
+	if err != nil {
+		return fmt.Errorf("failed to write to file: %v", err)
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to flush to disk: %v", err)
+	}
+
+	return nil
+}
+
+func RemoveYAMLLines(input string) string {
+	lines := strings.Split(input, "\n")
+	filtered := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		if !strings.Contains(line, "```yaml") && !strings.Contains(line, "```") {
+			filtered = append(filtered, line)
+		}
+	}
+
+	return strings.Join(filtered, "\n")
+}
@@ -0,0 +1,173 @@
+package llm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const corpusIndexFile = "index.json"
+
+// CorpusEntry describes a single content-addressed blob stored in the prompt corpus.
+type CorpusEntry struct {
+	Kind  string `json:"kind"`
+	Size  int    `json:"size"`
+	Count int    `json:"count"`
+}
+
+// PromptCorpus stores every prompt and code context sent to the model by its sha256 hash
+// and counts how often identical content is re-sent, across runs.
+type PromptCorpus struct {
+	dir     string
+	mu      sync.Mutex
+	entries map[string]*CorpusEntry
+	// run holds the counts observed during the current run only.
+	run map[string]int
+}
+
+// OpenPromptCorpus opens (or creates) a prompt corpus in dir.
+func OpenPromptCorpus(dir string) (*PromptCorpus, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create prompt corpus dir: %v", err)
+	}
+	pc := &PromptCorpus{
+		dir:     dir,
+		entries: make(map[string]*CorpusEntry),
+		run:     make(map[string]int),
+	}
+	content, err := os.ReadFile(filepath.Join(dir, corpusIndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &pc.entries); err != nil {
+			return nil, fmt.Errorf("failed to read prompt corpus index: %v", err)
+		}
+	}
+	return pc, nil
+}
+
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Add stores content under its hash, bumps its counters and saves the index, so a run that
+// exits early keeps what it sent.
+func (pc *PromptCorpus) Add(kind string, content string) error {
+	if pc == nil {
+		return nil
+	}
+	h := contentHash(content)
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	e, ok := pc.entries[h]
+	if !ok {
+		if err := os.WriteFile(filepath.Join(pc.dir, h+".txt"), []byte(content), 0o644); err != nil {
+			return fmt.Errorf("failed to store prompt: %v", err)
+		}
+		e = &CorpusEntry{Kind: kind, Size: len(content)}
+		pc.entries[h] = e
+	}
+	e.Count++
+	pc.run[h]++
+	return pc.save()
+}
+
+// AddPrompt stores the code context and every message of a request.
+func (pc *PromptCorpus) AddPrompt(allCode string, msgs []Message) error {
+	if pc == nil {
+		return nil
+	}
+	if allCode != "" {
+		if err := pc.Add("code", allCode); err != nil {
+			return err
+		}
+	}
+	for _, m := range msgs {
+		if err := pc.Add(m.Role, m.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save persists the corpus index.
+func (pc *PromptCorpus) Save() error {
+	if pc == nil {
+		return nil
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.save()
+}
+
+// save writes the index, pc.mu held.
+func (pc *PromptCorpus) save() error {
+	content, err := json.MarshalIndent(pc.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteToFile(string(content), filepath.Join(pc.dir, corpusIndexFile))
+}
+
+// CorpusStats summarizes how much content was re-sent.
+type CorpusStats struct {
+	Kind          string
+	Sent          int
+	Unique        int
+	BytesSent     int
+	BytesRepeated int
+}
+
+func (pc *PromptCorpus) stats(counts func(h string, e *CorpusEntry) int) []CorpusStats {
+	byKind := make(map[string]*CorpusStats)
+	for h, e := range pc.entries {
+		n := counts(h, e)
+		if n == 0 {
+			continue
+		}
+		s, ok := byKind[e.Kind]
+		if !ok {
+			s = &CorpusStats{Kind: e.Kind}
+			byKind[e.Kind] = s
+		}
+		s.Sent += n
+		s.Unique++
+		s.BytesSent += n * e.Size
+		s.BytesRepeated += (n - 1) * e.Size
+	}
+	res := make([]CorpusStats, 0, len(byKind))
+	for _, s := range byKind {
+		res = append(res, *s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Kind < res[j].Kind })
+	return res
+}
+
+// WriteReport prints dedup statistics for the current run and for the whole corpus.
+func (pc *PromptCorpus) WriteReport(w io.Writer) {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	printStats := func(title string, stats []CorpusStats) {
+		fmt.Fprintln(w, title)
+		for _, s := range stats {
+			fmt.Fprintf(w, "  %-10s sent %4d, unique %4d, repeated %d of %d bytes\n",
+				s.Kind, s.Sent, s.Unique, s.BytesRepeated, s.BytesSent)
+		}
+	}
+	printStats("Prompt corpus, this run:", pc.stats(func(h string, _ *CorpusEntry) int { return pc.run[h] }))
+	printStats("Prompt corpus, all runs:", pc.stats(func(_ string, e *CorpusEntry) int { return e.Count }))
+}
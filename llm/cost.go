@@ -0,0 +1,215 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modelPrices are the prices in USD per 1K prompt and completion tokens of known models, by
+// model name prefix.
+var modelPrices = []struct {
+	prefix     string
+	prompt     float64
+	completion float64
+}{
+	{"gpt-4-32k", 0.06, 0.12},
+	{"gpt-4-1106", 0.01, 0.03},
+	{"gpt-4-0125", 0.01, 0.03},
+	{"gpt-4-turbo", 0.01, 0.03},
+	{"gpt-4o", 0.005, 0.015},
+	{"gpt-4", 0.03, 0.06},
+	{"gpt-3.5-turbo-16k", 0.003, 0.004},
+	{"gpt-3.5-turbo-0125", 0.0005, 0.0015},
+	{"gpt-3.5-turbo", 0.0015, 0.002},
+}
+
+// RequestCost returns the estimated cost in USD of a request of the model, false when the
+// model's prices are unknown, e.g. for local models.
+func RequestCost(model string, promptTokens int, completionTokens int) (float64, bool) {
+	for _, p := range modelPrices {
+		if strings.HasPrefix(model, p.prefix) {
+			return (float64(promptTokens)*p.prompt + float64(completionTokens)*p.completion) / 1000, true
+		}
+	}
+	return 0, false
+}
+
+// WithMaxCost aborts requests that could make the estimated spend of the client exceed usd.
+func WithMaxCost(usd float64) Option {
+	return func(o *GeneratorOptions) {
+		o.MaxCost = usd
+	}
+}
+
+// BudgetExceededError is returned for requests not sent because they could exceed the
+// spending limit.
+type BudgetExceededError struct {
+	MaxCost float64
+	// Spent includes the worst case cost of the requests in flight.
+	Spent float64
+	// Cost is the worst case cost of the request, with a completion of MaxTokens.
+	Cost float64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("the request could cost $%.4f, exceeding the budget of $%.2f with $%.4f spent", e.Cost, e.MaxCost, e.Spent)
+}
+
+// StageUsage is the token usage and estimated cost of the requests of a stage.
+type StageUsage struct {
+	Stage            Stage
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+	// UnpricedRequests went to models whose prices are unknown and are not in Cost.
+	UnpricedRequests int
+}
+
+// costTracker accounts the usage of the requests. The worst case cost of every request is
+// reserved before it is sent, so that parallel requests can't exceed the budget together.
+type costTracker struct {
+	maxCost float64
+
+	mu       sync.Mutex
+	spent    float64
+	reserved float64
+	stages   map[Stage]*StageUsage
+}
+
+func newCostTracker(maxCost float64) *costTracker {
+	return &costTracker{maxCost: maxCost, stages: make(map[Stage]*StageUsage)}
+}
+
+// reserve sets aside the worst case cost of a request, failing when it could exceed the budget.
+func (t *costTracker) reserve(cost float64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.maxCost > 0 && t.spent+t.reserved+cost > t.maxCost {
+		return &BudgetExceededError{MaxCost: t.maxCost, Spent: t.spent + t.reserved, Cost: cost}
+	}
+	t.reserved += cost
+	return nil
+}
+
+// settle replaces the reservation of a request by its usage, nil for failed requests.
+func (t *costTracker) settle(reserved float64, used *StageUsage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reserved -= reserved
+	if used == nil {
+		return
+	}
+	t.spent += used.Cost
+	u := t.stages[used.Stage]
+	if u == nil {
+		u = &StageUsage{Stage: used.Stage}
+		t.stages[used.Stage] = u
+	}
+	u.Add(*used)
+}
+
+func (u *StageUsage) Add(o StageUsage) {
+	u.Requests += o.Requests
+	u.PromptTokens += o.PromptTokens
+	u.CompletionTokens += o.CompletionTokens
+	u.Cost += o.Cost
+	u.UnpricedRequests += o.UnpricedRequests
+}
+
+// usage returns the usage of every stage, sorted by stage.
+func (t *costTracker) usage() []StageUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make([]StageUsage, 0, len(t.stages))
+	for _, u := range t.stages {
+		res = append(res, *u)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Stage < res[j].Stage
+	})
+	return res
+}
+
+// Usage returns the token usage and estimated cost of the client's requests per stage.
+// Requests without a stage are reported under the empty stage.
+func (c *Client) Usage() []StageUsage {
+	return c.costs.usage()
+}
+
+// metered sends the prompt within the budget, accounts its usage and records it in the run log.
+// Tokens are counted with the model's tokenizer, failed requests are not accounted.
+func (c *Client) metered(prompt Prompt, send func() (string, error)) (string, error) {
+	model := c.model
+	if prompt.Model != "" {
+		model = prompt.Model
+	}
+	promptTokens := PromptTokens(model, prompt.Messages)
+	worst, _ := RequestCost(model, promptTokens, prompt.MaxTokens)
+	if err := c.costs.reserve(worst); err != nil {
+		return "", err
+	}
+	start := time.Now()
+	resp, err := send()
+	event := LogEvent{
+		Event:        "request",
+		Stage:        prompt.Stage,
+		Target:       prompt.Target,
+		Model:        model,
+		PromptTokens: promptTokens,
+		LatencyMS:    time.Since(start).Milliseconds(),
+		Prompt:       promptText(prompt.Messages),
+	}
+	if err != nil {
+		c.costs.settle(worst, nil)
+		if !errors.Is(err, ErrPromptCaptured) {
+			event.Error = err.Error()
+			c.runLog.Log(LevelWarn, event)
+		}
+		return resp, err
+	}
+	completionTokens := CountTokens(model, resp)
+	event.CompletionTokens = completionTokens
+	event.Response = resp
+	c.runLog.Log(LevelInfo, event)
+	cost, priced := RequestCost(model, promptTokens, completionTokens)
+	unpriced := 0
+	if !priced {
+		unpriced = 1
+	}
+	c.costs.settle(worst, &StageUsage{
+		Stage:            prompt.Stage,
+		Requests:         1,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		Cost:             cost,
+		UnpricedRequests: unpriced,
+	})
+	return resp, nil
+}
+
+// WriteUsage prints the usage per stage and in total.
+func WriteUsage(w io.Writer, usage []StageUsage) {
+	if len(usage) == 0 {
+		return
+	}
+	var total StageUsage
+	fmt.Fprintf(w, "%-8s %8s %10s %10s %10s\n", "stage", "requests", "prompt", "completion", "cost")
+	for _, u := range usage {
+		stage := string(u.Stage)
+		if stage == "" {
+			stage = "other"
+		}
+		fmt.Fprintf(w, "%-8s %8d %10d %10d %10s\n", stage, u.Requests, u.PromptTokens, u.CompletionTokens, fmt.Sprintf("$%.4f", u.Cost))
+		total.Add(u)
+	}
+	fmt.Fprintf(w, "%-8s %8d %10d %10d %10s\n", "total", total.Requests, total.PromptTokens, total.CompletionTokens, fmt.Sprintf("$%.4f", total.Cost))
+	if total.UnpricedRequests > 0 {
+		fmt.Fprintf(w, "%d requests went to models of unknown prices and are not in the cost\n", total.UnpricedRequests)
+	}
+}
@@ -0,0 +1,126 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPDebugFile is the file the HTTP exchanges are recorded in, in the -debug-http directory.
+const HTTPDebugFile = "http.jsonl"
+
+// maxDebugErrorBytes caps the error body recorded for failed responses.
+const maxDebugErrorBytes = 1024
+
+// WithHTTPDebugLog records the metadata of every HTTP exchange with the API into w as JSON
+// lines, see HTTPExchange.
+func WithHTTPDebugLog(w io.Writer) Option {
+	return func(o *GeneratorOptions) {
+		o.HTTPDebugLog = w
+	}
+}
+
+// HTTPExchange is the sanitized metadata of an HTTP request to the API and its response:
+// neither the prompts nor the completions nor the credentials are recorded.
+type HTTPExchange struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	// URL is the request URL without its query.
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	// LatencyMS is the time until the response headers were received, streams keep going
+	// after that.
+	LatencyMS int64 `json:"latency_ms"`
+	// Headers are the response's request ID, processing time and rate limit headers.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Error is the transport error or the start of the body of a failed response.
+	Error string `json:"error,omitempty"`
+}
+
+// debugHeader reports whether the response header is recorded.
+func debugHeader(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "x-request-id", "retry-after", "openai-processing-ms", "openai-model", "openai-version":
+		return true
+	}
+	return strings.HasPrefix(name, "x-ratelimit-")
+}
+
+// httpDebugTransport records an HTTPExchange for every request.
+type httpDebugTransport struct {
+	http.RoundTripper
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (t *httpDebugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	u := *req.URL
+	u.RawQuery = ""
+	u.User = nil
+	ex := HTTPExchange{
+		Time:      start,
+		Method:    req.Method,
+		URL:       u.String(),
+		LatencyMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		ex.Error = err.Error()
+		t.record(ex)
+		return resp, err
+	}
+	ex.Status = resp.StatusCode
+	for name, values := range resp.Header {
+		if debugHeader(name) && len(values) > 0 {
+			if ex.Headers == nil {
+				ex.Headers = make(map[string]string)
+			}
+			ex.Headers[strings.ToLower(name)] = values[0]
+		}
+	}
+	if resp.StatusCode >= 400 {
+		// Error bodies carry the provider's explanation, put the read part back for the client.
+		head, readErr := io.ReadAll(io.LimitReader(resp.Body, maxDebugErrorBytes))
+		ex.Error = string(head)
+		if readErr != nil {
+			ex.Error += " (" + readErr.Error() + ")"
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	}
+	t.record(ex)
+	return resp, nil
+}
+
+func (t *httpDebugTransport) record(ex HTTPExchange) {
+	line, err := json.Marshal(ex)
+	if err != nil {
+		log.Println("Failed to encode the HTTP exchange:", err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.w.Write(append(line, '\n')); err != nil {
+		log.Println("Failed to record the HTTP exchange:", err)
+	}
+}
+
+// OpenHTTPDebugLog opens the HTTP debug file in dir for appending, creating dir if needed.
+func OpenHTTPDebugLog(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filepath.Join(dir, HTTPDebugFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
@@ -0,0 +1,182 @@
+package llm
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sentiens/goptest/aggregator"
+)
+
+// FindModuleRoot walks up from dir looking for a go.mod file.
+func FindModuleRoot(dir string) (root string, modulePath string, err error) {
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	for {
+		content, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			for _, line := range strings.Split(string(content), "\n") {
+				line = strings.TrimSpace(line)
+				if strings.HasPrefix(line, "module ") {
+					return dir, strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "module ")), "\""), nil
+				}
+			}
+			return dir, "", nil
+		}
+		if !os.IsNotExist(err) {
+			return "", "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", fmt.Errorf("no go.mod found")
+		}
+		dir = parent
+	}
+}
+
+// externalImports returns the imports of a Go source file that belong neither to the
+// standard library nor to the given module.
+func externalImports(src string, modulePath string) ([]string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ImportsOnly)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, imp := range f.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			return nil, err
+		}
+		if aggregator.IsStdlibImport(path) {
+			continue
+		}
+		if modulePath != "" && (path == modulePath || strings.HasPrefix(path, modulePath+"/")) {
+			continue
+		}
+		res = append(res, path)
+	}
+	return res, nil
+}
+
+func runGo(dir string, args ...string) error {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	log.Printf("go %s: %s", strings.Join(args, " "), out)
+	if err != nil {
+		return fmt.Errorf("go %s failed: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// UpdateDeps runs `go get` for every third-party import of the generated test file
+// and tidies the module afterwards.
+func UpdateDeps(src string, outputFilePath string) error {
+	dir := filepath.Dir(outputFilePath)
+	root, modulePath, err := FindModuleRoot(dir)
+	if err != nil {
+		return err
+	}
+	imports, err := externalImports(src, modulePath)
+	if err != nil {
+		return fmt.Errorf("failed to parse imports: %v", err)
+	}
+	if len(imports) == 0 {
+		return nil
+	}
+	fmt.Println("Adding test dependencies:", strings.Join(imports, ", "))
+	if err := runGo(root, append([]string{"get"}, imports...)...); err != nil {
+		return err
+	}
+	return runGo(root, "mod", "tidy")
+}
+
+// DependencyPolicy restricts the imports of the generated tests to the standard library, the
+// module under test and the Allowed paths, for repositories that forbid libraries such as
+// testify.
+type DependencyPolicy struct {
+	// ModulePath is the path of the module under test, whose packages are always allowed.
+	ModulePath string
+	// Allowed lists the other import paths tests may use, subpackages included.
+	Allowed []string
+}
+
+// WithDependencyPolicy restricts the imports of the generated tests and mocks: the prompts
+// name the allowed libraries and completions importing others are generated again.
+func WithDependencyPolicy(p *DependencyPolicy) Option {
+	return func(o *GeneratorOptions) {
+		o.DependencyPolicy = p
+	}
+}
+
+func (p *DependencyPolicy) allows(path string) bool {
+	for _, allowed := range p.Allowed {
+		if path == allowed || strings.HasPrefix(path, allowed+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Disallowed returns the imports of the generated code the policy does not allow. The code
+// may be a snippet without package clause or wrapped in markdown fences.
+func (p *DependencyPolicy) Disallowed(code string) ([]string, error) {
+	imports, err := externalImports(aggregator.Aggregate("p", []string{code}, false), p.ModulePath)
+	if err != nil {
+		return nil, err
+	}
+	var disallowed []string
+	for _, path := range imports {
+		if !p.allows(path) {
+			disallowed = append(disallowed, path)
+		}
+	}
+	return disallowed, nil
+}
+
+// instructions tells the model which libraries it may import.
+func (p *DependencyPolicy) instructions() string {
+	if len(p.Allowed) == 0 {
+		return "Only import packages of the standard library and of the module under test. " +
+			"Do not use third-party libraries such as testify or gomock: assert with the testing package and write mocks by hand."
+	}
+	return "Only import packages of the standard library, of the module under test and of these libraries: " +
+		strings.Join(p.Allowed, ", ") + ". Do not use any other third-party library."
+}
+
+// maxDependencyRetries is how often a completion importing disallowed libraries is generated again.
+const maxDependencyRetries = 2
+
+// auditDependencies sends the prompt and, while the completion imports libraries the
+// dependency policy does not allow, sends it again with the completion and the allowed
+// libraries. Completions that don't parse are left to the compile checks.
+func (c *Client) auditDependencies(prompt Prompt, send func(Prompt) (string, error)) (string, error) {
+	for i := 0; ; i++ {
+		resp, err := send(prompt)
+		if err != nil || c.depPolicy == nil {
+			return resp, err
+		}
+		disallowed, err := c.depPolicy.Disallowed(resp)
+		if err != nil || len(disallowed) == 0 {
+			return resp, nil
+		}
+		if i >= maxDependencyRetries {
+			return "", fmt.Errorf("the code still imports disallowed libraries after %d attempts: %s", i+1, strings.Join(disallowed, ", "))
+		}
+		log.Printf("%s for %s imports disallowed libraries, generating it again: %s", prompt.Stage, prompt.Target, strings.Join(disallowed, ", "))
+		messages := append([]Message(nil), prompt.Messages...)
+		prompt.Messages = append(messages,
+			Message{Role: RoleAssistant, Content: resp},
+			Message{Role: RoleUser, Content: fmt.Sprintf("The code imports %s, which this repository does not allow. %s Write the complete code again.",
+				strings.Join(disallowed, ", "), c.depPolicy.instructions())},
+		)
+	}
+}
@@ -0,0 +1,81 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/sentiens/goptest/spec"
+)
+
+// ParseDifferentialPair parses "Reference,Candidate".
+func ParseDifferentialPair(pair string) (reference string, candidate string, err error) {
+	reference, candidate, ok := strings.Cut(pair, ",")
+	reference, candidate = strings.TrimSpace(reference), strings.TrimSpace(candidate)
+	if !ok || reference == "" || candidate == "" {
+		return "", "", fmt.Errorf("expected two comma-separated functions, got %q", pair)
+	}
+	return reference, candidate, nil
+}
+
+// differentialSignatures returns the signatures of both implementations, failing when
+// one of them cannot be found in the code.
+func differentialSignatures(allCode string, reference string, candidate string) (string, error) {
+	fns, fset, err := FindTargetFuncs(allCode, reference+" "+candidate)
+	if err != nil {
+		return "", err
+	}
+	found := make(map[string]string)
+	for _, fn := range fns {
+		decl := *fn
+		decl.Body = nil
+		decl.Doc = nil
+		found[FuncName(fn)] = PrintNode(fset, &decl)
+		found[fn.Name.Name] = found[FuncName(fn)]
+	}
+	var sigs []string
+	for _, name := range []string{reference, candidate} {
+		sig, ok := found[name]
+		if !ok {
+			return "", fmt.Errorf("function %s not found in the code files", name)
+		}
+		sigs = append(sigs, sig)
+	}
+	return strings.Join(sigs, "\n"), nil
+}
+
+// DifferentialSpec describes the differential test between two implementations.
+func DifferentialSpec(reference string, candidate string, signatures string) Spec {
+	return Spec{
+		Name: "Test" + spec.Identifier(candidate) + "_MatchesReference",
+		Description: fmt.Sprintf(
+			"%s is the reference implementation and %s the new one:\n%s\n"+
+				"1. Generate a table of inputs covering typical values, boundaries, empty and nil values and invalid input\n"+
+				"2. Call both implementations with every input\n"+
+				"3. Expect identical results, including errors (compare with reflect.DeepEqual or errors.Is)\n"+
+				"4. Report the input on every mismatch\n"+
+				"If all parameter types are supported by go test fuzzing, also add a Fuzz%s_MatchesReference fuzz target "+
+				"seeded with the table inputs that asserts the same agreement.",
+			reference, candidate, signatures, spec.Identifier(candidate)),
+	}
+}
+
+// GenerateDifferentialTest generates tests asserting that two implementations agree on generated inputs.
+func (c *Client) GenerateDifferentialTest(
+	ctx context.Context,
+	reference string,
+	candidate string,
+	allCode string,
+	pkg string,
+	extraInstructions string,
+) (Spec, string, error) {
+	signatures, err := differentialSignatures(allCode, reference, candidate)
+	if err != nil {
+		return Spec{}, "", err
+	}
+	spec := DifferentialSpec(reference, candidate, signatures)
+	log.Println("Differential test spec:", spec.Description)
+	code, err := c.GenerateTestCode(ctx, spec, reference+" vs "+candidate, allCode, pkg, extraInstructions)
+	return spec, code, err
+}
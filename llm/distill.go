@@ -0,0 +1,134 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const ExamplesFileName = ".goptest-examples.json"
+
+// maxExamplesPerStage is the number of the most recent examples kept for every stage.
+const maxExamplesPerStage = 2
+
+// Example is a request of a stage completed by a strong model, shown to cheaper models as a
+// few-shot example.
+type Example struct {
+	Stage Stage `json:"stage"`
+	// Input is the condensed request, e.g. the test case, without the code under test.
+	Input  string `json:"input"`
+	Output string `json:"output"`
+}
+
+// ExampleStore keeps the examples of a package. Once a model stronger than the cheapest one
+// of the scheduler completed a request of a stage, its output is included in the requests of
+// that stage sent to the models weaker than the strongest one, improving their output
+// without fine-tuning.
+type ExampleStore struct {
+	Examples []Example `json:"examples"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// WithExamples distills the outputs of strong models into few-shot examples for cheap ones,
+// see ExampleStore. It needs a model scheduler.
+func WithExamples(s *ExampleStore) Option {
+	return func(o *GeneratorOptions) {
+		o.Examples = s
+	}
+}
+
+// LoadExamples reads the examples of a package, returning an empty store when missing.
+func LoadExamples(pkgDir string) (*ExampleStore, error) {
+	s := &ExampleStore{path: filepath.Join(pkgDir, ExamplesFileName)}
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, s); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", ExamplesFileName, err)
+	}
+	return s, nil
+}
+
+// Add records an example of the stage, dropping the oldest ones beyond maxExamplesPerStage,
+// and saves the store.
+func (s *ExampleStore) Add(stage Stage, input string, output string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Examples = append(s.Examples, Example{Stage: stage, Input: input, Output: output})
+	var kept []Example
+	seen := 0
+	for i := len(s.Examples) - 1; i >= 0; i-- {
+		e := s.Examples[i]
+		if e.Stage == stage {
+			if seen == maxExamplesPerStage {
+				continue
+			}
+			seen++
+		}
+		kept = append([]Example{e}, kept...)
+	}
+	s.Examples = kept
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteToFile(string(content), s.path)
+}
+
+// instructions renders the examples of the stage for a prompt, empty when there are none.
+func (s *ExampleStore) instructions(stage Stage) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	for _, e := range s.Examples {
+		if e.Stage != stage {
+			continue
+		}
+		if b.Len() == 0 {
+			b.WriteString("Here are outputs accepted for other requests of this package, follow their style and use of the package's API:\n")
+		}
+		fmt.Fprintf(&b, "\nRequest:\n%s\nOutput:\n%s\n", e.Input, e.Output)
+	}
+	return b.String()
+}
+
+// withExamples adds the examples of the prompt's stage to its last message when the model is
+// weaker than the strongest one of the scheduler.
+func (c *Client) withExamples(prompt Prompt) Prompt {
+	if c.examples == nil || prompt.ExampleInput == "" || len(prompt.Messages) == 0 {
+		return prompt
+	}
+	if prompt.Model == c.scheduler.Models[len(c.scheduler.Models)-1] {
+		return prompt
+	}
+	examples := c.examples.instructions(prompt.Stage)
+	if examples == "" {
+		return prompt
+	}
+	messages := append([]Message(nil), prompt.Messages...)
+	last := &messages[len(messages)-1]
+	last.Content += "\n\n" + examples
+	prompt.Messages = messages
+	return prompt
+}
+
+// distill records the output of a request completed by a model stronger than the cheapest
+// one of the scheduler as an example.
+func (c *Client) distill(prompt Prompt, output string) {
+	if c.examples == nil || prompt.ExampleInput == "" || prompt.Model == c.scheduler.Models[0] {
+		return
+	}
+	if err := c.examples.Add(prompt.Stage, prompt.ExampleInput, output); err != nil {
+		log.Printf("Failed to save the example: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// embeddingBatchSize is the number of texts embedded per request.
+const embeddingBatchSize = 100
+
+// Embedder is implemented by providers able to compute embeddings of texts.
+type Embedder interface {
+	// Embed returns one embedding vector per text.
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// Embed computes the embeddings of the texts with the ada-002 embedding model.
+func (p *OpenAIProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	res := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		end := start + embeddingBatchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+		resp, err := p.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+			Input: texts[start:end],
+			Model: openai.AdaEmbeddingV2,
+		})
+		if err != nil {
+			return nil, openAIError(err, 0)
+		}
+		if len(resp.Data) != end-start {
+			return nil, fmt.Errorf("got %d embeddings for %d texts", len(resp.Data), end-start)
+		}
+		batch := make([][]float32, end-start)
+		for _, e := range resp.Data {
+			if e.Index < 0 || e.Index >= len(batch) {
+				return nil, fmt.Errorf("embedding index %d out of range", e.Index)
+			}
+			batch[e.Index] = e.Embedding
+		}
+		res = append(res, batch...)
+	}
+	return res, nil
+}
@@ -0,0 +1,176 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/sentiens/goptest/spec"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Response formats of the test cases stage.
+const (
+	// FormatAuto asks for JSON matching casesSchema and falls back to YAML text when the
+	// provider or model does not support function calling.
+	FormatAuto = "auto"
+	// FormatJSON always asks for JSON matching casesSchema, failing when it is not supported.
+	FormatJSON = "json"
+	// FormatText asks for YAML in plain text and cleans up the response.
+	FormatText = "text"
+)
+
+// WithResponseFormat sets how the test cases are requested: FormatAuto, FormatJSON or
+// FormatText.
+func WithResponseFormat(format string) Option {
+	return func(o *GeneratorOptions) {
+		o.ResponseFormat = format
+	}
+}
+
+// errJSONUnsupported is returned when the provider or model can't produce JSON responses.
+var errJSONUnsupported = errors.New("JSON mode not supported")
+
+// casesSchema is the JSON schema of the test cases, the arguments of the function the model
+// calls with them.
+var casesSchema = &Schema{
+	Name:        "submit_test_cases",
+	Description: "Submits the test cases of the tests to implement.",
+	Parameters: json.RawMessage(`{
+  "type": "object",
+  "properties": {
+    "cases": {
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string", "description": "Name of the test function, e.g. TestThing_Action_WhenSomething."},
+          "instructions": {"type": "string", "description": "Precise input description and output and/or mock expectations."}
+        },
+        "required": ["name", "instructions"],
+        "additionalProperties": false
+      }
+    }
+  },
+  "required": ["cases"],
+  "additionalProperties": false
+}`),
+}
+
+// useJSON reports whether the test cases are requested in JSON mode.
+func (c *Client) useJSON() bool {
+	switch c.responseFormat {
+	case FormatJSON:
+		return true
+	case FormatText:
+		return false
+	}
+	return !c.jsonUnsupported.Load()
+}
+
+// jsonModeRejected reports whether the request failed because the provider does not accept
+// the response_format or tools parameters.
+func jsonModeRejected(err error) bool {
+	var providerErr *ProviderError
+	if !errors.As(err, &providerErr) || providerErr.StatusCode < 400 || providerErr.StatusCode >= 500 ||
+		providerErr.StatusCode == http.StatusTooManyRequests {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, param := range []string{"response_format", "json", "tool", "function"} {
+		if strings.Contains(msg, param) {
+			return true
+		}
+	}
+	return false
+}
+
+func promptForTestCasesJSON(allCode string, list string, extraInstructions string) []Message {
+	systemContent := "Acting as a senior developer " +
+		"you should read given code and create instructions to implement the tests.\n" +
+		"Call the submit_test_cases function with a `cases` array of objects with the `name` and `instructions` string fields.\n" +
+		"`instructions` field should contain precise input description and output and/or mock expectations based on the provided code.\n" +
+		"Example: {\"cases\": [{\"name\": \"TestThing_Action1_WhenSomething\", \"instructions\": \"1. ...\\n2. ...\"}]}"
+	userContent := fmt.Sprintf(
+		"Here is my code: \n```go\n%s```\n"+
+			"Refine these tests: \n\"\"\"%s\"\"\"\n",
+		allCode,
+		list,
+	)
+	if extraInstructions != "" {
+		userContent += "\n" + extraInstructions
+	}
+	return []Message{
+		{Role: RoleSystem, Content: systemContent},
+		{Role: RoleUser, Content: userContent},
+	}
+}
+
+// casesFromJSON converts a response matching casesSchema into the YAML `cases` list of the
+// spec files. The error lists every violation of the schema, see spec.Validate.
+func casesFromJSON(resp string) (string, error) {
+	var parsed struct {
+		Cases []Spec `json:"cases"`
+	}
+	dec := json.NewDecoder(strings.NewReader(resp))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&parsed); err != nil {
+		return "", err
+	}
+	if err := spec.Validate(&SpecList{Specs: parsed.Cases}); err != nil {
+		return "", err
+	}
+	out, err := yaml.Marshal(struct {
+		Cases []Spec `yaml:"cases"`
+	}{parsed.Cases})
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// generateTestCasesJSON requests the test cases as the arguments of a call of the function
+// described by casesSchema and requests them again, pointing out the violations, while they do
+// not match it, see WithSpecRetries. It returns errJSONUnsupported when the provider rejects
+// function calling, ignores it and answers with something else than JSON, or still violates
+// the schema after the retries.
+func (c *Client) generateTestCasesJSON(ctx context.Context, whatToTest string, allCode string, testList string, extraInstructions string) (string, error) {
+	prompt := c.BasicPrompt()
+	prompt.Schema = casesSchema
+	prompt.Messages = c.withOverride(StageCases, promptForTestCasesJSON(allCode, testList, extraInstructions))
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return "", err
+	}
+	for i := 0; ; i++ {
+		resp, err := c.runStage(StageCases, whatToTest, func() (string, error) {
+			return c.streamCompletion(ctx, StageCases, whatToTest, prompt)
+		})
+		if err != nil {
+			if jsonModeRejected(err) {
+				return "", fmt.Errorf("%w: %v", errJSONUnsupported, err)
+			}
+			return "", err
+		}
+		if !json.Valid([]byte(resp)) {
+			return "", fmt.Errorf("%w: the response is not JSON", errJSONUnsupported)
+		}
+		cases, err := casesFromJSON(resp)
+		if err == nil {
+			return cases, nil
+		}
+		if i >= c.specRetries {
+			return "", fmt.Errorf("%w: invalid JSON response after %d attempts: %v", errJSONUnsupported, i+1, err)
+		}
+		log.Printf("Test cases for %s do not match the schema, requesting them again: %v", whatToTest, err)
+		messages := append([]Message(nil), prompt.Messages...)
+		prompt.Messages = append(messages,
+			Message{Role: RoleAssistant, Content: resp},
+			Message{Role: RoleUser, Content: fmt.Sprintf("The arguments do not match the schema of %s: %v. Call it again with all the test cases.", casesSchema.Name, err)},
+		)
+	}
+}
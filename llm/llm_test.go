@@ -0,0 +1,1812 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type fakeProvider struct {
+	prompts []Prompt
+	reply   string
+}
+
+func (p *fakeProvider) Complete(_ context.Context, prompt Prompt) (string, error) {
+	p.prompts = append(p.prompts, prompt)
+	return p.reply, nil
+}
+
+func (p *fakeProvider) Stream(ctx context.Context, prompt Prompt, onDelta func(string)) (string, error) {
+	out, err := p.Complete(ctx, prompt)
+	onDelta(out)
+	return out, err
+}
+
+func TestDifferentialSignatures(t *testing.T) {
+	code := `package calc
+
+func SumV1(xs []int) int { return 0 }
+
+func SumV2(xs []int) int { return 0 }
+`
+	got, err := differentialSignatures(code, "SumV1", "SumV2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "func SumV1(xs []int) int\nfunc SumV2(xs []int) int"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := differentialSignatures(code, "SumV1", "SumV3"); err == nil {
+		t.Error("expected an error for a missing implementation")
+	}
+}
+
+func TestRegressionSpec(t *testing.T) {
+	testCases := []struct {
+		what     string
+		diff     string
+		wantName string
+	}{
+		{"ParseDate", "", "TestParseDate_Regression"},
+		{"", "-a\n+b", "TestBug_Regression"},
+	}
+	for _, tc := range testCases {
+		spec := RegressionSpec(tc.what, "  crashes on empty input\n", tc.diff)
+		if spec.Name != tc.wantName {
+			t.Errorf("name = %q, want %q", spec.Name, tc.wantName)
+		}
+		if !strings.Contains(spec.Description, "\"\"\"\ncrashes on empty input\n\"\"\"") {
+			t.Errorf("description does not quote the bug report: %q", spec.Description)
+		}
+		if got := strings.Contains(spec.Description, "```diff"); got != (tc.diff != "") {
+			t.Errorf("description contains diff = %v, want %v", got, tc.diff != "")
+		}
+	}
+}
+
+func TestCaptureLines(t *testing.T) {
+	output := "=== RUN   TestGoptestCapture\n" +
+		"goptest-capture: Add(1, 2) => 3\n" +
+		"goptest-capture: Div(1, 0) => \"runtime error: integer divide by zero\"  \n" +
+		"--- PASS: TestGoptestCapture (0.00s)\n"
+	want := []string{"Add(1, 2) => 3", "Div(1, 0) => \"runtime error: integer divide by zero\""}
+	if got := captureLines(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestVerifyHelpers(t *testing.T) {
+	src := `package calc
+
+func TestAdd(t *testing.T) {
+	t.Skip("goptest: likely production bug: Add overflows silently")
+}
+
+func FuzzAdd(f *testing.F) {}
+
+func helper() {}
+
+func (s suite) TestMethod() {}
+`
+	names, err := testFuncNames(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"TestAdd", "FuzzAdd"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("testFuncNames = %q, want %q", names, want)
+	}
+	if got, want := LikelyBugs(src), []string{"goptest: likely production bug: Add overflows silently"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LikelyBugs = %q, want %q", got, want)
+	}
+}
+
+func TestWriteGoFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gen_test.go")
+	src := "package calc\n\nimport (\n\t\"fmt\"\n\t\"testing\"\n)\n\nfunc TestUpper(t *testing.T) {\n\tif strings.ToUpper(\"a\") != \"A\" {\n\t\tt.Fail()\n\t}\n}\n"
+	if err := WriteGoFile(src, path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "import (\n\t\"strings\"\n\t\"testing\"\n)"; !strings.Contains(string(got), want) {
+		t.Errorf("imports not fixed, got:\n%s", got)
+	}
+}
+
+func TestFindInterfaceContract(t *testing.T) {
+	code := `package kv
+
+// Store keeps values by key.
+type Store interface {
+	// Get returns ErrNotFound for missing keys.
+	Get(key string) (string, error)
+	Put(key, value string) error
+}
+
+type memStore struct{ m map[string]string }
+
+func newUnused() {}
+
+func NewMemStore() *memStore { return &memStore{m: map[string]string{}} }
+
+func (s *memStore) Get(k string) (string, error) { return s.m[k], nil }
+func (s *memStore) Put(k, v string) error         { s.m[k] = v; return nil }
+
+type nopStore struct{}
+
+func (nopStore) Get(string) (string, error) { return "", nil }
+func (nopStore) Put(string, string) error   { return nil }
+
+type readOnly struct{}
+
+func (readOnly) Get(key string) (string, error) { return "", nil }
+func (readOnly) Put(key string) error            { return nil }
+`
+	contract, err := FindInterfaceContract(code, "Store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantImpls := []Implementation{
+		{Type: "memStore", Pointer: true, Constructor: "NewMemStore"},
+		{Type: "nopStore"},
+	}
+	if !reflect.DeepEqual(contract.Implementations, wantImpls) {
+		t.Errorf("got implementations %+v, want %+v", contract.Implementations, wantImpls)
+	}
+	if !strings.HasPrefix(contract.Decl, "// Store keeps values by key.\ntype Store interface {") {
+		t.Errorf("unexpected declaration %q", contract.Decl)
+	}
+
+	specs, wiring := ContractWiring(contract)
+	if len(specs) != 2 || specs[0].Name != "TestMemStore_StoreContract" {
+		t.Errorf("unexpected specs %+v", specs)
+	}
+	if !strings.Contains(wiring[0], "RunStoreContract(t, func() Store { return NewMemStore() })") ||
+		!strings.Contains(wiring[1], "RunStoreContract(t, func() Store { return nopStore{} })") {
+		t.Errorf("unexpected wiring %q", wiring)
+	}
+	if _, err := FindInterfaceContract(code, "Cache"); err == nil {
+		t.Error("expected an error for a missing interface")
+	}
+}
+
+func TestContextWindow(t *testing.T) {
+	if got := ContextWindow("gpt-4-0613"); got != 8192 {
+		t.Errorf("ContextWindow(gpt-4-0613) = %d", got)
+	}
+	if got := ContextWindow("gpt-4-32k-0613"); got != 32768 {
+		t.Errorf("ContextWindow(gpt-4-32k-0613) = %d", got)
+	}
+	if got := ContextWindow("llama2"); got != 0 {
+		t.Errorf("ContextWindow(llama2) = %d", got)
+	}
+	if got := CountTokens("gpt-4", "hello world"); got != 2 {
+		t.Errorf("CountTokens = %d, want 2", got)
+	}
+
+	c, err := NewClient(WithProvider(&fakeProvider{}), WithModel("gpt-3.5-turbo"), WithMaxTokens(2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt := c.BasicPrompt()
+	prompt.Messages = []Message{{Role: RoleUser, Content: strings.Repeat("func F() {}\n", 800)}}
+	fitted, err := c.fitContextWindow(prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := PromptTokens("gpt-3.5-turbo", prompt.Messages); fitted.MaxTokens != 4096-tokens {
+		t.Errorf("expected the completion shortened to %d tokens, got %d", 4096-tokens, fitted.MaxTokens)
+	}
+	prompt.Messages[0].Content = strings.Repeat("func F() {}\n", 2000)
+	var windowErr *ContextWindowError
+	if _, err := c.fitContextWindow(prompt); !errors.As(err, &windowErr) {
+		t.Errorf("expected a ContextWindowError, got %v", err)
+	}
+}
+
+func TestRankFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go": "package p\n\nfunc Other() {}\n",
+		"b.go": "package p\n\nfunc Helper() { Parse() }\n",
+		"c.go": "package p\n\nfunc Parse() {}\n",
+	}
+	var paths []string
+	for _, name := range []string{"a.go", "b.go", "c.go"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(files[name]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	want := []string{paths[2], paths[1], paths[0]}
+	if got := RankFiles(paths, "Parse function"); !reflect.DeepEqual(got, want) {
+		t.Errorf("RankFiles = %v, want %v", got, want)
+	}
+	if got := RankFiles(paths, ""); !reflect.DeepEqual(got, paths) {
+		t.Errorf("expected the order kept without a target, got %v", got)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	testCases := []struct {
+		attempt    int
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{1, 0, time.Second},
+		{2, 0, 2 * time.Second},
+		{3, 0, 4 * time.Second},
+		{4, 0, 5 * time.Second},
+		{1, 3 * time.Second, 3 * time.Second},
+		{1, time.Hour, 5 * time.Second},
+	}
+	for _, tc := range testCases {
+		if got := p.backoff(tc.attempt, tc.retryAfter); got != tc.want {
+			t.Errorf("backoff(%d, %s) = %s, want %s", tc.attempt, tc.retryAfter, got, tc.want)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		if got := p.backoff(2, 0); got < time.Second || got > 2*time.Second {
+			t.Fatalf("backoff with jitter = %s, want between 1s and 2s", got)
+		}
+	}
+
+	now := time.Date(2023, time.May, 1, 12, 0, 0, 0, time.UTC)
+	if got := parseRetryAfter("7", now); got != 7*time.Second {
+		t.Errorf("parseRetryAfter(7) = %s", got)
+	}
+	if got := parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now); got != time.Minute {
+		t.Errorf("parseRetryAfter(date) = %s", got)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"message":"rate limited","type":"requests"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"done"}}]}`)
+	}))
+	defer server.Close()
+
+	var waits []time.Duration
+	cb := &retryRecorder{waits: &waits}
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	c, err := NewClient(WithAPIKey("key"), WithAPIBase(server.URL), WithRetryPolicy(policy), WithCallbacks(cb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Complete(context.Background(), c.BasicPrompt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "done" || requests != 3 {
+		t.Errorf("got %q after %d requests", got, requests)
+	}
+	// Retry-After is capped by MaxBackoff.
+	if !reflect.DeepEqual(waits, []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}) {
+		t.Errorf("unexpected waits %v", waits)
+	}
+
+	requests = -10
+	if _, err := c.Complete(context.Background(), c.BasicPrompt()); err == nil {
+		t.Error("expected an error once the attempts are used up")
+	}
+}
+
+// stageCallbacks implements Callbacks without RetryCallbacks, like implementations written
+// before retries were reported.
+type stageCallbacks struct{}
+
+func (stageCallbacks) OnStageStart(Stage, string) {}
+
+func (stageCallbacks) OnDelta(Stage, string, string) {}
+
+func (stageCallbacks) OnStageEnd(StageResult) {}
+
+func TestClientRetriesWithoutRetryCallbacks(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"done"}}]}`)
+	}))
+	defer server.Close()
+
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	c, err := NewClient(WithAPIKey("key"), WithAPIBase(server.URL), WithRetryPolicy(policy), WithCallbacks(stageCallbacks{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Complete(context.Background(), c.BasicPrompt()); err != nil || got != "done" {
+		t.Errorf("got %q, %v after %d requests", got, err, requests)
+	}
+}
+
+// eventsRecorder records the retry events.
+type eventsRecorder struct {
+	NopCallbacks
+	events []RetryEvent
+}
+
+func (r *eventsRecorder) OnRetry(event RetryEvent) {
+	r.events = append(r.events, event)
+}
+
+func TestRetryEvents(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"message":"rate limited","type":"requests"}}`)
+		default:
+			fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"done"}}]}`)
+		}
+	}))
+	defer server.Close()
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	recorder := &eventsRecorder{}
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	c, err := NewClient(WithAPIKey("key"), WithAPIBase(server.URL), WithRetryPolicy(policy), WithCallbacks(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Complete(context.Background(), c.BasicPrompt())
+	w.Close()
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed, _ := io.ReadAll(r)
+	if len(printed) > 0 {
+		t.Errorf("the retries printed %q, want them reported through the callbacks only", printed)
+	}
+
+	if len(recorder.events) != 2 {
+		t.Fatalf("got %d retry events, want 2: %+v", len(recorder.events), recorder.events)
+	}
+	for i, want := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		e := recorder.events[i]
+		if e.StatusCode != want || e.Attempt != i+1 || e.Wait <= 0 || e.Wait > policy.MaxBackoff || e.Err == nil || e.Restart {
+			t.Errorf("retry event %d = %+v, want status %d of attempt %d", i, e, want, i+1)
+		}
+	}
+}
+
+func TestHTTPDebugLog(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-Request-Id", fmt.Sprintf("req_%d", requests))
+		w.Header().Set("X-Ratelimit-Remaining-Requests", "0")
+		w.Header().Set("Set-Cookie", "session=secret")
+		if requests == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"message":"rate limited","type":"requests"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"done"}}]}`)
+	}))
+	defer server.Close()
+
+	var log strings.Builder
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	c, err := NewClient(WithAPIKey("secret-key"), WithAPIBase(server.URL), WithRetryPolicy(policy), WithHTTPDebugLog(&log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt := c.BasicPrompt()
+	prompt.Messages = []Message{{Role: RoleUser, Content: "private prompt"}}
+	if got, err := c.Complete(context.Background(), prompt); err != nil || got != "done" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	if strings.Contains(log.String(), "secret") || strings.Contains(log.String(), "private prompt") {
+		t.Errorf("the log is not sanitized:\n%s", log.String())
+	}
+	var exchanges []HTTPExchange
+	scanner := bufio.NewScanner(strings.NewReader(log.String()))
+	for scanner.Scan() {
+		var ex HTTPExchange
+		if err := json.Unmarshal(scanner.Bytes(), &ex); err != nil {
+			t.Fatal(err)
+		}
+		exchanges = append(exchanges, ex)
+	}
+	if len(exchanges) != 2 {
+		t.Fatalf("got %d exchanges, want 2:\n%s", len(exchanges), log.String())
+	}
+	first := exchanges[0]
+	if first.Status != http.StatusTooManyRequests || first.Headers["x-request-id"] != "req_1" ||
+		first.Headers["x-ratelimit-remaining-requests"] != "0" || !strings.Contains(first.Error, "rate limited") {
+		t.Errorf("unexpected exchange %+v", first)
+	}
+	if exchanges[1].Status != http.StatusOK || exchanges[1].Error != "" || !strings.HasSuffix(exchanges[1].URL, "/chat/completions") {
+		t.Errorf("unexpected exchange %+v", exchanges[1])
+	}
+}
+
+func TestCompleteCanceled(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// The server notices the client hanging up once the body is read.
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	c, err := NewClient(WithAPIKey("key"), WithAPIBase(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := c.Complete(ctx, c.BasicPrompt()); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the in-flight request to be canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); requests != 1 || elapsed > time.Second {
+		t.Errorf("%d requests took %s", requests, elapsed)
+	}
+}
+
+// eventRecorder records the stage callbacks as lines.
+type eventRecorder struct {
+	NopCallbacks
+	events []string
+}
+
+func (r *eventRecorder) OnStageStart(stage Stage, target string) {
+	r.events = append(r.events, fmt.Sprintf("start %s %s", stage, target))
+}
+
+func (r *eventRecorder) OnDelta(stage Stage, target string, delta string) {
+	r.events = append(r.events, fmt.Sprintf("delta %s %s %q", stage, target, delta))
+}
+
+func (r *eventRecorder) OnStageEnd(result StageResult) {
+	r.events = append(r.events, fmt.Sprintf("end %s %s %q %v", result.Stage, result.Target, result.Output, result.Err))
+}
+
+func TestStageCallbacks(t *testing.T) {
+	provider := &fakeProvider{reply: "Add returns the sum."}
+	recorder := &eventRecorder{}
+	c, err := NewClient(WithProvider(provider), WithParallel(1), WithCallbacks(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GenerateSpec(context.Background(), "Add", "package calc", ""); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"start spec Add",
+		`delta spec Add "Add returns the sum."`,
+		`end spec Add "Add returns the sum." <nil>`,
+	}
+	if !reflect.DeepEqual(recorder.events, want) {
+		t.Errorf("got the events %q, want %q", recorder.events, want)
+	}
+
+	recorder.events = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, err = NewClient(WithProvider(&ctxProvider{fakeProvider: *provider}), WithParallel(1), WithCallbacks(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GenerateSpec(ctx, "Add", "package calc", ""); err == nil {
+		t.Fatal("expected an error with a canceled context")
+	}
+	if len(recorder.events) != 2 || recorder.events[1] != `end spec Add "" context canceled` {
+		t.Errorf("got the events %q, want the start and the failed end", recorder.events)
+	}
+}
+
+type ctxKey struct{}
+
+// ctxProvider records the value of ctxKey in the context of every request and fails the
+// requests of canceled contexts like an HTTP provider.
+type ctxProvider struct {
+	fakeProvider
+	values []any
+}
+
+func (p *ctxProvider) Complete(ctx context.Context, prompt Prompt) (string, error) {
+	p.values = append(p.values, ctx.Value(ctxKey{}))
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return p.fakeProvider.Complete(ctx, prompt)
+}
+
+func (p *ctxProvider) Stream(ctx context.Context, prompt Prompt, onDelta func(string)) (string, error) {
+	p.values = append(p.values, ctx.Value(ctxKey{}))
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return p.fakeProvider.Stream(ctx, prompt, onDelta)
+}
+
+func TestGenerateContext(t *testing.T) {
+	provider := &ctxProvider{fakeProvider: fakeProvider{reply: "cases:\n  - name: TestAdd\n    instructions: add\n"}}
+	c, err := NewClient(WithProvider(provider), WithParallel(1), WithResponseFormat(FormatText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "run")
+	stages := map[string]func(ctx context.Context) (string, error){
+		"GenerateSpec": func(ctx context.Context) (string, error) {
+			return c.GenerateSpec(ctx, "Add", "package calc", "")
+		},
+		"GenerateTestsList": func(ctx context.Context) (string, error) {
+			return c.GenerateTestsList(ctx, "Add", "package calc", "")
+		},
+		"GenerateTestCases": func(ctx context.Context) (string, error) {
+			return c.GenerateTestCases(ctx, "Add", "package calc", "", "")
+		},
+		"GenerateMocks": func(ctx context.Context) (string, error) {
+			return c.GenerateMocks(ctx, "Add", "package calc", "")
+		},
+		"GenerateTestCode": func(ctx context.Context) (string, error) {
+			return c.GenerateTestCode(ctx, Spec{Name: "TestAdd"}, "Add", "package calc", "calc", "")
+		},
+	}
+	for name, generate := range stages {
+		provider.values = nil
+		if _, err := generate(ctx); err != nil {
+			t.Fatalf("%s() failed: %v", name, err)
+		}
+		if len(provider.values) == 0 || provider.values[0] != "run" {
+			t.Errorf("%s() sent its requests with the contexts %v, want the caller's", name, provider.values)
+		}
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := generate(canceled); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s() = %v with a canceled context, want context.Canceled", name, err)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		io.Copy(io.Discard, r.Body)
+		if requests == 1 {
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"done"}}]}`)
+	}))
+	defer server.Close()
+
+	var waits []time.Duration
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	c, err := NewClient(WithAPIKey("key"), WithAPIBase(server.URL), WithRetryPolicy(policy),
+		WithRequestTimeout(50*time.Millisecond), WithCallbacks(&retryRecorder{waits: &waits}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Complete(context.Background(), c.BasicPrompt())
+	if err != nil || got != "done" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if requests != 2 || len(waits) != 1 {
+		t.Errorf("got %d requests and %d retries, expected the timed out attempt to be retried", requests, len(waits))
+	}
+
+	c, err = NewClient(WithAPIKey("key"), WithAPIBase(server.URL), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithRequestTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests = 0
+	var timeout *RequestTimeoutError
+	if _, err := c.Complete(context.Background(), c.BasicPrompt()); !errors.As(err, &timeout) {
+		t.Errorf("expected a RequestTimeoutError, got %v", err)
+	}
+}
+
+type retryRecorder struct {
+	NopCallbacks
+	waits *[]time.Duration
+}
+
+func (r *retryRecorder) OnRetry(event RetryEvent) {
+	*r.waits = append(*r.waits, event.Wait)
+}
+
+// flakyStreamProvider drops the connection of the first stream after one delta.
+type flakyStreamProvider struct {
+	fakeProvider
+	streams int
+}
+
+func (p *flakyStreamProvider) Stream(ctx context.Context, prompt Prompt, onDelta func(string)) (string, error) {
+	p.streams++
+	if p.streams == 1 {
+		onDelta("cases:")
+		return "", io.ErrUnexpectedEOF
+	}
+	return p.fakeProvider.Stream(ctx, prompt, onDelta)
+}
+
+func TestStreamRestart(t *testing.T) {
+	reply := "cases:\n  - name: TestAdd\n    instructions: add"
+	provider := &flakyStreamProvider{fakeProvider: fakeProvider{reply: reply}}
+	var waits []time.Duration
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	c, err := NewClient(WithProvider(provider), WithRetryPolicy(policy), WithCallbacks(&retryRecorder{waits: &waits}),
+		WithResponseFormat(FormatText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GenerateTestCases(context.Background(), "Add", "package calc", "1. TestAdd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != reply || provider.streams != 2 || len(waits) != 1 {
+		t.Errorf("got %q after %d streams and %d retries", got, provider.streams, len(waits))
+	}
+
+	provider.streams = 0
+	c, err = NewClient(WithProvider(provider), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}), WithResponseFormat(FormatText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var interrupted *StreamInterruptedError
+	if _, err := c.GenerateTestCases(context.Background(), "Add", "package calc", "1. TestAdd", ""); !errors.As(err, &interrupted) {
+		t.Errorf("expected a StreamInterruptedError without retries, got %v", err)
+	}
+}
+
+func TestResponseFormat(t *testing.T) {
+	provider := &fakeProvider{reply: `{"cases": [{"name": "TestAdd_Positive", "instructions": "1. Add 1 and 2\n2. Expect 3"}]}`}
+	c, err := NewClient(WithProvider(provider), WithParallel(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GenerateTestCases(context.Background(), "Add", "package calc", "1. TestAdd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Cases []Spec `yaml:"cases"`
+	}
+	if err := yaml.Unmarshal([]byte(got), &parsed); err != nil {
+		t.Fatalf("invalid YAML %q: %v", got, err)
+	}
+	if len(parsed.Cases) != 1 || parsed.Cases[0].Name != "TestAdd_Positive" || !strings.Contains(parsed.Cases[0].Description, "Expect 3") {
+		t.Errorf("unexpected cases %+v", parsed.Cases)
+	}
+
+	provider = &fakeProvider{reply: "cases:\n  - name: TestAdd\n    instructions: add"}
+	c, err = NewClient(WithProvider(provider), WithParallel(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		got, err := c.GenerateTestCases(context.Background(), "Add", "package calc", "1. TestAdd", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(got, "name: TestAdd") {
+			t.Errorf("call %d: unexpected cases %q", i, got)
+		}
+	}
+	// The first call tries JSON mode and falls back, the second one goes straight to text.
+	if len(provider.prompts) != 3 {
+		t.Errorf("got %d requests, want 3", len(provider.prompts))
+	}
+
+	provider = &fakeProvider{reply: "not JSON"}
+	c, err = NewClient(WithProvider(provider), WithParallel(1), WithResponseFormat(FormatJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GenerateTestCases(context.Background(), "Add", "package calc", "1. TestAdd", ""); !errors.Is(err, errJSONUnsupported) {
+		t.Errorf("expected errJSONUnsupported in JSON mode, got %v", err)
+	}
+
+	scripted := &scriptedProvider{replies: []string{
+		`{"cases": [{"name": "TestAdd_Positive"}, {"name": "TestAdd_Positive", "instructions": "add"}]}`,
+		`{"cases": [{"name": "TestAdd_Positive", "instructions": "1. Add 1 and 2"}]}`,
+	}}
+	c, err = NewClient(WithProvider(scripted), WithParallel(1), WithResponseFormat(FormatJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = c.GenerateTestCases(context.Background(), "Add", "package calc", "1. TestAdd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "name: TestAdd_Positive") || len(scripted.prompts) != 2 {
+		t.Fatalf("got %q after %d requests", got, len(scripted.prompts))
+	}
+	if scripted.prompts[0].Schema != casesSchema {
+		t.Errorf("the cases were not requested with their schema")
+	}
+	retry := scripted.prompts[1].Messages
+	if last := retry[len(retry)-1].Content; !strings.Contains(last, "cases[0].instructions is empty") || !strings.Contains(last, "cases[1].name TestAdd_Positive repeats cases[0].name") {
+		t.Errorf("the retry does not point out the violations: %q", last)
+	}
+
+	req := (&OpenAIProvider{model: "gpt-4"}).request(Prompt{Schema: casesSchema})
+	if len(req.Tools) != 1 || req.Tools[0].Function.Name != casesSchema.Name || req.ToolChoice == nil {
+		t.Errorf("the schema is not sent as a function: %+v", req)
+	}
+}
+
+func TestSpecRetries(t *testing.T) {
+	provider := &scriptedProvider{replies: []string{
+		"cases:\n  - name: adds numbers\n    instructions: TODO",
+		"```yaml\ncases:\n  - name: TestAdd_Positive\n    instructions: 1. Add 1 and 2\n```",
+	}}
+	c, err := NewClient(WithProvider(provider), WithParallel(1), WithResponseFormat(FormatText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GenerateTestCases(context.Background(), "Add", "package calc", "1. TestAdd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "name: TestAdd_Positive") || len(provider.prompts) != 2 {
+		t.Fatalf("got %q after %d requests", got, len(provider.prompts))
+	}
+	retry := provider.prompts[1].Messages
+	if last := retry[len(retry)-1].Content; !strings.Contains(last, `cases[0].name "adds numbers" is not a valid Go identifier`) ||
+		!strings.Contains(last, `cases[0].instructions is a placeholder: "TODO"`) {
+		t.Errorf("the retry does not point out the problems: %q", last)
+	}
+
+	provider = &scriptedProvider{replies: []string{"cases: [unclosed"}}
+	c, err = NewClient(WithProvider(provider), WithParallel(1), WithResponseFormat(FormatText), WithSpecRetries(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GenerateTestCases(context.Background(), "Add", "package calc", "1. TestAdd", ""); err == nil || !strings.Contains(err.Error(), "not valid YAML") {
+		t.Errorf("expected the YAML error, got %v", err)
+	}
+	if len(provider.prompts) != 2 {
+		t.Errorf("got %d requests, want 2 with one retry", len(provider.prompts))
+	}
+}
+
+func TestProgressEvents(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewProgressWriter(&buf)
+	provider := &fakeProvider{reply: "cases:\n  - name: TestAdd\n    instructions: add"}
+	var waits []time.Duration
+	c, err := NewClient(WithProvider(provider), WithParallel(1), WithResponseFormat(FormatText),
+		WithCallbacks(&retryRecorder{waits: &waits}), WithProgress(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GenerateTestCases(context.Background(), "Add", "package calc", "1. TestAdd", ""); err != nil {
+		t.Fatal(err)
+	}
+	p.SpecStatus(1, 3, "Add", Spec{Name: "TestAdd"}, SpecFailed, errors.New("timeout"))
+	// A nil writer drops the events.
+	var none *ProgressWriter
+	none.SpecStatus(0, 1, "Add", Spec{Name: "TestAdd"}, SpecGenerated, nil)
+
+	var events []ProgressEvent
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e ProgressEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid event %q: %v", line, err)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("event without time: %q", line)
+		}
+		e.Time, e.DurationMS = time.Time{}, 0
+		events = append(events, e)
+	}
+	want := []ProgressEvent{
+		{Event: ProgressStageStart, Stage: StageCases, Target: "Add"},
+		{Event: ProgressStageEnd, Stage: StageCases, Target: "Add", Status: "ok"},
+		{Event: ProgressSpec, Target: "Add", Spec: "TestAdd", Index: 2, Total: 3, Status: SpecFailed, Error: "timeout"},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %+v, want %+v", events, want)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	testCases := []struct {
+		name    string
+		headers map[string]string
+		want    RateLimit
+		wantOK  bool
+	}{
+		{
+			name: "openai",
+			headers: map[string]string{
+				"X-Ratelimit-Remaining-Requests": "2",
+				"X-Ratelimit-Remaining-Tokens":   "1500",
+				"X-Ratelimit-Reset-Requests":     "1m30s",
+				"X-Ratelimit-Reset-Tokens":       "20ms",
+			},
+			want:   RateLimit{RemainingRequests: 2, RemainingTokens: 1500, ResetRequests: 90 * time.Second, ResetTokens: 20 * time.Millisecond},
+			wantOK: true,
+		},
+		{
+			name:    "seconds",
+			headers: map[string]string{"X-Ratelimit-Remaining-Requests": "0", "X-Ratelimit-Reset-Requests": "1.5"},
+			want:    RateLimit{RemainingRequests: 0, RemainingTokens: -1, ResetRequests: 1500 * time.Millisecond},
+			wantOK:  true,
+		},
+		{
+			name:    "none",
+			headers: map[string]string{"X-Ratelimit-Reset-Requests": "1s"},
+			want:    RateLimit{RemainingRequests: -1, RemainingTokens: -1, ResetRequests: time.Second},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tc.headers {
+				h.Set(k, v)
+			}
+			got, ok := parseRateLimit(h)
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("got %+v, %t, want %+v, %t", got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-Ratelimit-Remaining-Requests", "0")
+		w.Header().Set("X-Ratelimit-Reset-Requests", "100ms")
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"done"}}]}`)
+	}))
+	defer server.Close()
+	c, err := NewClient(WithAPIKey("key"), WithAPIBase(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Complete(context.Background(), c.BasicPrompt()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second request waits for the requests limit to be reset instead of being rejected.
+	if elapsed := time.Since(start); requests != 2 || elapsed < 80*time.Millisecond {
+		t.Errorf("%d requests took %s, expected a pause", requests, elapsed)
+	}
+}
+
+// modelProvider replies per model and records the models the prompts were sent to.
+type modelProvider struct {
+	replies map[string]string
+	models  []string
+	prompts []Prompt
+}
+
+func (p *modelProvider) Complete(_ context.Context, prompt Prompt) (string, error) {
+	p.models = append(p.models, prompt.Model)
+	p.prompts = append(p.prompts, prompt)
+	return p.replies[prompt.Model], nil
+}
+
+func (p *modelProvider) Stream(ctx context.Context, prompt Prompt, onDelta func(string)) (string, error) {
+	return p.Complete(ctx, prompt)
+}
+
+func TestModelScheduler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	scheduler, err := LoadModelScheduler([]string{"cheap", "strong"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &modelProvider{replies: map[string]string{
+		"cheap":  "I can't write this test.",
+		"strong": "func TestAdd(t *testing.T) {}",
+	}}
+	c, err := NewClient(WithProvider(provider), WithParallel(1), WithModelScheduler(scheduler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt := c.BasicPrompt()
+	prompt.Stage = StageCode
+	for i := 0; i < 2; i++ {
+		got, err := c.Complete(context.Background(), prompt)
+		if err != nil || got != provider.replies["strong"] {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+	// The cheap model failed the first request, the second one goes to the strong model.
+	if !reflect.DeepEqual(provider.models, []string{"cheap", "strong", "strong"}) {
+		t.Errorf("requests sent to %v", provider.models)
+	}
+	// Other stages still start with the cheap model.
+	if got := scheduler.Ladder(StageList); !reflect.DeepEqual(got, []string{"cheap", "strong"}) {
+		t.Errorf("list ladder %v", got)
+	}
+
+	loaded, err := LoadModelScheduler([]string{"cheap", "strong"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Ladder(StageCode); !reflect.DeepEqual(got, []string{"strong"}) {
+		t.Errorf("code ladder after reloading %v", got)
+	}
+}
+
+func TestDistillation(t *testing.T) {
+	dir := t.TempDir()
+	scheduler, err := LoadModelScheduler([]string{"cheap", "strong"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.MinSuccessRate = 0.4
+	examples, err := LoadExamples(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &modelProvider{replies: map[string]string{
+		"cheap":  "Sorry.",
+		"strong": "func TestAdd_One(t *testing.T) { require.Equal(t, 2, Add(1, 1)) }",
+	}}
+	c, err := NewClient(WithProvider(provider), WithParallel(1), WithModelScheduler(scheduler), WithExamples(examples))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := c.GenerateTestCode(ctx, Spec{Name: "TestAdd_One", Description: "1. Add 1 and 1"}, "Add", "package calc", "calc", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cheap model gets the strong model's test as an example.
+	provider.replies["cheap"] = "func TestAdd_Two(t *testing.T) {}"
+	if _, err := c.GenerateTestCode(ctx, Spec{Name: "TestAdd_Two", Description: "1. Add 2 and 2"}, "Add", "package calc", "calc", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(provider.models, []string{"cheap", "strong", "cheap"}) {
+		t.Fatalf("requests sent to %v", provider.models)
+	}
+	last := provider.prompts[2].Messages
+	if content := last[len(last)-1].Content; !strings.Contains(content, "TestAdd_One") || !strings.Contains(content, "require.Equal") {
+		t.Errorf("expected the example in the cheap model's prompt:\n%s", content)
+	}
+	if content := provider.prompts[1].Messages[0].Content; strings.Contains(content, "Here are outputs accepted") {
+		t.Error("expected no examples for the strong model")
+	}
+
+	loaded, err := LoadExamples(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Examples) != 1 || loaded.Examples[0].Stage != StageCode {
+		t.Errorf("unexpected saved examples %+v", loaded.Examples)
+	}
+}
+
+func TestCostTracking(t *testing.T) {
+	provider := &fakeProvider{reply: "func TestAdd(t *testing.T) {}"}
+	c, err := NewClient(WithProvider(provider), WithParallel(1), WithModel("gpt-4"), WithMaxTokens(1000), WithMaxCost(0.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt := c.BasicPrompt()
+	prompt.Stage = StageCode
+	prompt.Messages = []Message{{Role: RoleUser, Content: "Write a test for Add."}}
+	if _, err := c.Complete(context.Background(), prompt); err != nil {
+		t.Fatal(err)
+	}
+	usage := c.Usage()
+	if len(usage) != 1 || usage[0].Stage != StageCode || usage[0].Requests != 1 || usage[0].PromptTokens == 0 || usage[0].CompletionTokens == 0 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	want, _ := RequestCost("gpt-4", usage[0].PromptTokens, usage[0].CompletionTokens)
+	if usage[0].Cost != want || want <= 0 {
+		t.Errorf("cost %f, want %f", usage[0].Cost, want)
+	}
+
+	// A completion of 2000 tokens could cost $0.12, over the budget: the request isn't sent.
+	prompt.MaxTokens = 2000
+	var budgetErr *BudgetExceededError
+	if _, err := c.Complete(context.Background(), prompt); !errors.As(err, &budgetErr) {
+		t.Errorf("expected a BudgetExceededError, got %v", err)
+	}
+	if len(provider.prompts) != 1 {
+		t.Errorf("got %d requests, want 1", len(provider.prompts))
+	}
+
+	var out strings.Builder
+	WriteUsage(&out, c.Usage())
+	if !strings.Contains(out.String(), "code ") || !strings.Contains(out.String(), "total ") {
+		t.Errorf("unexpected usage report:\n%s", out.String())
+	}
+}
+
+func TestClientConcurrentUse(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		inFlight    int
+		maxInFlight int
+		conns       = make(map[string]bool)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		conns[r.RemoteAddr] = true
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"done"}}]}`)
+	}))
+	defer server.Close()
+
+	c, err := NewClient(WithAPIKey("key"), WithAPIBase(server.URL), WithParallel(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.Complete(context.Background(), c.BasicPrompt())
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if maxInFlight != 2 {
+		t.Errorf("%d requests were in flight at the same time, want the 2 of WithParallel", maxInFlight)
+	}
+	if len(conns) > 2 {
+		t.Errorf("the requests used %d connections, want the 2 kept alive to be reused", len(conns))
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(4)
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		if err := l.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(full); err == nil {
+		t.Fatal("expected no free slot")
+	}
+
+	l.throttle()
+	if got := l.current(); got != 2 {
+		t.Fatalf("limit after throttling = %d, want 2", got)
+	}
+	for i := 0; i < 2; i++ {
+		l.release()
+	}
+	// Two requests are still in flight with a limit of two until one more finishes.
+	acquired := make(chan struct{})
+	go func() {
+		if err := l.acquire(ctx); err == nil {
+			close(acquired)
+		}
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a slot over the throttled limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.release()
+	<-acquired
+
+	for i := 0; i < 2; i++ {
+		l.succeeded()
+	}
+	if got := l.current(); got != 3 {
+		t.Errorf("limit after 2 successes = %d, want 3", got)
+	}
+	l.throttle()
+	l.throttle()
+	l.throttle()
+	if got := l.current(); got != 1 {
+		t.Errorf("limit = %d, want at least 1", got)
+	}
+}
+
+func TestSlowTests(t *testing.T) {
+	provider := &fakeProvider{reply: "func TestAdd(t *testing.T) {}"}
+	c, err := NewClient(WithProvider(provider), WithParallel(1), WithTestTimeBudget(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GenerateTestCode(context.Background(), Spec{Name: "TestAdd"}, "Add", "package calc\n", "calc", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(provider.prompts[0].Messages[0].Content, "Every test must complete within 1s.") {
+		t.Errorf("the code prompt misses the time budget:\n%s", provider.prompts[0].Messages[0].Content)
+	}
+
+	src := `package calc
+
+func TestPoll(t *testing.T) {
+	for range time.Tick(time.Millisecond) {
+		time.Sleep(time.Second)
+		time.Sleep(time.Second)
+	}
+}
+
+func TestFast(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	<-ctx.Done()
+}
+`
+	output := `=== RUN   TestPoll
+--- PASS: TestPoll (0.00s)
+=== RUN   TestFast
+--- PASS: TestFast (1.00s)
+=== RUN   TestSlow
+    --- FAIL: TestSlow/case_1 (5.01s)
+--- FAIL: TestSlow (5.01s)
+`
+	want := []SlowTest{
+		{Name: "TestPoll", Reason: "calls time.Tick"},
+		{Name: "TestPoll", Reason: "calls time.Sleep"},
+		{Name: "TestSlow/case_1", Reason: "took 5.01s"},
+		{Name: "TestSlow", Reason: "took 5.01s"},
+	}
+	if got := c.SlowTests(src, output); !reflect.DeepEqual(got, want) {
+		t.Errorf("SlowTests() = %+v, want %+v", got, want)
+	}
+
+	c, err = NewClient(WithProvider(provider))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.SlowTests(src, output); got != nil {
+		t.Errorf("expected no slow tests without a budget, got %+v", got)
+	}
+}
+
+func TestNetGuard(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.20\n",
+		"fetch_test.go": `package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExternal(t *testing.T) {
+	if _, err := http.Get("http://example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	if _, err := http.Get(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+}
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	overlay := map[string]string{netGuardFile: netGuardSource("fetch", "")}
+	output, ok, err := RunTests(context.Background(), dir, "", []string{"TestExternal", "TestLocal"}, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || !strings.Contains(output, "--- FAIL: TestExternal") || !strings.Contains(output, "--- PASS: TestLocal") {
+		t.Fatalf("expected only the external call to fail:\n%s", output)
+	}
+	if blockedNetworkReport(output) == "" {
+		t.Errorf("expected a report of the blocked call:\n%s", output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, netGuardFile)); !os.IsNotExist(err) {
+		t.Errorf("expected the guard not to be written to the package, got %v", err)
+	}
+}
+
+func TestRunLog(t *testing.T) {
+	testCases := []struct {
+		name       string
+		level      LogLevel
+		wantPrompt bool
+	}{
+		{name: "debug logs prompts", level: LevelDebug, wantPrompt: true},
+		{name: "info omits prompts", level: LevelInfo},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			provider := &fakeProvider{reply: "func TestAdd(t *testing.T) {}"}
+			c, err := NewClient(WithProvider(provider), WithParallel(1), WithModel("gpt-4"), WithRunLog(NewRunLog(&buf, tc.level)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.GenerateTestCode(context.Background(), Spec{Name: "TestAdd"}, "Add", "package calc\n", "calc", ""); err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintln(NewRunLog(&buf, tc.level), "cli.go:1: Failed to save the checkpoint")
+
+			var events []LogEvent
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				var e LogEvent
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					t.Fatalf("invalid line %q: %v", line, err)
+				}
+				events = append(events, e)
+			}
+			if len(events) != 3 {
+				t.Fatalf("expected a request, a stage and a log event, got %+v", events)
+			}
+			req, stage, msg := events[0], events[1], events[2]
+			if req.Event != "request" || req.Level != "info" || req.Stage != StageCode || req.Target != "TestAdd" || req.Model != "gpt-4" ||
+				req.PromptTokens == 0 || req.CompletionTokens == 0 {
+				t.Errorf("unexpected request event %+v", req)
+			}
+			if (req.Prompt != "") != tc.wantPrompt || (req.Response != "") != tc.wantPrompt {
+				t.Errorf("prompt logged: %v, want %v", req.Prompt != "", tc.wantPrompt)
+			}
+			if stage.Event != "stage" || stage.Stage != StageCode || stage.Target != "TestAdd" {
+				t.Errorf("unexpected stage event %+v", stage)
+			}
+			if msg.Event != "log" || msg.Level != "warn" || msg.Message != "cli.go:1: Failed to save the checkpoint" {
+				t.Errorf("unexpected log event %+v", msg)
+			}
+		})
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	provider := &fakeProvider{reply: "func TestAdd(t *testing.T) {}"}
+	recorder, err := NewClient(WithProvider(provider), WithParallel(1), WithModel("gpt-4"), WithRecorder(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := Spec{Name: "TestAdd", Description: "Add 1 and 2, expect 3"}
+	code := "package calc\n\nfunc Add(a, b int) int { return a + b }\n"
+	if _, err := recorder.GenerateTestCode(context.Background(), spec, "Add", code, "calc", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := NewClient(WithAPIKey(""), WithModel("gpt-4"), WithReplay(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := replayer.GenerateTestCode(context.Background(), spec, "Add", code, "calc", "")
+	if err != nil || got != provider.reply {
+		t.Errorf("replayed %q, %v, want %q", got, err, provider.reply)
+	}
+	spec.Name = "TestAdd_Twice"
+	if _, err := replayer.GenerateTestCode(context.Background(), spec, "Add", code, "calc", ""); err == nil || !strings.Contains(err.Error(), "no recording") {
+		t.Errorf("expected a missing recording for a changed prompt, got %v", err)
+	}
+	if len(provider.prompts) != 1 {
+		t.Errorf("expected the replay to make no requests, got %d", len(provider.prompts))
+	}
+}
+
+// scriptedProvider replies with the replies in order, repeating the last one.
+type scriptedProvider struct {
+	fakeProvider
+	replies []string
+}
+
+func (p *scriptedProvider) Complete(_ context.Context, prompt Prompt) (string, error) {
+	p.prompts = append(p.prompts, prompt)
+	reply := p.replies[0]
+	if len(p.replies) > 1 {
+		p.replies = p.replies[1:]
+	}
+	return reply, nil
+}
+
+func (p *scriptedProvider) Stream(ctx context.Context, prompt Prompt, onDelta func(string)) (string, error) {
+	out, err := p.Complete(ctx, prompt)
+	onDelta(out)
+	return out, err
+}
+
+func TestDependencyPolicy(t *testing.T) {
+	testify := "```go\nimport (\n\t\"testing\"\n\t\"github.com/stretchr/testify/assert\"\n)\n\nfunc TestAdd(t *testing.T) { assert.Equal(t, 2, Add(1, 1)) }\n```"
+	stdlib := "import (\n\t\"testing\"\n\t\"example.com/calc/internal/num\"\n\t\"github.com/google/go-cmp/cmp\"\n)\n\nfunc TestAdd(t *testing.T) {}\n"
+
+	policy := &DependencyPolicy{ModulePath: "example.com/calc", Allowed: []string{"github.com/google/go-cmp"}}
+	if got, err := policy.Disallowed(testify); err != nil || !reflect.DeepEqual(got, []string{"github.com/stretchr/testify/assert"}) {
+		t.Errorf("Disallowed(testify) = %v, %v, want the testify import", got, err)
+	}
+	if got, err := policy.Disallowed(stdlib); err != nil || len(got) != 0 {
+		t.Errorf("Disallowed(allowed) = %v, %v, want none", got, err)
+	}
+
+	provider := &scriptedProvider{replies: []string{testify, stdlib}}
+	c, err := NewClient(WithProvider(provider), WithAPIKey(""), WithParallel(1), WithDependencyPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := c.GenerateTestCode(context.Background(), Spec{Name: "TestAdd"}, "Add", "package calc\n", "calc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != stdlib {
+		t.Errorf("got code %q, want the regenerated one", code)
+	}
+	if len(provider.prompts) != 2 {
+		t.Fatalf("sent %d prompts, want the test generated again once", len(provider.prompts))
+	}
+	first := provider.prompts[0].Messages[0].Content
+	if strings.Contains(first, "stretchr/testify") || strings.Contains(first, "golang/mock") {
+		t.Errorf("the prompt suggests a disallowed library:\n%s", first)
+	}
+	if !strings.Contains(first, "github.com/google/go-cmp") {
+		t.Errorf("the prompt does not name the allowed libraries:\n%s", first)
+	}
+	retry := provider.prompts[1].Messages
+	if last := retry[len(retry)-1].Content; !strings.Contains(last, "imports github.com/stretchr/testify/assert") {
+		t.Errorf("the retry does not name the disallowed import: %q", last)
+	}
+
+	provider = &scriptedProvider{replies: []string{testify}}
+	c, err = NewClient(WithProvider(provider), WithAPIKey(""), WithParallel(1), WithDependencyPolicy(&DependencyPolicy{ModulePath: "example.com/calc"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GenerateTestCode(context.Background(), Spec{Name: "TestAdd"}, "Add", "package calc\n", "calc", ""); err == nil {
+		t.Error("expected an error once the retries imported testify too")
+	}
+	if len(provider.prompts) != maxDependencyRetries+1 {
+		t.Errorf("sent %d prompts, want %d", len(provider.prompts), maxDependencyRetries+1)
+	}
+}
+
+func TestLongTests(t *testing.T) {
+	long := "```go\nfunc TestAdd(t *testing.T) {\n" + strings.Repeat("\tt.Log()\n", 10) + "}\n\nfunc TestSub(t *testing.T) {}\n```"
+	got, err := LongTests(long, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []LongTest{{Name: "TestAdd", Lines: 12}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LongTests() = %v, want %v", got, want)
+	}
+
+	short := "func TestAdd(t *testing.T) {}\n"
+	provider := &fakeProvider{reply: short}
+	c, err := NewClient(WithProvider(provider), WithAPIKey(""), WithParallel(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := c.SimplifyTestCode(context.Background(), "Add", long, 8, "package calc\n", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != short {
+		t.Errorf("got code %q, want the simplified one", code)
+	}
+	if len(provider.prompts) != 1 || provider.prompts[0].Stage != StageSimplify {
+		t.Fatalf("sent %d prompts, want one simplify prompt", len(provider.prompts))
+	}
+	if user := provider.prompts[0].Messages[1].Content; !strings.Contains(user, "TestAdd (12 lines)") || strings.Contains(user, "TestSub (") {
+		t.Errorf("the prompt does not name only the long test:\n%s", user)
+	}
+
+	if code, err := c.SimplifyTestCode(context.Background(), "Add", short, 8, "package calc\n", ""); err != nil || code != short || len(provider.prompts) != 1 {
+		t.Errorf("short code was sent to the model or changed: %q, %v", code, err)
+	}
+}
+
+func TestTableRows(t *testing.T) {
+	src := []byte(`package calc
+
+import "testing"
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b int
+		want int
+	}{
+		{name: "one", a: 1, b: 0, want: 1},
+		{},
+	}
+	for _, tt := range tests {
+		if got := Add(tt.a, tt.b); got != tt.want {
+			t.Errorf("Add() = %d, want %d", got, tt.want)
+		}
+	}
+}
+`)
+	fset := token.NewFileSet()
+	table, err := FindCaseTable(fset, src, "TestAdd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{`{name: "one", a: 1, b: 0, want: 1}`}; !reflect.DeepEqual(table.Rows, want) {
+		t.Errorf("Rows = %q, want %q", table.Rows, want)
+	}
+
+	provider := &fakeProvider{reply: "```go\n{name: \"negative\", a: -1, b: -2, want: -3},\n{name: \"zero\", want: 0},\n```"}
+	c, err := NewClient(WithProvider(provider), WithAPIKey(""), WithParallel(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := c.GenerateTableRows(context.Background(), table, 2, "TestAdd", "package calc\n", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || provider.prompts[0].Stage != StageRows {
+		t.Fatalf("got rows %q", rows)
+	}
+	if user := provider.prompts[0].Messages[1].Content; !strings.Contains(user, "Add 2 entries") || !strings.Contains(user, "func TestAdd(") {
+		t.Errorf("the prompt misses the test or the count:\n%s", user)
+	}
+
+	out, err := AddTableRows(fset, src, table, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\t\t{name: \"one\", a: 1, b: 0, want: 1},\n\n\t\t" + rowsAnnotation + "\n" +
+		"\t\t{name: \"negative\", a: -1, b: -2, want: -3},\n\t\t{name: \"zero\", want: 0},\n\t}\n"
+	if !strings.Contains(string(out), want) {
+		t.Errorf("got\n%s\nwant it to contain\n%s", out, want)
+	}
+	if strings.Contains(string(out), "{},") {
+		t.Errorf("the empty entry is kept:\n%s", out)
+	}
+
+	if _, err := FindCaseTable(token.NewFileSet(), []byte("package calc\n\nfunc TestSub(t *testing.T) {}\n"), "TestSub"); err == nil {
+		t.Error("expected an error for a test without a table")
+	}
+}
+
+func TestFixFile(t *testing.T) {
+	testCases := []struct {
+		name          string
+		failures      int
+		maxIterations int
+		wantOK        bool
+		wantFixes     int
+	}{
+		{name: "passes", failures: 0, maxIterations: 2, wantOK: true, wantFixes: 0},
+		{name: "fixed", failures: 1, maxIterations: 2, wantOK: true, wantFixes: 1},
+		{name: "gives up", failures: 5, maxIterations: 2, wantOK: false, wantFixes: 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "calc_draft_test.go")
+			header := "//go:build goptest_draft\n\n"
+			if err := WriteToFile(header+"package calc\n\nfunc TestAdd(t *testing.T) {}\n", path); err != nil {
+				t.Fatal(err)
+			}
+			checks, fixes := 0, 0
+			check := func() (string, bool, error) {
+				checks++
+				if checks > tc.failures {
+					return "", true, nil
+				}
+				return fmt.Sprintf("failure %d", checks), false, nil
+			}
+			fix := func(code string, diagnostics string) (string, error) {
+				fixes++
+				if strings.Contains(code, "//go:build") {
+					t.Errorf("fix got the header:\n%s", code)
+				}
+				if want := fmt.Sprintf("failure %d", fixes); diagnostics != want {
+					t.Errorf("fix got diagnostics %q, want %q", diagnostics, want)
+				}
+				return fmt.Sprintf("func TestAdd(t *testing.T) {}\n\nfunc TestFix%d(t *testing.T) {}\n", fixes), nil
+			}
+
+			diagnostics, ok, err := fixFile(path, header, "calc", tc.maxIterations, check, fix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.wantOK || fixes != tc.wantFixes {
+				t.Errorf("fixFile() ok = %v after %d fixes, want %v after %d", ok, fixes, tc.wantOK, tc.wantFixes)
+			}
+			if !ok && diagnostics != fmt.Sprintf("failure %d", tc.maxIterations+1) {
+				t.Errorf("fixFile() diagnostics = %q, want the last ones", diagnostics)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(content), header) {
+				t.Errorf("the header was not kept:\n%s", content)
+			}
+			if tc.wantFixes > 0 && !strings.Contains(string(content), fmt.Sprintf("func TestFix%d(", tc.wantFixes)) {
+				t.Errorf("the file is not the last fix:\n%s", content)
+			}
+		})
+	}
+}
+
+func TestUndefinedContext(t *testing.T) {
+	dir := t.TempDir()
+	src := "package store\n\ntype Store struct{ m map[string]string }\n\n" +
+		"func NewStore() *Store { return &Store{m: map[string]string{}} }\n\n" +
+		"func (s *Store) Get(key string) string { return s.m[key] }\n\nfunc unrelated() {}\n"
+	if err := WriteToFile(src, filepath.Join(dir, "store.go")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "store_draft_test.go")
+	if err := WriteToFile("package store\n\nfunc NewStore() {}\n", path); err != nil {
+		t.Fatal(err)
+	}
+
+	diagnostics := "vet: ./store_draft_test.go:8:7: undefined: NewStore\n" +
+		"./store_draft_test.go:9:4: s.Put undefined (type *Store has no field or method Put)\n" +
+		"./store_draft_test.go:10:2: undefined: newFixture\n" +
+		"./store_draft_test.go:11:2: undefined: strings.Bogus\n"
+	got := undefinedContext(context.Background(), path, diagnostics)
+	for _, want := range []string{
+		"func NewStore() *Store {",
+		"type Store struct{ m map[string]string }",
+		"func (s *Store) Get(key string) string\n",
+		"not declared anywhere in the package, do not use them: newFixture.",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("undefinedContext() misses %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "unrelated") || strings.Contains(got, "Bogus") || strings.Contains(got, "func NewStore() {}") {
+		t.Errorf("undefinedContext() adds more than the undefined identifiers:\n%s", got)
+	}
+	if got := undefinedContext(context.Background(), path, "./store_draft_test.go:8:7: missing return"); got != "" {
+		t.Errorf("undefinedContext() = %q without undefined identifiers", got)
+	}
+}
+
+func TestUndefinedContextDependencies(t *testing.T) {
+	t.Setenv("GOPROXY", "off")
+	t.Setenv("GOFLAGS", "-mod=mod")
+	t.Setenv("GOWORK", "off")
+	root := t.TempDir()
+	files := map[string]string{
+		"go.mod":            "module example.com/app\n\ngo 1.20\n\nrequire example.com/kv v0.1.0\n\nreplace example.com/kv => ./kv\n",
+		"app.go":            "package app\n",
+		"kv/go.mod":         "module example.com/kv\n\ngo 1.20\n",
+		"kv/kv.go":          "package kv\n\n// Open opens a store.\nfunc Open(path string) (*Store, error) { return &Store{}, nil }\n\n// Store is a key-value store.\ntype Store struct{}\n\n// Get returns the value of key.\nfunc (s *Store) Get(key string) string { return \"\" }\n",
+		"app_draft_test.go": "package app\n\nimport (\n\t\"strings\"\n\t\"testing\"\n\n\t\"example.com/kv\"\n)\n\nfunc TestApp(t *testing.T) {}\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteToFile(content, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diagnostics := "./app_draft_test.go:11:2: undefined: kv.New\n" +
+		"./app_draft_test.go:12:2: s.Put undefined (type *kv.Store has no field or method Put)\n" +
+		"./app_draft_test.go:13:2: undefined: strings.Bogus\n"
+	got := undefinedContext(context.Background(), filepath.Join(root, "app_draft_test.go"), diagnostics)
+	for _, want := range []string{"go doc example.com/kv:", "func Open(path string) (*Store, error)", "go doc example.com/kv Store:", "func (s *Store) Get(key string) string"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("undefinedContext() misses %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "strings") {
+		t.Errorf("undefinedContext() looks up the standard library:\n%s", got)
+	}
+}
+
+func TestExternalImports(t *testing.T) {
+	src := `package calc
+
+import (
+	"fmt"
+	"net/http"
+
+	"example.com/m"
+	"example.com/m/internal/testutil"
+	"example.com/mod"
+	"github.com/stretchr/testify/assert"
+)
+`
+	testCases := []struct {
+		name       string
+		modulePath string
+		want       []string
+	}{
+		{name: "module", modulePath: "example.com/m", want: []string{"example.com/mod", "github.com/stretchr/testify/assert"}},
+		{name: "no module", modulePath: "", want: []string{"example.com/m", "example.com/m/internal/testutil", "example.com/mod", "github.com/stretchr/testify/assert"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := externalImports(src, tc.modulePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("externalImports() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindModuleRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "go.mod"), []byte("module \"example.com/m\"\n\ngo 1.20\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "internal", "calc")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	gotRoot, modulePath, err := FindModuleRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantRoot, _ := filepath.Abs(root); gotRoot != wantRoot || modulePath != "example.com/m" {
+		t.Errorf("FindModuleRoot() = %s, %s, want %s, example.com/m", gotRoot, modulePath, wantRoot)
+	}
+}
+
+func TestPromptCorpus(t *testing.T) {
+	dir := t.TempDir()
+	pc, err := OpenPromptCorpus(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"test Add", "test Sub"} {
+		msgs := []Message{{Role: RoleSystem, Content: "system"}, {Role: RoleUser, Content: user}}
+		if err := pc.AddPrompt("package calc", msgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []CorpusStats{
+		{Kind: "code", Sent: 2, Unique: 1, BytesSent: 24, BytesRepeated: 12},
+		{Kind: RoleSystem, Sent: 2, Unique: 1, BytesSent: 12, BytesRepeated: 6},
+		{Kind: RoleUser, Sent: 2, Unique: 2, BytesSent: 16, BytesRepeated: 0},
+	}
+	if got := pc.stats(func(h string, _ *CorpusEntry) int { return pc.run[h] }); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats() = %+v, want %+v", got, want)
+	}
+
+	// The index is saved as the prompts are added, without Save.
+	reopened, err := OpenPromptCorpus(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Add("code", "package calc"); err != nil {
+		t.Fatal(err)
+	}
+	if e := reopened.entries[contentHash("package calc")]; e == nil || e.Count != 3 {
+		t.Errorf("code entry = %+v across runs, want a count of 3", e)
+	}
+	if got := reopened.stats(func(h string, _ *CorpusEntry) int { return reopened.run[h] }); len(got) != 1 || got[0].Sent != 1 {
+		t.Errorf("stats() of the second run = %+v, want the code sent once", got)
+	}
+}
+
+// chatServer is an OpenAI compatible API answering every chat completion with reply and
+// recording the path and model of the requests.
+func chatServer(t *testing.T, reply string) (srv *httptest.Server, requests *[]string) {
+	var mu sync.Mutex
+	requests = new([]string)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode the request: %v", err)
+		}
+		mu.Lock()
+		*requests = append(*requests, r.URL.Path+" "+req.Model)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id": "1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": %q}, "finish_reason": "stop"}]}`, reply)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func TestOpenAICompatibleBase(t *testing.T) {
+	prompt := Prompt{Messages: []Message{{Role: RoleUser, Content: "hi"}}, MaxTokens: 10}
+
+	srv, requests := chatServer(t, "ollama reply")
+	got, err := NewOllamaProvider(srv.URL+"/v1", "llama3", nil).Complete(context.Background(), prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/v1/chat/completions llama3"}; got != "ollama reply" || !reflect.DeepEqual(*requests, want) {
+		t.Errorf("ollama: got %q with requests %v, want %v", got, *requests, want)
+	}
+
+	envSrv, envRequests := chatServer(t, "env reply")
+	flagSrv, flagRequests := chatServer(t, "flag reply")
+	t.Setenv("OPENAI_API_BASE", envSrv.URL+"/v1")
+	testCases := []struct {
+		name     string
+		opts     []Option
+		want     string
+		requests *[]string
+	}{
+		{name: "OPENAI_API_BASE", want: "env reply", requests: envRequests},
+		{name: "-api-base", opts: []Option{WithAPIBase(flagSrv.URL + "/v1")}, want: "flag reply", requests: flagRequests},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]Option{WithAPIKey("key"), WithModel("local-model"), WithParallel(1)}, tc.opts...)
+			c, err := NewClient(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.provider.Complete(context.Background(), prompt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"/v1/chat/completions local-model"}; got != tc.want || !reflect.DeepEqual(*tc.requests, want) {
+				t.Errorf("got %q with requests %v, want %q with %v", got, *tc.requests, tc.want, want)
+			}
+		})
+	}
+}
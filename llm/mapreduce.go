@@ -0,0 +1,67 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+func promptForMergeCases(whatToTest string, partials []string, extraInstructions string) []Message {
+	systemContent := fmt.Sprintf("Acting as a senior developer you should merge test cases written separately for parts of the same code.\n"+
+		"Remove duplicated and overlapping cases, keeping the most precise instructions, and give every case a unique name.\n"+
+		"Using YAML format you should only write one `cases` list with the `name` and `instructions` fields.\n"+
+		"Example schema: \n```yaml\n%s\n```\n", yamlExample)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Merge these test cases for '%s':\n", whatToTest)
+	for i, p := range partials {
+		fmt.Fprintf(&b, "\nPart %d of %d:\n```yaml\n%s\n```\n", i+1, len(partials), strings.TrimSpace(RemoveYAMLLines(p)))
+	}
+	if extraInstructions != "" {
+		b.WriteString("\n" + extraInstructions)
+	}
+	return []Message{
+		{Role: RoleSystem, Content: systemContent},
+		{Role: RoleUser, Content: b.String()},
+	}
+}
+
+// GenerateTestCasesChunked generates test cases for code too large for one prompt: the cases
+// of every chunk, see ChunkCode, are generated separately and then merged, deduplicated
+// and renamed into one list by a reduce prompt.
+func (c *Client) GenerateTestCasesChunked(
+	ctx context.Context,
+	whatToTest string,
+	chunks []string,
+	testList string,
+	extraInstructions string,
+) (string, error) {
+	if len(chunks) == 1 {
+		return c.GenerateTestCases(ctx, whatToTest, chunks[0], testList, extraInstructions)
+	}
+	partials := make([]string, len(chunks))
+	errs := make([]error, len(chunks))
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk string) {
+			defer wg.Done()
+			partials[i], errs[i] = c.GenerateTestCases(ctx, whatToTest, chunk, testList, extraInstructions)
+		}(i, chunk)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return "", fmt.Errorf("part %d of %d: %v", i+1, len(chunks), err)
+		}
+	}
+
+	prompt := c.BasicPrompt()
+	prompt.Messages = c.withOverride(StageMerge, promptForMergeCases(whatToTest, partials, extraInstructions))
+	if err := c.corpus.AddPrompt(strings.Join(partials, "\n"), prompt.Messages); err != nil {
+		return "", err
+	}
+	return c.runStage(StageMerge, whatToTest, func() (string, error) {
+		return c.streamCompletion(ctx, StageMerge, whatToTest, prompt)
+	})
+}
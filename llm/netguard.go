@@ -0,0 +1,77 @@
+package llm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NetworkBlockedMarker starts the errors of the network calls blocked in verification runs.
+const NetworkBlockedMarker = "goptest: blocked network call"
+
+// netGuardFile is added to the package of the verified tests with a go build overlay.
+const netGuardFile = "goptest_netguard_test.go"
+
+// WithNetworkBlocked fails the network calls of the generated tests to anything but loopback
+// addresses in VerifyFile runs, and has the model replace them with fakes or local servers.
+func WithNetworkBlocked(block bool) Option {
+	return func(o *GeneratorOptions) {
+		o.BlockNetwork = block
+	}
+}
+
+// netGuardSource replaces http.DefaultTransport and the DNS resolver of the test binary by
+// ones failing everything but loopback addresses, so httptest servers keep working. Clients
+// with their own transports are still caught by the resolver unless they dial IP addresses.
+func netGuardSource(pkgName string, tags string) string {
+	var b strings.Builder
+	if tags != "" {
+		fmt.Fprintf(&b, "//go:build %s\n\n", tags)
+	}
+	fmt.Fprintf(&b, `package %s
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+type goptestNetGuard struct{ next http.RoundTripper }
+
+func (g goptestNetGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !goptestLoopback(req.URL.Hostname()) {
+		return nil, fmt.Errorf("%s to %%s: use httptest or a fake instead", req.URL.Host)
+	}
+	return g.next.RoundTrip(req)
+}
+
+func goptestLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func init() {
+	http.DefaultTransport = goptestNetGuard{next: http.DefaultTransport}
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			return nil, fmt.Errorf("%s: DNS lookup, use httptest or a fake instead")
+		},
+	}
+}
+`, pkgName, NetworkBlockedMarker, NetworkBlockedMarker)
+	return b.String()
+}
+
+// blockedNetworkReport explains the blocked network calls of the go test output to the model,
+// empty when there are none.
+func blockedNetworkReport(output string) string {
+	if !strings.Contains(output, NetworkBlockedMarker) {
+		return ""
+	}
+	return "Some tests made real network calls, which are blocked: replace them with httptest servers, " +
+		"fakes or mocks of the clients, and never reach external hosts.\n"
+}
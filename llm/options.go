@@ -0,0 +1,166 @@
+package llm
+
+import (
+	"io"
+	"time"
+)
+
+// Stage names a step of the generation pipeline.
+type Stage string
+
+// Pipeline stages.
+const (
+	StageSpec  Stage = "spec"
+	StageList  Stage = "list"
+	StageCases Stage = "cases"
+	StageMocks Stage = "mocks"
+	StageCode  Stage = "code"
+	// StageRepair fixes compile errors of generated tests.
+	StageRepair Stage = "repair"
+	// StageCapture writes the program capturing current behavior for characterization tests.
+	StageCapture Stage = "capture"
+	// StageVerify fixes failing generated tests.
+	StageVerify Stage = "verify"
+	// StageMerge merges the test cases generated for the chunks of large code.
+	StageMerge Stage = "merge"
+	// StageSimplify shortens generated tests over the line limit.
+	StageSimplify Stage = "simplify"
+	// StageRows adds entries to the table of an existing table-driven test.
+	StageRows Stage = "rows"
+	// StageCompare finds the cases candidate case lists expect different behavior of.
+	StageCompare Stage = "compare"
+)
+
+// GeneratorOptions configures a Client. The zero value of every field means "use the default".
+type GeneratorOptions struct {
+	// Model is the chat model to use, gpt-4 by default.
+	Model string
+	// MaxTokens limits the completion size, derived from the model when zero.
+	MaxTokens int
+	// APIKey overrides the OPENAI_API_KEY environment variable.
+	APIKey string
+	// APIBase overrides the OPENAI_API_BASE environment variable, for OpenAI compatible servers.
+	APIBase string
+	// PromptCorpus, when set, records every prompt sent by the client.
+	PromptCorpus *PromptCorpus
+	// Callbacks are notified about stage progress, nothing is printed by default.
+	Callbacks Callbacks
+	// Provider completes the prompts, the OpenAI API when nil.
+	Provider Provider
+	// Parallel limits the number of concurrent API requests, 2 by default.
+	Parallel int
+	// PromptOverrides replace the system instructions of the given stages.
+	PromptOverrides map[Stage]string
+	// RetryPolicy controls the retries of failed requests, DefaultRetryPolicy when nil.
+	RetryPolicy *RetryPolicy
+	// ResponseFormat of the test cases, FormatAuto when empty.
+	ResponseFormat string
+	// SpecRetries is how many times invalid test cases are requested again, 2 when zero and
+	// none when negative.
+	SpecRetries int
+	// HTTPDebugLog receives the metadata of the HTTP exchanges when set.
+	HTTPDebugLog io.Writer
+	// Scheduler picks the model of every request instead of Model when set.
+	Scheduler *ModelScheduler
+	// Examples, when set with a Scheduler, distills strong model outputs for cheap models.
+	Examples *ExampleStore
+	// MaxCost is the estimated spend in USD requests are not sent beyond, no limit when zero.
+	MaxCost float64
+	// RequestTimeout bounds every attempt of a request, streams included, no limit when zero.
+	RequestTimeout time.Duration
+	// TestTimeBudget is the time every generated test must complete in, not enforced when zero.
+	TestTimeBudget time.Duration
+	// BlockNetwork fails the non-loopback network calls of the tests run by VerifyFile.
+	BlockNetwork bool
+	// RunLog records the requests and stages of the client when set.
+	RunLog *RunLog
+	// RecordDir receives a fixture of every completed prompt when set.
+	RecordDir string
+	// ReplayDir serves the recorded responses instead of Provider when set.
+	ReplayDir string
+	// Artifacts receives every attempt of the prompts when set.
+	Artifacts *ArtifactStore
+	// StreamCode streams the test code of every spec to Callbacks.OnDelta.
+	StreamCode bool
+	// DependencyPolicy restricts the imports of the generated tests and mocks when set.
+	DependencyPolicy *DependencyPolicy
+}
+
+// Option modifies GeneratorOptions.
+type Option func(*GeneratorOptions)
+
+// WithModel sets the chat model.
+func WithModel(model string) Option {
+	return func(o *GeneratorOptions) {
+		o.Model = model
+	}
+}
+
+// WithMaxTokens sets the maximum number of completion tokens.
+func WithMaxTokens(maxTokens int) Option {
+	return func(o *GeneratorOptions) {
+		o.MaxTokens = maxTokens
+	}
+}
+
+// WithAPIKey sets the API key instead of reading OPENAI_API_KEY.
+func WithAPIKey(key string) Option {
+	return func(o *GeneratorOptions) {
+		o.APIKey = key
+	}
+}
+
+// WithParallel limits the number of concurrent API requests made by the client.
+func WithParallel(n int) Option {
+	return func(o *GeneratorOptions) {
+		o.Parallel = n
+	}
+}
+
+// WithAPIBase sends requests to an OpenAI compatible API at the given base URL.
+func WithAPIBase(url string) Option {
+	return func(o *GeneratorOptions) {
+		o.APIBase = url
+	}
+}
+
+// WithPromptOverrides replaces the system instructions of the given stages. The code and
+// everything else the stage sends are kept.
+func WithPromptOverrides(overrides map[Stage]string) Option {
+	return func(o *GeneratorOptions) {
+		o.PromptOverrides = overrides
+	}
+}
+
+// WithSpecRetries sets how many times the test cases are requested again, with the problems
+// found by spec.Validate, when they are invalid: empty or repeated names, names that are not
+// Go identifiers or instructions left as placeholders. Negative values disable the retries.
+func WithSpecRetries(n int) Option {
+	return func(o *GeneratorOptions) {
+		o.SpecRetries = n
+	}
+}
+
+// WithCodeStreaming streams the test code of every spec to the OnDelta callback, which is
+// called concurrently for the specs generated in parallel.
+func WithCodeStreaming() Option {
+	return func(o *GeneratorOptions) {
+		o.StreamCode = true
+	}
+}
+
+// WithPromptCorpus records every prompt in the given corpus.
+func WithPromptCorpus(pc *PromptCorpus) Option {
+	return func(o *GeneratorOptions) {
+		o.PromptCorpus = pc
+	}
+}
+
+// StageResult is the outcome of a single pipeline stage.
+type StageResult struct {
+	Stage    Stage
+	Target   string
+	Output   string
+	Duration time.Duration
+	Err      error
+}
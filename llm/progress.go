@@ -0,0 +1,136 @@
+package llm
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Progress event kinds.
+const (
+	// ProgressStageStart is sent when a stage sends its request.
+	ProgressStageStart = "stage_start"
+	// ProgressStageEnd is sent when a stage finished, with its error when it failed.
+	ProgressStageEnd = "stage_end"
+	// ProgressRetry is sent before a failed request is retried.
+	ProgressRetry = "retry"
+	// ProgressSpec is sent when the status of the test of a spec changes.
+	ProgressSpec = "spec"
+	// ProgressDone is sent when the command wrote its output.
+	ProgressDone = "done"
+)
+
+// Statuses of the ProgressSpec events.
+const (
+	SpecGenerating = "generating"
+	SpecGenerated  = "generated"
+	// SpecCached is a test restored from the checkpoint of an earlier run.
+	SpecCached   = "cached"
+	SpecFailed   = "failed"
+	SpecSkipped  = "skipped"
+	SpecRejected = "rejected"
+)
+
+// ProgressEvent is a JSON line of -progress-fd, for GUIs and CI wrappers to render the
+// progress of a run without parsing the human readable output.
+type ProgressEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	Stage Stage     `json:"stage,omitempty"`
+	// Target is what the stage or spec is for, e.g. the -what of the run.
+	Target string `json:"target,omitempty"`
+	// Spec, Index and Total identify the spec of ProgressSpec events, Index starting at 1.
+	Spec   string `json:"spec,omitempty"`
+	Index  int    `json:"index,omitempty"`
+	Total  int    `json:"total,omitempty"`
+	Status string `json:"status,omitempty"`
+	// DurationMS is the duration of the stage of ProgressStageEnd events.
+	DurationMS int64 `json:"duration_ms,omitempty"`
+	// Attempt, StatusCode and WaitMS describe the failed request of ProgressRetry events.
+	Attempt    int   `json:"attempt,omitempty"`
+	StatusCode int   `json:"status_code,omitempty"`
+	WaitMS     int64 `json:"wait_ms,omitempty"`
+	// Output is the file written, for ProgressDone events.
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ProgressWriter writes progress events as JSON lines. A nil ProgressWriter drops them.
+//
+// A ProgressWriter is safe for concurrent use.
+type ProgressWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewProgressWriter returns a ProgressWriter writing to w.
+func NewProgressWriter(w io.Writer) *ProgressWriter {
+	return &ProgressWriter{enc: json.NewEncoder(w)}
+}
+
+// Emit writes the event, stamped with the current time.
+func (p *ProgressWriter) Emit(event ProgressEvent) {
+	if p == nil {
+		return
+	}
+	event.Time = time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// A reader that went away does not fail the run.
+	_ = p.enc.Encode(event)
+}
+
+// SpecStatus sends the status of the test of the spec, the index-th of total.
+func (p *ProgressWriter) SpecStatus(index int, total int, target string, spec Spec, status string, err error) {
+	event := ProgressEvent{Event: ProgressSpec, Target: target, Spec: spec.Name, Index: index + 1, Total: total, Status: status}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	p.Emit(event)
+}
+
+// progressCallbacks sends the stage and retry events of a client to a ProgressWriter and
+// passes them on.
+type progressCallbacks struct {
+	Callbacks
+	p *ProgressWriter
+}
+
+// WithProgress sends the stage and retry events of the client to p as well as to its
+// callbacks, whichever option set them. Pass it after WithCallbacks.
+func WithProgress(p *ProgressWriter) Option {
+	return func(o *GeneratorOptions) {
+		if p == nil {
+			return
+		}
+		cb := o.Callbacks
+		if cb == nil {
+			cb = NopCallbacks{}
+		}
+		o.Callbacks = &progressCallbacks{Callbacks: cb, p: p}
+	}
+}
+
+func (cb *progressCallbacks) OnStageStart(stage Stage, target string) {
+	cb.p.Emit(ProgressEvent{Event: ProgressStageStart, Stage: stage, Target: target})
+	cb.Callbacks.OnStageStart(stage, target)
+}
+
+func (cb *progressCallbacks) OnStageEnd(result StageResult) {
+	event := ProgressEvent{Event: ProgressStageEnd, Stage: result.Stage, Target: result.Target, DurationMS: result.Duration.Milliseconds(), Status: "ok"}
+	if result.Err != nil {
+		event.Status, event.Error = "failed", result.Err.Error()
+	}
+	cb.p.Emit(event)
+	cb.Callbacks.OnStageEnd(result)
+}
+
+func (cb *progressCallbacks) OnRetry(event RetryEvent) {
+	e := ProgressEvent{Event: ProgressRetry, Attempt: event.Attempt, StatusCode: event.StatusCode, WaitMS: event.Wait.Milliseconds()}
+	if event.Err != nil {
+		e.Error = event.Err.Error()
+	}
+	cb.p.Emit(e)
+	onRetry(cb.Callbacks, event)
+}
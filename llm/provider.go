@@ -0,0 +1,210 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Message roles.
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Message is a single chat message of a prompt.
+type Message struct {
+	Role    string
+	Content string
+}
+
+// Prompt is a provider independent chat completion request.
+type Prompt struct {
+	Messages    []Message
+	MaxTokens   int
+	Temperature float32
+	TopP        float32
+	// JSON asks for a JSON object response. Providers without JSON mode should fail the
+	// request with a ProviderError mentioning response_format.
+	JSON bool
+	// Schema asks for a JSON object matching the schema, through the provider's function
+	// calling API. Providers without it should fail the request with a ProviderError
+	// mentioning tools.
+	Schema *Schema
+	// Model overrides the provider's model for this prompt when set.
+	Model string
+	// Stage is the pipeline stage the prompt belongs to, used to schedule its model.
+	Stage Stage
+	// Target is what the prompt is for, e.g. the spec name, recorded in the run log.
+	Target string
+	// ExampleInput is the request condensed for few-shot examples, see ExampleStore.
+	ExampleInput string
+}
+
+// Schema is the JSON schema of a structured response, sent as the parameters of the function
+// the model has to call. The response is the function's arguments.
+type Schema struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+}
+
+// Provider is an LLM backend able to complete chat prompts.
+type Provider interface {
+	// Complete returns the whole completion of the prompt.
+	Complete(ctx context.Context, p Prompt) (string, error)
+	// Stream completes the prompt, calling onDelta for every received chunk, and
+	// returns the whole completion.
+	Stream(ctx context.Context, p Prompt, onDelta func(delta string)) (string, error)
+}
+
+// ProviderError is returned by providers for failed HTTP requests, so the client can
+// decide whether to retry them.
+type ProviderError struct {
+	StatusCode int
+	// RetryAfter is the wait the server asked for with a Retry-After header, 0 when unknown.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("provider request failed with status %d: %v", e.StatusCode, e.Err)
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// WithProvider uses the given provider instead of the OpenAI API.
+func WithProvider(p Provider) Option {
+	return func(o *GeneratorOptions) {
+		o.Provider = p
+	}
+}
+
+// OpenAIProvider completes prompts with the OpenAI chat completion API.
+type OpenAIProvider struct {
+	client *openai.Client
+	model  string
+}
+
+// NewOpenAIProvider returns a provider using the given OpenAI client and model.
+func NewOpenAIProvider(client *openai.Client, model string) *OpenAIProvider {
+	return &OpenAIProvider{client: client, model: model}
+}
+
+// DefaultOllamaBase is the OpenAI compatible endpoint of a local Ollama server.
+const DefaultOllamaBase = "http://localhost:11434/v1"
+
+// NewOllamaProvider returns a provider for local models served by Ollama through its
+// OpenAI compatible API. No API key is needed; baseURL defaults to DefaultOllamaBase and a nil
+// httpClient to the default client of the OpenAI API.
+func NewOllamaProvider(baseURL string, model string, httpClient *http.Client) *OpenAIProvider {
+	if baseURL == "" {
+		baseURL = DefaultOllamaBase
+	}
+	config := openai.DefaultConfig("ollama")
+	config.BaseURL = baseURL
+	if httpClient != nil {
+		config.HTTPClient = httpClient
+	}
+	return NewOpenAIProvider(openai.NewClientWithConfig(config), model)
+}
+
+func (p *OpenAIProvider) request(prompt Prompt) openai.ChatCompletionRequest {
+	req := openai.ChatCompletionRequest{
+		Model:       p.model,
+		MaxTokens:   prompt.MaxTokens,
+		Temperature: prompt.Temperature,
+		TopP:        prompt.TopP,
+	}
+	if prompt.Model != "" {
+		req.Model = prompt.Model
+	}
+	if prompt.JSON {
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	}
+	if prompt.Schema != nil {
+		req.Tools = []openai.Tool{{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        prompt.Schema.Name,
+				Description: prompt.Schema.Description,
+				Parameters:  prompt.Schema.Parameters,
+			},
+		}}
+		req.ToolChoice = openai.ToolChoice{Type: openai.ToolTypeFunction, Function: openai.ToolFunction{Name: prompt.Schema.Name}}
+	}
+	for _, m := range prompt.Messages {
+		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+			Role:    m.Role,
+			Content: m.Content,
+		})
+	}
+	return req
+}
+
+func openAIError(err error, retryAfter time.Duration) error {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return &ProviderError{StatusCode: apiErr.HTTPStatusCode, RetryAfter: retryAfter, Err: err}
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return &ProviderError{StatusCode: reqErr.HTTPStatusCode, RetryAfter: retryAfter, Err: err}
+	}
+	return err
+}
+
+func (p *OpenAIProvider) Complete(ctx context.Context, prompt Prompt) (string, error) {
+	var retryAfter time.Duration
+	resp, err := p.client.CreateChatCompletion(withRetryAfter(ctx, &retryAfter), p.request(prompt))
+	if err != nil {
+		return "", openAIError(err, retryAfter)
+	}
+	if len(resp.Choices) == 0 {
+		return "", errors.New("no choices in completion response")
+	}
+	if calls := resp.Choices[0].Message.ToolCalls; len(calls) > 0 {
+		return calls[0].Function.Arguments, nil
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+func (p *OpenAIProvider) Stream(ctx context.Context, prompt Prompt, onDelta func(delta string)) (string, error) {
+	var retryAfter time.Duration
+	stream, err := p.client.CreateChatCompletionStream(withRetryAfter(ctx, &retryAfter), p.request(prompt))
+	if err != nil {
+		return "", openAIError(err, retryAfter)
+	}
+	var result string
+	defer stream.Close()
+	for {
+		response, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+
+		if err != nil {
+			return "", openAIError(err, 0)
+		}
+
+		if len(response.Choices) == 0 {
+			continue
+		}
+		delta := response.Choices[0].Delta.Content
+		// The arguments of a function call arrive in pieces, like the content.
+		for _, call := range response.Choices[0].Delta.ToolCalls {
+			delta += call.Function.Arguments
+		}
+		onDelta(delta)
+		result += delta
+	}
+}
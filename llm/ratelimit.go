@@ -0,0 +1,103 @@
+package llm
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimit is the rate limit state reported by the x-ratelimit headers of a response.
+// Remaining counts are -1 when the header is missing.
+type RateLimit struct {
+	RemainingRequests int
+	RemainingTokens   int
+	// ResetRequests and ResetTokens are the time until the limits are replenished.
+	ResetRequests time.Duration
+	ResetTokens   time.Duration
+}
+
+// parseRateLimit reads the rate limit headers of a response, false when there are none.
+func parseRateLimit(h http.Header) (RateLimit, bool) {
+	rl := RateLimit{
+		RemainingRequests: parseRemaining(h.Get("X-Ratelimit-Remaining-Requests")),
+		RemainingTokens:   parseRemaining(h.Get("X-Ratelimit-Remaining-Tokens")),
+		ResetRequests:     parseReset(h.Get("X-Ratelimit-Reset-Requests")),
+		ResetTokens:       parseReset(h.Get("X-Ratelimit-Reset-Tokens")),
+	}
+	return rl, rl.RemainingRequests >= 0 || rl.RemainingTokens >= 0
+}
+
+func parseRemaining(value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// parseReset parses a reset header given as a duration like "6m0s" or "20ms" or in seconds.
+func parseReset(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return 0
+}
+
+// rateLimitKey is the context key of the func the transport reports the rate limit
+// headers of responses to.
+type rateLimitKey struct{}
+
+// withRateLimitObserver returns a context in which the requests' rate limits are reported
+// to observe.
+func withRateLimitObserver(ctx context.Context, observe func(RateLimit)) context.Context {
+	return context.WithValue(ctx, rateLimitKey{}, observe)
+}
+
+// rateLimitTransport reports the rate limit headers of responses for the requests whose
+// context asks for them.
+type rateLimitTransport struct {
+	http.RoundTripper
+}
+
+func (t rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if observe, ok := req.Context().Value(rateLimitKey{}).(func(RateLimit)); ok {
+		if rl, ok := parseRateLimit(resp.Header); ok {
+			observe(rl)
+		}
+	}
+	return resp, nil
+}
+
+// observeRateLimit pauses new requests until the limits are reset when the remaining
+// requests would not cover the requests in flight or the remaining tokens one completion,
+// instead of running into rate limiting errors.
+func (c *Client) observeRateLimit(rl RateLimit) {
+	var wait time.Duration
+	if rl.RemainingRequests >= 0 && rl.RemainingRequests < c.slots.current() {
+		wait = rl.ResetRequests
+	}
+	if rl.RemainingTokens >= 0 && rl.RemainingTokens < int(c.maxTokens) && rl.ResetTokens > wait {
+		wait = rl.ResetTokens
+	}
+	if wait <= 0 {
+		return
+	}
+	if c.retry.MaxBackoff > 0 && wait > c.retry.MaxBackoff {
+		wait = c.retry.MaxBackoff
+	}
+	log.Printf("Close to the rate limit (remaining requests=%d tokens=%d), pausing new requests for %s",
+		rl.RemainingRequests, rl.RemainingTokens, wait)
+	c.slots.pause(time.Now().Add(wait))
+}
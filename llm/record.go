@@ -0,0 +1,126 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Recording is a prompt completed by the model, stored as a fixture file.
+type Recording struct {
+	Model    string    `json:"model"`
+	JSON     bool      `json:"json,omitempty"`
+	Schema   string    `json:"schema,omitempty"`
+	Messages []Message `json:"messages"`
+	Response string    `json:"response"`
+}
+
+// WithRecorder saves every completed prompt and its response as a fixture in dir, to be served
+// back by WithReplay.
+func WithRecorder(dir string) Option {
+	return func(o *GeneratorOptions) {
+		o.RecordDir = dir
+	}
+}
+
+// WithReplay completes the prompts with the responses recorded in dir instead of calling the
+// model, unless a provider is given. Prompts without a recording fail.
+func WithReplay(dir string) Option {
+	return func(o *GeneratorOptions) {
+		o.ReplayDir = dir
+	}
+}
+
+// recordingPath returns the fixture file of the prompt sent to model. Prompts are keyed by
+// everything the model sees, so a changed prompt misses its old recording.
+func recordingPath(dir string, model string, p Prompt) string {
+	if p.Model != "" {
+		model = p.Model
+	}
+	key, _ := json.Marshal(Recording{Model: model, JSON: p.JSON, Schema: schemaName(p), Messages: p.Messages})
+	sum := sha256.Sum256(key)
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// schemaName returns the name of the prompt's schema, empty without one.
+func schemaName(p Prompt) string {
+	if p.Schema == nil {
+		return ""
+	}
+	return p.Schema.Name
+}
+
+// recordingProvider saves the responses of its provider.
+type recordingProvider struct {
+	Provider
+	dir   string
+	model string
+}
+
+func (p *recordingProvider) Complete(ctx context.Context, prompt Prompt) (string, error) {
+	resp, err := p.Provider.Complete(ctx, prompt)
+	if err == nil {
+		err = p.save(prompt, resp)
+	}
+	return resp, err
+}
+
+func (p *recordingProvider) Stream(ctx context.Context, prompt Prompt, onDelta func(delta string)) (string, error) {
+	resp, err := p.Provider.Stream(ctx, prompt, onDelta)
+	if err == nil {
+		err = p.save(prompt, resp)
+	}
+	return resp, err
+}
+
+func (p *recordingProvider) save(prompt Prompt, resp string) error {
+	model := p.model
+	if prompt.Model != "" {
+		model = prompt.Model
+	}
+	content, err := json.MarshalIndent(Recording{Model: model, JSON: prompt.JSON, Schema: schemaName(prompt), Messages: prompt.Messages, Response: resp}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(p.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to save the recording: %v", err)
+	}
+	if err := WriteToFile(string(content), recordingPath(p.dir, p.model, prompt)); err != nil {
+		return fmt.Errorf("failed to save the recording: %v", err)
+	}
+	return nil
+}
+
+// replayProvider serves the recorded responses without network access.
+type replayProvider struct {
+	dir   string
+	model string
+}
+
+func (p *replayProvider) Complete(_ context.Context, prompt Prompt) (string, error) {
+	path := recordingPath(p.dir, p.model, prompt)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("no recording of the %s prompt in %s, record it again", prompt.Stage, p.dir)
+	}
+	if err != nil {
+		return "", err
+	}
+	var r Recording
+	if err := json.Unmarshal(content, &r); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return r.Response, nil
+}
+
+func (p *replayProvider) Stream(ctx context.Context, prompt Prompt, onDelta func(delta string)) (string, error) {
+	resp, err := p.Complete(ctx, prompt)
+	if err == nil {
+		onDelta(resp)
+	}
+	return resp, err
+}
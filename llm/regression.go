@@ -0,0 +1,85 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sentiens/goptest/spec"
+)
+
+// fixDiff returns the uncommitted changes of the given files, which usually are the fix
+// of the bug. Outside of a git repository it returns an empty diff.
+func fixDiff(ctx context.Context, files []string) string {
+	if len(files) == 0 {
+		return ""
+	}
+	args := []string{"diff", "HEAD", "--"}
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return ""
+		}
+		args = append(args, abs)
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = filepath.Dir(files[0])
+	out, err := cmd.Output()
+	if err != nil {
+		log.Println("Failed to read the fix diff:", err)
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// RegressionSpec describes a regression test reproducing the bug, to pass only with the fix.
+func RegressionSpec(whatToTest string, bug string, diff string) Spec {
+	name := "Bug"
+	if whatToTest != "" {
+		name = spec.Identifier(whatToTest)
+	}
+	description := fmt.Sprintf(
+		"The code was fixed for this bug report:\n\"\"\"\n%s\n\"\"\"\n", strings.TrimSpace(bug))
+	if diff != "" {
+		description += "The fix changed:\n```diff\n" + diff + "\n```\n"
+	}
+	description += "1. Reproduce the exact scenario of the bug report: the same inputs, state and call sequence\n" +
+		"2. Expect the correct behavior, so the test fails on the code before the fix and passes after it\n" +
+		"3. Keep the test focused on this bug only and reference it in the test comment"
+	return Spec{
+		Name:        "Test" + name + "_Regression",
+		Description: description,
+	}
+}
+
+// GenerateRegressionTest generates a focused test reproducing the bug described in the bug file
+// against the fixed code.
+func (c *Client) GenerateRegressionTest(
+	ctx context.Context,
+	bugFile string,
+	codeFiles []string,
+	whatToTest string,
+	allCode string,
+	pkg string,
+	extraInstructions string,
+) (Spec, string, error) {
+	bug, err := os.ReadFile(bugFile)
+	if err != nil {
+		return Spec{}, "", err
+	}
+	if strings.TrimSpace(string(bug)) == "" {
+		return Spec{}, "", fmt.Errorf("bug file %s is empty", bugFile)
+	}
+	spec := RegressionSpec(whatToTest, string(bug), fixDiff(ctx, codeFiles))
+	log.Println("Regression test spec:", spec.Description)
+	target := whatToTest
+	if target == "" {
+		target = "the fixed code"
+	}
+	code, err := c.GenerateTestCode(ctx, spec, target, allCode, pkg, extraInstructions)
+	return spec, code, err
+}
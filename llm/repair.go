@@ -0,0 +1,144 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sentiens/goptest/aggregator"
+)
+
+// CompileCheck runs go vet, which type checks the test files too, on the package in dir.
+// It returns the compiler diagnostics when the package does not build.
+func CompileCheck(ctx context.Context, dir string, tags string) (diagnostics string, ok bool, err error) {
+	args := []string{"vet"}
+	if tags != "" {
+		args = append(args, "-tags", tags)
+	}
+	args = append(args, ".")
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return string(out), false, nil
+		}
+		return "", false, fmt.Errorf("failed to run go vet: %v", err)
+	}
+	return string(out), true, nil
+}
+
+func repairPrompt(code string, diagnostics string, allCode string, extraInstructions string) []Message {
+	systemContent := "Acting as a senior Go developer you should fix the test file so that it compiles and passes go vet. " +
+		"Change only what the errors require, keep every test and comment, do not modify the code under test. " +
+		"Return the complete corrected test file."
+	userContent := fmt.Sprintf(
+		"The code under test is: \n```go\n%s```\n"+
+			"The test file is: \n```go\n%s```\n"+
+			"go vet reports: \n```\n%s```\n",
+		allCode,
+		code,
+		diagnostics,
+	)
+	if extraInstructions != "" {
+		userContent += "\n" + extraInstructions
+	}
+	return []Message{
+		{Role: RoleSystem, Content: systemContent},
+		{Role: RoleUser, Content: userContent},
+	}
+}
+
+// RepairTestCode asks the model to fix the compile errors of a test file.
+func (c *Client) RepairTestCode(
+	ctx context.Context,
+	target string,
+	code string,
+	diagnostics string,
+	allCode string,
+	extraInstructions string,
+) (string, error) {
+	if c.depPolicy != nil {
+		extraInstructions = strings.TrimSpace(extraInstructions + "\n" + c.depPolicy.instructions())
+	}
+	prompt := c.BasicPrompt()
+	prompt.Temperature = 0
+	prompt.TopP = 1
+	prompt.Messages = c.withOverride(StageRepair, repairPrompt(code, diagnostics, allCode, extraInstructions))
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return "", err
+	}
+
+	prompt.Stage = StageRepair
+	prompt.Target = target
+	return c.runStage(StageRepair, target, func() (string, error) {
+		return c.Complete(ctx, prompt)
+	})
+}
+
+// RepairFile compile-checks the generated test file at path and lets the model repair it
+// until it compiles or maxIterations repairs were tried. header is kept on top of every
+// repaired version (e.g. the draft build tag). The declarations of the identifiers the
+// compiler reports as undefined, from the package or the module cache, are added to the
+// repair prompt. It returns the last
+// diagnostics when the file still does not compile.
+func (c *Client) RepairFile(
+	ctx context.Context,
+	path string,
+	header string,
+	tags string,
+	pkgName string,
+	allCode string,
+	extraInstructions string,
+	maxIterations int,
+) (diagnostics string, ok bool, err error) {
+	check := func() (string, bool, error) {
+		return CompileCheck(ctx, filepath.Dir(path), tags)
+	}
+	fix := func(code string, diagnostics string) (string, error) {
+		extra := extraInstructions
+		if undefined := undefinedContext(ctx, path, diagnostics); undefined != "" {
+			extra = strings.TrimSpace(extra + "\n" + undefined)
+		}
+		return c.RepairTestCode(ctx, filepath.Base(path), code, diagnostics, allCode, extra)
+	}
+	return fixFile(path, header, pkgName, maxIterations, check, fix)
+}
+
+// fixFile runs check on the file at path and rewrites it with the output of fix until the
+// check passes or maxIterations fixes were tried.
+func fixFile(
+	path string,
+	header string,
+	pkgName string,
+	maxIterations int,
+	check func() (string, bool, error),
+	fix func(code string, diagnostics string) (string, error),
+) (diagnostics string, ok bool, err error) {
+	for i := 0; ; i++ {
+		diagnostics, ok, err = check()
+		if err != nil || ok || i >= maxIterations {
+			return diagnostics, ok, err
+		}
+		log.Printf("Fix iteration %d of %s: %s", i+1, path, diagnostics)
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, err
+		}
+		code := strings.TrimPrefix(string(content), header)
+		fixed, err := fix(code, diagnostics)
+		if err != nil {
+			return "", false, err
+		}
+		if err := WriteGoFile(header+aggregator.Aggregate(pkgName, []string{fixed}, false), path); err != nil {
+			return "", false, err
+		}
+	}
+}
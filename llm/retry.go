@@ -0,0 +1,199 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how requests failing with rate limits or server errors are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one, 1 disables retries.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubled for every further one.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts, including waits asked for by Retry-After.
+	MaxBackoff time.Duration
+	// Jitter is the fraction of every wait that is randomized, between 0 and 1.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is used when no policy is configured.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     time.Minute,
+	Jitter:         0.5,
+}
+
+// WithRetryPolicy sets how failed requests are retried.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(o *GeneratorOptions) {
+		o.RetryPolicy = &p
+	}
+}
+
+// WithRequestTimeout bounds every attempt of a request. Timed out attempts are retried
+// like server errors.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(o *GeneratorOptions) {
+		o.RequestTimeout = d
+	}
+}
+
+// retryable reports whether the request may succeed when it is sent again and returns the
+// event describing the retry, without the wait.
+func retryable(err error) (RetryEvent, bool) {
+	event := RetryEvent{Err: err}
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		event.StatusCode = providerErr.StatusCode
+		event.Wait = providerErr.RetryAfter
+	}
+	var timeout *RequestTimeoutError
+	if errors.As(err, &timeout) {
+		return event, true
+	}
+	var interrupted *StreamInterruptedError
+	if errors.As(err, &interrupted) {
+		// Streams break midway on dropped connections as well, whatever the cause.
+		event.Restart = true
+		return event, true
+	}
+	if event.StatusCode == http.StatusTooManyRequests || event.StatusCode >= 500 {
+		return event, true
+	}
+	return event, false
+}
+
+// backoff returns the wait before the retry following the failed attempt, starting at 1.
+// A Retry-After asked for by the server replaces the exponential backoff.
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	wait := retryAfter
+	if wait <= 0 {
+		wait = p.InitialBackoff
+		for i := 1; i < attempt && (p.MaxBackoff <= 0 || wait < p.MaxBackoff); i++ {
+			wait *= 2
+		}
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if p.Jitter > 0 && retryAfter <= 0 {
+		// Spread the retries of parallel requests: wait between (1-Jitter)*wait and wait.
+		wait -= time.Duration(rand.Float64() * p.Jitter * float64(wait))
+	}
+	return wait
+}
+
+// withRetries calls send in a request slot until it succeeds, fails with an error that is
+// not retryable or the policy's attempts are used up. Rate limited requests lower the number
+// of slots, the slot is given up while waiting for the retry. send is given a context in
+// which the rate limit headers of the responses pause the slots before the limits are hit.
+func (c *Client) withRetries(ctx context.Context, send func(ctx context.Context) (string, error)) (string, error) {
+	sendCtx := withRateLimitObserver(ctx, c.observeRateLimit)
+	for attempt := 1; ; attempt++ {
+		if err := c.slots.acquire(ctx); err != nil {
+			return "", err
+		}
+		resp, err := c.sendAttempt(sendCtx, send)
+		c.slots.release()
+		if err == nil {
+			c.slots.succeeded()
+			return resp, nil
+		}
+		event, ok := retryable(err)
+		if event.StatusCode == http.StatusTooManyRequests {
+			c.slots.throttle()
+			log.Printf("Rate limited, lowering the concurrent requests to %d", c.slots.current())
+		}
+		if !ok || attempt >= c.retry.MaxAttempts {
+			return resp, err
+		}
+		event.Attempt = attempt
+		event.Wait = c.retry.backoff(attempt, event.Wait)
+		log.Printf("Retrying request: status=%d attempt=%d wait=%s restart=%t err=%v",
+			event.StatusCode, event.Attempt, event.Wait, event.Restart, event.Err)
+		onRetry(c.callbacks, event)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(event.Wait):
+		}
+	}
+}
+
+// sendAttempt calls send with the request timeout. Attempts timing out while the caller's
+// context is still alive fail with a RequestTimeoutError.
+func (c *Client) sendAttempt(ctx context.Context, send func(ctx context.Context) (string, error)) (string, error) {
+	if c.requestTimeout <= 0 {
+		return send(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+	defer cancel()
+	resp, err := send(attemptCtx)
+	if err != nil && ctx.Err() == nil && attemptCtx.Err() != nil {
+		return resp, &RequestTimeoutError{Timeout: c.requestTimeout, Err: err}
+	}
+	return resp, err
+}
+
+// RequestTimeoutError is returned for request attempts exceeding the request timeout.
+type RequestTimeoutError struct {
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *RequestTimeoutError) Error() string {
+	return fmt.Sprintf("request timed out after %s: %v", e.Timeout, e.Err)
+}
+
+func (e *RequestTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// retryAfterKey is the context key of the *time.Duration the transport stores the
+// Retry-After of a response in.
+type retryAfterKey struct{}
+
+// withRetryAfter returns a context in which the requests' Retry-After is recorded into d.
+func withRetryAfter(ctx context.Context, d *time.Duration) context.Context {
+	return context.WithValue(ctx, retryAfterKey{}, d)
+}
+
+// retryAfterTransport records the Retry-After header of responses for the requests whose
+// context asks for it, the OpenAI client does not expose response headers of failures.
+type retryAfterTransport struct {
+	http.RoundTripper
+}
+
+func (t retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if d, ok := req.Context().Value(retryAfterKey{}).(*time.Duration); ok {
+		*d = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	return resp, nil
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date, 0 when
+// it is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
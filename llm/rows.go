@@ -0,0 +1,182 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strings"
+
+	"github.com/sentiens/goptest/aggregator"
+)
+
+// rowsAnnotation marks the table entries added by the rows command.
+const rowsAnnotation = "// REVIEW(goptest): generated cases, check their inputs and expected values."
+
+// CaseTable is the table of a table-driven test: the composite literal of a slice or map of
+// cases, e.g. tests := []struct{ name string; in, want int }{...}.
+type CaseTable struct {
+	// Test is the source of the test function.
+	Test string
+	// Type is the source of the table's type.
+	Type string
+	// Rows are the sources of the filled in entries, the ones without fields are left out.
+	Rows []string
+
+	lit   *ast.CompositeLit
+	empty []ast.Expr
+}
+
+// FindCaseTable returns the first slice or map literal of the test function testName in src
+// whose entries are composite literals, or which has no entries yet.
+func FindCaseTable(fset *token.FileSet, src []byte, testName string) (*CaseTable, error) {
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var fn *ast.FuncDecl
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok && d.Recv == nil && d.Name.Name == testName {
+			fn = d
+		}
+	}
+	if fn == nil || fn.Body == nil {
+		return nil, fmt.Errorf("no test function %s", testName)
+	}
+	offset := func(pos token.Pos) int { return fset.Position(pos).Offset }
+	source := func(n ast.Node) string { return string(src[offset(n.Pos()):offset(n.End())]) }
+
+	var table *CaseTable
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		lit, ok := n.(*ast.CompositeLit)
+		if !ok || table != nil {
+			return table == nil
+		}
+		switch lit.Type.(type) {
+		case *ast.ArrayType, *ast.MapType:
+		default:
+			return true
+		}
+		t := &CaseTable{Test: source(fn), Type: source(lit.Type), lit: lit}
+		for _, elt := range lit.Elts {
+			row := elt
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				row = kv.Value
+			}
+			rowLit, ok := row.(*ast.CompositeLit)
+			if !ok {
+				return true
+			}
+			if len(rowLit.Elts) == 0 {
+				t.empty = append(t.empty, elt)
+				continue
+			}
+			t.Rows = append(t.Rows, source(elt))
+		}
+		table = t
+		return false
+	})
+	if table == nil {
+		return nil, fmt.Errorf("no table of cases in %s", testName)
+	}
+	return table, nil
+}
+
+func rowsPrompt(table *CaseTable, count int, allCode string, extraInstructions string) []Message {
+	systemContent := "Acting as a senior Go developer you should add cases to the table of a table-driven test. " +
+		"Fill in every field the table's type has, with inputs and expected values derived from the code under test, " +
+		"cover edge cases and errors the existing entries miss and do not repeat them. " +
+		"Return only the new entries of the table literal, each followed by a comma, in a go code block, " +
+		"without the surrounding test, declarations or imports."
+	userContent := fmt.Sprintf(
+		"The code under test is: \n```go\n%s```\n"+
+			"The test is: \n```go\n%s\n```\n"+
+			"Its table has the type %s. Add %d entries.\n",
+		allCode,
+		table.Test,
+		table.Type,
+		count,
+	)
+	if extraInstructions != "" {
+		userContent += "\n" + extraInstructions
+	}
+	return []Message{
+		{Role: RoleSystem, Content: systemContent},
+		{Role: RoleUser, Content: userContent},
+	}
+}
+
+// GenerateTableRows asks the model for count new entries of the table of a table-driven test.
+// It returns the sources of the entries.
+func (c *Client) GenerateTableRows(
+	ctx context.Context,
+	table *CaseTable,
+	count int,
+	target string,
+	allCode string,
+	extraInstructions string,
+) ([]string, error) {
+	prompt := c.BasicPrompt()
+	prompt.Messages = c.withOverride(StageRows, rowsPrompt(table, count, allCode, extraInstructions))
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return nil, err
+	}
+
+	prompt.Stage = StageRows
+	prompt.Target = target
+	out, err := c.runStage(StageRows, target, func() (string, error) {
+		return c.Complete(ctx, prompt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseTableRows(table.Type, out)
+}
+
+// parseTableRows parses the entries of a table literal of type typ out of a response.
+func parseTableRows(typ string, response string) ([]string, error) {
+	body := aggregator.ExtractCode(response)
+	src := "package p\n\nvar _ = " + typ + "{\n" + body + "\n}\n"
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the table entries: %v", err)
+	}
+	lit := f.Decls[0].(*ast.GenDecl).Specs[0].(*ast.ValueSpec).Values[0].(*ast.CompositeLit)
+	var rows []string
+	for _, elt := range lit.Elts {
+		rows = append(rows, src[fset.Position(elt.Pos()).Offset:fset.Position(elt.End()).Offset])
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no table entries in the response")
+	}
+	return rows, nil
+}
+
+// AddTableRows replaces the entries without fields of the table in src by rows, after the
+// filled in entries, and returns the formatted source.
+func AddTableRows(fset *token.FileSet, src []byte, table *CaseTable, rows []string) ([]byte, error) {
+	offset := func(pos token.Pos) int { return fset.Position(pos).Offset }
+	var b strings.Builder
+	last := 0
+	for _, elt := range table.empty {
+		end := offset(elt.End())
+		// Remove the comma after the entry too.
+		if rest := strings.TrimLeft(string(src[end:]), " \t"); strings.HasPrefix(rest, ",") {
+			end = len(src) - len(rest) + 1
+		}
+		b.Write(src[last:offset(elt.Pos())])
+		last = end
+	}
+	rbrace := offset(table.lit.Rbrace)
+	b.Write(src[last:rbrace])
+	b.WriteString("\n" + rowsAnnotation + "\n")
+	for _, row := range rows {
+		b.WriteString(row + ",\n")
+	}
+	b.Write(src[rbrace:])
+	return format.Source([]byte(b.String()))
+}
@@ -0,0 +1,135 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a run log event.
+type LogLevel int
+
+// Log levels, from the most verbose.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses debug, info, warn or error.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want debug, info, warn or error", s)
+}
+
+// maxLoggedText is the length prompts and responses are truncated to in the run log.
+const maxLoggedText = 2000
+
+// LogEvent is a line of the run log.
+type LogEvent struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	// Event is request for API requests, stage for finished stages and log for messages.
+	Event  string `json:"event"`
+	Stage  Stage  `json:"stage,omitempty"`
+	Target string `json:"target,omitempty"`
+	Model  string `json:"model,omitempty"`
+
+	PromptTokens     int   `json:"prompt_tokens,omitempty"`
+	CompletionTokens int   `json:"completion_tokens,omitempty"`
+	LatencyMS        int64 `json:"latency_ms,omitempty"`
+	// Prompt and Response are truncated to maxLoggedText and only logged at debug level.
+	Prompt   string `json:"prompt,omitempty"`
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// RunLog writes the events of a run as JSON lines. A nil RunLog discards them.
+type RunLog struct {
+	level LogLevel
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewRunLog returns a run log writing the events of level and above to w.
+func NewRunLog(w io.Writer, level LogLevel) *RunLog {
+	return &RunLog{w: w, level: level}
+}
+
+// WithRunLog records the requests and stages of the client in the run log.
+func WithRunLog(l *RunLog) Option {
+	return func(o *GeneratorOptions) {
+		o.RunLog = l
+	}
+}
+
+// Log writes the event unless it is below the log's level.
+func (l *RunLog) Log(level LogLevel, e LogEvent) {
+	if l == nil || level < l.level {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Level = level.String()
+	if l.level > LevelDebug {
+		e.Prompt, e.Response = "", ""
+	} else {
+		e.Prompt, e.Response = truncateText(e.Prompt), truncateText(e.Response)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(line, '\n'))
+}
+
+// Write logs the lines written by the standard logger as log events, at warn level when
+// they report a failure and at debug level otherwise.
+func (l *RunLog) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		level := LevelDebug
+		if lower := strings.ToLower(line); strings.Contains(lower, "failed") || strings.Contains(lower, "warning") {
+			level = LevelWarn
+		}
+		l.Log(level, LogEvent{Event: "log", Message: line})
+	}
+	return len(p), nil
+}
+
+func truncateText(s string) string {
+	if len(s) <= maxLoggedText {
+		return s
+	}
+	return fmt.Sprintf("%s...[%d bytes truncated]", s[:maxLoggedText], len(s)-maxLoggedText)
+}
+
+// promptText renders the messages of a prompt for the run log.
+func promptText(messages []Message) string {
+	var b strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&b, "%s: %s\n", m.Role, m.Content)
+	}
+	return b.String()
+}
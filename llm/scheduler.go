@@ -0,0 +1,205 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultMinSuccessRate is the predicted success rate a model needs to be picked for a stage.
+const DefaultMinSuccessRate = 0.8
+
+// ModelStats counts the requests of a stage completed by a model.
+type ModelStats struct {
+	Attempts  int `json:"attempts"`
+	Successes int `json:"successes"`
+}
+
+// predictedSuccess estimates the chance of the next request succeeding. Untried models are
+// predicted to succeed, so every model gets a chance before the history rules it out.
+func (s *ModelStats) predictedSuccess() float64 {
+	if s == nil {
+		return 1
+	}
+	return float64(s.Successes+1) / float64(s.Attempts+1)
+}
+
+// ModelScheduler assigns every request to the cheapest model predicted to succeed for its
+// stage, based on the success rates of the earlier runs, and escalates to the stronger models
+// when it fails.
+type ModelScheduler struct {
+	// Models are ordered from the cheapest to the strongest.
+	Models []string
+	// MinSuccessRate is the predicted success rate a model needs, DefaultMinSuccessRate when 0.
+	MinSuccessRate float64
+
+	path  string
+	mu    sync.Mutex
+	stats map[Stage]map[string]*ModelStats
+}
+
+// WithModelScheduler picks the model of every request with the scheduler instead of using the
+// client's model.
+func WithModelScheduler(s *ModelScheduler) Option {
+	return func(o *GeneratorOptions) {
+		o.Scheduler = s
+	}
+}
+
+// DefaultModelStatsPath returns the file the success rates are kept in across runs.
+func DefaultModelStatsPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "goptest", "model-stats.json")
+}
+
+// LoadModelScheduler returns a scheduler for the models, cheapest first, with the success
+// rates recorded in the stats file at path. An empty path keeps the rates in memory only.
+func LoadModelScheduler(models []string, path string) (*ModelScheduler, error) {
+	if len(models) == 0 {
+		return nil, errors.New("no models to schedule")
+	}
+	s := &ModelScheduler{Models: models, path: path, stats: make(map[Stage]map[string]*ModelStats)}
+	if path == "" {
+		return s, nil
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &s.stats); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Ladder returns the models to try for a request of the stage: the cheapest model predicted
+// to succeed, followed by the stronger ones to escalate to.
+func (s *ModelScheduler) Ladder(stage Stage) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	min := s.MinSuccessRate
+	if min == 0 {
+		min = DefaultMinSuccessRate
+	}
+	for i, m := range s.Models {
+		if s.stats[stage][m].predictedSuccess() >= min {
+			return s.Models[i:]
+		}
+	}
+	return s.Models[len(s.Models)-1:]
+}
+
+// Record adds the outcome of a request of the stage completed by the model to the stats and
+// saves them.
+func (s *ModelScheduler) Record(stage Stage, model string, success bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats[stage] == nil {
+		s.stats[stage] = make(map[string]*ModelStats)
+	}
+	st := s.stats[stage][model]
+	if st == nil {
+		st = &ModelStats{}
+		s.stats[stage][model] = st
+	}
+	st.Attempts++
+	if success {
+		st.Successes++
+	}
+	if s.path == "" {
+		return
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Failed to save the model stats: %v", err)
+	}
+}
+
+func (s *ModelScheduler) save() error {
+	content, err := json.MarshalIndent(s.stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := WriteToFile(string(content), tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// stageOutputError rejects completions that can't be the output of the stage, so that the
+// request is escalated to a stronger model.
+func stageOutputError(stage Stage, out string) error {
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return errors.New("empty completion")
+	}
+	switch stage {
+	case StageCases, StageMerge:
+		if !strings.Contains(out, "cases") {
+			return errors.New("no cases in the completion")
+		}
+	case StageCode, StageMocks, StageRepair, StageVerify, StageCapture, StageSimplify:
+		if !strings.Contains(out, "func ") {
+			return errors.New("no Go functions in the completion")
+		}
+	case StageCompare:
+		if !strings.Contains(out, "ambiguous") {
+			return errors.New("no ambiguous cases list in the completion")
+		}
+	case StageRows:
+		if !strings.Contains(out, "{") {
+			return errors.New("no table entries in the completion")
+		}
+	}
+	return nil
+}
+
+// withModels sends the prompt with the models the scheduler picks for its stage, escalating
+// to the next stronger model when the request fails or the completion is unusable. Prompts
+// without a stage and clients without a scheduler are sent with the client's model.
+func (c *Client) withModels(ctx context.Context, prompt Prompt, send func(prompt Prompt) (string, error)) (string, error) {
+	if c.scheduler == nil || prompt.Stage == "" {
+		return send(prompt)
+	}
+	var (
+		resp string
+		err  error
+	)
+	ladder := c.scheduler.Ladder(prompt.Stage)
+	for i, model := range ladder {
+		prompt.Model = model
+		resp, err = send(c.withExamples(prompt))
+		if err == nil {
+			err = stageOutputError(prompt.Stage, resp)
+		}
+		var budgetErr *BudgetExceededError
+		if ctx.Err() != nil || errors.Is(err, ErrPromptCaptured) || errors.As(err, &budgetErr) {
+			return resp, err
+		}
+		c.scheduler.Record(prompt.Stage, model, err == nil)
+		if err == nil {
+			log.Printf("Stage %s completed by %s", prompt.Stage, model)
+			c.distill(prompt, resp)
+			return resp, nil
+		}
+		if i < len(ladder)-1 {
+			log.Printf("Stage %s failed with %s, escalating to %s: %v", prompt.Stage, model, ladder[i+1], err)
+		}
+	}
+	return resp, err
+}
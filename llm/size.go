@@ -0,0 +1,100 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+
+	"github.com/sentiens/goptest/aggregator"
+)
+
+// LongTest is a generated test function over the line limit.
+type LongTest struct {
+	Name  string
+	Lines int
+}
+
+// LongTests returns the functions of the generated code longer than maxLines lines, helpers
+// included.
+func LongTests(code string, maxLines int) ([]LongTest, error) {
+	fset := token.NewFileSet()
+	src := aggregator.Aggregate("p", []string{code}, false)
+	f, err := parser.ParseFile(fset, "", src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	var res []LongTest
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		lines := fset.Position(fn.End()).Line - fset.Position(fn.Pos()).Line + 1
+		if lines > maxLines {
+			res = append(res, LongTest{Name: fn.Name.Name, Lines: lines})
+		}
+	}
+	return res, nil
+}
+
+func simplifyPrompt(code string, long []LongTest, maxLines int, allCode string, extraInstructions string) []Message {
+	systemContent := "Acting as a senior Go developer you should simplify generated tests that are too long to review. " +
+		"Keep the behavior each test checks, but remove mocks and stubs the code under test does not need, " +
+		"merge repeated setup into table cases or a small helper and drop redundant assertions. " +
+		"Return the complete simplified test code."
+	var names []string
+	for _, t := range long {
+		names = append(names, fmt.Sprintf("%s (%d lines)", t.Name, t.Lines))
+	}
+	userContent := fmt.Sprintf(
+		"The code under test is: \n```go\n%s```\n"+
+			"The test code is: \n```go\n%s```\n"+
+			"Simplify %s to at most %d lines each.\n",
+		allCode,
+		code,
+		strings.Join(names, ", "),
+		maxLines,
+	)
+	if extraInstructions != "" {
+		userContent += "\n" + extraInstructions
+	}
+	return []Message{
+		{Role: RoleSystem, Content: systemContent},
+		{Role: RoleUser, Content: userContent},
+	}
+}
+
+// SimplifyTestCode asks the model to shorten the functions of the generated test code that are
+// longer than maxLines lines. The code is returned unchanged when none is.
+func (c *Client) SimplifyTestCode(
+	ctx context.Context,
+	target string,
+	code string,
+	maxLines int,
+	allCode string,
+	extraInstructions string,
+) (string, error) {
+	long, err := LongTests(code, maxLines)
+	if err != nil || len(long) == 0 {
+		return code, err
+	}
+	if c.depPolicy != nil {
+		extraInstructions = strings.TrimSpace(extraInstructions + "\n" + c.depPolicy.instructions())
+	}
+	prompt := c.BasicPrompt()
+	prompt.Temperature = 0
+	prompt.TopP = 1
+	prompt.Messages = c.withOverride(StageSimplify, simplifyPrompt(code, long, maxLines, allCode, extraInstructions))
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return "", err
+	}
+
+	prompt.Stage = StageSimplify
+	prompt.Target = target
+	return c.runStage(StageSimplify, target, func() (string, error) {
+		return c.Complete(ctx, prompt)
+	})
+}
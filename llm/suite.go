@@ -0,0 +1,243 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strings"
+
+	"github.com/sentiens/goptest/spec"
+)
+
+// Implementation is a type of the package implementing an interface.
+type Implementation struct {
+	Type string
+	// Pointer is set when some methods have pointer receivers, so only *Type implements it.
+	Pointer bool
+	// Constructor is a New function without parameters returning the type, if any.
+	Constructor string
+}
+
+// InterfaceContract is an interface of the package with the implementations found for it.
+type InterfaceContract struct {
+	Name string
+	// Decl is the interface declaration including its doc comment.
+	Decl            string
+	Implementations []Implementation
+}
+
+// signatureKey prints the parameter and result types of a function type, ignoring names.
+func signatureKey(fset *token.FileSet, ft *ast.FuncType) string {
+	fields := func(fl *ast.FieldList) string {
+		if fl == nil {
+			return ""
+		}
+		var parts []string
+		for _, f := range fl.List {
+			n := len(f.Names)
+			if n == 0 {
+				n = 1
+			}
+			for i := 0; i < n; i++ {
+				parts = append(parts, PrintNode(fset, f.Type))
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+	return "(" + fields(ft.Params) + ")(" + fields(ft.Results) + ")"
+}
+
+// FindInterfaceContract finds the interface in the code and the types implementing it. The
+// check is syntactic: an implementation declares every explicit method of the interface with
+// the same parameter and result types. Methods of embedded interfaces are not checked.
+func FindInterfaceContract(allCode string, name string) (*InterfaceContract, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", allCode, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		iface *ast.InterfaceType
+		decl  string
+	)
+	for _, d := range f.Decls {
+		gd, ok := d.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if it, ok := ts.Type.(*ast.InterfaceType); ok && ts.Name.Name == name {
+				iface = it
+				single := *gd
+				single.Specs = []ast.Spec{ts}
+				if len(gd.Specs) > 1 {
+					single.Lparen, single.Rparen = token.NoPos, token.NoPos
+					single.Doc = ts.Doc
+				}
+				decl = PrintNode(fset, &single)
+			}
+		}
+	}
+	if iface == nil {
+		return nil, fmt.Errorf("interface %s not found in the code files", name)
+	}
+
+	want := make(map[string]string)
+	for _, m := range iface.Methods.List {
+		ft, ok := m.Type.(*ast.FuncType)
+		if !ok {
+			continue
+		}
+		for _, n := range m.Names {
+			want[n.Name] = signatureKey(fset, ft)
+		}
+	}
+
+	type methodSet struct {
+		methods map[string]string
+		pointer bool
+	}
+	types := make(map[string]*methodSet)
+	constructors := make(map[string]string)
+	for _, d := range f.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		if fn.Recv == nil {
+			// A constructor without parameters returning T or *T.
+			if strings.HasPrefix(fn.Name.Name, "New") && len(fn.Type.Params.List) == 0 &&
+				fn.Type.Results != nil && len(fn.Type.Results.List) == 1 {
+				if typeName := BaseTypeName(fn.Type.Results.List[0].Type); typeName != "" {
+					constructors[typeName] = fn.Name.Name
+				}
+			}
+			continue
+		}
+		typeName, pointer := ReceiverType(fn.Recv)
+		if typeName == "" {
+			continue
+		}
+		ms := types[typeName]
+		if ms == nil {
+			ms = &methodSet{methods: make(map[string]string)}
+			types[typeName] = ms
+		}
+		ms.methods[fn.Name.Name] = signatureKey(fset, fn.Type)
+		if _, ok := want[fn.Name.Name]; ok && pointer {
+			ms.pointer = true
+		}
+	}
+
+	contract := &InterfaceContract{Name: name, Decl: decl}
+	for typeName, ms := range types {
+		implements := len(want) > 0
+		for method, sig := range want {
+			if ms.methods[method] != sig {
+				implements = false
+				break
+			}
+		}
+		if implements {
+			contract.Implementations = append(contract.Implementations, Implementation{
+				Type:        typeName,
+				Pointer:     ms.pointer,
+				Constructor: constructors[typeName],
+			})
+		}
+	}
+	sort.Slice(contract.Implementations, func(i, j int) bool {
+		return contract.Implementations[i].Type < contract.Implementations[j].Type
+	})
+	return contract, nil
+}
+
+// SuiteFuncName is the name of the reusable conformance suite of the interface. It is not a
+// TestXxx function, go vet rejects test functions with additional parameters.
+func SuiteFuncName(iface string) string {
+	return "Run" + iface + "Contract"
+}
+
+func contractSuitePrompt(contract *InterfaceContract, allCode string, pkg string, extraInstructions string) []Message {
+	suite := SuiteFuncName(contract.Name)
+	systemContent := "Acting as a senior Go developer you should write a reusable conformance test suite for an interface. " +
+		fmt.Sprintf("Write func %s(t *testing.T, newImpl func() %s) in package %s. ", suite, contract.Name, pkg) +
+		"It runs one t.Run subtest per behavior every implementation must have, derived from the interface's " +
+		"method doc comments and the implementations' common behavior, and calls newImpl in every subtest for a fresh instance. " +
+		"Use only the interface's methods, never a concrete type. Return only Go code with all imports."
+	userContent := fmt.Sprintf("Interface: \n```go\n%s\n```\nCode: \n```go\n%s```\n", contract.Decl, allCode)
+	if extraInstructions != "" {
+		userContent += "\n" + extraInstructions
+	}
+	return []Message{
+		{Role: RoleSystem, Content: systemContent},
+		{Role: RoleUser, Content: userContent},
+	}
+}
+
+// ContractWiring returns the tests running the suite for every implementation.
+func ContractWiring(contract *InterfaceContract) (specs []Spec, code []string) {
+	suite := SuiteFuncName(contract.Name)
+	for _, impl := range contract.Implementations {
+		name := "Test" + spec.Identifier(impl.Type) + "_" + contract.Name + "Contract"
+		var construct, review string
+		switch {
+		case impl.Constructor != "":
+			construct = impl.Constructor + "()"
+		case impl.Pointer:
+			construct = "&" + impl.Type + "{}"
+			review = "\t// REVIEW(goptest): initialize " + impl.Type + " if its zero value is not ready to use.\n"
+		default:
+			construct = impl.Type + "{}"
+			review = "\t// REVIEW(goptest): initialize " + impl.Type + " if its zero value is not ready to use.\n"
+		}
+		specs = append(specs, Spec{
+			Name:        name,
+			Description: fmt.Sprintf("Run the %s conformance suite for %s", contract.Name, impl.Type),
+		})
+		code = append(code, fmt.Sprintf("import \"testing\"\n\nfunc %s(t *testing.T) {\n%s\t%s(t, func() %s { return %s })\n}\n",
+			name, review, suite, contract.Name, construct))
+	}
+	return specs, code
+}
+
+// GenerateContractSuite generates a reusable conformance suite for the interface and the
+// tests running it for the implementations found in the package.
+func (c *Client) GenerateContractSuite(
+	ctx context.Context,
+	iface string,
+	allCode string,
+	pkg string,
+	extraInstructions string,
+) ([]Spec, []string, error) {
+	contract, err := FindInterfaceContract(allCode, iface)
+	if err != nil {
+		return nil, nil, err
+	}
+	prompt := c.BasicPrompt()
+	prompt.Temperature = 0
+	prompt.TopP = 1
+	prompt.Messages = c.withOverride(StageCode, contractSuitePrompt(contract, allCode, pkg, extraInstructions))
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return nil, nil, err
+	}
+	prompt.Stage = StageCode
+	prompt.Target = SuiteFuncName(iface)
+	suite, err := c.runStage(StageCode, prompt.Target, func() (string, error) {
+		return c.Complete(ctx, prompt)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	specs := []Spec{{
+		Name:        SuiteFuncName(iface),
+		Description: fmt.Sprintf("Conformance suite every %s implementation must pass", iface),
+	}}
+	wiringSpecs, wiring := ContractWiring(contract)
+	return append(specs, wiringSpecs...), append([]string{suite}, wiring...), nil
+}
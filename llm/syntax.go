@@ -0,0 +1,140 @@
+package llm
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"strings"
+	"unicode"
+)
+
+// FuncName returns the name of a function declaration, prefixed with its receiver type for methods.
+func FuncName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return fn.Name.Name
+	}
+	t := fn.Recv.List[0].Type
+	for {
+		switch tt := t.(type) {
+		case *ast.StarExpr:
+			t = tt.X
+			continue
+		case *ast.IndexExpr:
+			t = tt.X
+			continue
+		case *ast.IndexListExpr:
+			t = tt.X
+			continue
+		case *ast.Ident:
+			return tt.Name + "." + fn.Name.Name
+		}
+		return fn.Name.Name
+	}
+}
+
+// identifierWords splits free text into the identifiers it mentions, keeping Type.Method pairs.
+func identifierWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.'
+	})
+}
+
+// FindTargetFuncs returns the functions of the code that are mentioned in the free-text target.
+func FindTargetFuncs(allCode string, whatToTest string) ([]*ast.FuncDecl, *token.FileSet, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", allCode, parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
+	words := make(map[string]bool)
+	for _, w := range identifierWords(whatToTest) {
+		words[strings.Trim(w, ".")] = true
+	}
+	var res []*ast.FuncDecl
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		if words[FuncName(fn)] || words[fn.Name.Name] {
+			res = append(res, fn)
+		}
+	}
+	return res, fset, nil
+}
+
+func PrintNode(fset *token.FileSet, node any) string {
+	var buf bytes.Buffer
+	cfg := printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	if err := cfg.Fprint(&buf, fset, node); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// BaseTypeName returns the name of a named type, without pointers, slices, maps values
+// and package qualifiers, or "" for unnamed and predeclared types.
+func BaseTypeName(expr ast.Expr) string {
+	for {
+		switch t := expr.(type) {
+		case *ast.StarExpr:
+			expr = t.X
+		case *ast.ArrayType:
+			expr = t.Elt
+		case *ast.MapType:
+			expr = t.Value
+		case *ast.Ellipsis:
+			expr = t.Elt
+		case *ast.IndexExpr:
+			expr = t.X
+		case *ast.IndexListExpr:
+			expr = t.X
+		case *ast.SelectorExpr:
+			return t.Sel.Name
+		case *ast.Ident:
+			if isPredeclaredType(t.Name) {
+				return ""
+			}
+			return t.Name
+		default:
+			return ""
+		}
+	}
+}
+
+func isPredeclaredType(name string) bool {
+	switch name {
+	case "any", "bool", "byte", "comparable", "complex64", "complex128", "error", "float32", "float64",
+		"int", "int8", "int16", "int32", "int64", "rune", "string",
+		"uint", "uint8", "uint16", "uint32", "uint64", "uintptr":
+		return true
+	}
+	return false
+}
+
+// ReceiverType returns the type name of a method receiver and whether it is a pointer.
+func ReceiverType(recv *ast.FieldList) (string, bool) {
+	if recv == nil || len(recv.List) == 0 {
+		return "", false
+	}
+	t := recv.List[0].Type
+	pointer := false
+	if star, ok := t.(*ast.StarExpr); ok {
+		t, pointer = star.X, true
+	}
+	switch tt := t.(type) {
+	case *ast.Ident:
+		return tt.Name, pointer
+	case *ast.IndexExpr:
+		if id, ok := tt.X.(*ast.Ident); ok {
+			return id.Name, pointer
+		}
+	case *ast.IndexListExpr:
+		if id, ok := tt.X.(*ast.Ident); ok {
+			return id.Name, pointer
+		}
+	}
+	return "", false
+}
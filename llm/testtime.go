@@ -0,0 +1,104 @@
+package llm
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithTestTimeBudget has every generated test complete within d: the code prompts forbid real
+// sleeps and polling, and VerifyFile has the model rewrite the tests that sleep, poll or run
+// longer.
+func WithTestTimeBudget(d time.Duration) Option {
+	return func(o *GeneratorOptions) {
+		o.TestTimeBudget = d
+	}
+}
+
+func testTimeInstructions(budget time.Duration) string {
+	return fmt.Sprintf("Every test must complete within %s. Do not call time.Sleep or poll with tickers or loops "+
+		"waiting for real time to pass: inject a fake clock, synchronize with channels or a sync.WaitGroup and "+
+		"use short context deadlines instead.", budget)
+}
+
+// SlowTest is a test over the time budget or waiting for real time to pass.
+type SlowTest struct {
+	Name   string
+	Reason string
+}
+
+// waitingCalls are the calls of the time package making tests wait for real time to pass.
+var waitingCalls = map[string]bool{"Sleep": true, "Tick": true, "NewTicker": true}
+
+// waitingTests returns the tests of src calling time.Sleep or polling with tickers.
+func waitingTests(src string) ([]SlowTest, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	var res []SlowTest
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Body == nil || !strings.HasPrefix(fn.Name.Name, "Test") {
+			continue
+		}
+		calls := make(map[string]bool)
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "time" && waitingCalls[sel.Sel.Name] && !calls[sel.Sel.Name] {
+				calls[sel.Sel.Name] = true
+				res = append(res, SlowTest{Name: fn.Name.Name, Reason: "calls time." + sel.Sel.Name})
+			}
+			return true
+		})
+	}
+	return res, nil
+}
+
+var testDurationRe = regexp.MustCompile(`(?m)^\s*--- (?:PASS|FAIL): (\S+) \(([0-9.]+)s\)`)
+
+// overBudgetTests returns the tests of the verbose go test output that ran longer than budget.
+func overBudgetTests(output string, budget time.Duration) []SlowTest {
+	var res []SlowTest
+	for _, m := range testDurationRe.FindAllStringSubmatch(output, -1) {
+		seconds, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			continue
+		}
+		if d := time.Duration(seconds * float64(time.Second)); d > budget {
+			res = append(res, SlowTest{Name: m[1], Reason: fmt.Sprintf("took %s", d)})
+		}
+	}
+	return res
+}
+
+// SlowTests returns the tests of the test file src over the client's time budget, statically
+// and, when output is not empty, by their run time in the verbose go test output.
+func (c *Client) SlowTests(src string, output string) []SlowTest {
+	if c.testBudget <= 0 {
+		return nil
+	}
+	slow, err := waitingTests(src)
+	if err != nil {
+		return nil
+	}
+	return append(slow, overBudgetTests(output, c.testBudget)...)
+}
+
+// slowTestsReport describes the slow tests as failures for the model to fix.
+func slowTestsReport(slow []SlowTest, budget time.Duration) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "These tests exceed the budget of %s per test or wait for real time to pass:\n", budget)
+	for _, s := range slow {
+		fmt.Fprintf(&b, "--- SLOW: %s %s\n", s.Name, s.Reason)
+	}
+	return b.String()
+}
@@ -0,0 +1,108 @@
+package llm
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter limits the number of requests in flight. The limit adapts to rate limiting like
+// TCP congestion control: it is halved when a request is rate limited and grows by one after
+// as many successful requests as the limit, up to the configured maximum.
+type limiter struct {
+	mu        sync.Mutex
+	max       int
+	limit     int
+	inFlight  int
+	successes int
+	// pausedUntil holds back new requests until the provider's rate limits are reset.
+	pausedUntil time.Time
+	// changed is closed and replaced whenever a slot may have become free.
+	changed chan struct{}
+}
+
+func newLimiter(max int) *limiter {
+	return &limiter{max: max, limit: max, changed: make(chan struct{})}
+}
+
+// acquire waits for a free slot and the end of a pause.
+func (l *limiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if wait := time.Until(l.pausedUntil); wait > 0 {
+			l.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+		if l.inFlight < l.limit {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.notify()
+}
+
+func (l *limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// throttle halves the limit after a request was rate limited.
+func (l *limiter) throttle() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit /= 2
+	if l.limit < 1 {
+		l.limit = 1
+	}
+	l.successes = 0
+}
+
+// succeeded records a successful request, raising the limit again after enough of them.
+func (l *limiter) succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit >= l.max {
+		return
+	}
+	l.successes++
+	if l.successes >= l.limit {
+		l.limit++
+		l.successes = 0
+		l.notify()
+	}
+}
+
+// pause holds back new requests until the given time, requests in flight are not affected.
+func (l *limiter) pause(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// current returns the current limit.
+func (l *limiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
@@ -0,0 +1,195 @@
+package llm
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	tiktoken "github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+const (
+	// minCompletionTokens is the smallest completion a request is shortened to so the prompt
+	// fits the context window.
+	minCompletionTokens = 512
+	// PromptReserveTokens is the part of the context window left for the instructions,
+	// specs and examples around the code files.
+	PromptReserveTokens = 1500
+)
+
+// contextWindows are the context window sizes in tokens of known models, by model name prefix.
+var contextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	{"gpt-4-32k", 32768},
+	{"gpt-4-1106", 128000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4o", 128000},
+	{"gpt-4", 8192},
+	{"gpt-3.5-turbo-16k", 16384},
+	{"gpt-3.5-turbo-1106", 16385},
+	{"gpt-3.5-turbo", 4096},
+}
+
+// ContextWindow returns the context window size of the model in tokens, 0 when unknown.
+func ContextWindow(model string) int {
+	for _, w := range contextWindows {
+		if strings.HasPrefix(model, w.prefix) {
+			return w.tokens
+		}
+	}
+	return 0
+}
+
+var (
+	loadEncodings sync.Once
+	encodingsMu   sync.Mutex
+	encodings     = make(map[string]*tiktoken.Tiktoken)
+)
+
+// encodingFor returns the tokenizer of the model, cl100k_base for unknown models.
+func encodingFor(model string) (*tiktoken.Tiktoken, error) {
+	// The encodings are embedded, counting tokens never downloads them.
+	loadEncodings.Do(func() {
+		tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+	})
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	if enc, ok := encodings[model]; ok {
+		return enc, nil
+	}
+	enc, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		enc, err = tiktoken.GetEncoding("cl100k_base")
+		if err != nil {
+			return nil, err
+		}
+	}
+	encodings[model] = enc
+	return enc, nil
+}
+
+// CountTokens returns the number of tokens of the text for the model, estimated from its
+// length when the tokenizer is not available.
+func CountTokens(model string, text string) int {
+	enc, err := encodingFor(model)
+	if err != nil {
+		log.Println("Estimating token count:", err)
+		return estimateTokens(text)
+	}
+	return len(enc.EncodeOrdinary(text))
+}
+
+// PromptTokens returns the number of tokens the messages take in a chat completion request,
+// including the per message overhead of the chat format.
+func PromptTokens(model string, messages []Message) int {
+	tokens := 3
+	for _, m := range messages {
+		tokens += 4 + CountTokens(model, string(m.Role)) + CountTokens(model, m.Content)
+	}
+	return tokens
+}
+
+// ContextWindowError is returned for prompts that don't fit the model's context window.
+type ContextWindowError struct {
+	Model        string
+	PromptTokens int
+	Window       int
+}
+
+func (e *ContextWindowError) Error() string {
+	return fmt.Sprintf("the prompt has %d tokens, more than the %d tokens %s accepts with a minimal answer; "+
+		"pass fewer code files, lower -code-budget or use a model with a larger context window",
+		e.PromptTokens, e.Window, e.Model)
+}
+
+// fitContextWindow checks the prompt against the model's context window before it is sent.
+// The completion is shortened when the prompt and MaxTokens together exceed the window, and
+// a ContextWindowError is returned when not even a minimal completion fits.
+func (c *Client) fitContextWindow(prompt Prompt) (Prompt, error) {
+	model := c.model
+	if prompt.Model != "" {
+		model = prompt.Model
+	}
+	window := ContextWindow(model)
+	if window == 0 {
+		return prompt, nil
+	}
+	tokens := PromptTokens(model, prompt.Messages)
+	if tokens+minCompletionTokens > window {
+		return prompt, &ContextWindowError{Model: model, PromptTokens: tokens, Window: window}
+	}
+	if tokens+prompt.MaxTokens > window {
+		log.Printf("Warning: the prompt has %d tokens, shortening the completion from %d to %d tokens to fit the %d tokens of %s",
+			tokens, prompt.MaxTokens, window-tokens, window, model)
+		prompt.MaxTokens = window - tokens
+	}
+	return prompt, nil
+}
+
+// CodeBudget returns the tokens left for the code files in the model's context window after
+// the completion and the rest of the prompt, 0 when the window is unknown.
+func CodeBudget(model string, maxTokens int) int {
+	window := ContextWindow(model)
+	if window == 0 {
+		return 0
+	}
+	budget := window - maxTokens - PromptReserveTokens
+	if budget < minCompletionTokens {
+		budget = minCompletionTokens
+	}
+	return budget
+}
+
+// RankFiles orders the code files by relevance to the target, so a budget summarizes the
+// least relevant ones: files declaring the target come first, then files by the number of
+// mentions of the target's names. Ties and unreadable files keep their order.
+func RankFiles(paths []string, whatToTest string) []string {
+	if whatToTest == "" || len(paths) < 2 {
+		return paths
+	}
+	contents := make([]string, len(paths))
+	declares := make([]bool, len(paths))
+	var names []string
+	for i, p := range paths {
+		content, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		contents[i] = string(content)
+		fns, _, err := FindTargetFuncs(contents[i], whatToTest)
+		if err != nil {
+			continue
+		}
+		for _, fn := range fns {
+			declares[i] = true
+			names = append(names, fn.Name.Name)
+		}
+	}
+	if len(names) == 0 {
+		for _, w := range identifierWords(whatToTest) {
+			if w = strings.Trim(w, "."); len(w) > 2 {
+				names = append(names, w)
+			}
+		}
+	}
+	scores := make(map[string]int, len(paths))
+	for i, p := range paths {
+		if declares[i] {
+			scores[p] += 1 << 20
+		}
+		for _, name := range names {
+			scores[p] += strings.Count(contents[i], name)
+		}
+	}
+	ranked := append([]string(nil), paths...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scores[ranked[i]] > scores[ranked[j]]
+	})
+	return ranked
+}
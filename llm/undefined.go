@@ -0,0 +1,235 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sentiens/goptest/aggregator"
+)
+
+var (
+	// undefinedRe matches the identifiers the compiler reports as undefined.
+	undefinedRe = regexp.MustCompile(`undefined: ([A-Za-z_]\w*(?:\.[A-Za-z_]\w*)?)`)
+	// noMemberRe matches the types the compiler reports a missing field or method of.
+	noMemberRe = regexp.MustCompile(`\(type \*?([A-Za-z_]\w*(?:\.[A-Za-z_]\w*)?) has no field or method`)
+)
+
+// undefinedIdentifiers returns the matches of re in diagnostics, in order and without
+// duplicates. Identifiers of other packages are qualified, e.g. store.New.
+func undefinedIdentifiers(re *regexp.Regexp, diagnostics string) []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, m := range re.FindAllStringSubmatch(diagnostics, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			res = append(res, m[1])
+		}
+	}
+	return res
+}
+
+// packageDeclarations returns the declarations of names in the Go files of dir, except
+// skip, with the method signatures of the types among them. missing lists the names
+// declared nowhere in the package.
+func packageDeclarations(dir string, skip string, names []string) (decls string, missing []string, err error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return "", nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	found := make(map[string]bool)
+	var b strings.Builder
+	fset := token.NewFileSet()
+	for _, m := range matches {
+		if filepath.Base(m) == filepath.Base(skip) {
+			continue
+		}
+		f, err := parser.ParseFile(fset, m, nil, 0)
+		if err != nil {
+			continue
+		}
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if recv, _ := ReceiverType(d.Recv); recv != "" {
+					if wanted[recv] {
+						d.Body = nil
+						b.WriteString(PrintNode(fset, d) + "\n")
+					}
+				} else if wanted[d.Name.Name] {
+					found[d.Name.Name] = true
+					b.WriteString(PrintNode(fset, d) + "\n")
+				}
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					var specNames []*ast.Ident
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						specNames = []*ast.Ident{s.Name}
+					case *ast.ValueSpec:
+						specNames = s.Names
+					}
+					for _, n := range specNames {
+						if wanted[n.Name] {
+							found[n.Name] = true
+							b.WriteString(PrintNode(fset, &ast.GenDecl{Tok: d.Tok, Specs: []ast.Spec{spec}}) + "\n")
+							break
+						}
+					}
+				}
+			}
+		}
+	}
+	for _, name := range names {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	return b.String(), missing, nil
+}
+
+// maxDocLines caps the go doc output added to the repair prompt per package.
+const maxDocLines = 80
+
+// importNames maps the names the Go file src refers to its imports by to their paths.
+func importNames(src string) map[string]string {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ImportsOnly)
+	if err != nil {
+		return nil
+	}
+	res := make(map[string]string)
+	for _, imp := range f.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		if imp.Name != nil {
+			res[imp.Name.Name] = path
+			continue
+		}
+		elems := strings.Split(path, "/")
+		name := elems[len(elems)-1]
+		if len(elems) > 1 && len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+			name = elems[len(elems)-2]
+		}
+		res[strings.TrimPrefix(name, "go-")] = path
+	}
+	return res
+}
+
+// goDoc returns the go doc output of the package path, or of its member when set, run in
+// dir so that the module's dependencies resolve from the module cache.
+func goDoc(ctx context.Context, dir string, path string, member string) (string, error) {
+	args := []string{"doc", "-short", path}
+	if member != "" {
+		args = []string{"doc", path, member}
+	}
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("go %s failed: %v", strings.Join(args, " "), err)
+	}
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(lines) > maxDocLines {
+		lines = append(lines[:maxDocLines], "...")
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// dependencyDocs returns the exported API of the third-party packages of the undefined
+// qualified identifiers, e.g. store.New, and the documentation of the qualified types
+// missing a member, through the imports of the test file src. Standard library packages
+// are left out.
+func dependencyDocs(ctx context.Context, dir string, src string, identifiers []string, types []string) string {
+	imports := importNames(src)
+	var b strings.Builder
+	seen := make(map[string]bool)
+	lookup := func(id string, whole bool) {
+		name, member, _ := strings.Cut(id, ".")
+		path, ok := imports[name]
+		if !ok || aggregator.IsStdlibImport(path) {
+			return
+		}
+		if whole {
+			member = ""
+		}
+		key := strings.TrimSpace(path + " " + member)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		doc, err := goDoc(ctx, dir, path, member)
+		if err != nil {
+			log.Printf("Failed to look up %s: %v", id, err)
+			return
+		}
+		fmt.Fprintf(&b, "go doc %s:\n```\n%s```\n", key, doc)
+	}
+	for _, id := range identifiers {
+		lookup(id, true)
+	}
+	for _, id := range types {
+		lookup(id, false)
+	}
+	return b.String()
+}
+
+// undefinedContext returns instructions with the declarations of the identifiers that
+// diagnostics reports as undefined in the test file at path, so that the repair sees the
+// code the generation prompt left out: the declarations of the package, the identifiers
+// it declares nowhere, so the model stops using them, and the go doc of the third-party
+// packages the qualified ones belong to.
+func undefinedContext(ctx context.Context, path string, diagnostics string) string {
+	var local, qualified, qualifiedTypes []string
+	identifiers := undefinedIdentifiers(undefinedRe, diagnostics)
+	types := undefinedIdentifiers(noMemberRe, diagnostics)
+	for _, id := range identifiers {
+		if strings.Contains(id, ".") {
+			qualified = append(qualified, id)
+		} else {
+			local = append(local, id)
+		}
+	}
+	for _, id := range types {
+		if strings.Contains(id, ".") {
+			qualifiedTypes = append(qualifiedTypes, id)
+		} else {
+			local = append(local, id)
+		}
+	}
+	var b strings.Builder
+	if len(local) > 0 {
+		decls, missing, err := packageDeclarations(filepath.Dir(path), path, local)
+		if err == nil && decls != "" {
+			fmt.Fprintf(&b, "The undefined identifiers are declared in the package as follows:\n```go\n%s```\n", decls)
+		}
+		if err == nil && len(missing) > 0 {
+			sort.Strings(missing)
+			fmt.Fprintf(&b, "These identifiers are not declared anywhere in the package, do not use them: %s.\n",
+				strings.Join(missing, ", "))
+		}
+	}
+	if len(qualified) > 0 || len(qualifiedTypes) > 0 {
+		if src, err := os.ReadFile(path); err == nil {
+			if docs := dependencyDocs(ctx, filepath.Dir(path), string(src), qualified, qualifiedTypes); docs != "" {
+				fmt.Fprintf(&b, "The imported packages export:\n%s", docs)
+			}
+		}
+	}
+	return b.String()
+}
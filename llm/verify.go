@@ -0,0 +1,223 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// LikelyBugMarker starts the skip reason of tests the model considers to have found a bug
+// in the code under test.
+const LikelyBugMarker = "goptest: likely production bug"
+
+// testFuncNames returns the names of the test and fuzz functions declared in src.
+func testFuncNames(src string) ([]string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil {
+			continue
+		}
+		if name := fn.Name.Name; strings.HasPrefix(name, "Test") || strings.HasPrefix(name, "Fuzz") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// RunTests runs the named tests of the package in dir verbosely, reporting the time of every
+// test, and returns the go test output. The files of overlay, source by file name, are added
+// to the package for the run with a go build overlay, so the package directory is never
+// modified.
+func RunTests(ctx context.Context, dir string, tags string, names []string, overlay map[string]string) (output string, ok bool, err error) {
+	args := []string{"test", "-count=1", "-timeout=2m", "-v"}
+	if len(overlay) > 0 {
+		tmp, err := os.MkdirTemp("", "goptest-overlay")
+		if err != nil {
+			return "", false, err
+		}
+		defer os.RemoveAll(tmp)
+		overlayPath, err := writeOverlay(tmp, dir, overlay)
+		if err != nil {
+			return "", false, err
+		}
+		args = append(args, "-overlay", overlayPath)
+	}
+	if tags != "" {
+		args = append(args, "-tags", tags)
+	}
+	if len(names) > 0 {
+		quoted := make([]string, len(names))
+		for i, name := range names {
+			quoted[i] = regexp.QuoteMeta(name)
+		}
+		args = append(args, "-run", "^("+strings.Join(quoted, "|")+")$")
+	}
+	args = append(args, ".")
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return string(out), false, nil
+		}
+		return "", false, fmt.Errorf("failed to run go test: %v", err)
+	}
+	return string(out), true, nil
+}
+
+// writeOverlay writes the files, source by file name, and the go build overlay adding them to
+// the package in dir to tmp, and returns the path of the overlay.
+func writeOverlay(tmp string, dir string, files map[string]string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	replace := make(map[string]string)
+	for name, src := range files {
+		path := filepath.Join(tmp, name)
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			return "", err
+		}
+		replace[filepath.Join(absDir, name)] = path
+	}
+	overlay, err := json.Marshal(map[string]map[string]string{"Replace": replace})
+	if err != nil {
+		return "", err
+	}
+	overlayPath := filepath.Join(tmp, "overlay.json")
+	if err := os.WriteFile(overlayPath, overlay, 0644); err != nil {
+		return "", err
+	}
+	return overlayPath, nil
+}
+
+func verifyPrompt(code string, output string, allCode string, extraInstructions string) []Message {
+	systemContent := "Acting as a senior Go developer you should make the failing tests of the test file pass. " +
+		"Decide for every failure whether the test or the code under test is wrong. " +
+		"When the test is wrong, fix it. When the code under test is wrong, keep the test's expectation and add " +
+		fmt.Sprintf("t.Skip(%q) as its first statement. ", LikelyBugMarker+": <one sentence on the bug>") +
+		"Do not modify the code under test and keep every other test. Return the complete corrected test file."
+	userContent := fmt.Sprintf(
+		"The code under test is: \n```go\n%s```\n"+
+			"The test file is: \n```go\n%s```\n"+
+			"go test reports: \n```\n%s```\n",
+		allCode,
+		code,
+		output,
+	)
+	if extraInstructions != "" {
+		userContent += "\n" + extraInstructions
+	}
+	return []Message{
+		{Role: RoleSystem, Content: systemContent},
+		{Role: RoleUser, Content: userContent},
+	}
+}
+
+// FixFailingTests asks the model to fix the failing tests of a test file, or to flag the
+// failures caused by bugs in the code under test.
+func (c *Client) FixFailingTests(
+	ctx context.Context,
+	target string,
+	code string,
+	output string,
+	allCode string,
+	extraInstructions string,
+) (string, error) {
+	prompt := c.BasicPrompt()
+	prompt.Temperature = 0
+	prompt.TopP = 1
+	if c.testBudget > 0 {
+		extraInstructions = strings.TrimSpace(extraInstructions + "\n" + testTimeInstructions(c.testBudget))
+	}
+	if c.depPolicy != nil {
+		extraInstructions = strings.TrimSpace(extraInstructions + "\n" + c.depPolicy.instructions())
+	}
+	prompt.Messages = c.withOverride(StageVerify, verifyPrompt(code, output, allCode, extraInstructions))
+	if err := c.corpus.AddPrompt(allCode, prompt.Messages); err != nil {
+		return "", err
+	}
+
+	prompt.Stage = StageVerify
+	prompt.Target = target
+	return c.runStage(StageVerify, target, func() (string, error) {
+		return c.Complete(ctx, prompt)
+	})
+}
+
+// VerifyFile runs the tests of the generated test file at path and lets the model fix the
+// failing ones, those over the test time budget and, when blocked, those making network calls,
+// until they pass or maxIterations fixes were tried. It returns the last go test output when tests still fail.
+func (c *Client) VerifyFile(
+	ctx context.Context,
+	path string,
+	header string,
+	tags string,
+	pkgName string,
+	allCode string,
+	extraInstructions string,
+	maxIterations int,
+) (output string, ok bool, err error) {
+	dir := filepath.Dir(path)
+	check := func() (string, bool, error) {
+		if diagnostics, ok, err := CompileCheck(ctx, dir, tags); err != nil || !ok {
+			return diagnostics, ok, err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, err
+		}
+		names, err := testFuncNames(string(content))
+		if err != nil {
+			return "", false, err
+		}
+		if len(names) == 0 {
+			return "", true, nil
+		}
+		var overlay map[string]string
+		if c.blockNetwork {
+			overlay = map[string]string{netGuardFile: netGuardSource(pkgName, tags)}
+		}
+		output, ok, err := RunTests(ctx, dir, tags, names, overlay)
+		if err != nil {
+			return output, ok, err
+		}
+		if report := blockedNetworkReport(output); report != "" {
+			output += "\n" + report
+		}
+		if slow := c.SlowTests(string(content), output); len(slow) > 0 {
+			return output + "\n" + slowTestsReport(slow, c.testBudget), false, nil
+		}
+		return output, ok, nil
+	}
+	fix := func(code string, output string) (string, error) {
+		return c.FixFailingTests(ctx, filepath.Base(path), code, output, allCode, extraInstructions)
+	}
+	return fixFile(path, header, pkgName, maxIterations, check, fix)
+}
+
+// LikelyBugs returns the skip reasons of the tests flagged as finding production bugs.
+func LikelyBugs(src string) []string {
+	var bugs []string
+	for _, line := range strings.Split(src, "\n") {
+		if i := strings.Index(line, LikelyBugMarker); i >= 0 {
+			bugs = append(bugs, strings.TrimRight(line[i:], "\")"))
+		}
+	}
+	return bugs
+}
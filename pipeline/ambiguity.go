@@ -0,0 +1,47 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// generateCandidates generates n case lists for the test list in parallel and flags the cases
+// they disagree on. It returns the first list.
+func generateCandidates(ctx context.Context, c *llm.Client, report *RunReport, whatToTest string, allCode string, list string, instructions string, n int) (string, error) {
+	candidates := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			candidates[i], errs[i] = c.GenerateTestCases(ctx, whatToTest, allCode, list, instructions)
+		}(i)
+	}
+	wg.Wait()
+	var generated []string
+	for i, err := range errs {
+		if err != nil {
+			fmt.Printf("Failed to generate candidate %d of the test cases: %v\n", i+1, err)
+			continue
+		}
+		generated = append(generated, candidates[i])
+	}
+	if len(generated) == 0 {
+		return "", errs[0]
+	}
+	if len(generated) == 1 {
+		return generated[0], nil
+	}
+	ambiguous, err := c.CompareCandidates(ctx, whatToTest, allCode, generated)
+	if err != nil {
+		// The cases are still usable, only the check is missing.
+		fmt.Printf("Failed to compare the candidate test cases: %v\n", err)
+		return generated[0], nil
+	}
+	report.AddAmbiguous(ambiguous...)
+	return generated[0], nil
+}
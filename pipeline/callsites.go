@@ -0,0 +1,191 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+const (
+	maxCallSites     = 10
+	callSiteContext  = 3
+	maxCallSitesFile = 2
+)
+
+// CallSite is a call of the target from another package of the module.
+type CallSite struct {
+	// Source is the file of the call relative to the module root and its line.
+	Source string
+	// Caller is the name of the function containing the call.
+	Caller string
+	// Snippet is the code around the call, limited to the calling function.
+	Snippet string
+	test    bool
+}
+
+// importName returns the name the file refers to the imported package by, or "" when the
+// file does not import it. pkgName is the declared name of the imported package.
+func importName(f *ast.File, importPath string, pkgName string) string {
+	for _, imp := range f.Imports {
+		p, err := strconv.Unquote(imp.Path.Value)
+		if err != nil || p != importPath {
+			continue
+		}
+		if imp.Name != nil {
+			if imp.Name.Name == "_" || imp.Name.Name == "." {
+				return ""
+			}
+			return imp.Name.Name
+		}
+		if pkgName != "" {
+			return pkgName
+		}
+		return path.Base(importPath)
+	}
+	return ""
+}
+
+// fileCallSites finds the calls of funcs in the file. Package functions must be qualified
+// with the package name, methods are matched by name only.
+func fileCallSites(fset *token.FileSet, f *ast.File, src []byte, name string, funcs map[string]bool, methods map[string]bool) []CallSite {
+	lines := strings.Split(string(src), "\n")
+	var res []CallSite
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		first := fset.Position(fn.Pos()).Line
+		last := fset.Position(fn.End()).Line
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			if len(res) >= maxCallSitesFile {
+				return false
+			}
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == name {
+				if !funcs[sel.Sel.Name] {
+					return true
+				}
+			} else if !methods[sel.Sel.Name] {
+				return true
+			}
+			pos := fset.Position(call.Pos())
+			from, to := pos.Line-callSiteContext, fset.Position(call.End()).Line+callSiteContext
+			if from < first {
+				from = first
+			}
+			if to > last {
+				to = last
+			}
+			res = append(res, CallSite{
+				Source:  fmt.Sprintf("%s:%d", filepath.ToSlash(pos.Filename), pos.Line),
+				Caller:  llm.FuncName(fn),
+				Snippet: strings.Join(lines[from-1:to], "\n"),
+			})
+			return false
+		})
+	}
+	return res
+}
+
+// FindCallSites scans the packages of the module rooted at root that import the package in
+// pkgDir for calls of the target. Calls from non-test files come first, they show how the
+// target is used in production.
+func FindCallSites(root string, pkgDir string, importPath string, allCode string, whatToTest string) ([]CallSite, error) {
+	pkgName, funcs, methods, err := targetCallNames(allCode, whatToTest)
+	if err != nil || len(funcs)+len(methods) == 0 {
+		return nil, err
+	}
+	ix, err := NewModuleIndex(root, "")
+	if err != nil {
+		return nil, err
+	}
+	_, err = ix.Refresh()
+	res, siteErr := ix.callSites(pkgDir, importPath, pkgName, funcs, methods)
+	if err == nil {
+		err = siteErr
+	}
+	return res, err
+}
+
+// targetCallNames returns the package name of allCode and the exported functions and methods
+// of the target, the names its call sites call.
+func targetCallNames(allCode string, whatToTest string) (pkgName string, funcs map[string]bool, methods map[string]bool, err error) {
+	fns, _, err := llm.FindTargetFuncs(allCode, whatToTest)
+	if err != nil || len(fns) == 0 {
+		return "", nil, nil, err
+	}
+	if f, err := parser.ParseFile(token.NewFileSet(), "", allCode, parser.PackageClauseOnly); err == nil {
+		pkgName = f.Name.Name
+	}
+	funcs = make(map[string]bool)
+	methods = make(map[string]bool)
+	for _, fn := range fns {
+		if !fn.Name.IsExported() {
+			continue
+		}
+		if fn.Recv == nil {
+			funcs[fn.Name.Name] = true
+		} else {
+			methods[fn.Name.Name] = true
+		}
+	}
+	return pkgName, funcs, methods, nil
+}
+
+// callSiteInstructions renders the call sites as prompt context.
+func callSiteInstructions(sites []CallSite) string {
+	if len(sites) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Other packages of the module call the tested code like this, " +
+		"cover these real usage scenarios and the inputs they pass:\n```go\n")
+	for _, s := range sites {
+		fmt.Fprintf(&b, "// %s in %s\n%s\n\n", s.Source, s.Caller, s.Snippet)
+	}
+	return strings.TrimSuffix(b.String(), "\n") + "```\n"
+}
+
+// loadCallSites finds the call sites of the target in the module of pkgDir, see FindCallSites.
+// They are asked from the goptest daemon at daemon when set, and found here when the daemon is
+// not reachable.
+func loadCallSites(pkgDir string, allCode string, whatToTest string, daemon string) string {
+	if daemon != "" {
+		resp, err := daemonContext(daemon, ContextRequest{Dir: pkgDir, Code: allCode, What: whatToTest, CallSites: true})
+		if err == nil {
+			return resp.CallSites
+		}
+		log.Printf("Looking for call sites without the daemon at %s: %v", daemon, err)
+	}
+	root, _, err := llm.FindModuleRoot(pkgDir)
+	if err != nil {
+		log.Println("Not looking for call sites:", err)
+		return ""
+	}
+	importPath, err := packageImportPath(pkgDir)
+	if err != nil {
+		log.Println("Not looking for call sites:", err)
+		return ""
+	}
+	sites, err := FindCallSites(root, pkgDir, importPath, allCode, whatToTest)
+	if err != nil {
+		log.Println("Failed to find call sites:", err)
+	}
+	return callSiteInstructions(sites)
+}
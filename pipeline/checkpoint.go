@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+const CheckpointFileName = ".goptest-state.json"
+
+// Checkpoint records the test code of every spec as soon as it is generated, so that an
+// interrupted run can be resumed without generating it again.
+type Checkpoint struct {
+	// Specs maps the checkpointKey of the generated specs to their test code.
+	Specs map[string]string `json:"specs"`
+
+	path string
+	mu   sync.Mutex
+}
+
+func checkpointPath(pkgDir string) string {
+	return filepath.Join(pkgDir, CheckpointFileName)
+}
+
+// checkpointKey identifies a spec of a target. The instructions are part of the key, so
+// specs edited since they were generated are generated again.
+func checkpointKey(target string, spec llm.Spec) string {
+	sum := sha256.Sum256([]byte(spec.Description))
+	return fmt.Sprintf("%s/%s/%x", target, spec.Name, sum[:8])
+}
+
+// NewCheckpoint returns an empty checkpoint of a package, replacing the saved one on the
+// first Save.
+func NewCheckpoint(pkgDir string) *Checkpoint {
+	return &Checkpoint{Specs: make(map[string]string), path: checkpointPath(pkgDir)}
+}
+
+// LoadCheckpoint reads the checkpoint of a package, returning an empty one when missing.
+func LoadCheckpoint(pkgDir string) (*Checkpoint, error) {
+	cp := NewCheckpoint(pkgDir)
+	content, err := os.ReadFile(cp.path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, cp); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", CheckpointFileName, err)
+	}
+	if cp.Specs == nil {
+		cp.Specs = make(map[string]string)
+	}
+	return cp, nil
+}
+
+// Generated returns the saved test code of the spec.
+func (c *Checkpoint) Generated(target string, spec llm.Spec) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	code, ok := c.Specs[checkpointKey(target, spec)]
+	return code, ok
+}
+
+// Save records the test code of the spec and writes the checkpoint file. The file is
+// replaced atomically, a run killed while saving keeps the previous checkpoint.
+func (c *Checkpoint) Save(target string, spec llm.Spec, code string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Specs[checkpointKey(target, spec)] = code
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := llm.WriteToFile(string(content), tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Remove deletes the checkpoint file once the run is complete.
+func (c *Checkpoint) Remove() error {
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
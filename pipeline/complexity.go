@@ -0,0 +1,78 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"log"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// cyclomaticComplexity computes the McCabe complexity of a function:
+// one plus the number of decision points.
+func cyclomaticComplexity(fn *ast.FuncDecl) int {
+	complexity := 1
+	if fn.Body == nil {
+		return complexity
+	}
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.IfStmt, *ast.ForStmt, *ast.RangeStmt:
+			complexity++
+		case *ast.CaseClause:
+			if n.List != nil {
+				complexity++
+			}
+		case *ast.CommClause:
+			if n.Comm != nil {
+				complexity++
+			}
+		case *ast.BinaryExpr:
+			if n.Op == token.LAND || n.Op == token.LOR {
+				complexity++
+			}
+		}
+		return true
+	})
+	return complexity
+}
+
+// specCountRange maps a complexity to the range of test cases worth asking for.
+func specCountRange(complexity int) (lo int, hi int) {
+	switch {
+	case complexity <= 2:
+		return 2, 3
+	case complexity <= 5:
+		return 4, 6
+	case complexity <= 10:
+		return 6, 10
+	default:
+		hi = complexity + 5
+		if hi > 25 {
+			hi = 25
+		}
+		return 10, hi
+	}
+}
+
+// specCountInstructions tells the list stage how many tests to return based on the complexity
+// of the targeted functions. It returns an empty string when no target function can be found.
+func specCountInstructions(allCode string, whatToTest string) string {
+	fns, _, err := llm.FindTargetFuncs(allCode, whatToTest)
+	if err != nil {
+		log.Println("Failed to parse code for complexity:", err)
+		return ""
+	}
+	if len(fns) == 0 {
+		return ""
+	}
+	complexity := 0
+	for _, fn := range fns {
+		complexity += cyclomaticComplexity(fn)
+	}
+	lo, hi := specCountRange(complexity)
+	log.Printf("Target complexity %d, asking for %d-%d tests", complexity, lo, hi)
+	return fmt.Sprintf("The target has a cyclomatic complexity of %d. "+
+		"Return between %d and %d test names, one per distinct behavior or branch.", complexity, lo, hi)
+}
@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// Contract is the testable part of a target's documentation.
+type Contract struct {
+	Target string
+	Claims []string
+}
+
+var (
+	sentenceEndRe = regexp.MustCompile(`([.!?;])\s+`)
+	rangeClaimRe  = regexp.MustCompile(`\d+\s*(\.\.|-|to)\s*\d+|\[\s*-?\d+\s*,\s*-?\d+\s*[\])]`)
+	claimWords    = []string{
+		"return", "error", "err", "nil", "panic", "must", "never", "always", "empty",
+		"zero", "negative", "positive", "between", "at least", "at most", "greater", "less",
+		"invalid", "fails", "only if", "unless", "otherwise", "default",
+	}
+)
+
+// docSentences splits doc comment text into sentences.
+func docSentences(doc string) []string {
+	text := strings.Join(strings.Fields(doc), " ")
+	text = sentenceEndRe.ReplaceAllString(text, "$1\n")
+	var res []string
+	for _, s := range strings.Split(text, "\n") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// isTestableClaim reports whether a doc sentence states behavior a test can check.
+func isTestableClaim(sentence string) bool {
+	if rangeClaimRe.MatchString(sentence) {
+		return true
+	}
+	lower := strings.ToLower(sentence)
+	for _, w := range claimWords {
+		if strings.Contains(lower, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtractContracts extracts the testable claims from the doc comments of the targeted functions.
+func ExtractContracts(allCode string, whatToTest string) ([]Contract, error) {
+	fns, _, err := llm.FindTargetFuncs(allCode, whatToTest)
+	if err != nil {
+		return nil, err
+	}
+	var res []Contract
+	for _, fn := range fns {
+		if fn.Doc == nil {
+			continue
+		}
+		c := Contract{Target: llm.FuncName(fn)}
+		for _, s := range docSentences(fn.Doc.Text()) {
+			if isTestableClaim(s) {
+				c.Claims = append(c.Claims, s)
+			}
+		}
+		if len(c.Claims) > 0 {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+// contractInstructions lists the documented claims the cases must cover.
+func contractInstructions(allCode string, whatToTest string) string {
+	contracts, err := ExtractContracts(allCode, whatToTest)
+	if err != nil {
+		log.Println("Failed to extract doc contracts:", err)
+		return ""
+	}
+	if len(contracts) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("The documentation states this contract. Every claim must be covered by at least one test case:\n")
+	for _, c := range contracts {
+		for _, claim := range c.Claims {
+			fmt.Fprintf(&b, "- %s: %s\n", c.Target, claim)
+		}
+	}
+	return b.String()
+}
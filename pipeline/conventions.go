@@ -0,0 +1,236 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sentiens/goptest/aggregator"
+	"github.com/sentiens/goptest/llm"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const conventionsFileName = ".goptest-conventions.yaml"
+
+// Conventions is the learned-preferences memory of a package, derived from generated
+// test files that were kept by the user.
+type Conventions struct {
+	Assertions map[string]int `yaml:"assertions,omitempty"`
+	Naming     map[string]int `yaml:"naming,omitempty"`
+	Helpers    map[string]int `yaml:"helpers,omitempty"`
+	TableTests int            `yaml:"table_tests"`
+	Subtests   int            `yaml:"subtests"`
+	Tests      int            `yaml:"tests"`
+	// Pending lists generated files that were not accepted yet.
+	Pending []string `yaml:"pending,omitempty"`
+	// Learned lists files already accounted for.
+	Learned []string `yaml:"learned,omitempty"`
+}
+
+func conventionsPath(pkgDir string) string {
+	return filepath.Join(pkgDir, conventionsFileName)
+}
+
+// LoadConventions reads the conventions file of a package, returning empty conventions when missing.
+func LoadConventions(pkgDir string) (*Conventions, error) {
+	conv := &Conventions{}
+	content, err := os.ReadFile(conventionsPath(pkgDir))
+	if os.IsNotExist(err) {
+		return conv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(content, conv); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", conventionsFileName, err)
+	}
+	return conv, nil
+}
+
+// Save writes the conventions file of a package.
+func (c *Conventions) Save(pkgDir string) error {
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return llm.WriteToFile(string(content), conventionsPath(pkgDir))
+}
+
+// AddPending remembers a freshly generated file so it can be learned from once accepted.
+func (c *Conventions) AddPending(path string) {
+	for _, p := range c.Pending {
+		if p == path {
+			return
+		}
+	}
+	c.Pending = append(c.Pending, path)
+}
+
+// LearnAccepted inspects pending files. A file counts as accepted once it exists outside
+// of the draft build tag and contains test functions.
+func (c *Conventions) LearnAccepted(pkgDir string) {
+	var pending []string
+	for _, p := range c.Pending {
+		path := p
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(pkgDir, p)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) || isDraftFile(path) {
+			pending = append(pending, p)
+			continue
+		}
+		learned, err := c.learnFile(path)
+		if err != nil {
+			log.Printf("not learning conventions from %s: %v", path, err)
+		}
+		if !learned {
+			pending = append(pending, p)
+			continue
+		}
+		c.Learned = append(c.Learned, p)
+	}
+	c.Pending = pending
+}
+
+func isDraftFile(path string) bool {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(string(content), "//go:build "+DraftBuildTag)
+}
+
+func bump(m *map[string]int, key string) {
+	if *m == nil {
+		*m = make(map[string]int)
+	}
+	(*m)[key]++
+}
+
+func (c *Conventions) learnFile(path string) (bool, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, nil, 0)
+	if err != nil {
+		return false, err
+	}
+
+	imports := make(map[string]string)
+	for _, imp := range f.Imports {
+		p, _ := strconv.Unquote(imp.Path.Value)
+		name := filepath.Base(p)
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		imports[name] = p
+	}
+
+	tests := 0
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || !strings.HasPrefix(fn.Name.Name, "Test") || fn.Body == nil {
+			continue
+		}
+		tests++
+		bump(&c.Naming, namingPattern(fn.Name.Name))
+
+		assertion := "stdlib"
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CompositeLit:
+				if at, ok := n.Type.(*ast.ArrayType); ok {
+					if _, ok := at.Elt.(*ast.StructType); ok {
+						c.TableTests++
+					}
+				}
+			case *ast.SelectorExpr:
+				x, ok := n.X.(*ast.Ident)
+				if !ok {
+					return true
+				}
+				if x.Name == "t" && n.Sel.Name == "Run" {
+					c.Subtests++
+				}
+				p, ok := imports[x.Name]
+				if !ok {
+					return true
+				}
+				switch {
+				case strings.HasPrefix(p, "github.com/stretchr/testify/"):
+					assertion = "testify/" + filepath.Base(p)
+				case !aggregator.IsStdlibImport(p):
+					bump(&c.Helpers, p+"."+n.Sel.Name)
+				}
+			}
+			return true
+		})
+		bump(&c.Assertions, assertion)
+	}
+	c.Tests += tests
+	return tests > 0, nil
+}
+
+// namingPattern classifies a test function name, e.g. TestThing_Condition.
+func namingPattern(name string) string {
+	parts := strings.Split(strings.TrimPrefix(name, "Test"), "_")
+	switch len(parts) {
+	case 1:
+		return "TestSubject"
+	case 2:
+		return "TestSubject_Condition"
+	default:
+		return "TestSubject_Action_Condition"
+	}
+}
+
+func topKeys(m map[string]int, n int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// Instructions renders the learned conventions as prompt instructions.
+func (c *Conventions) Instructions() string {
+	if c.Tests == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Follow the conventions of previously accepted tests in this package:\n")
+	if a := topKeys(c.Assertions, 1); len(a) > 0 {
+		if a[0] == "stdlib" {
+			b.WriteString("- Use plain testing package checks (t.Errorf/t.Fatalf), no assertion libraries.\n")
+		} else {
+			fmt.Fprintf(&b, "- Use github.com/stretchr/%s for assertions.\n", a[0])
+		}
+	}
+	if n := topKeys(c.Naming, 1); len(n) > 0 {
+		fmt.Fprintf(&b, "- Name tests like %s.\n", n[0])
+	}
+	if c.TableTests*2 >= c.Tests {
+		b.WriteString("- Prefer table-driven tests.\n")
+	}
+	if c.Subtests*2 >= c.Tests {
+		b.WriteString("- Use t.Run subtests.\n")
+	}
+	if h := topKeys(c.Helpers, 5); len(h) > 0 {
+		fmt.Fprintf(&b, "- Reuse these helpers: %s.\n", strings.Join(h, ", "))
+	}
+	return b.String()
+}
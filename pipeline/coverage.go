@@ -0,0 +1,199 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+	"golang.org/x/tools/cover"
+)
+
+// maxGapLines bounds the uncovered lines shown per function in prompts.
+const maxGapLines = 40
+
+// LineRange is the lines Start to End of a file, both included.
+type LineRange struct {
+	Start int
+	End   int
+}
+
+// CoverageGap is a function of the package whose statements the tests do not all run.
+type CoverageGap struct {
+	// Func is the function, or the method as Type.Method.
+	Func string
+	File string
+	Line int
+	// Statements and Covered count the statements of the function and the ones run.
+	Statements int
+	Covered    int
+	// Uncovered are the lines of the blocks not run, in order.
+	Uncovered []LineRange
+	// Code is the source of the Uncovered lines, prefixed with their line numbers.
+	Code string
+	// Trivial is why the function is too simple to need generated tests, e.g. "getter",
+	// "" when it is not.
+	Trivial string
+}
+
+// RunCoverage runs the tests of the package in dir with -coverprofile and parses the
+// profile. Failing tests still produce a profile, they are reported and the profile returned.
+func RunCoverage(ctx context.Context, dir string) ([]*cover.Profile, error) {
+	tmp, err := os.MkdirTemp("", "goptest-coverage")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	profilePath := filepath.Join(tmp, "cover.out")
+	cmd := exec.CommandContext(ctx, "go", "test", "-count=1", "-timeout=5m", "-coverprofile="+profilePath, ".")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("failed to run go test: %v", err)
+		}
+		if _, statErr := os.Stat(profilePath); statErr != nil {
+			return nil, fmt.Errorf("go test failed without a coverage profile:\n%s", out)
+		}
+		log.Printf("Some tests of %s fail, the coverage is of the ones that ran:\n%s", dir, out)
+	}
+	return cover.ParseProfiles(profilePath)
+}
+
+// CoverageGaps returns the functions of the package files in dir that the profiles do not
+// fully cover, the most uncovered statements first and the trivial functions last. Only the
+// functions named in funcs are considered unless it is empty.
+func CoverageGaps(dir string, profiles []*cover.Profile, funcs []string) ([]CoverageGap, error) {
+	paths, err := PackageFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Profiles name the files by import path, the files of one package differ in their base.
+	byBase := make(map[string]*cover.Profile)
+	for _, p := range profiles {
+		byBase[path.Base(p.FileName)] = p
+	}
+	wanted := make(map[string]bool)
+	for _, name := range funcs {
+		if name = strings.TrimSpace(name); name != "" {
+			wanted[name] = true
+		}
+	}
+	var gaps []CoverageGap
+	for _, p := range paths {
+		profile := byBase[filepath.Base(p)]
+		if profile == nil {
+			continue
+		}
+		src, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, p, src, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.Split(string(src), "\n")
+		generated := isGeneratedFile(f)
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil || (len(wanted) > 0 && !wanted[llm.FuncName(fn)]) {
+				continue
+			}
+			if gap, ok := funcGap(fset, fn, profile.Blocks, lines); ok {
+				gap.File = filepath.Base(p)
+				gap.Trivial = trivialReason(fn, generated)
+				gaps = append(gaps, gap)
+			}
+		}
+	}
+	sort.SliceStable(gaps, func(i, j int) bool {
+		if (gaps[i].Trivial == "") != (gaps[j].Trivial == "") {
+			return gaps[i].Trivial == ""
+		}
+		return gaps[i].Statements-gaps[i].Covered > gaps[j].Statements-gaps[j].Covered
+	})
+	return gaps, nil
+}
+
+// funcGap sums the blocks of the function; ok is false when all of them ran.
+func funcGap(fset *token.FileSet, fn *ast.FuncDecl, blocks []cover.ProfileBlock, lines []string) (gap CoverageGap, ok bool) {
+	start, end := fset.Position(fn.Body.Lbrace), fset.Position(fn.Body.Rbrace)
+	gap = CoverageGap{Func: llm.FuncName(fn), Line: fset.Position(fn.Pos()).Line}
+	for _, b := range blocks {
+		if b.StartLine < start.Line || b.StartLine == start.Line && b.StartCol < start.Column ||
+			b.EndLine > end.Line || b.EndLine == end.Line && b.EndCol > end.Column+1 {
+			continue
+		}
+		gap.Statements += b.NumStmt
+		if b.Count > 0 {
+			gap.Covered += b.NumStmt
+			continue
+		}
+		if b.NumStmt == 0 {
+			continue
+		}
+		// Blocks of one branch are often adjacent.
+		if n := len(gap.Uncovered); n > 0 && b.StartLine <= gap.Uncovered[n-1].End+1 {
+			if b.EndLine > gap.Uncovered[n-1].End {
+				gap.Uncovered[n-1].End = b.EndLine
+			}
+			continue
+		}
+		gap.Uncovered = append(gap.Uncovered, LineRange{Start: b.StartLine, End: b.EndLine})
+	}
+	if len(gap.Uncovered) == 0 {
+		return gap, false
+	}
+	var code strings.Builder
+	shown := 0
+	for i, r := range gap.Uncovered {
+		if i > 0 {
+			code.WriteString("...\n")
+		}
+		for line := r.Start; line <= r.End && line <= len(lines); line++ {
+			if shown == maxGapLines {
+				code.WriteString("...\n")
+				gap.Code = code.String()
+				return gap, true
+			}
+			fmt.Fprintf(&code, "%d: %s\n", line, lines[line-1])
+			shown++
+		}
+	}
+	gap.Code = code.String()
+	return gap, true
+}
+
+// CoverageTarget is the -what of the tests of the gaps.
+func CoverageTarget(gaps []CoverageGap) string {
+	names := make([]string, len(gaps))
+	for i, gap := range gaps {
+		names[i] = gap.Func
+	}
+	return "the code of " + strings.Join(names, ", ") + " the existing tests do not cover"
+}
+
+// CoverageInstructions asks for tests running the uncovered lines of the gaps.
+func CoverageInstructions(gaps []CoverageGap) string {
+	var b strings.Builder
+	b.WriteString("The existing tests do not run the following lines. Only write tests whose inputs run them, " +
+		"one branch per test, and do not repeat what the existing tests already cover:\n")
+	for _, gap := range gaps {
+		fmt.Fprintf(&b, "\n%s (%s:%d), %d of %d statements covered:\n```go\n%s```\n",
+			gap.Func, gap.File, gap.Line, gap.Covered, gap.Statements, gap.Code)
+	}
+	return b.String()
+}
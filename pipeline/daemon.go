@@ -0,0 +1,171 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultDaemonAddr is the address goptest daemon listens on by default.
+const DefaultDaemonAddr = "127.0.0.1:7723"
+
+// daemonTimeout bounds the requests to the daemon, which answers from memory; a slower daemon
+// is not worth waiting for.
+const daemonTimeout = 5 * time.Second
+
+// ContextRequest asks the daemon for the module context of a target.
+type ContextRequest struct {
+	// Dir is the directory of the package under test.
+	Dir string `json:"dir"`
+	// Code is the code of the package as sent to the model.
+	Code string `json:"code"`
+	// What is the target, needed for the call sites.
+	What string `json:"what,omitempty"`
+	// Module asks for the summary of the other packages in about ModuleBudget tokens, no
+	// limit when zero.
+	Module       bool `json:"module,omitempty"`
+	ModuleBudget int  `json:"module_budget,omitempty"`
+	// CallSites asks for the calls of What from the other packages.
+	CallSites bool `json:"call_sites,omitempty"`
+}
+
+// ContextResponse is the module context of a target, rendered as prompt instructions.
+type ContextResponse struct {
+	Module string `json:"module,omitempty"`
+	// Omitted is the number of packages that did not fit ModuleBudget.
+	Omitted   int    `json:"omitted,omitempty"`
+	CallSites string `json:"call_sites,omitempty"`
+}
+
+// DaemonStatus describes the index of a running daemon.
+type DaemonStatus struct {
+	Root       string    `json:"root"`
+	ModulePath string    `json:"module_path"`
+	Files      int       `json:"files"`
+	Refreshed  time.Time `json:"refreshed"`
+}
+
+// DaemonHandler serves the context of the targets of one module from its index:
+// POST /context with a ContextRequest and GET /status.
+func DaemonHandler(ix *ModuleIndex) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/context", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST a context request", http.StatusMethodNotAllowed)
+			return
+		}
+		var req ContextRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid context request: %v", err), http.StatusBadRequest)
+			return
+		}
+		resp, err := ix.context(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, resp)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		ix.mu.RLock()
+		status := DaemonStatus{Root: ix.root, ModulePath: ix.modulePath, Files: len(ix.files), Refreshed: ix.refreshed}
+		ix.mu.RUnlock()
+		writeJSON(w, status)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write the response: %v", err)
+	}
+}
+
+// context assembles the context of the request from the index.
+func (ix *ModuleIndex) context(req ContextRequest) (*ContextResponse, error) {
+	dir, err := filepath.Abs(req.Dir)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(ix.root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%s is not in the module at %s", req.Dir, ix.root)
+	}
+	importPath := ix.modulePath
+	if rel != "." {
+		importPath += "/" + filepath.ToSlash(rel)
+	}
+	resp := &ContextResponse{}
+	if req.Module {
+		resp.Module, resp.Omitted = packModuleFor(ix.Packages(), importPath, req.Code, req.ModuleBudget)
+	}
+	if req.CallSites {
+		sites, err := ix.CallSites(dir, importPath, req.Code, req.What)
+		if err != nil {
+			return nil, err
+		}
+		resp.CallSites = callSiteInstructions(sites)
+	}
+	return resp, nil
+}
+
+// WatchModule refreshes the index every interval until stop is closed.
+func WatchModule(ix *ModuleIndex, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			changed, err := ix.Refresh()
+			if err != nil {
+				log.Printf("Failed to refresh the index: %v", err)
+			} else if changed > 0 {
+				log.Printf("Reindexed %d changed files", changed)
+			}
+		}
+	}
+}
+
+// daemonContext asks the daemon at addr for the context of a target.
+func daemonContext(addr string, req ContextRequest) (*ContextResponse, error) {
+	dir, err := filepath.Abs(req.Dir)
+	if err != nil {
+		return nil, err
+	}
+	req.Dir = dir
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: daemonTimeout}
+	httpResp, err := client.Post(daemonURL(addr, "/context"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		var msg bytes.Buffer
+		_, _ = msg.ReadFrom(httpResp.Body)
+		return nil, fmt.Errorf("%s: %s", httpResp.Status, strings.TrimSpace(msg.String()))
+	}
+	var resp ContextResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("invalid context response: %v", err)
+	}
+	return &resp, nil
+}
+
+func daemonURL(addr string, path string) string {
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return strings.TrimSuffix(addr, "/") + path
+	}
+	return "http://" + addr + path
+}
@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sentiens/goptest/aggregator"
+	"github.com/sentiens/goptest/llm"
+)
+
+// DraftBuildTag excludes draft test files from regular builds. Run `go test -tags goptest_draft`
+// to try the drafted tests.
+const DraftBuildTag = "goptest_draft"
+
+// DraftPath returns the draft file path for the requested output path,
+// e.g. foo_test.go becomes foo_draft_test.go.
+func DraftPath(outputPath string) string {
+	base := strings.TrimSuffix(strings.TrimSuffix(outputPath, ".go"), "_test")
+	return base + "_draft_test.go"
+}
+
+// ownerAnnotation marks the team owning a generated file, for routing its review.
+const ownerAnnotation = "// goptest:owner "
+
+// draftHeader returns the header of the draft files, with the owner annotation when the owner
+// is known.
+func draftHeader(owner string) string {
+	header := fmt.Sprintf("//go:build %s\n\n"+
+		"// Code drafted by goptest. Review every test marked with REVIEW, then move it\n"+
+		"// to a regular test file. Run the drafts with: go test -tags %s\n",
+		DraftBuildTag, DraftBuildTag)
+	if owner != "" {
+		header += ownerAnnotation + owner + "\n"
+	}
+	return header + "\n"
+}
+
+// FileOwner returns the owner annotated in the header of a generated file, "" when none.
+func FileOwner(src string) string {
+	for _, line := range strings.Split(src, "\n") {
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+		if strings.HasPrefix(line, ownerAnnotation) {
+			return strings.TrimSpace(strings.TrimPrefix(line, ownerAnnotation))
+		}
+	}
+	return ""
+}
+
+// reviewAnnotation describes what a reviewer should check for the test generated from spec.
+func reviewAnnotation(spec llm.Spec) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "// REVIEW(goptest): %s\n", spec.Name)
+	instructions := strings.TrimSpace(spec.Description)
+	if instructions != "" {
+		b.WriteString("// Spec:\n")
+		for _, line := range strings.Split(instructions, "\n") {
+			b.WriteString("//   " + strings.TrimRight(line, " \t") + "\n")
+		}
+	}
+	b.WriteString("// Check that inputs, assertions and mock expectations match the spec.\n")
+	return b.String()
+}
+
+// DraftFile aggregates the generated responses into a draft test file owned by owner,
+// resolving the conflicts of their declarations with the ones in reg. Every test is
+// annotated with the spec it was generated from and, when traces is not nil, with the trace
+// annotation in traces[i] linking it to its artifacts. When comment is set, every declaration
+// is commented out.
+func DraftFile(reg *aggregator.Registry, pkgName string, owner string, specs []llm.Spec, responses []string, traces []string, comment bool) string {
+	annotated := make([]string, len(responses))
+	for i, resp := range responses {
+		trace := ""
+		if traces != nil {
+			trace = traces[i]
+		}
+		annotated[i] = annotateTest(resp, specs[i], trace)
+	}
+	return draftHeader(owner) + reg.Aggregate(pkgName, annotated, comment)
+}
+
+// annotateTest adds the review annotation of spec and the trace right before its test
+// function, so they are kept when the declarations before the test are dropped as duplicates,
+// or before the response when the test is not found.
+func annotateTest(response string, spec llm.Spec, trace string) string {
+	decl := "func " + spec.Name + "("
+	i := 0
+	if !strings.HasPrefix(response, decl) {
+		// Zero when not found.
+		i = strings.Index(response, "\n"+decl) + 1
+	}
+	return response[:i] + reviewAnnotation(spec) + trace + response[i:]
+}
@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// Spec export formats.
+const (
+	ExportCSV      = "csv"
+	ExportXray     = "xray"
+	ExportTestRail = "testrail"
+)
+
+var stepNumberRe = regexp.MustCompile(`^\s*(\d+[.)]|[-*])\s*`)
+
+// instructionSteps splits spec instructions into steps without their list markers.
+func instructionSteps(instructions string) []string {
+	var steps []string
+	for _, line := range strings.Split(instructions, "\n") {
+		line = strings.TrimSpace(stepNumberRe.ReplaceAllString(line, ""))
+		if line != "" {
+			steps = append(steps, line)
+		}
+	}
+	return steps
+}
+
+// isExpectation reports whether a step describes an expected result rather than an action.
+func isExpectation(step string) bool {
+	lower := strings.ToLower(step)
+	for _, prefix := range []string{"expect", "then ", "assert", "verify", "check ", "ensure"} {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportSpecs writes the spec lists in one of the test-management import formats:
+// a plain CSV, the Xray test case CSV (one row per step) or the TestRail CSV.
+func ExportSpecs(w io.Writer, format string, lists []*llm.SpecList) error {
+	cw := csv.NewWriter(w)
+	var err error
+	switch format {
+	case ExportCSV:
+		err = exportPlainCSV(cw, lists)
+	case ExportXray:
+		err = exportXray(cw, lists)
+	case ExportTestRail:
+		err = exportTestRail(cw, lists)
+	default:
+		return fmt.Errorf("unknown export format %q, use %s, %s or %s", format, ExportCSV, ExportXray, ExportTestRail)
+	}
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func exportPlainCSV(cw *csv.Writer, lists []*llm.SpecList) error {
+	if err := cw.Write([]string{"Target", "Name", "Instructions"}); err != nil {
+		return err
+	}
+	for _, l := range lists {
+		for _, spec := range l.Specs {
+			if err := cw.Write([]string{l.Testing, spec.Name, strings.TrimSpace(spec.Description)}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func exportXray(cw *csv.Writer, lists []*llm.SpecList) error {
+	if err := cw.Write([]string{"Issue Id", "Summary", "Description", "Test Type", "Action", "Data", "Result"}); err != nil {
+		return err
+	}
+	id := 0
+	for _, l := range lists {
+		for _, spec := range l.Specs {
+			id++
+			type step struct{ action, result string }
+			var steps []step
+			for _, s := range instructionSteps(spec.Description) {
+				if isExpectation(s) && len(steps) > 0 && steps[len(steps)-1].result == "" {
+					steps[len(steps)-1].result = s
+					continue
+				}
+				if isExpectation(s) {
+					steps = append(steps, step{result: s})
+					continue
+				}
+				steps = append(steps, step{action: s})
+			}
+			if len(steps) == 0 {
+				steps = append(steps, step{})
+			}
+			for i, s := range steps {
+				summary, description, testType := "", "", ""
+				if i == 0 {
+					summary, description, testType = spec.Name, l.Testing, "Manual"
+				}
+				row := []string{strconv.Itoa(id), summary, description, testType, s.action, "", s.result}
+				if err := cw.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func exportTestRail(cw *csv.Writer, lists []*llm.SpecList) error {
+	if err := cw.Write([]string{"Title", "Section", "Template", "Steps", "Expected Result"}); err != nil {
+		return err
+	}
+	for _, l := range lists {
+		for _, spec := range l.Specs {
+			var actions, expectations []string
+			for _, s := range instructionSteps(spec.Description) {
+				if isExpectation(s) {
+					expectations = append(expectations, s)
+				} else {
+					actions = append(actions, s)
+				}
+			}
+			row := []string{
+				spec.Name,
+				l.Testing,
+				"Test Case (Text)",
+				numbered(actions),
+				numbered(expectations),
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func numbered(lines []string) string {
+	var b strings.Builder
+	for i, l := range lines {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%d. %s", i+1, l)
+	}
+	return b.String()
+}
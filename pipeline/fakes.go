@@ -0,0 +1,293 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sentiens/goptest/aggregator"
+	"github.com/sentiens/goptest/llm"
+)
+
+// FakesFile is the test file the generated fake data helpers are written to.
+const FakesFile = "goptest_fakes_test.go"
+
+// fakeValues are realistic values for string fields, keyed by words found in the field
+// name or its json tag.
+var fakeValues = []struct {
+	word  string
+	value string
+}{
+	{"email", "jane.doe@example.com"},
+	{"url", "https://example.com/jane"},
+	{"uuid", "3f2b6c1e-8a4d-4e7f-9b2a-5c6d7e8f9a0b"},
+	{"phone", "+1-202-555-0143"},
+	{"firstname", "Jane"},
+	{"lastname", "Doe"},
+	{"username", "jdoe"},
+	{"name", "Jane Doe"},
+	{"city", "Springfield"},
+	{"country", "US"},
+	{"zip", "62704"},
+	{"street", "742 Evergreen Terrace"},
+	{"address", "742 Evergreen Terrace, Springfield"},
+	{"currency", "USD"},
+	{"password", "s3cr3t-Passw0rd"},
+	{"token", "tok_4eC39HqLyjWDarjtT1zdp7dc"},
+	{"title", "Quarterly report"},
+	{"description", "A short description of the item"},
+	{"status", "active"},
+	{"id", "id-1024"},
+}
+
+// fakeHelperName returns the name of the helper building values of the named type.
+func fakeHelperName(typeName string) string {
+	return "fake" + strings.ToUpper(typeName[:1]) + typeName[1:]
+}
+
+// fieldWords returns the lower-cased words of a field name and its json tag.
+func fieldWords(field *ast.Field, name string) string {
+	words := strings.ToLower(name)
+	if field.Tag != nil {
+		if tag, err := strconv.Unquote(field.Tag.Value); err == nil {
+			if json, _, _ := strings.Cut(reflect.StructTag(tag).Get("json"), ","); json != "" {
+				words += " " + strings.ToLower(strings.ReplaceAll(json, "_", ""))
+			}
+		}
+	}
+	return words
+}
+
+// hasWord reports whether one of the words ends with suffix, e.g. "userid" has "id".
+func hasWord(words string, suffix string) bool {
+	for _, w := range strings.Fields(words) {
+		if strings.HasSuffix(w, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTag returns the literal value of a gofakeit style fake:"..." tag, if any.
+func fakeTag(field *ast.Field) (string, bool) {
+	if field.Tag == nil {
+		return "", false
+	}
+	tag, err := strconv.Unquote(field.Tag.Value)
+	if err != nil {
+		return "", false
+	}
+	value, ok := reflect.StructTag(tag).Lookup("fake")
+	if !ok || value == "skip" || value == "-" || strings.Contains(value, "{") {
+		return "", false
+	}
+	return value, true
+}
+
+// fakeExpr returns a Go expression with a realistic value of the field type, or "" to keep
+// the zero value. structs are the struct types declared in the package.
+func fakeExpr(typ ast.Expr, words string, tagValue string, hasTag bool, structs map[string]*ast.StructType) string {
+	switch t := typ.(type) {
+	case *ast.Ident:
+		if _, ok := structs[t.Name]; ok {
+			return fakeHelperName(t.Name) + "()"
+		}
+		switch t.Name {
+		case "string":
+			if hasTag {
+				return strconv.Quote(tagValue)
+			}
+			for _, v := range fakeValues {
+				if hasWord(words, v.word) {
+					return strconv.Quote(v.value)
+				}
+			}
+			return strconv.Quote("example " + strings.Fields(words)[0])
+		case "bool":
+			return "true"
+		case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64":
+			if hasTag {
+				if _, err := strconv.ParseInt(tagValue, 10, 64); err == nil {
+					return tagValue
+				}
+			}
+			switch {
+			case hasWord(words, "age"):
+				return "34"
+			case hasWord(words, "port"):
+				return "8080"
+			case hasWord(words, "year"):
+				return "2023"
+			case hasWord(words, "count"), hasWord(words, "quantity"):
+				return "3"
+			}
+			return "42"
+		case "float32", "float64":
+			return "19.99"
+		}
+	case *ast.SelectorExpr:
+		if pkg, ok := t.X.(*ast.Ident); ok && pkg.Name == "time" {
+			switch t.Sel.Name {
+			case "Time":
+				return "time.Date(2023, time.April, 1, 12, 0, 0, 0, time.UTC)"
+			case "Duration":
+				return "5 * time.Second"
+			}
+		}
+	case *ast.ArrayType:
+		if t.Len != nil {
+			return ""
+		}
+		if elem := fakeExpr(t.Elt, words, tagValue, hasTag, structs); elem != "" {
+			return "[]" + typeString(t.Elt) + "{" + elem + "}"
+		}
+	}
+	return ""
+}
+
+// typeString prints a type expression of a struct field.
+func typeString(expr ast.Expr) string {
+	return llm.PrintNode(token.NewFileSet(), expr)
+}
+
+// FakeHelpers generates builder helpers with realistic values for the struct parameters of
+// the target and the structs they contain. Helpers already in existing, signatures keyed by
+// name, are reused. It returns the new declarations and the signatures of all helpers for
+// the target.
+func FakeHelpers(allCode string, whatToTest string, existing map[string]string) (decls []string, signatures []string) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", allCode, 0)
+	if err != nil {
+		return nil, nil
+	}
+	structs := make(map[string]*ast.StructType)
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if st, ok := ts.Type.(*ast.StructType); ok && ts.TypeParams == nil {
+				structs[ts.Name.Name] = st
+			}
+		}
+	}
+
+	_, paramTypes := targetInputs(allCode, whatToTest)
+	var queue []string
+	for name := range paramTypes {
+		if _, ok := structs[name]; ok {
+			queue = append(queue, name)
+		}
+	}
+	sort.Strings(queue)
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		helper := fakeHelperName(name)
+		if sig, ok := existing[helper]; ok {
+			signatures = append(signatures, sig)
+		} else {
+			signatures = append(signatures, fmt.Sprintf("func %s(opts ...func(*%s)) %s", helper, name, name))
+		}
+
+		var fields strings.Builder
+		for _, field := range structs[name].Fields.List {
+			// Nested value structs get their own helper, pointers are left nil to avoid cycles.
+			if id, ok := field.Type.(*ast.Ident); ok {
+				if _, ok := structs[id.Name]; ok {
+					queue = append(queue, id.Name)
+				}
+			}
+			if arr, ok := field.Type.(*ast.ArrayType); ok {
+				if id, ok := arr.Elt.(*ast.Ident); ok && arr.Len == nil {
+					if _, ok := structs[id.Name]; ok {
+						queue = append(queue, id.Name)
+					}
+				}
+			}
+			tagValue, hasTag := fakeTag(field)
+			for _, n := range field.Names {
+				if n.Name == "_" {
+					continue
+				}
+				if expr := fakeExpr(field.Type, fieldWords(field, n.Name), tagValue, hasTag, structs); expr != "" {
+					fmt.Fprintf(&fields, "\t\t%s: %s,\n", n.Name, expr)
+				}
+			}
+		}
+		if _, ok := existing[helper]; ok {
+			continue
+		}
+		decls = append(decls, fmt.Sprintf(
+			"// %s returns a %s with realistic values, opts override single fields.\n"+
+				"func %s(opts ...func(*%s)) %s {\n\tv := %s{\n%s\t}\n\tfor _, opt := range opts {\n\t\topt(&v)\n\t}\n\treturn v\n}",
+			helper, name, helper, name, name, name, fields.String()))
+	}
+	return decls, signatures
+}
+
+// existingFakeHelpers returns the signatures of the fake helpers declared in the test files
+// of dir, keyed by name.
+func existingFakeHelpers(dir string) map[string]string {
+	res := make(map[string]string)
+	paths, _ := filepath.Glob(filepath.Join(dir, "*_test.go"))
+	for _, path := range paths {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			continue
+		}
+		for _, decl := range f.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && strings.HasPrefix(fn.Name.Name, "fake") {
+				sig := *fn
+				sig.Body = nil
+				res[fn.Name.Name] = llm.PrintNode(fset, &sig)
+			}
+		}
+	}
+	return res
+}
+
+// WriteFakeHelpers adds the missing fake helpers of the target to the FakesFile of the package
+// in dir and returns the signatures of the helpers the tests should use.
+func WriteFakeHelpers(dir string, pkgName string, allCode string, whatToTest string) ([]string, error) {
+	decls, signatures := FakeHelpers(allCode, whatToTest, existingFakeHelpers(dir))
+	if len(decls) == 0 {
+		return signatures, nil
+	}
+	path := filepath.Join(dir, FakesFile)
+	responses := []string{}
+	if content, err := os.ReadFile(path); err == nil {
+		responses = append(responses, string(content))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	responses = append(responses, strings.Join(decls, "\n\n"))
+	if err := llm.WriteGoFile(aggregator.Aggregate(pkgName, responses, false), path); err != nil {
+		return nil, err
+	}
+	return signatures, nil
+}
+
+// fakeHelpersInstructions asks the model to build inputs with the fake helpers.
+func fakeHelpersInstructions(signatures []string) string {
+	if len(signatures) == 0 {
+		return ""
+	}
+	return "Build struct inputs with these helpers of the package instead of writing literals, " +
+		"override only the fields the test is about, e.g. fakeUser(func(u *User) { u.Age = -1 }):\n```go\n" +
+		strings.Join(signatures, "\n") + "\n```\n"
+}
@@ -0,0 +1,211 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sentiens/goptest/aggregator"
+	"github.com/sentiens/goptest/llm"
+	"github.com/sentiens/goptest/spec"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConcatFiles combines multiple code files into a single string.
+func ConcatFiles(fs []string) (pkgName string, files string, err error) {
+	return ConcatFilesWithBudget(fs, 0)
+}
+
+// ConcatFilesWithBudget combines the code files like ConcatFiles, keeping the result within
+// about budget tokens counted with the cl100k_base encoding: once the files so far use up the
+// budget, the remaining ones are summarized as the doc comments and signatures of their
+// exported declarations. The first file is always included in full, a budget of zero
+// includes every file in full. See RankFiles to put the most relevant files first.
+func ConcatFilesWithBudget(fs []string, budget int) (pkgName string, files string, err error) {
+	var (
+		rfs        []string
+		used       int
+		summarized []string
+	)
+
+	for i, f := range fs {
+		fc, err := os.ReadFile(f)
+		if err != nil {
+			return "", "", err
+		}
+		content := string(fc)
+		if budget > 0 && i > 0 && used+llm.CountTokens("", content) > budget {
+			if summary, err := PublicAPI(content); err == nil {
+				content = summary
+				summarized = append(summarized, f)
+			}
+		}
+		used += llm.CountTokens("", content)
+		rfs = append(rfs, content)
+
+		var filePkg string
+		scanner := bufio.NewScanner(bytes.NewReader(fc))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "package ") {
+				filePkg = strings.TrimPrefix(line, "package ")
+				break
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return "", "", err
+		}
+		if i == 0 {
+			pkgName = filePkg
+		} else if filePkg != pkgName {
+			return "", "", fmt.Errorf(
+				"code files span multiple packages (%s in %s, %s in %s)",
+				pkgName, fs[0], filePkg, f,
+			)
+		}
+	}
+	if len(summarized) > 0 {
+		log.Printf("Summarized %d files as signatures to fit %d tokens: %s", len(summarized), budget, strings.Join(summarized, ", "))
+	}
+	s := aggregator.Aggregate(pkgName, rfs, false)
+
+	return pkgName, s, nil
+}
+
+// MergeGoFile merges the declarations of code into the Go file at path, keeping its content
+// and skipping the declarations whose name it already declares, and writes it with goimports
+// when any is added. A missing file is created for package pkgName. It returns the names of the
+// added and skipped declarations.
+func MergeGoFile(code string, pkgName string, fPath string) (added []string, skipped []string, err error) {
+	existing := "package " + pkgName + "\n"
+	content, err := os.ReadFile(fPath)
+	switch {
+	case err == nil:
+		existing = string(content)
+	case !os.IsNotExist(err):
+		return nil, nil, err
+	}
+	merged, added, skipped, err := aggregator.Merge(existing, code)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to merge into %s: %v", fPath, err)
+	}
+	if len(added) == 0 {
+		return added, skipped, nil
+	}
+	return added, skipped, llm.WriteGoFile(merged, fPath)
+}
+
+func ImportFeatureFile(featurePath string, specFilePath string) error {
+	content, err := os.ReadFile(featurePath)
+	if err != nil {
+		return err
+	}
+	specList, err := ImportFeature(string(content))
+	if err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(specList)
+	if err != nil {
+		return err
+	}
+	return llm.WriteToFile(string(out), specFilePath)
+}
+
+func ImportLogsFile(logsPath string, function string, maxCases int, specFilePath string) (int, error) {
+	f, err := os.Open(logsPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	observations, err := ReadObservations(f, function)
+	if err != nil {
+		return 0, err
+	}
+	if len(observations) == 0 {
+		return 0, fmt.Errorf("no function calls with inputs and outputs found in %s", logsPath)
+	}
+	lists := ObservationSpecs(observations, maxCases)
+	cases := 0
+	for _, l := range lists {
+		cases += len(l.Specs)
+	}
+	return cases, writeSpecLists(lists, specFilePath)
+}
+
+// SpecFailure is a spec whose test code could not be generated.
+type SpecFailure struct {
+	Testing string
+	Spec    llm.Spec
+	Err     error
+}
+
+// FailedSpecsPath returns the path the failed specs of the spec file are written to.
+func FailedSpecsPath(specFilePath string) string {
+	return strings.TrimSuffix(specFilePath, filepath.Ext(specFilePath)) + ".failed.yaml"
+}
+
+// FailedSpecLists groups the failed specs by target, in the order of their first failure,
+// as the spec file to re-run them from.
+func FailedSpecLists(failures []SpecFailure) []*llm.SpecList {
+	var lists []*llm.SpecList
+	byTarget := make(map[string]*llm.SpecList)
+	for _, f := range failures {
+		l, ok := byTarget[f.Testing]
+		if !ok {
+			l = &llm.SpecList{Testing: f.Testing}
+			byTarget[f.Testing] = l
+			lists = append(lists, l)
+		}
+		l.Specs = append(l.Specs, f.Spec)
+	}
+	return lists
+}
+
+// writeSpecLists writes the spec lists as a YAML spec file, one document per target.
+// WriteFailedSpecs writes the failed specs to the spec file to re-run them from, see
+// FailedSpecsPath.
+func WriteFailedSpecs(failures []SpecFailure, specFilePath string) error {
+	return writeSpecLists(FailedSpecLists(failures), FailedSpecsPath(specFilePath))
+}
+
+func writeSpecLists(lists []*llm.SpecList, specFilePath string) error {
+	var docs []string
+	for _, l := range lists {
+		out, err := yaml.Marshal(l)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, string(out))
+	}
+	return llm.WriteToFile(strings.Join(docs, "---\n"), specFilePath)
+}
+
+func ExportSpecFile(specFilePath string, exportPath string, format string) error {
+	specLists, err := spec.Load(specFilePath)
+	if err != nil {
+		return err
+	}
+	var out strings.Builder
+	if err := ExportSpecs(&out, format, specLists); err != nil {
+		return err
+	}
+	return llm.WriteToFile(out.String(), exportPath)
+}
+
+func loadTestHelpers(dir string) string {
+	root, modulePath, err := llm.FindModuleRoot(dir)
+	if err != nil {
+		log.Println("Not looking for test helpers:", err)
+		return ""
+	}
+	helpers, err := FindTestHelpers(root, modulePath)
+	if err != nil {
+		log.Println("Failed to scan for test helpers:", err)
+		return ""
+	}
+	return testHelpersInstructions(helpers)
+}
@@ -0,0 +1,126 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+	"github.com/sentiens/goptest/spec"
+)
+
+var gherkinStepKeywords = []string{"Given ", "When ", "Then ", "And ", "But ", "* "}
+
+func gherkinKeyword(line string, keywords ...string) (string, bool) {
+	for _, k := range keywords {
+		if strings.HasPrefix(line, k+":") {
+			return strings.TrimSpace(strings.TrimPrefix(line, k+":")), true
+		}
+	}
+	return "", false
+}
+
+type gherkinScenario struct {
+	name     string
+	steps    []string
+	examples []string
+}
+
+// ImportFeature converts a Gherkin feature file into a SpecList: the feature becomes the tested
+// part and every scenario a test case whose instructions are the Background and scenario steps.
+func ImportFeature(content string) (*llm.SpecList, error) {
+	var (
+		feature      string
+		background   []string
+		scenarios    []*gherkinScenario
+		current      *gherkinScenario
+		inBackground bool
+		inExamples   bool
+		inDocStr     bool
+	)
+	addStep := func(step string) {
+		switch {
+		case inBackground:
+			background = append(background, step)
+		case current != nil && inExamples:
+			current.examples = append(current.examples, step)
+		case current != nil:
+			current.steps = append(current.steps, step)
+		}
+	}
+
+	for _, raw := range strings.Split(content, "\n") {
+		line := strings.TrimSpace(raw)
+		if strings.HasPrefix(line, `"""`) || strings.HasPrefix(line, "```") {
+			inDocStr = !inDocStr
+			continue
+		}
+		if inDocStr {
+			addStep("  " + line)
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+		if name, ok := gherkinKeyword(line, "Feature"); ok {
+			feature = name
+			continue
+		}
+		if _, ok := gherkinKeyword(line, "Background"); ok {
+			inBackground, inExamples = true, false
+			continue
+		}
+		if name, ok := gherkinKeyword(line, "Scenario Outline", "Scenario Template", "Scenario", "Example"); ok {
+			current = &gherkinScenario{name: name}
+			scenarios = append(scenarios, current)
+			inBackground, inExamples = false, false
+			continue
+		}
+		if _, ok := gherkinKeyword(line, "Examples", "Scenarios"); ok {
+			inExamples = true
+			continue
+		}
+		if strings.HasPrefix(line, "|") {
+			addStep(line)
+			continue
+		}
+		for _, k := range gherkinStepKeywords {
+			if strings.HasPrefix(line, k) {
+				addStep(line)
+				break
+			}
+		}
+	}
+
+	if feature == "" {
+		return nil, errors.New("no Feature found")
+	}
+	if len(scenarios) == 0 {
+		return nil, fmt.Errorf("feature %q has no scenarios", feature)
+	}
+
+	specList := &llm.SpecList{Testing: feature}
+	for _, sc := range scenarios {
+		var b strings.Builder
+		n := 1
+		for _, step := range append(append([]string{}, background...), sc.steps...) {
+			if strings.HasPrefix(step, "  ") || strings.HasPrefix(step, "|") {
+				b.WriteString("   " + step + "\n")
+				continue
+			}
+			fmt.Fprintf(&b, "%d. %s\n", n, step)
+			n++
+		}
+		if len(sc.examples) > 0 {
+			b.WriteString("Run the steps for every row of these examples:\n")
+			for _, row := range sc.examples {
+				b.WriteString("   " + row + "\n")
+			}
+		}
+		specList.Specs = append(specList.Specs, llm.Spec{
+			Name:        "Test" + spec.Identifier(feature) + "_" + spec.Identifier(sc.name),
+			Description: b.String(),
+		})
+	}
+	return specList, nil
+}
@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var githubIssueRe = regexp.MustCompile(`^([\w.-]+)/([\w.-]+)#(\d+)$`)
+
+// githubIssue is the part of the GitHub issues API response goptest uses.
+type githubIssue struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// FetchGitHubIssue fetches the title and body of an issue referenced as owner/repo#number.
+// GITHUB_TOKEN is used for authentication when set, and GITHUB_API_URL, as set by GitHub
+// Actions, replaces the API of github.com, e.g. for GitHub Enterprise Server.
+func FetchGitHubIssue(ctx context.Context, ref string) (string, error) {
+	m := githubIssueRe.FindStringSubmatch(ref)
+	if m == nil {
+		return "", fmt.Errorf("invalid issue reference %q, expected owner/repo#number", ref)
+	}
+	api := "https://api.github.com"
+	if base := os.Getenv("GITHUB_API_URL"); base != "" {
+		api = strings.TrimSuffix(base, "/")
+	}
+	url := fmt.Sprintf("%s/repos/%s/%s/issues/%s", api, m[1], m[2], m[3])
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: %s", ref, resp.Status)
+	}
+	var issue githubIssue
+	if err := json.NewDecoder(resp.Body).Decode(&issue); err != nil {
+		return "", fmt.Errorf("failed to decode issue %s: %v", ref, err)
+	}
+	return issue.Title + "\n\n" + issue.Body, nil
+}
+
+// issueInstructions wraps issue text as acceptance criteria for the list and cases prompts.
+func issueInstructions(issue string) string {
+	issue = strings.TrimSpace(issue)
+	if issue == "" {
+		return ""
+	}
+	return "The tests must verify the acceptance criteria of this issue. " +
+		"Cover every requirement it states and assert the behavior it asks for:\n\"\"\"\n" + issue + "\n\"\"\"\n"
+}
+
+// loadIssue reads the issue text from a file or fetches it from GitHub.
+func loadIssue(ctx context.Context, issueFile string, issueRef string) (string, error) {
+	var parts []string
+	if issueFile != "" {
+		content, err := os.ReadFile(issueFile)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, string(content))
+	}
+	if issueRef != "" {
+		issue, err := FetchGitHubIssue(ctx, issueRef)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, issue)
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// gitHistory returns the messages of the last n commits touching the given files.
+func gitHistory(ctx context.Context, files []string, n int) (string, error) {
+	if n <= 0 || len(files) == 0 {
+		return "", nil
+	}
+	args := []string{"log", "-n", strconv.Itoa(n), "--no-merges", "--format=commit %h%n%B", "--"}
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, abs)
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = filepath.Dir(files[0])
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git log failed: %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitHistoryInstructions presents commit messages as intent the tests should respect.
+func gitHistoryInstructions(history string) string {
+	if history == "" {
+		return ""
+	}
+	return "Recent commit messages touching this code explain the intended behavior, " +
+		"use them to decide what the tests should expect:\n\"\"\"\n" + history + "\n\"\"\"\n"
+}
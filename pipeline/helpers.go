@@ -0,0 +1,171 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// testHelperDirs are package directory names that conventionally hold shared test helpers.
+var testHelperDirs = map[string]bool{
+	"testutil":     true,
+	"testutils":    true,
+	"testhelper":   true,
+	"testhelpers":  true,
+	"mocks":        true,
+	"mock":         true,
+	"fakes":        true,
+	"testfixtures": true,
+}
+
+// exportedSignatures returns the exported declarations of a file with function bodies removed.
+func exportedSignatures(fset *token.FileSet, f *ast.File) []string {
+	var res []string
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if !d.Name.IsExported() {
+				continue
+			}
+			if d.Recv != nil && !receiverExported(d.Recv) {
+				continue
+			}
+			fn := *d
+			fn.Body = nil
+			res = append(res, llm.PrintNode(fset, &fn))
+		case *ast.GenDecl:
+			if d.Tok == token.IMPORT {
+				continue
+			}
+			var specs []ast.Spec
+			for _, s := range d.Specs {
+				switch s := s.(type) {
+				case *ast.TypeSpec:
+					if s.Name.IsExported() {
+						specs = append(specs, s)
+					}
+				case *ast.ValueSpec:
+					for _, n := range s.Names {
+						if n.IsExported() {
+							specs = append(specs, s)
+							break
+						}
+					}
+				}
+			}
+			if len(specs) == 0 {
+				continue
+			}
+			gd := *d
+			gd.Specs = specs
+			if len(specs) > 1 && !gd.Lparen.IsValid() {
+				gd.Lparen = d.Pos()
+			}
+			res = append(res, llm.PrintNode(fset, &gd))
+		}
+	}
+	return res
+}
+
+func receiverExported(recv *ast.FieldList) bool {
+	if len(recv.List) == 0 {
+		return false
+	}
+	t := recv.List[0].Type
+	for {
+		switch tt := t.(type) {
+		case *ast.StarExpr:
+			t = tt.X
+		case *ast.IndexExpr:
+			t = tt.X
+		case *ast.IndexListExpr:
+			t = tt.X
+		case *ast.Ident:
+			return tt.IsExported()
+		default:
+			return false
+		}
+	}
+}
+
+// FindTestHelpers scans the module rooted at root for shared test helper packages
+// and returns their exported API, keyed by import path. It fails without a module path,
+// the helpers could not be imported.
+func FindTestHelpers(root string, modulePath string) (map[string][]string, error) {
+	if modulePath == "" {
+		return nil, fmt.Errorf("the go.mod of %s declares no module path", root)
+	}
+	res := make(map[string][]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			name := d.Name()
+			if path != root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		if !testHelperDirs[filepath.Base(dir)] {
+			return nil
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			// Broken helper files should not stop the generation.
+			log.Printf("skipping test helper %s: %v", path, err)
+			return nil
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return err
+		}
+		importPath := modulePath
+		if rel != "." {
+			importPath += "/" + filepath.ToSlash(rel)
+		}
+		if strings.HasSuffix(path, "_test.go") {
+			// Test files of a helper package are not importable.
+			return nil
+		}
+		res[importPath] = append(res[importPath], exportedSignatures(fset, f)...)
+		return nil
+	})
+	return res, err
+}
+
+// testHelpersInstructions renders the discovered helpers as prompt instructions.
+func testHelpersInstructions(helpers map[string][]string) string {
+	if len(helpers) == 0 {
+		return ""
+	}
+	paths := make([]string, 0, len(helpers))
+	for p := range helpers {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	b.WriteString("The repository already maintains these test helpers. " +
+		"Reuse them instead of writing your own fakes or mocks when they fit:\n")
+	for _, p := range paths {
+		if len(helpers[p]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "```go\n// import %q\n%s\n```\n", p, strings.Join(helpers[p], "\n\n"))
+	}
+	return b.String()
+}
@@ -0,0 +1,205 @@
+package pipeline
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexedFile is a Go file of the module as parsed by the ModuleIndex.
+type indexedFile struct {
+	// path is absolute, rel is relative to the module root and names the file in positions.
+	path    string
+	rel     string
+	modTime time.Time
+	size    int64
+	src     []byte
+	fset    *token.FileSet
+	// f is nil when the file does not parse.
+	f *ast.File
+}
+
+// ModuleIndex keeps the parsed Go files of a module, so the module summary and the call sites
+// are assembled without reading and parsing the module again. Refresh parses only the files
+// changed since the previous refresh.
+//
+// A ModuleIndex is safe for concurrent use.
+type ModuleIndex struct {
+	root       string
+	modulePath string
+
+	mu        sync.RWMutex
+	files     map[string]*indexedFile
+	refreshed time.Time
+}
+
+// NewModuleIndex returns an empty index of the module rooted at root, see Refresh.
+func NewModuleIndex(root string, modulePath string) (*ModuleIndex, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	return &ModuleIndex{root: root, modulePath: modulePath, files: make(map[string]*indexedFile)}, nil
+}
+
+// Refresh parses the Go files added or modified since the last refresh and forgets the
+// removed ones. Hidden, vendor and testdata directories are skipped. It returns the number of
+// files parsed or removed.
+func (ix *ModuleIndex) Refresh() (changed int, err error) {
+	ix.mu.RLock()
+	old := ix.files
+	ix.mu.RUnlock()
+
+	files := make(map[string]*indexedFile, len(old))
+	err = filepath.WalkDir(ix.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			name := d.Name()
+			if p != ix.root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(p, ".go") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if prev := old[p]; prev != nil && prev.modTime.Equal(info.ModTime()) && prev.size == info.Size() {
+			files[p] = prev
+			return nil
+		}
+		src, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(ix.root, p)
+		if err != nil {
+			return err
+		}
+		file := &indexedFile{path: p, rel: rel, modTime: info.ModTime(), size: info.Size(), src: src, fset: token.NewFileSet()}
+		file.f, err = parser.ParseFile(file.fset, rel, src, parser.ParseComments)
+		if err != nil {
+			log.Printf("skipping %s while indexing the module: %v", p, err)
+			file.f = nil
+		}
+		files[p] = file
+		changed++
+		return nil
+	})
+	for p := range old {
+		if files[p] == nil {
+			changed++
+		}
+	}
+
+	ix.mu.Lock()
+	ix.files = files
+	ix.refreshed = time.Now()
+	ix.mu.Unlock()
+	return changed, err
+}
+
+// sortedFiles returns the parsed files of the index sorted by path.
+func (ix *ModuleIndex) sortedFiles() []*indexedFile {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	var res []*indexedFile
+	for _, file := range ix.files {
+		if file.f != nil {
+			res = append(res, file)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].path < res[j].path
+	})
+	return res
+}
+
+// Packages summarizes the packages of the module, sorted by import path, like ModulePackages.
+func (ix *ModuleIndex) Packages() []*PackageSummary {
+	byDir := make(map[string]*PackageSummary)
+	for _, file := range ix.sortedFiles() {
+		if strings.HasSuffix(file.path, "_test.go") || file.f.Name.Name == "main" {
+			continue
+		}
+		dir := filepath.Dir(file.rel)
+		pkg, ok := byDir[dir]
+		if !ok {
+			importPath := ix.modulePath
+			if dir != "." {
+				importPath += "/" + filepath.ToSlash(dir)
+			}
+			pkg = &PackageSummary{ImportPath: importPath, Imports: make(map[string]bool)}
+			byDir[dir] = pkg
+		}
+		for _, imp := range file.f.Imports {
+			if p, err := strconv.Unquote(imp.Path.Value); err == nil {
+				pkg.Imports[p] = true
+			}
+		}
+		pkg.Signatures = append(pkg.Signatures, exportedSignatures(file.fset, file.f)...)
+	}
+	var res []*PackageSummary
+	for _, pkg := range byDir {
+		if len(pkg.Signatures) > 0 {
+			res = append(res, pkg)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ImportPath < res[j].ImportPath
+	})
+	return res
+}
+
+// CallSites finds the calls of the target in the packages of the module importing the
+// package in pkgDir, like FindCallSites.
+func (ix *ModuleIndex) CallSites(pkgDir string, importPath string, allCode string, whatToTest string) ([]CallSite, error) {
+	pkgName, funcs, methods, err := targetCallNames(allCode, whatToTest)
+	if err != nil || len(funcs)+len(methods) == 0 {
+		return nil, err
+	}
+	return ix.callSites(pkgDir, importPath, pkgName, funcs, methods)
+}
+
+func (ix *ModuleIndex) callSites(pkgDir string, importPath string, pkgName string, funcs map[string]bool, methods map[string]bool) ([]CallSite, error) {
+	pkgDir, err := filepath.Abs(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	var res []CallSite
+	for _, file := range ix.sortedFiles() {
+		// Tests of the package itself may be external but are not call sites of other packages.
+		if isDraftFile(file.path) || filepath.Dir(file.path) == pkgDir {
+			continue
+		}
+		name := importName(file.f, importPath, pkgName)
+		if name == "" {
+			continue
+		}
+		for _, site := range fileCallSites(file.fset, file.f, file.src, name, funcs, methods) {
+			site.test = strings.HasSuffix(file.path, "_test.go")
+			res = append(res, site)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return !res[i].test && res[j].test
+	})
+	if len(res) > maxCallSites {
+		res = res[:maxCallSites]
+	}
+	return res, nil
+}
@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+const (
+	maxInputExamples    = 20
+	maxInputExampleSize = 300
+	maxFixtures         = 10
+)
+
+// InputExample is a realistic value for a target's parameter found in the module.
+type InputExample struct {
+	// Source is the file the example was found in, relative to the module root.
+	Source string
+	// Code is the Go expression: a call of the target or a literal of a parameter type.
+	Code string
+}
+
+// targetInputs returns the names of the target functions and of their parameter types.
+func targetInputs(allCode string, whatToTest string) (funcs map[string]bool, types map[string]bool) {
+	fns, _, err := llm.FindTargetFuncs(allCode, whatToTest)
+	if err != nil {
+		return nil, nil
+	}
+	funcs = make(map[string]bool)
+	types = make(map[string]bool)
+	for _, fn := range fns {
+		funcs[fn.Name.Name] = true
+		for _, p := range fn.Type.Params.List {
+			if name := llm.BaseTypeName(p.Type); name != "" {
+				types[name] = true
+			}
+		}
+	}
+	return funcs, types
+}
+
+// inputExamples collects the calls of funcs and the composite literals of types in the file.
+func inputExamples(fset *token.FileSet, f *ast.File, funcs map[string]bool, types map[string]bool) []string {
+	var res []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		var example ast.Node
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			// The target's own declaration is not an example of its usage.
+			if n.Recv == nil && funcs[n.Name.Name] {
+				return false
+			}
+		case *ast.CallExpr:
+			name := ""
+			switch fn := n.Fun.(type) {
+			case *ast.Ident:
+				name = fn.Name
+			case *ast.SelectorExpr:
+				name = fn.Sel.Name
+			}
+			if funcs[name] && len(n.Args) > 0 {
+				example = n
+			}
+		case *ast.CompositeLit:
+			if n.Type != nil && types[llm.BaseTypeName(n.Type)] {
+				example = n
+			}
+		}
+		if example == nil {
+			return true
+		}
+		if code := llm.PrintNode(fset, example); code != "" && len(code) <= maxInputExampleSize {
+			res = append(res, code)
+		}
+		return false
+	})
+	return res
+}
+
+// MineInputs scans the Go files of the module rooted at root for realistic inputs of the
+// target: calls of it and literals of its parameter types in tests and example usages.
+// Examples from test files come first.
+func MineInputs(root string, allCode string, whatToTest string) ([]InputExample, error) {
+	funcs, types := targetInputs(allCode, whatToTest)
+	if len(funcs) == 0 {
+		return nil, nil
+	}
+	var tests, usages []InputExample
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			name := d.Name()
+			if path != root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || isDraftFile(path) {
+			return nil
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			log.Printf("skipping %s while mining inputs: %v", path, err)
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		for _, code := range inputExamples(fset, f, funcs, types) {
+			if seen[code] {
+				continue
+			}
+			seen[code] = true
+			example := InputExample{Source: filepath.ToSlash(rel), Code: code}
+			if strings.HasSuffix(path, "_test.go") {
+				tests = append(tests, example)
+			} else {
+				usages = append(usages, example)
+			}
+		}
+		return nil
+	})
+	res := append(tests, usages...)
+	if len(res) > maxInputExamples {
+		res = res[:maxInputExamples]
+	}
+	return res, err
+}
+
+// fixtureFiles lists the files of the package's testdata directory.
+func fixtureFiles(pkgDir string) []string {
+	var files []string
+	root := filepath.Join(pkgDir, "testdata")
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || len(files) >= maxFixtures {
+			return nil
+		}
+		if rel, err := filepath.Rel(pkgDir, path); err == nil {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+// inputCorpusInstructions renders the mined inputs and fixtures as prompt instructions.
+func inputCorpusInstructions(examples []InputExample, fixtures []string) string {
+	var b strings.Builder
+	if len(examples) > 0 {
+		b.WriteString("The module already uses these realistic inputs, " +
+			"base the test inputs on them instead of placeholder values like \"foo\" or \"bar\":\n```go\n")
+		for _, e := range examples {
+			fmt.Fprintf(&b, "// %s\n%s\n", e.Source, e.Code)
+		}
+		b.WriteString("```\n")
+	}
+	if len(fixtures) > 0 {
+		b.WriteString("These fixture files exist and can be loaded by the tests: " + strings.Join(fixtures, ", ") + "\n")
+	}
+	return b.String()
+}
+
+// loadInputCorpus mines the module of pkgDir for inputs of the target, see MineInputs.
+func loadInputCorpus(pkgDir string, allCode string, whatToTest string) string {
+	root, _, err := llm.FindModuleRoot(pkgDir)
+	if err != nil {
+		log.Println("Not mining inputs:", err)
+		root = pkgDir
+	}
+	examples, err := MineInputs(root, allCode, whatToTest)
+	if err != nil {
+		log.Println("Failed to mine inputs:", err)
+	}
+	return inputCorpusInstructions(examples, fixtureFiles(pkgDir))
+}
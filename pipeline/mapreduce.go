@@ -0,0 +1,41 @@
+package pipeline
+
+import (
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// ChunkCode splits the code into parts of about budget tokens. Every part is a file with the
+// package clause and imports of the code and a run of its top-level declarations, in source
+// order; declarations larger than the budget get a part of their own.
+func ChunkCode(allCode string, budget int) ([]string, error) {
+	header, decls, err := codeChunks(allCode, "")
+	if err != nil {
+		return nil, err
+	}
+	headerTokens := llm.CountTokens("", header)
+	var (
+		chunks  []string
+		current strings.Builder
+		used    int
+	)
+	flush := func() {
+		if current.Len() > 0 {
+			chunks = append(chunks, header+current.String())
+			current.Reset()
+		}
+		used = headerTokens
+	}
+	flush()
+	for _, d := range decls {
+		tokens := llm.CountTokens("", d.code)
+		if current.Len() > 0 && used+tokens > budget {
+			flush()
+		}
+		current.WriteString(d.code + "\n\n")
+		used += tokens
+	}
+	flush()
+	return chunks, nil
+}
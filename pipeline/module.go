@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// PackageSummary is the exported API of a package of the module.
+type PackageSummary struct {
+	ImportPath string
+	// Signatures are the exported declarations of the package's non-test files.
+	Signatures []string
+	// Imports are the import paths used by the package's non-test files.
+	Imports map[string]bool
+}
+
+func (p *PackageSummary) render() string {
+	return fmt.Sprintf("```go\n// import %q\n%s\n```\n", p.ImportPath, strings.Join(p.Signatures, "\n\n"))
+}
+
+// ModulePackages summarizes the packages of the module rooted at root, sorted by import path.
+// Packages without exported declarations are skipped.
+func ModulePackages(root string, modulePath string) ([]*PackageSummary, error) {
+	ix, err := NewModuleIndex(root, modulePath)
+	if err != nil {
+		return nil, err
+	}
+	_, err = ix.Refresh()
+	return ix.Packages(), err
+}
+
+// commonPrefixElements returns the number of leading path elements a and b share.
+func commonPrefixElements(a, b string) int {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	n := 0
+	for n < len(as) && n < len(bs) && as[n] == bs[n] {
+		n++
+	}
+	return n
+}
+
+// PackModule packs the package summaries for the target package into about budget tokens,
+// no limit when budget is zero. Packages are packed in the order they likely matter to the
+// target's tests: the ones the target imports, the ones importing the target, then the
+// others by their distance in the directory tree. Packages that don't fit are returned as
+// omitted.
+func PackModule(pkgs []*PackageSummary, targetPath string, targetImports map[string]bool, budget int) (packed []*PackageSummary, omitted []string) {
+	rank := func(p *PackageSummary) int {
+		switch {
+		case targetImports[p.ImportPath]:
+			return 0
+		case p.Imports[targetPath]:
+			return 1
+		}
+		return 2
+	}
+	var ordered []*PackageSummary
+	for _, p := range pkgs {
+		if p.ImportPath != targetPath {
+			ordered = append(ordered, p)
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ri, rj := rank(ordered[i]), rank(ordered[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return commonPrefixElements(ordered[i].ImportPath, targetPath) > commonPrefixElements(ordered[j].ImportPath, targetPath)
+	})
+
+	used := 0
+	for _, p := range ordered {
+		tokens := llm.CountTokens("", p.render())
+		if budget > 0 && used+tokens > budget {
+			omitted = append(omitted, p.ImportPath)
+			continue
+		}
+		used += tokens
+		packed = append(packed, p)
+	}
+	return packed, omitted
+}
+
+// wholeModuleInstructions renders the packed module as prompt context.
+func wholeModuleInstructions(packed []*PackageSummary, omitted []string) string {
+	if len(packed) == 0 && len(omitted) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("The other packages of the module export this API. " +
+		"Use their real types, constructors and functions when the tests need them instead of inventing or redefining them:\n")
+	for _, p := range packed {
+		b.WriteString(p.render())
+	}
+	if len(omitted) > 0 {
+		b.WriteString("These packages of the module did not fit and are not shown, do not guess their API: " +
+			strings.Join(omitted, ", ") + "\n")
+	}
+	return b.String()
+}
+
+// loadWholeModule summarizes the module of pkgDir around the target package into about
+// budget tokens, see PackModule. The summary is asked from the goptest daemon at daemon when
+// set, and assembled here when the daemon is not reachable.
+func loadWholeModule(pkgDir string, allCode string, budget int, daemon string) string {
+	if daemon != "" {
+		resp, err := daemonContext(daemon, ContextRequest{Dir: pkgDir, Code: allCode, Module: true, ModuleBudget: budget})
+		if err == nil {
+			warnOmittedPackages(resp.Omitted)
+			return resp.Module
+		}
+		log.Printf("Loading the module without the daemon at %s: %v", daemon, err)
+	}
+	root, modulePath, err := llm.FindModuleRoot(pkgDir)
+	if err != nil {
+		log.Println("Not packing the module:", err)
+		return ""
+	}
+	targetPath, err := packageImportPath(pkgDir)
+	if err != nil {
+		log.Println("Not packing the module:", err)
+		return ""
+	}
+	pkgs, err := ModulePackages(root, modulePath)
+	if err != nil {
+		log.Println("Failed to summarize the module:", err)
+	}
+	module, omitted := packModuleFor(pkgs, targetPath, allCode, budget)
+	warnOmittedPackages(omitted)
+	return module
+}
+
+// packModuleFor packs the summaries for the target package with the code allCode, see
+// PackModule, and renders them. It returns the number of packages left out.
+func packModuleFor(pkgs []*PackageSummary, targetPath string, allCode string, budget int) (string, int) {
+	targetImports := make(map[string]bool)
+	if f, err := parser.ParseFile(token.NewFileSet(), "", allCode, parser.ImportsOnly); err == nil {
+		for _, imp := range f.Imports {
+			if p, err := strconv.Unquote(imp.Path.Value); err == nil {
+				targetImports[p] = true
+			}
+		}
+	}
+	packed, omitted := PackModule(pkgs, targetPath, targetImports, budget)
+	return wholeModuleInstructions(packed, omitted), len(omitted)
+}
+
+func warnOmittedPackages(n int) {
+	if n > 0 {
+		fmt.Printf("Warning: %d packages of the module did not fit the context window and are left out\n", n)
+	}
+}
@@ -0,0 +1,160 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+	"github.com/sentiens/goptest/spec"
+)
+
+// maxObservationLine is the longest log line read, longer lines are skipped.
+const maxObservationLine = 1 << 20
+
+// Observation is a call of a function recorded in production logs or traces.
+type Observation struct {
+	Function string
+	// Input, Output and Error are the JSON encoded values, empty when not recorded.
+	Input  string
+	Output string
+	Error  string
+}
+
+// Field names accepted for the parts of an observation, the first one present wins.
+var (
+	observationFunctionKeys = []string{"function", "func", "method", "span", "name"}
+	observationInputKeys    = []string{"input", "inputs", "args", "arguments", "params", "request"}
+	observationOutputKeys   = []string{"output", "outputs", "result", "results", "return", "response"}
+	observationErrorKeys    = []string{"error", "err"}
+)
+
+// observationField returns the JSON of the first of the keys in the record.
+func observationField(record map[string]json.RawMessage, keys []string) string {
+	for _, k := range keys {
+		if v, ok := record[k]; ok && string(v) != "null" {
+			return compactJSON(v)
+		}
+	}
+	return ""
+}
+
+// compactJSON normalizes a JSON value so equal values have the same encoding: whitespace is
+// removed and object keys are sorted.
+func compactJSON(raw json.RawMessage) string {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return string(raw)
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return string(raw)
+	}
+	return string(out)
+}
+
+// parseObservation reads an observation from a JSON log line. The fields may be nested in an
+// "attributes" object as in OpenTelemetry spans. ok is false for lines that are not JSON
+// objects or miss the function or both input and output.
+func parseObservation(line []byte) (obs Observation, ok bool) {
+	var record map[string]json.RawMessage
+	if err := json.Unmarshal(line, &record); err != nil {
+		return obs, false
+	}
+	if raw, ok := record["attributes"]; ok {
+		var attributes map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &attributes); err == nil {
+			for k, v := range attributes {
+				if _, ok := record[k]; !ok {
+					record[k] = v
+				}
+			}
+		}
+	}
+	var function string
+	for _, k := range observationFunctionKeys {
+		if err := json.Unmarshal(record[k], &function); err == nil && function != "" {
+			break
+		}
+	}
+	obs = Observation{
+		Function: function,
+		Input:    observationField(record, observationInputKeys),
+		Output:   observationField(record, observationOutputKeys),
+	}
+	if errJSON := observationField(record, observationErrorKeys); errJSON != "" {
+		var msg string
+		if err := json.Unmarshal([]byte(errJSON), &msg); err == nil {
+			obs.Error = msg
+		} else {
+			obs.Error = errJSON
+		}
+	}
+	if obs.Function == "" || obs.Input == "" || (obs.Output == "" && obs.Error == "") {
+		return obs, false
+	}
+	return obs, true
+}
+
+// ReadObservations reads the calls recorded in JSON lines logs. Only calls of function are
+// returned unless it is empty, lines that aren't call records are skipped. Duplicate calls
+// are returned once.
+func ReadObservations(r io.Reader, function string) ([]Observation, error) {
+	var res []Observation
+	seen := make(map[Observation]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxObservationLine)
+	for scanner.Scan() {
+		obs, ok := parseObservation(scanner.Bytes())
+		if !ok || seen[obs] {
+			continue
+		}
+		if function != "" && obs.Function != function && !strings.HasSuffix(obs.Function, "."+function) {
+			continue
+		}
+		seen[obs] = true
+		res = append(res, obs)
+	}
+	return res, scanner.Err()
+}
+
+// ObservationSpecs turns the observations into spec lists, one per function with at most
+// maxCases cases each, whose expected values are the recorded outputs.
+func ObservationSpecs(observations []Observation, maxCases int) []*llm.SpecList {
+	byFunction := make(map[string]*llm.SpecList)
+	var functions []string
+	for _, obs := range observations {
+		l, ok := byFunction[obs.Function]
+		if !ok {
+			l = &llm.SpecList{Testing: obs.Function}
+			byFunction[obs.Function] = l
+			functions = append(functions, obs.Function)
+		}
+		if maxCases > 0 && len(l.Specs) >= maxCases {
+			continue
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "Call %s with the inputs observed in production: %s\n", obs.Function, obs.Input)
+		if obs.Error != "" {
+			fmt.Fprintf(&b, "Expect an error: %s\n", obs.Error)
+		} else {
+			fmt.Fprintf(&b, "Expect exactly the observed output: %s\n", obs.Output)
+		}
+		l.Specs = append(l.Specs, llm.Spec{
+			Name:        fmt.Sprintf("Test%s_Observed%d", spec.Identifier(obs.Function), len(l.Specs)+1),
+			Description: b.String(),
+		})
+	}
+	sort.Strings(functions)
+	res := make([]*llm.SpecList, 0, len(functions))
+	for _, f := range functions {
+		res = append(res, byFunction[f])
+	}
+	return res
+}
@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+	"github.com/sentiens/goptest/spec"
+)
+
+// PackageRoute is a package of the code files and the spec file targets it declares.
+type PackageRoute struct {
+	Dir     string
+	Paths   []string
+	Targets []string
+}
+
+// RoutePackages groups the code files by package directory and routes every target of the
+// spec file to the package declaring the functions, methods or types it names. It returns
+// nil when the code files are a single package, and fails when a target is declared in no
+// package or in several.
+func RoutePackages(paths []string, specFilePath string) ([]PackageRoute, error) {
+	var routes []*PackageRoute
+	byDir := make(map[string]*PackageRoute)
+	for _, p := range paths {
+		dir := filepath.Dir(p)
+		r, ok := byDir[dir]
+		if !ok {
+			r = &PackageRoute{Dir: dir}
+			byDir[dir] = r
+			routes = append(routes, r)
+		}
+		r.Paths = append(r.Paths, p)
+	}
+	if len(routes) < 2 {
+		return nil, nil
+	}
+
+	codes := make([]string, len(routes))
+	for i, r := range routes {
+		var err error
+		if _, codes[i], err = ConcatFiles(r.Paths); err != nil {
+			return nil, err
+		}
+	}
+	specLists, err := spec.Load(specFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load test specs: %v", err)
+	}
+	routed := make(map[string]bool)
+	for _, l := range specLists {
+		if routed[l.Testing] {
+			continue
+		}
+		routed[l.Testing] = true
+		var declaring []*PackageRoute
+		for i, r := range routes {
+			if declaresTarget(codes[i], l.Testing) {
+				declaring = append(declaring, r)
+			}
+		}
+		switch len(declaring) {
+		case 0:
+			return nil, fmt.Errorf("no package of the code files declares %q", l.Testing)
+		case 1:
+			declaring[0].Targets = append(declaring[0].Targets, l.Testing)
+		default:
+			dirs := make([]string, len(declaring))
+			for i, r := range declaring {
+				dirs[i] = r.Dir
+			}
+			return nil, fmt.Errorf("%q is declared in several packages: %s", l.Testing, strings.Join(dirs, ", "))
+		}
+	}
+
+	var res []PackageRoute
+	for _, r := range routes {
+		if len(r.Targets) > 0 {
+			res = append(res, *r)
+		}
+	}
+	return res, nil
+}
+
+// declaresTarget reports whether the code declares a function, method or type that the
+// free-text target mentions.
+func declaresTarget(code string, target string) bool {
+	if funcs, _, err := llm.FindTargetFuncs(code, target); err == nil && len(funcs) > 0 {
+		return true
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "", code, 0)
+	if err != nil {
+		return false
+	}
+	words := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(target, func(r rune) bool { return r == ' ' || r == ',' || r == '.' }) {
+		words[w] = true
+	}
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, s := range gen.Specs {
+			if ts, ok := s.(*ast.TypeSpec); ok && words[ts.Name.Name] {
+				return true
+			}
+		}
+	}
+	return false
+}
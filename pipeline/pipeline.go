@@ -0,0 +1,801 @@
+// Package pipeline runs the stages of goptest on the code under test: it loads the code,
+// grounds the prompts in the module and drafts, checks and merges the generated tests.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/build"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sentiens/goptest/aggregator"
+	"github.com/sentiens/goptest/llm"
+	"github.com/sentiens/goptest/spec"
+)
+
+var (
+	// ErrSpecSkipped is the error of the specs skipped by CodeOptions.RunSpecs, left out of
+	// the draft and of the failed specs.
+	ErrSpecSkipped = errors.New("skipped")
+	// ErrAlreadyTested is returned by ListInstructions when every function the target
+	// mentions already has tests.
+	ErrAlreadyTested = errors.New("already tested")
+	// ErrNothingToDraft is returned by GenerateCode when no test was generated, or every one
+	// was skipped or rejected.
+	ErrNothingToDraft = errors.New("every test was skipped or rejected, nothing to draft")
+)
+
+// Input is the loaded code under test.
+type Input struct {
+	Paths   []string
+	Dir     string
+	PkgName string
+	Code    string
+	Extra   string
+	Strict  bool
+	// Commented comments out the whole draft, see -uncommented.
+	Commented bool
+	// Full is all of the code files when Code had to be reduced to the budget.
+	Full   string
+	Budget int
+	// PublicAPI is set when Code is reduced to the exported API and PkgName is the
+	// external test package.
+	PublicAPI bool
+	// Owner is the team owning the generated tests, "" when unknown.
+	Owner string
+	// Daemon is the address of the goptest daemon, "" to assemble the context in process.
+	Daemon string
+}
+
+// LoadOptions select how the code under test is loaded.
+type LoadOptions struct {
+	// Model and MaxTokens size the code budget and the room left for the module.
+	Model     string
+	MaxTokens int
+	// CodeBudget is the token budget of the code files, 0 to derive it from the context
+	// window of Model and -1 for no limit.
+	CodeBudget int
+	// Funcs scopes the code to the functions, methods or types and their direct
+	// dependencies.
+	Funcs []string
+	// Retrieve keeps the declarations most relevant to the target over the budget, with the
+	// embeddings of Embedder, instead of summarizing whole files.
+	Retrieve bool
+	Embedder func() (llm.Embedder, error)
+	// ReuseHelpers adds the module's shared test helpers to the instructions.
+	ReuseHelpers bool
+	// WholeModule adds the exported API of every package of the module.
+	WholeModule bool
+	// PublicAPI reduces the code to its exported API for black-box tests.
+	PublicAPI bool
+	Extra     string
+	Strict    bool
+	Commented bool
+	Owner     string
+	Daemon    string
+}
+
+// PackageFiles returns the Go files of the package in dir that build for the current platform,
+// test files and files excluded by build constraints left out.
+func PackageFiles(dir string) ([]string, error) {
+	pkg, err := build.Default.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, len(pkg.GoFiles))
+	for i, name := range pkg.GoFiles {
+		files[i] = filepath.Join(dir, name)
+	}
+	return files, nil
+}
+
+// retrieveCode concatenates the code files and, when they exceed the budget, keeps the
+// declarations most relevant to the target. It falls back to summarizing files when the
+// embeddings are not available.
+func retrieveCode(ctx context.Context, embedder func() (llm.Embedder, error), paths []string, whatToTest string, budget int) (pkgName string, code string, err error) {
+	pkgName, code, err = ConcatFiles(paths)
+	if err != nil || llm.CountTokens("", code) <= budget {
+		return pkgName, code, err
+	}
+	err = errors.New("no embeddings API")
+	if embedder != nil {
+		var e llm.Embedder
+		if e, err = embedder(); err == nil {
+			var relevant string
+			relevant, err = RelevantCode(ctx, e, code, whatToTest, budget)
+			if err == nil {
+				return pkgName, relevant, nil
+			}
+		}
+	}
+	fmt.Printf("Warning: retrieving the relevant code failed, summarizing files instead: %v\n", err)
+	return ConcatFilesWithBudget(paths, budget)
+}
+
+// Load reads the code files. Files beyond the code budget are summarized, the least relevant
+// to whatToTest first.
+func Load(ctx context.Context, paths []string, whatToTest string, opts LoadOptions) (Input, error) {
+	if len(paths) == 0 {
+		return Input{}, errors.New("no code files")
+	}
+	in := Input{
+		Paths:     paths,
+		Dir:       filepath.Dir(paths[0]),
+		Extra:     opts.Extra,
+		Strict:    opts.Strict,
+		Commented: opts.Commented,
+		Owner:     opts.Owner,
+		Daemon:    opts.Daemon,
+	}
+	budget := opts.CodeBudget
+	if budget == 0 {
+		budget = llm.CodeBudget(opts.Model, opts.MaxTokens)
+	}
+	if budget > 0 {
+		paths = llm.RankFiles(paths, whatToTest)
+	} else {
+		budget = 0
+	}
+	var err error
+	if len(opts.Funcs) > 0 {
+		var full string
+		if in.PkgName, full, err = ConcatFiles(in.Paths); err != nil {
+			return Input{}, fmt.Errorf("failed to concatenate code files: %v", err)
+		}
+		if in.Code, err = ScopeCode(full, opts.Funcs); err != nil {
+			return Input{}, fmt.Errorf("failed to scope the code to %s: %v", strings.Join(opts.Funcs, ","), err)
+		}
+	} else if opts.Retrieve && budget > 0 && whatToTest != "" {
+		in.PkgName, in.Code, err = retrieveCode(ctx, opts.Embedder, paths, whatToTest, budget)
+	} else {
+		in.PkgName, in.Code, err = ConcatFilesWithBudget(paths, budget)
+	}
+	if err != nil {
+		return Input{}, fmt.Errorf("failed to concatenate code files: %v", err)
+	}
+	// The scoped code is all the prompts need, it is not reduced to the budget.
+	if budget > 0 && len(opts.Funcs) == 0 {
+		in.Budget = budget
+		if _, full, err := ConcatFiles(in.Paths); err == nil && full != in.Code {
+			in.Full = full
+		}
+	}
+	if tokens := llm.CountTokens(opts.Model, in.Code); budget > 0 && tokens > budget {
+		fmt.Printf("Warning: the code files have %d tokens, more than the %d tokens left in the context window of %s\n",
+			tokens, budget, opts.Model)
+	}
+	if in.Strict {
+		if err := strictCheckPackage(in.PkgName); err != nil {
+			return Input{}, fmt.Errorf("strict mode: %v", err)
+		}
+	}
+	if opts.ReuseHelpers {
+		if helpers := loadTestHelpers(in.Dir); helpers != "" {
+			in.Extra = strings.TrimSpace(in.Extra + "\n" + helpers)
+		}
+	}
+	if opts.WholeModule {
+		// The module gets what the code files leave of the context window.
+		moduleBudget := 0
+		if window := llm.ContextWindow(opts.Model); window > 0 {
+			moduleBudget = window - opts.MaxTokens - llm.PromptReserveTokens - llm.CountTokens(opts.Model, in.Code+in.Extra)
+		}
+		if moduleBudget < 0 {
+			fmt.Printf("Warning: no room left in the context window of %s for the module\n", opts.Model)
+		} else if module := loadWholeModule(in.Dir, in.Code, moduleBudget, in.Daemon); module != "" {
+			in.Extra = strings.TrimSpace(in.Extra + "\n" + module)
+		}
+	}
+	if opts.PublicAPI {
+		api, err := PublicAPI(in.Code)
+		if err != nil {
+			return Input{}, fmt.Errorf("failed to extract the public API: %v", err)
+		}
+		importPath, err := packageImportPath(in.Dir)
+		if err != nil {
+			log.Println("Unknown import path of the tested package:", err)
+		}
+		in.Extra = strings.TrimSpace(in.Extra + "\n" + publicAPIInstructions(in.PkgName, importPath))
+		in.Code = api
+		in.Full = ""
+		in.PkgName += "_test"
+		in.PublicAPI = true
+	}
+	return in, nil
+}
+
+// CheckTestFile compile-checks the test file and lets the model fix it, then runs its tests
+// when verifyIterations is positive. Draft files are checked with the draft build tag.
+func CheckTestFile(ctx context.Context, c *llm.Client, path string, in Input, repairIterations, verifyIterations int) error {
+	if repairIterations <= 0 && verifyIterations <= 0 {
+		return nil
+	}
+	if _, _, err := llm.FindModuleRoot(filepath.Dir(path)); err != nil {
+		fmt.Println("Skipping the compile check, the output is not inside a Go module")
+		return nil
+	}
+	header, tags := "", ""
+	if isDraftFile(path) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read output: %v", err)
+		}
+		header, tags = draftHeader(FileOwner(string(content))), DraftBuildTag
+	}
+	if repairIterations > 0 {
+		diagnostics, ok, err := c.RepairFile(ctx, path, header, tags, in.PkgName, in.Code, in.Extra, repairIterations)
+		if err != nil {
+			return fmt.Errorf("failed to compile-check the output: %v", err)
+		}
+		if !ok {
+			fmt.Printf("The tests still do not compile after %d repair attempts:\n%s\n", repairIterations, diagnostics)
+			return nil
+		}
+	}
+	if verifyIterations > 0 {
+		output, ok, err := c.VerifyFile(ctx, path, header, tags, in.PkgName, in.Code, in.Extra, verifyIterations)
+		if err != nil {
+			return fmt.Errorf("failed to verify the output: %v", err)
+		}
+		if !ok {
+			fmt.Printf("The tests still fail after %d fix attempts:\n%s\n", verifyIterations, output)
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read output: %v", err)
+	}
+	if verifyIterations > 0 {
+		for _, bug := range llm.LikelyBugs(string(content)) {
+			fmt.Println(bug)
+		}
+	}
+	for _, slow := range c.SlowTests(string(content), "") {
+		fmt.Printf("Warning: %s %s, tests must not wait for real time to pass\n", slow.Name, slow.Reason)
+	}
+	return nil
+}
+
+// WriteDraft writes the generated tests to the draft file of outputFilePath and checks it like
+// CheckTestFile. It returns the draft path.
+func WriteDraft(ctx context.Context, c *llm.Client, in Input, outputFilePath string, specs []llm.Spec, responses []string, repairIterations, verifyIterations int) (string, error) {
+	if in.Strict {
+		for i, code := range responses {
+			if err := StrictCheckCode(code); err != nil {
+				return "", fmt.Errorf("strict mode: spec '%s': %v", specs[i].Name, err)
+			}
+		}
+	}
+	draftFilePath := DraftPath(outputFilePath)
+	// The draft is compiled together with the output file, whose tests and helpers the
+	// generated ones must not redeclare.
+	reg := aggregator.NewRegistry()
+	if err := reg.AddDir(in.Dir, in.PkgName, draftFilePath); err != nil {
+		return "", fmt.Errorf("failed to read the declarations of the package: %v", err)
+	}
+	traces := make([]string, len(specs))
+	for i, spec := range specs {
+		traces[i] = c.Trace(spec.Name)
+	}
+	if err := llm.WriteGoFile(DraftFile(reg, in.PkgName, in.Owner, specs, responses, traces, in.Commented), draftFilePath); err != nil {
+		return "", fmt.Errorf("failed to write output to file: %v", err)
+	}
+	PrintRenamed(reg)
+	if in.Commented {
+		fmt.Println("Skipping the checks of the commented out draft")
+		return draftFilePath, nil
+	}
+	if ctx.Err() != nil {
+		fmt.Println("Skipping the checks of the interrupted or timed out run")
+		return draftFilePath, nil
+	}
+	return draftFilePath, CheckTestFile(ctx, c, draftFilePath, in, repairIterations, verifyIterations)
+}
+
+// MergeDraft merges the tests of the draft file into the output file and removes the draft.
+// It returns the output file path, or the draft path when the draft had nothing to merge,
+// e.g. when it is commented out, and is kept.
+func MergeDraft(draftFilePath string, outputFilePath string, pkgName string) (string, error) {
+	content, err := os.ReadFile(draftFilePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the draft: %v", err)
+	}
+	added, skipped, err := MergeGoFile(string(content), pkgName, outputFilePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to merge the draft: %v", err)
+	}
+	for _, name := range skipped {
+		fmt.Printf("Kept the existing %s of %s\n", name, outputFilePath)
+	}
+	if len(added) == 0 {
+		fmt.Printf("Nothing to merge into %s, keeping the draft\n", outputFilePath)
+		return draftFilePath, nil
+	}
+	fmt.Printf("Merged %d declarations into %s\n", len(added), outputFilePath)
+	if err := os.Remove(draftFilePath); err != nil {
+		log.Printf("Failed to remove the draft: %v", err)
+	}
+	return outputFilePath, nil
+}
+
+// PrintRenamed lists the generated declarations renamed because the package or another
+// response already declares their name.
+func PrintRenamed(reg *aggregator.Registry) {
+	for _, r := range reg.Renamed() {
+		fmt.Printf("Renamed %s to %s, the package already declares it differently\n", r.From, r.To)
+	}
+}
+
+// CasesOptions select what the test cases are generated for and ground them.
+type CasesOptions struct {
+	WhatToTest string
+	// IssueFile and IssueRef are the issue whose acceptance criteria the tests must cover, a
+	// file or a GitHub owner/repo#number.
+	IssueFile string
+	IssueRef  string
+	// GitLog is the number of commits touching the code files whose messages are shown.
+	GitLog    int
+	CallSites bool
+	// MapReduce generates the cases for every chunk of code over the budget and merges them.
+	MapReduce bool
+	// Candidates is the number of times the cases are generated to report the ambiguous ones.
+	Candidates int
+	// Force lists tests for the functions the package's tests already test too.
+	Force      bool
+	MineInputs bool
+}
+
+// PauseFunc lets the user edit the output of a stage before the pipeline continues.
+// It returns the possibly edited content.
+type PauseFunc func(stage llm.Stage, content string) (string, error)
+
+// NoPause is the PauseFunc that goes on with the output as is.
+func NoPause(_ llm.Stage, content string) (string, error) {
+	return content, nil
+}
+
+// CasesInstructions gathers the extra instructions of the test list and cases stages: the
+// issue, the git history, the call sites, the spec and the mined inputs of the target.
+func CasesInstructions(ctx context.Context, in Input, opts CasesOptions, spec string) (string, error) {
+	whatToTest := opts.WhatToTest
+	issue, err := loadIssue(ctx, opts.IssueFile, opts.IssueRef)
+	if err != nil {
+		return "", fmt.Errorf("failed to load issue: %v", err)
+	}
+	history, err := gitHistory(ctx, in.Paths, opts.GitLog)
+	if err != nil {
+		return "", fmt.Errorf("failed to read git history: %v", err)
+	}
+	casesInstructions := strings.TrimSpace(in.Extra + "\n" +
+		issueInstructions(issue) +
+		gitHistoryInstructions(history) +
+		contractInstructions(in.Code, whatToTest))
+	if opts.CallSites {
+		casesInstructions = strings.TrimSpace(casesInstructions + "\n" + loadCallSites(in.Dir, in.Code, whatToTest, in.Daemon))
+	}
+	if spec != "" {
+		casesInstructions = strings.TrimSpace(casesInstructions + "\n" +
+			"The specification of the tested part is:\n\"\"\"\n" + strings.TrimSpace(spec) + "\n\"\"\"\n")
+	}
+	if opts.MineInputs {
+		casesInstructions = strings.TrimSpace(casesInstructions + "\n" + loadInputCorpus(in.Dir, in.Code, whatToTest))
+	}
+	return casesInstructions, nil
+}
+
+// ListInstructions adds the expected number of cases to the instructions of the test list and,
+// unless force is set, the functions that already have tests to skip. It fails with
+// ErrAlreadyTested when every function the target mentions already has tests.
+func ListInstructions(in Input, whatToTest string, casesInstructions string, force bool) (string, error) {
+	instructions := strings.TrimSpace(casesInstructions + "\n" + specCountInstructions(in.Code, whatToTest))
+	if force {
+		return instructions, nil
+	}
+	tested, err := testedInstructions(in, whatToTest)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(instructions + "\n" + tested), nil
+}
+
+// GenerateCases runs the test list and test cases stages and returns the spec file content.
+// spec, when not empty, is the specification of the target from the spec stage.
+func GenerateCases(ctx context.Context, c *llm.Client, report *RunReport, in Input, opts CasesOptions, spec string, pause PauseFunc) (string, error) {
+	whatToTest := opts.WhatToTest
+	instructions, err := CasesInstructions(ctx, in, opts, spec)
+	if err != nil {
+		return "", err
+	}
+	listInstructions, err := ListInstructions(in, whatToTest, instructions, opts.Force)
+	if err != nil {
+		return "", err
+	}
+	list, err := c.GenerateTestsList(ctx, whatToTest, in.Code, listInstructions)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate test list: %v", err)
+	}
+	if list, err = pause(llm.StageList, list); err != nil {
+		return "", err
+	}
+
+	var s string
+	if opts.MapReduce && in.Full != "" {
+		var chunks []string
+		chunks, err = ChunkCode(in.Full, in.Budget)
+		if err != nil {
+			return "", fmt.Errorf("failed to split the code: %v", err)
+		}
+		fmt.Printf("Generating the test cases for %d parts of the code\n", len(chunks))
+		s, err = c.GenerateTestCasesChunked(ctx, whatToTest, chunks, list, instructions)
+	} else if opts.Candidates > 1 {
+		fmt.Printf("Generating %d candidates of the test cases\n", opts.Candidates)
+		s, err = generateCandidates(ctx, c, report, whatToTest, in.Code, list, instructions, opts.Candidates)
+	} else {
+		s, err = c.GenerateTestCases(ctx, whatToTest, in.Code, list, instructions)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to generate test cases: %v", err)
+	}
+	if in.Strict {
+		if err := strictCheckCases(s); err != nil {
+			return "", fmt.Errorf("strict mode: %v", err)
+		}
+	}
+	if err := llm.ValidateCasesYAML(s); err != nil {
+		return "", fmt.Errorf("invalid test cases: %v", err)
+	}
+	return "testing: " + whatToTest + "\n" + llm.RemoveYAMLLines(s), nil
+}
+
+// CodeOptions configure the test code generation from a spec file.
+type CodeOptions struct {
+	// OutputFilePath is the test file the tests are drafted next to.
+	OutputFilePath string
+	// Targets limits the generation to the specs of these targets, nil for every target of
+	// the spec file. See RoutePackages.
+	Targets []string
+	// LearnConventions learns conventions from accepted generated tests and reuses them.
+	LearnConventions bool
+	// UpdateDeps runs go get and go mod tidy for new test dependencies of the draft.
+	UpdateDeps bool
+	// Fakes writes the fake data builder helpers of the target's struct inputs.
+	Fakes bool
+	// Resume skips the specs whose test code an interrupted or failed run saved.
+	Resume bool
+	// MaxTestLines is the length of generated test functions warned about, 0 for no limit,
+	// and Simplify asks the model to shorten them.
+	MaxTestLines int
+	Simplify     bool
+	// Merge merges the draft into OutputFilePath.
+	Merge bool
+	// WarmStart is a partially written test file whose helpers, naming and setup the
+	// generated tests reuse.
+	WarmStart string
+	// StyleFrom are the comma-separated test files whose style the tests mimic, "auto" for
+	// the package's _test.go files and "none" or "" for none.
+	StyleFrom  string
+	MineInputs bool
+	// Repair and Verify are the iterations of the checks of the draft, see CheckTestFile.
+	Repair int
+	Verify int
+	// Progress receives the status of every spec, nil for none.
+	Progress *llm.ProgressWriter
+	// RunSpecs runs generate for every spec and returns their errors, ErrSpecSkipped for the
+	// specs to leave out, e.g. while showing their progress on a screen of its own. The
+	// progress of the specs is not printed then. nil runs them in parallel.
+	RunSpecs func(ctx context.Context, names []string, generate func(ctx context.Context, i int) error) []error
+	// Review shows the generated test of the spec and returns it, possibly edited or
+	// regenerated, and whether it is accepted. nil accepts every test.
+	Review func(spec llm.Spec, code string, regenerate func(instructions string) (string, error)) (string, bool)
+}
+
+// CodeConventions loads the conventions learned in the package when learn is set and adds
+// their instructions to the extra instructions of the code input.
+func CodeConventions(in *Input, learn bool) (*Conventions, error) {
+	if !learn {
+		return nil, nil
+	}
+	conventions, err := LoadConventions(in.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load conventions: %v", err)
+	}
+	conventions.LearnAccepted(in.Dir)
+	if instructions := conventions.Instructions(); instructions != "" {
+		in.Extra = strings.TrimSpace(in.Extra + "\n" + instructions)
+	}
+	return conventions, nil
+}
+
+// CodeStyle adds a sample of the tests of styleFrom, see CodeOptions, to the extra
+// instructions of the code input.
+func CodeStyle(in *Input, styleFrom string) error {
+	var paths []string
+	switch styleFrom {
+	case "none", "":
+		return nil
+	case "auto":
+		var err error
+		if paths, err = StyleFiles(in.Dir); err != nil {
+			return fmt.Errorf("failed to list the test files of %s: %v", in.Dir, err)
+		}
+	default:
+		paths = strings.Split(styleFrom, ",")
+	}
+	instructions, err := StyleInstructions(paths)
+	if err != nil {
+		return fmt.Errorf("failed to read the style tests: %v", err)
+	}
+	if instructions != "" {
+		in.Extra = strings.TrimSpace(in.Extra + "\n" + instructions)
+	}
+	return nil
+}
+
+// TargetCodeInstructions gathers the extra instructions of the code stage for the target: its
+// mined inputs and fake data helpers. The missing helpers are written to the package when
+// writeFakes is set.
+func TargetCodeInstructions(in Input, opts CodeOptions, target string, writeFakes bool) (string, error) {
+	var instructions []string
+	if opts.MineInputs {
+		instructions = append(instructions, loadInputCorpus(in.Dir, in.Code, target))
+	}
+	// The unexported fake helpers are not visible to the external test package.
+	if opts.Fakes && !in.PublicAPI {
+		var signatures []string
+		if writeFakes {
+			var err error
+			signatures, err = WriteFakeHelpers(in.Dir, in.PkgName, in.Code, target)
+			if err != nil {
+				return "", fmt.Errorf("failed to write fake data helpers: %v", err)
+			}
+		} else {
+			_, signatures = FakeHelpers(in.Code, target, existingFakeHelpers(in.Dir))
+		}
+		instructions = append(instructions, fakeHelpersInstructions(signatures))
+	}
+	if opts.WarmStart != "" {
+		warmStart, err := warmStartInstructions(opts.WarmStart)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the warm start test file: %v", err)
+		}
+		instructions = append(instructions, warmStart)
+	}
+	return strings.Join(instructions, "\n"), nil
+}
+
+// simplifyLongTests warns about the functions of the test code generated for spec that are
+// longer than MaxTestLines and, with Simplify, returns the code the model shortened.
+func simplifyLongTests(ctx context.Context, c *llm.Client, in Input, opts CodeOptions, target string, spec llm.Spec, code string, extra string) string {
+	if opts.MaxTestLines <= 0 {
+		return code
+	}
+	long, err := llm.LongTests(code, opts.MaxTestLines)
+	if err != nil || len(long) == 0 {
+		return code
+	}
+	for _, t := range long {
+		fmt.Printf("Warning: %s of spec '%s' has %d lines, over the limit of %d\n", t.Name, spec.Name, t.Lines, opts.MaxTestLines)
+	}
+	if !opts.Simplify {
+		return code
+	}
+	simplified, err := c.SimplifyTestCode(ctx, target, code, opts.MaxTestLines, in.Code, extra)
+	if err != nil {
+		fmt.Printf("Failed to simplify the test of spec '%s', keeping it: %v\n", spec.Name, err)
+		return code
+	}
+	if still, err := llm.LongTests(simplified, opts.MaxTestLines); err == nil && len(still) > 0 {
+		fmt.Printf("The simplified test of spec '%s' is still over the limit\n", spec.Name)
+	}
+	return simplified
+}
+
+// GenerateCode generates the test code of every spec of the spec file and writes the draft
+// of the ones that succeeded. It returns the draft path and the specs that failed, which are
+// also written to their own spec file. It fails with ErrNothingToDraft, with the failed specs,
+// when no test was left to draft.
+func GenerateCode(ctx context.Context, c *llm.Client, report *RunReport, in Input, opts CodeOptions, specFilePath string) (string, []SpecFailure, error) {
+	if opts.Merge && in.Commented {
+		return "", nil, errors.New("merging needs an uncommented draft, a commented out draft has no tests to merge")
+	}
+	conventions, err := CodeConventions(&in, opts.LearnConventions)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := CodeStyle(&in, opts.StyleFrom); err != nil {
+		return "", nil, err
+	}
+
+	// TODO: Refine specs with mocks again - do multiple iterations
+	specLists, err := spec.Load(specFilePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load test specs: %v", err)
+	}
+	report.Renamed = spec.Normalize(specLists)
+	var (
+		specs   []llm.Spec
+		targets []string
+	)
+	routed := make(map[string]bool)
+	for _, target := range opts.Targets {
+		routed[target] = true
+	}
+	for _, l := range specLists {
+		if opts.Targets != nil && !routed[l.Testing] {
+			continue
+		}
+		for _, spec := range l.Specs {
+			specs = append(specs, spec)
+			targets = append(targets, l.Testing)
+		}
+	}
+	if len(specs) == 0 {
+		return "", nil, fmt.Errorf("no test cases in %s, generate them again with goptest cases", specFilePath)
+	}
+
+	targetInstructions := make(map[string]string)
+	for _, target := range targets {
+		if _, ok := targetInstructions[target]; ok {
+			continue
+		}
+		if targetInstructions[target], err = TargetCodeInstructions(in, opts, target, true); err != nil {
+			return "", nil, err
+		}
+	}
+
+	checkpoint := NewCheckpoint(in.Dir)
+	if opts.Resume {
+		checkpoint, err = LoadCheckpoint(in.Dir)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to load the checkpoint: %v", err)
+		}
+	}
+
+	// RunSpecs owns the screen while the specs are generated.
+	printf := fmt.Printf
+	if opts.RunSpecs != nil {
+		printf = func(string, ...any) (int, error) { return 0, nil }
+	}
+	progress := opts.Progress
+	responses := make([]string, len(specs))
+	// Retried specs may have two attempts finishing at the same time.
+	var responsesMu sync.Mutex
+	generate := func(ctx context.Context, i int) error {
+		spec := specs[i]
+		if code, ok := checkpoint.Generated(targets[i], spec); ok {
+			progress.SpecStatus(i, len(specs), targets[i], spec, llm.SpecCached, nil)
+			printf("Skipping test code %d of %d for spec '%s', generated before\n", i+1, len(specs), spec.Description)
+			responsesMu.Lock()
+			responses[i] = code
+			responsesMu.Unlock()
+			return nil
+		}
+		progress.SpecStatus(i, len(specs), targets[i], spec, llm.SpecGenerating, nil)
+		printf("Generating test code %d of %d for spec '%s'\n", i+1, len(specs), spec.Description)
+		code, err := c.GenerateTestCode(
+			ctx,
+			spec,
+			targets[i],
+			in.Code,
+			in.PkgName,
+			strings.TrimSpace(in.Extra+"\n"+targetInstructions[targets[i]]),
+		)
+		if err != nil {
+			printf("Failed to generate test code for spec '%s': %v\n", spec.Name, err)
+			return err
+		}
+		progress.SpecStatus(i, len(specs), targets[i], spec, llm.SpecGenerated, nil)
+		responsesMu.Lock()
+		responses[i] = code
+		responsesMu.Unlock()
+		if err := checkpoint.Save(targets[i], spec, code); err != nil {
+			log.Printf("Failed to save the checkpoint: %v", err)
+		}
+		printf("Done generating test\n")
+		return nil
+	}
+
+	var errs []error
+	if opts.RunSpecs != nil {
+		names := make([]string, len(specs))
+		for i, spec := range specs {
+			names[i] = spec.Name
+		}
+		errs = opts.RunSpecs(ctx, names, generate)
+	} else {
+		errs = make([]error, len(specs))
+		var wg sync.WaitGroup
+		for i := range specs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = generate(ctx, i)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	// Keep the tests that were generated, and approved by Review, the failed specs are
+	// written to their own spec file to re-run only those.
+	var (
+		generated []llm.Spec
+		codes     []string
+		failed    []SpecFailure
+	)
+	for i, spec := range specs {
+		if errors.Is(errs[i], ErrSpecSkipped) {
+			progress.SpecStatus(i, len(specs), targets[i], spec, llm.SpecSkipped, nil)
+			fmt.Printf("Skipped spec '%s'\n", spec.Name)
+			continue
+		}
+		if errs[i] != nil {
+			progress.SpecStatus(i, len(specs), targets[i], spec, llm.SpecFailed, errs[i])
+			failed = append(failed, SpecFailure{Testing: targets[i], Spec: spec, Err: errs[i]})
+			continue
+		}
+		code := simplifyLongTests(ctx, c, in, opts, targets[i], spec, responses[i], strings.TrimSpace(in.Extra+"\n"+targetInstructions[targets[i]]))
+		if opts.Review != nil {
+			var ok bool
+			code, ok = opts.Review(spec, code, func(instructions string) (string, error) {
+				extra := strings.TrimSpace(in.Extra + "\n" + targetInstructions[targets[i]] + "\n" + instructions)
+				return c.GenerateTestCode(ctx, spec, targets[i], in.Code, in.PkgName, extra)
+			})
+			if !ok {
+				progress.SpecStatus(i, len(specs), targets[i], spec, llm.SpecRejected, nil)
+				fmt.Printf("Rejected the test of spec '%s'\n", spec.Name)
+				continue
+			}
+		}
+		generated = append(generated, spec)
+		codes = append(codes, code)
+	}
+	if len(failed) > 0 {
+		if err := WriteFailedSpecs(failed, specFilePath); err != nil {
+			fmt.Printf("Failed to write the failed specs: %v\n", err)
+		}
+	}
+	if len(generated) == 0 {
+		return "", failed, ErrNothingToDraft
+	}
+
+	outputFilePath := opts.OutputFilePath
+	draftFilePath, err := WriteDraft(ctx, c, in, outputFilePath, generated, codes, opts.Repair, opts.Verify)
+	if err != nil {
+		return "", failed, err
+	}
+	if opts.Merge {
+		if draftFilePath, err = MergeDraft(draftFilePath, outputFilePath, in.PkgName); err != nil {
+			return "", failed, err
+		}
+	}
+	if len(failed) == 0 {
+		if err := checkpoint.Remove(); err != nil {
+			log.Printf("Failed to remove the checkpoint: %v", err)
+		}
+	}
+	if conventions != nil {
+		rel, err := filepath.Rel(in.Dir, outputFilePath)
+		if err != nil {
+			rel = outputFilePath
+		}
+		conventions.AddPending(rel)
+		if err := conventions.Save(in.Dir); err != nil {
+			return "", failed, fmt.Errorf("failed to save conventions: %v", err)
+		}
+	}
+	if opts.UpdateDeps {
+		content, err := os.ReadFile(draftFilePath)
+		if err != nil {
+			return "", failed, fmt.Errorf("failed to read output: %v", err)
+		}
+		if err := llm.UpdateDeps(string(content), outputFilePath); err != nil {
+			return "", failed, fmt.Errorf("failed to update dependencies: %v", err)
+		}
+	}
+	return draftFilePath, failed, nil
+}
@@ -0,0 +1,1560 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/sentiens/goptest/aggregator"
+	"github.com/sentiens/goptest/llm"
+	"github.com/sentiens/goptest/spec"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+func TestSpecCountInstructions(t *testing.T) {
+	code := `package calc
+
+func Add(a, b int) int {
+	return a + b
+}
+
+func Clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi && hi > lo {
+		return hi
+	}
+	switch {
+	case v == 0:
+		return 0
+	default:
+		return v
+	}
+}
+`
+	testCases := []struct {
+		what string
+		want string
+	}{
+		{what: "Add function", want: "cyclomatic complexity of 1. Return between 2 and 3"},
+		{what: "the Clamp func", want: "cyclomatic complexity of 5. Return between 4 and 6"},
+		{what: "Add and Clamp", want: "cyclomatic complexity of 6. Return between 6 and 10"},
+		{what: "Subtract", want: ""},
+	}
+	for _, tc := range testCases {
+		got := specCountInstructions(code, tc.what)
+		if !strings.Contains(got, tc.want) || (tc.want == "" && got != "") {
+			t.Errorf("specCountInstructions(%q) = %q, want it to contain %q", tc.what, got, tc.want)
+		}
+	}
+}
+
+func TestImportFeature(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", "features", "login.feature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ImportFeature(string(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &llm.SpecList{
+		Testing: "User login",
+		Specs: []llm.Spec{
+			{
+				Name: "TestUserLogin_SuccessfulLogin",
+				Description: "1. Given a user \"alice\" with password \"secret\"\n" +
+					"2. When \"alice\" logs in with \"secret\"\n" +
+					"3. Then a session token is returned\n",
+			},
+			{
+				Name: "TestUserLogin_RejectedCredentials",
+				Description: "1. Given a user \"alice\" with password \"secret\"\n" +
+					"2. When \"<user>\" logs in with \"<password>\"\n" +
+					"3. Then the error is ErrInvalidCredentials\n" +
+					"4. But no session is created\n" +
+					"Run the steps for every row of these examples:\n" +
+					"   | user  | password |\n" +
+					"   | alice | wrong    |\n" +
+					"   | bob   | secret   |\n",
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+type fakeProvider struct {
+	prompts []llm.Prompt
+	reply   string
+}
+
+func (p *fakeProvider) Complete(_ context.Context, prompt llm.Prompt) (string, error) {
+	p.prompts = append(p.prompts, prompt)
+	return p.reply, nil
+}
+
+func (p *fakeProvider) Stream(ctx context.Context, prompt llm.Prompt, onDelta func(string)) (string, error) {
+	out, err := p.Complete(ctx, prompt)
+	onDelta(out)
+	return out, err
+}
+
+func TestExportSpecs(t *testing.T) {
+	lists, err := spec.Load(filepath.Join("testdata", "specs", "steps.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{ExportCSV, ExportXray, ExportTestRail} {
+		t.Run(format, func(t *testing.T) {
+			var out strings.Builder
+			if err := ExportSpecs(&out, format, lists); err != nil {
+				t.Fatal(err)
+			}
+
+			goldenPath := filepath.Join("testdata", "export", format+".csv")
+			if *update {
+				if err := os.WriteFile(goldenPath, []byte(out.String()), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != string(want) {
+				t.Errorf("output mismatch\ngot:\n%s\nwant:\n%s", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestExtractContracts(t *testing.T) {
+	code := `package calc
+
+// Divide divides a by b. It returns ErrDivisionByZero when b is zero.
+// Results are rounded towards zero. The function is fast.
+func Divide(a, b int) (int, error) {
+	return 0, nil
+}
+
+// Percent converts a ratio to a percentage in the range 0-100.
+func Percent(r float64) float64 {
+	return r * 100
+}
+`
+	got, err := ExtractContracts(code, "Divide and Percent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Contract{
+		{Target: "Divide", Claims: []string{
+			"It returns ErrDivisionByZero when b is zero.",
+			"Results are rounded towards zero.",
+		}},
+		{Target: "Percent", Claims: []string{
+			"Percent converts a ratio to a percentage in the range 0-100.",
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestMineInputs(t *testing.T) {
+	dir := filepath.Join("testdata", "inputs")
+	code, err := os.ReadFile(filepath.Join(dir, "date.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := MineInputs(dir, string(code), "ParseDate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []InputExample{
+		{Source: "date_test.go", Code: `ParseDate("2023-04-01", Layout{Format: "2006-01-02", Strict: true})`},
+		{Source: "cmd/main.go", Code: `date.ParseDate("1 Apr 2023", date.Layout{Format: "2 Jan 2006"})`},
+		{Source: "cmd/main.go", Code: `date.ParseDate("2023-04-01", date.Layout{Format: "2006-01-02", Strict: true})`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if fixtures := fixtureFiles(dir); !reflect.DeepEqual(fixtures, []string{"testdata/valid.txt"}) {
+		t.Errorf("got fixtures %q", fixtures)
+	}
+}
+
+func TestFakeHelpers(t *testing.T) {
+	code := `package users
+
+import "time"
+
+type Address struct {
+	Street string
+	Zip    string ` + "`json:\"postal_code\" fake:\"10115\"`" + `
+}
+
+type User struct {
+	ID        string
+	Email     string ` + "`json:\"email_address\"`" + `
+	Age       int
+	Admin     bool
+	CreatedAt time.Time
+	Home      Address
+	Manager   *User
+	Tags      []string
+}
+
+type Options struct{ Limit int }
+
+func Register(u User, opts *Options) error { return nil }
+`
+	decls, signatures := FakeHelpers(code, "Register", map[string]string{
+		"fakeOptions": "func fakeOptions() Options",
+	})
+	src := aggregator.Aggregate("users", decls, false)
+	for _, want := range []string{
+		`ID:        "id-1024",`,
+		`Email:     "jane.doe@example.com",`,
+		`Age:       34,`,
+		`CreatedAt: time.Date(2023, time.April, 1, 12, 0, 0, 0, time.UTC),`,
+		`Home:      fakeAddress(),`,
+		`Tags:      []string{"example tags"},`,
+		`Zip:    "10115",`,
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("helpers do not contain %q:\n%s", want, src)
+		}
+	}
+	if strings.Contains(src, "Manager") || strings.Contains(src, "func fakeOptions") {
+		t.Errorf("unexpected helper content:\n%s", src)
+	}
+	wantSignatures := []string{
+		"func fakeOptions() Options",
+		"func fakeUser(opts ...func(*User)) User",
+		"func fakeAddress(opts ...func(*Address)) Address",
+	}
+	if !reflect.DeepEqual(signatures, wantSignatures) {
+		t.Errorf("got signatures %q, want %q", signatures, wantSignatures)
+	}
+}
+
+func TestPublicAPI(t *testing.T) {
+	code := `package shop
+
+import "errors"
+
+// Cart holds the items of a customer.
+type Cart struct {
+	// Owner is the customer.
+	Owner string
+	items []string
+	mu    sync.Mutex
+}
+
+// Add adds an item.
+func (c *Cart) Add(item string) error {
+	if item == "" {
+		return errors.New("empty item")
+	}
+	c.items = append(c.items, item)
+	return nil
+}
+
+func (c *Cart) reset() { c.items = nil }
+
+func helper() int { return 1 }
+`
+	api, err := PublicAPI(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"package shop", `import "errors"`, "// Cart holds the items", "Owner string", "// Add adds an item.", "func (c *Cart) Add(item string) error"} {
+		if !strings.Contains(api, want) {
+			t.Errorf("missing %q in:\n%s", want, api)
+		}
+	}
+	for _, unwanted := range []string{"items []string", "mu ", "reset", "helper", "empty item"} {
+		if strings.Contains(api, unwanted) {
+			t.Errorf("unexpected %q in:\n%s", unwanted, api)
+		}
+	}
+}
+
+func TestScopeCode(t *testing.T) {
+	code := `package store
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrNotFound is returned for missing keys.
+var ErrNotFound = errors.New("not found")
+
+const maxKey = 64
+
+// DB is the storage backend.
+type DB interface{ Get(key string) (string, bool) }
+
+// Store caches a DB.
+type Store struct {
+	db    DB
+	cache map[string]string
+}
+
+// Get returns the value of key.
+func (s *Store) Get(key string) (string, error) {
+	key = normalize(key)
+	if v, ok := s.lookup(key); ok {
+		return v, nil
+	}
+	return "", ErrNotFound
+}
+
+func (s *Store) lookup(key string) (string, bool) { return s.db.Get(key) }
+
+// Put is not a dependency of Get.
+func (s *Store) Put(key, value string) { s.cache[key] = value }
+
+func normalize(key string) string {
+	if len(key) > maxKey {
+		key = key[:maxKey]
+	}
+	return strings.ToLower(key)
+}
+
+func Unrelated() {}
+`
+	testCases := []struct {
+		name    string
+		symbols []string
+		want    []string
+		notWant []string
+		wantErr bool
+	}{
+		{
+			name:    "method",
+			symbols: []string{"Store.Get"},
+			want:    []string{"import (", "// ErrNotFound is returned", "type DB interface", "type Store struct", "func (s *Store) Get", "func (s *Store) lookup", "func normalize"},
+			notWant: []string{"maxKey = 64", "func (s *Store) Put", "func Unrelated"},
+		},
+		{
+			name:    "function",
+			symbols: []string{"normalize", " Unrelated"},
+			want:    []string{"const maxKey = 64", "func normalize", "func Unrelated"},
+			notWant: []string{"type Store", "ErrNotFound"},
+		},
+		{
+			name:    "type with its methods",
+			symbols: []string{"Store"},
+			want:    []string{"type Store struct", "func (s *Store) Put", "func (s *Store) Get", "type DB interface"},
+			notWant: []string{"func Unrelated"},
+		},
+		{name: "unknown symbol", symbols: []string{"Store.Delete"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ScopeCode(code, tc.symbols)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got:\n%s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := parser.ParseFile(token.NewFileSet(), "", got, 0); err != nil {
+				t.Fatalf("the scoped code does not parse: %v\n%s", err, got)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("missing %q in:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tc.notWant {
+				if strings.Contains(got, notWant) {
+					t.Errorf("unexpected %q in:\n%s", notWant, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"go.mod":         "module example.com/m\n",
+		"shop/shop.go":   "package shop\n\nfunc Add(a, b int) int { return a + b }\n",
+		"app/main.go":    "package app\n\nimport \"example.com/m/shop\"\n\nfunc Total(a int) int { return shop.Add(a, 1) }\n",
+		"money/money.go": "package money\n\ntype Amount int64\n",
+	}
+	write := func(name, content string) {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		write(name, content)
+	}
+	ix, err := NewModuleIndex(root, "example.com/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ix.Refresh(); err != nil || n != 3 {
+		t.Fatalf("Refresh() = %d, %v, want the 3 Go files", n, err)
+	}
+	srv := httptest.NewServer(DaemonHandler(ix))
+	defer srv.Close()
+
+	pkgDir := filepath.Join(root, "shop")
+	code := files["shop/shop.go"]
+	if got, want := loadWholeModule(pkgDir, code, 0, srv.URL), loadWholeModule(pkgDir, code, 0, ""); got != want || !strings.Contains(got, "type Amount int64") {
+		t.Errorf("the daemon packs the module as\n%s\nwant\n%s", got, want)
+	}
+	if got := loadCallSites(pkgDir, code, "Add", srv.URL); !strings.Contains(got, "// app/main.go:5 in Total") {
+		t.Errorf("unexpected call sites from the daemon:\n%s", got)
+	}
+
+	// Only the changed file is parsed again and the daemon serves it.
+	write("money/money.go", "package money\n\ntype Amount int64\n\ntype Currency string\n")
+	if n, err := ix.Refresh(); err != nil || n != 1 {
+		t.Fatalf("Refresh() = %d, %v, want the changed file", n, err)
+	}
+	if got := loadWholeModule(pkgDir, code, 0, srv.URL); !strings.Contains(got, "type Currency string") {
+		t.Errorf("the daemon serves a stale module:\n%s", got)
+	}
+
+	if _, err := daemonContext(srv.URL, ContextRequest{Dir: t.TempDir(), Module: true}); err == nil {
+		t.Error("expected an error for a directory outside the module")
+	}
+	// An unreachable daemon falls back to loading the module.
+	srv.Close()
+	if got := loadWholeModule(pkgDir, code, 0, srv.URL); !strings.Contains(got, "type Currency string") {
+		t.Errorf("no module without the daemon:\n%s", got)
+	}
+}
+
+func TestFindCallSites(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"go.mod":             "module example.com/m\n",
+		"shop/shop.go":       "package shop\n\nfunc Add(a, b int) int { return a + b }\n",
+		"shop/shop_test.go":  "package shop_test\n\nimport \"example.com/m/shop\"\n\nvar _ = shop.Add(0, 0)\n\nfunc f() { shop.Add(9, 9) }\n",
+		"app/app_test.go":    "package app\n\nimport \"example.com/m/shop\"\n\nfunc g() { shop.Add(3, 4) }\n",
+		"app/main.go":        "package app\n\nimport s \"example.com/m/shop\"\n\nfunc Total(items []int) int {\n\tt := 0\n\tfor _, i := range items {\n\t\tt = s.Add(t, i)\n\t}\n\treturn t\n}\n",
+		"other/unrelated.go": "package other\n\nfunc h(shop interface{ Add(int, int) int }) { shop.Add(1, 2) }\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sites, err := FindCallSites(root, filepath.Join(root, "shop"), "example.com/m/shop", files["shop/shop.go"], "Add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sites) != 2 {
+		t.Fatalf("expected 2 call sites, got %+v", sites)
+	}
+	if sites[0].Source != "app/main.go:8" || sites[0].Caller != "Total" || !strings.Contains(sites[0].Snippet, "for _, i := range items") {
+		t.Errorf("unexpected first call site %+v", sites[0])
+	}
+	if sites[1].Source != "app/app_test.go:5" {
+		t.Errorf("unexpected second call site %+v", sites[1])
+	}
+	if got := callSiteInstructions(sites); !strings.Contains(got, "// app/main.go:8 in Total") {
+		t.Errorf("unexpected instructions:\n%s", got)
+	}
+}
+
+func TestConcatFilesWithBudget(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.go")
+	dep := filepath.Join(dir, "dep.go")
+	if err := os.WriteFile(target, []byte("package p\n\nfunc Target() int { return helper() }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	depCode := "package p\n\n// Helper does the work.\nfunc Helper() int {\n\treturn helper()\n}\n\nfunc helper() int { return 42 }\n"
+	if err := os.WriteFile(dep, []byte(depCode), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, full, err := ConcatFilesWithBudget([]string{target, dep}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(full, "return 42") {
+		t.Errorf("expected the full code without a budget:\n%s", full)
+	}
+	_, summarized, err := ConcatFilesWithBudget([]string{target, dep}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"func Target() int { return helper() }", "// Helper does the work.", "func Helper() int\n"} {
+		if !strings.Contains(summarized, want) {
+			t.Errorf("missing %q in:\n%s", want, summarized)
+		}
+	}
+	if strings.Contains(summarized, "return 42") {
+		t.Errorf("expected the dependency to be summarized:\n%s", summarized)
+	}
+}
+
+func TestRoutePackages(t *testing.T) {
+	root := t.TempDir()
+	calc := filepath.Join(root, "calc", "calc.go")
+	shapes := filepath.Join(root, "shapes", "shapes.go")
+	files := map[string]string{
+		calc:   "package calc\n\nfunc Add(a, b int) int { return a + b }\n",
+		shapes: "package shapes\n\ntype Circle struct{ R float64 }\n\nfunc (c Circle) Area() float64 { return 3 * c.R * c.R }\n",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	specFilePath := filepath.Join(root, "specs.yaml")
+	specs := "testing: Circle\ncases:\n  - name: TestCircleArea\n    instructions: area of a unit circle\n" +
+		"---\ntesting: Add function\ncases:\n  - name: TestAdd\n    instructions: add two numbers\n"
+	if err := os.WriteFile(specFilePath, []byte(specs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if routes, err := RoutePackages([]string{calc}, specFilePath); routes != nil || err != nil {
+		t.Errorf("RoutePackages() = %v, %v for a single package, want nil", routes, err)
+	}
+	routes, err := RoutePackages([]string{calc, shapes}, specFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PackageRoute{
+		{Dir: filepath.Dir(calc), Paths: []string{calc}, Targets: []string{"Add function"}},
+		{Dir: filepath.Dir(shapes), Paths: []string{shapes}, Targets: []string{"Circle"}},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Fatalf("RoutePackages() = %+v, want %+v", routes, want)
+	}
+
+	provider := &fakeProvider{reply: "func TestGenerated(t *testing.T) {}\n"}
+	c, err := llm.NewClient(llm.WithProvider(provider), llm.WithParallel(1), llm.WithResponseFormat(llm.FormatText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range routes {
+		in, err := Load(context.Background(), r.Paths, "", LoadOptions{CodeBudget: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := CodeOptions{OutputFilePath: filepath.Join(r.Dir, "generated_test.go"), Targets: r.Targets}
+		draftFilePath, failed, err := GenerateCode(context.Background(), c, &RunReport{}, in, opts, specFilePath)
+		if err != nil || len(failed) > 0 {
+			t.Fatalf("GenerateCode() failed for %s: %v, %v", r.Dir, err, failed)
+		}
+		content, err := os.ReadFile(draftFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(draftFilePath) != r.Dir || !strings.Contains(string(content), "package "+filepath.Base(r.Dir)+"\n") {
+			t.Errorf("the tests of %s are drafted in %s:\n%s", r.Targets, draftFilePath, content)
+		}
+	}
+	if len(provider.prompts) != 2 {
+		t.Errorf("got %d code prompts, want one per spec", len(provider.prompts))
+	}
+
+	if err := os.WriteFile(specFilePath, []byte("testing: Sub\ncases:\n  - name: TestSub\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RoutePackages([]string{calc, shapes}, specFilePath); err == nil {
+		t.Error("expected an error for a target no package declares")
+	}
+}
+
+func TestImportObservations(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "logs", "calls.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	observations, err := ReadObservations(f, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Observation{
+		{Function: "pricing.Convert", Input: `{"amount":100,"from":"USD","to":"EUR"}`, Output: `{"amount":92.5,"currency":"EUR"}`},
+		{Function: "pricing.Convert", Input: `[-5,"USD","EUR"]`, Error: "negative amount"},
+		{Function: "Round", Input: `[2.675,2]`, Output: "2.68"},
+	}
+	if !reflect.DeepEqual(observations, want) {
+		t.Fatalf("got %+v\nwant %+v", observations, want)
+	}
+
+	specs := ObservationSpecs(observations, 1)
+	if len(specs) != 2 || specs[0].Testing != "Round" || specs[1].Testing != "pricing.Convert" {
+		t.Fatalf("unexpected spec lists %+v", specs)
+	}
+	convert := specs[1].Specs
+	if len(convert) != 1 || convert[0].Name != "TestPricingConvert_Observed1" ||
+		!strings.Contains(convert[0].Description, `Expect exactly the observed output: {"amount":92.5,"currency":"EUR"}`) {
+		t.Errorf("unexpected cases %+v", convert)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	observations, err = ReadObservations(f, "Convert")
+	if err != nil || len(observations) != 2 {
+		t.Errorf("expected the 2 Convert calls, got %+v, %v", observations, err)
+	}
+}
+
+// keywordEmbedder embeds texts as the occurrences of its keywords.
+type keywordEmbedder []string
+
+func (k keywordEmbedder) Embed(_ context.Context, texts []string) ([][]float32, error) {
+	var res [][]float32
+	for _, text := range texts {
+		var v []float32
+		for _, w := range k {
+			v = append(v, float32(strings.Count(strings.ToLower(text), w)))
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+func TestRelevantCode(t *testing.T) {
+	code := `package p
+
+import "strings"
+
+type Parser struct{ sep string }
+
+// Parse splits the input.
+func (p *Parser) Parse(s string) []string { return strings.Split(s, p.sep) }
+
+// tokenize is used for parsing tokens.
+func tokenize(s string) []string { return strings.Fields(s) }
+
+// Render renders HTML.
+func Render(w io.Writer) error { return nil }
+`
+	got, err := RelevantCode(context.Background(), keywordEmbedder{"pars", "token", "render"}, code, "Parse tokens", 75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`import "strings"`, "type Parser struct", "func (p *Parser) Parse", "func tokenize"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Render") {
+		t.Errorf("expected the unrelated Render to be dropped:\n%s", got)
+	}
+}
+
+func TestPackModule(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"go.mod":            "module example.com/m\n",
+		"shop/shop.go":      "package shop\n\nimport \"example.com/m/money\"\n\nfunc Total(p []money.Amount) money.Amount { return p[0] }\n",
+		"money/money.go":    "package money\n\n// Amount is in cents.\ntype Amount int64\n\nfunc parse() {}\n",
+		"api/api.go":        "package api\n\nimport \"example.com/m/shop\"\n\nfunc Handler() { shop.Total(nil) }\n",
+		"shop/cart/cart.go": "package cart\n\ntype Cart struct{ Items []string }\n",
+		"internal/x/x.go":   "package x\n\nfunc unexported() {}\n",
+		"cmd/app/main.go":   "package main\n\nfunc Main() {}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkgs, err := ModulePackages(root, "example.com/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, p := range pkgs {
+		paths = append(paths, p.ImportPath)
+	}
+	if want := []string{"example.com/m/api", "example.com/m/money", "example.com/m/shop", "example.com/m/shop/cart"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("ModulePackages = %v, want %v", paths, want)
+	}
+
+	imports := map[string]bool{"example.com/m/money": true}
+	packed, omitted := PackModule(pkgs, "example.com/m/shop", imports, 0)
+	paths = nil
+	for _, p := range packed {
+		paths = append(paths, p.ImportPath)
+	}
+	if want := []string{"example.com/m/money", "example.com/m/api", "example.com/m/shop/cart"}; !reflect.DeepEqual(paths, want) || len(omitted) > 0 {
+		t.Errorf("PackModule = %v, omitted %v, want %v", paths, omitted, want)
+	}
+	packed, omitted = PackModule(pkgs, "example.com/m/shop", imports, 30)
+	if len(packed) != 1 || packed[0].ImportPath != "example.com/m/money" || len(omitted) != 2 {
+		t.Errorf("expected only money to fit, got %v, omitted %v", packed, omitted)
+	}
+	if got := wholeModuleInstructions(packed, omitted); !strings.Contains(got, "// Amount is in cents.\ntype Amount int64") ||
+		!strings.Contains(got, "example.com/m/api, example.com/m/shop/cart") {
+		t.Errorf("unexpected instructions:\n%s", got)
+	}
+}
+
+func TestGenerateTestCasesChunked(t *testing.T) {
+	var code strings.Builder
+	code.WriteString("package big\n\nimport \"strings\"\n\n")
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(&code, "// F%d upper-cases the input.\nfunc F%d(s string) string { return strings.ToUpper(s) }\n\n", i, i)
+	}
+	chunks, err := ChunkCode(code.String(), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	seen := 0
+	for _, chunk := range chunks {
+		if !strings.HasPrefix(chunk, "package big\n\nimport \"strings\"") {
+			t.Errorf("chunk without the file header:\n%s", chunk)
+		}
+		seen += strings.Count(chunk, "func F")
+	}
+	if seen != 6 {
+		t.Errorf("expected every function in exactly one chunk, got %d", seen)
+	}
+
+	provider := &fakeProvider{reply: "cases:\n  - name: TestF\n    instructions: call F"}
+	// One request at a time, the fake provider records the prompts unsynchronized.
+	c, err := llm.NewClient(llm.WithProvider(provider), llm.WithParallel(1), llm.WithResponseFormat(llm.FormatText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GenerateTestCasesChunked(context.Background(), "F functions", chunks, "1. TestF", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != provider.reply || len(provider.prompts) != len(chunks)+1 {
+		t.Fatalf("got %q after %d prompts", got, len(provider.prompts))
+	}
+	merge := provider.prompts[len(chunks)].Messages[1].Content
+	if !strings.Contains(merge, fmt.Sprintf("Part %d of %d:", len(chunks), len(chunks))) {
+		t.Errorf("unexpected merge prompt:\n%s", merge)
+	}
+}
+
+func TestFailedSpecLists(t *testing.T) {
+	failed := []SpecFailure{
+		{Testing: "Add", Spec: llm.Spec{Name: "TestAdd_Overflow", Description: "1. Add max ints"}, Err: errors.New("timeout")},
+		{Testing: "Sub", Spec: llm.Spec{Name: "TestSub_Negative", Description: "1. Subtract"}, Err: errors.New("timeout")},
+		{Testing: "Add", Spec: llm.Spec{Name: "TestAdd_Zero", Description: "1. Add zero"}, Err: errors.New("bad response")},
+	}
+	path := FailedSpecsPath(filepath.Join(t.TempDir(), "specs.json"))
+	if filepath.Base(path) != "specs.failed.yaml" {
+		t.Errorf("unexpected failed specs path %s", path)
+	}
+	if err := writeSpecLists(FailedSpecLists(failed), path); err != nil {
+		t.Fatal(err)
+	}
+	lists, err := spec.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 2 || lists[0].Testing != "Add" || lists[1].Testing != "Sub" {
+		t.Fatalf("unexpected lists %+v", lists)
+	}
+	if len(lists[0].Specs) != 2 || lists[0].Specs[1].Name != "TestAdd_Zero" || lists[1].Specs[0].Description != "1. Subtract" {
+		t.Errorf("unexpected specs %+v %+v", lists[0].Specs, lists[1].Specs)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	spec := llm.Spec{Name: "TestAdd_Positive", Description: "1. Add 1 and 2"}
+	cp := NewCheckpoint(dir)
+	if err := cp.Save("Add", spec, "func TestAdd_Positive(t *testing.T) {}"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, ok := loaded.Generated("Add", spec); !ok || code != "func TestAdd_Positive(t *testing.T) {}" {
+		t.Errorf("got %q, %t", code, ok)
+	}
+	edited := spec
+	edited.Description = "1. Add 2 and 2"
+	if _, ok := loaded.Generated("Add", edited); ok {
+		t.Error("expected edited specs to be generated again")
+	}
+	if _, ok := loaded.Generated("Sub", spec); ok {
+		t.Error("expected the spec of another target to be generated")
+	}
+
+	if err := loaded.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := LoadCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty.Specs) != 0 {
+		t.Errorf("expected an empty checkpoint after removal, got %v", empty.Specs)
+	}
+}
+
+func TestDraftOwner(t *testing.T) {
+	draft := DraftFile(aggregator.NewRegistry(), "calc", "@org/payments", []llm.Spec{{Name: "TestAdd"}}, []string{"func TestAdd(t *testing.T) {}\n"}, nil, false)
+	if !strings.HasPrefix(draft, draftHeader("@org/payments")) || FileOwner(draft) != "@org/payments" {
+		t.Errorf("unexpected owner of draft:\n%s", draft)
+	}
+	if draft := DraftFile(aggregator.NewRegistry(), "calc", "", []llm.Spec{{Name: "TestAdd"}}, []string{"func TestAdd(t *testing.T) {}\n"}, nil, false); FileOwner(draft) != "" {
+		t.Errorf("expected no owner:\n%s", draft)
+	}
+
+	var out strings.Builder
+	(&RunReport{Owner: "@org/payments"}).WriteSummary(&out)
+	if out.String() != "Owner: @org/payments\n" {
+		t.Errorf("unexpected summary %q", out.String())
+	}
+}
+
+// scriptedProvider replies with the replies in order, repeating the last one.
+type scriptedProvider struct {
+	fakeProvider
+	replies []string
+}
+
+func (p *scriptedProvider) Complete(_ context.Context, prompt llm.Prompt) (string, error) {
+	p.prompts = append(p.prompts, prompt)
+	reply := p.replies[0]
+	if len(p.replies) > 1 {
+		p.replies = p.replies[1:]
+	}
+	return reply, nil
+}
+
+func (p *scriptedProvider) Stream(ctx context.Context, prompt llm.Prompt, onDelta func(string)) (string, error) {
+	out, err := p.Complete(ctx, prompt)
+	onDelta(out)
+	return out, err
+}
+
+func TestWarmStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calc_test.go")
+	src := "package calc\n\nimport \"testing\"\n\nfunc newCalc(t *testing.T) *Calc { return &Calc{} }\n\nfunc TestCalc_Add(t *testing.T) {\n\tif newCalc(t).Add(1, 1) != 2 {\n\t\tt.Fail()\n\t}\n}\n"
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := warmStartInstructions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{src[:len(src)-1], "helpers, types and fixtures (newCalc)", "Do not repeat what TestCalc_Add already cover"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("instructions miss %q:\n%s", want, got)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("package calc\n\nfunc TestBroken(\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := warmStartInstructions(path); err == nil {
+		t.Error("expected an error for a file that does not parse")
+	}
+}
+
+func TestDraftFile(t *testing.T) {
+	responses := []string{
+		"func TestAdd(t *testing.T) {}\n",
+		"func TestSub(t *testing.T) {\n\tif Sub(3, 2) != 1 {\n\nfunc TestMul(t *testing.T) {}\n",
+	}
+	specs := []llm.Spec{{Name: "TestAdd"}, {Name: "TestMul"}}
+
+	draft := DraftFile(aggregator.NewRegistry(), "calc", "", specs, responses, nil, false)
+	for _, want := range []string{"\nfunc TestAdd(t *testing.T) {}", "\nfunc TestMul(t *testing.T) {}", "// func TestSub(t *testing.T) {"} {
+		if !strings.Contains(draft, want) {
+			t.Errorf("draft misses %q:\n%s", want, draft)
+		}
+	}
+
+	draft = DraftFile(aggregator.NewRegistry(), "calc", "", specs, responses, nil, true)
+	if !strings.Contains(draft, "// func TestMul(t *testing.T)") || strings.Contains(draft, "\nfunc ") {
+		t.Errorf("the commented draft has code:\n%s", draft)
+	}
+}
+
+func TestDraftAnnotations(t *testing.T) {
+	for output, want := range map[string]string{
+		"calc_test.go":           "calc_draft_test.go",
+		"pkg/generated_test.go":  "pkg/generated_draft_test.go",
+		"pkg/generated_tests.go": "pkg/generated_tests_draft_test.go",
+	} {
+		if got := DraftPath(output); got != want {
+			t.Errorf("DraftPath(%q) = %q, want %q", output, got, want)
+		}
+	}
+
+	specs := []llm.Spec{{Name: "TestAdd", Description: "adds two numbers\nreturns their sum"}}
+	responses := []string{"func helper() int { return 1 }\n\nfunc TestAdd(t *testing.T) {}\n"}
+	draft := DraftFile(aggregator.NewRegistry(), "calc", "", specs, responses, nil, false)
+	if !strings.HasPrefix(draft, "//go:build "+DraftBuildTag+"\n\n") {
+		t.Errorf("the draft is not behind the build tag:\n%s", draft)
+	}
+	for _, want := range []string{
+		"// REVIEW(goptest): TestAdd\n// Spec:\n",
+		"adds two numbers\n",
+		"returns their sum\n",
+		"match the spec.\nfunc TestAdd(t *testing.T) {}",
+	} {
+		if !strings.Contains(draft, want) {
+			t.Errorf("the test annotation misses %q:\n%s", want, draft)
+		}
+	}
+	if !strings.Contains(draft, "func helper() int { return 1 }") || strings.Contains(draft, "// func helper") {
+		t.Errorf("the draft is not left uncommented:\n%s", draft)
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	first := "cases:\n  - name: TestParse_Empty\n    instructions: Parse(\"\") returns ErrEmpty\n"
+	second := "cases:\n  - name: TestParse_EmptyInput\n    instructions: Parse(\"\") returns 0 and no error\n"
+	comparison := "```yaml\nambiguous:\n  - name: TestParse_Empty\n    behavior: Parse(\"\")\n    expectations: [returns ErrEmpty, returns 0 and no error]\n```"
+	provider := &scriptedProvider{replies: []string{first, second, comparison}}
+	c, err := llm.NewClient(llm.WithProvider(provider), llm.WithAPIKey(""), llm.WithParallel(1), llm.WithResponseFormat(llm.FormatText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &RunReport{}
+	cases, err := generateCandidates(context.Background(), c, report, "Parse", "package calc\n", "- empty input", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cases != first && cases != second {
+		t.Errorf("got cases %q, want a candidate", cases)
+	}
+	if len(provider.prompts) != 3 || provider.prompts[2].Stage != llm.StageCompare {
+		t.Fatalf("sent %d prompts, want two candidates and a comparison", len(provider.prompts))
+	}
+	if user := provider.prompts[2].Messages[1].Content; !strings.Contains(user, "Case list 2") || !strings.Contains(user, "returns 0 and no error") {
+		t.Errorf("the comparison misses a candidate:\n%s", user)
+	}
+	want := []llm.AmbiguousCase{{Target: "Parse", Name: "TestParse_Empty", Behavior: `Parse("")`, Expectations: []string{"returns ErrEmpty", "returns 0 and no error"}}}
+	if !reflect.DeepEqual(report.Ambiguous, want) {
+		t.Errorf("Ambiguous = %+v, want %+v", report.Ambiguous, want)
+	}
+	var b strings.Builder
+	report.WriteSummary(&b)
+	if !strings.Contains(b.String(), "TestParse_Empty (Parse): Parse(\"\"): returns ErrEmpty vs. returns 0 and no error") {
+		t.Errorf("the summary misses the ambiguous case:\n%s", b.String())
+	}
+}
+
+func TestPackageFiles(t *testing.T) {
+	dir := t.TempDir()
+	other := "windows"
+	if runtime.GOOS == "windows" {
+		other = "linux"
+	}
+	files := map[string]string{
+		"foo.go":                      "package foo\n",
+		"bar.go":                      "package foo\n",
+		"foo_test.go":                 "package foo\n",
+		"README.md":                   "package foo\n",
+		"gen.go":                      "//go:build ignore\n\npackage main\n",
+		"foo_" + runtime.GOOS + ".go": "package foo\n",
+		"foo_" + other + ".go":        "package foo\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := PackageFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "bar.go"), filepath.Join(dir, "foo.go"), filepath.Join(dir, "foo_"+runtime.GOOS+".go")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PackageFiles() = %v, want %v", got, want)
+	}
+	if _, err := PackageFiles(t.TempDir()); err == nil {
+		t.Error("expected an error for a directory without Go files")
+	}
+}
+
+func TestCoverageGaps(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.20\n",
+		"sign.go": `package sign
+
+func Sign(n int) string {
+	if n < 0 {
+		return "negative"
+	}
+	if n == 0 {
+		return "zero"
+	}
+	return "positive"
+}
+
+func Abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+`,
+		"sign_test.go": `package sign
+
+import "testing"
+
+func TestSign(t *testing.T) {
+	if got := Sign(1); got != "positive" {
+		t.Fatal(got)
+	}
+}
+
+func TestAbs(t *testing.T) {
+	if Abs(-1) != 1 || Abs(1) != 1 {
+		t.Fatal("wrong")
+	}
+}
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	profiles, err := RunCoverage(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gaps, err := CoverageGaps(dir, profiles, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps) != 1 {
+		t.Fatalf("got %d gaps, want only Sign: %+v", len(gaps), gaps)
+	}
+	gap := gaps[0]
+	if gap.Func != "Sign" || gap.File != "sign.go" || gap.Line != 3 || gap.Covered >= gap.Statements {
+		t.Errorf("unexpected gap %+v", gap)
+	}
+	if want := []LineRange{{Start: 5, End: 6}, {Start: 8, End: 9}}; !reflect.DeepEqual(gap.Uncovered, want) {
+		t.Errorf("Uncovered = %v, want %v", gap.Uncovered, want)
+	}
+	if !strings.Contains(gap.Code, `5: 		return "negative"`) || !strings.Contains(gap.Code, `8: 		return "zero"`) {
+		t.Errorf("the code misses the uncovered lines:\n%s", gap.Code)
+	}
+	if gaps, err := CoverageGaps(dir, profiles, []string{"Abs"}); err != nil || len(gaps) != 0 {
+		t.Errorf("CoverageGaps(Abs) = %+v, %v, want no gaps", gaps, err)
+	}
+	if instructions := CoverageInstructions(gaps); !strings.Contains(instructions, "Sign (sign.go:3)") {
+		t.Errorf("the instructions miss the gap:\n%s", instructions)
+	}
+}
+
+func TestTrivialReason(t *testing.T) {
+	src := `package store
+
+type Store struct {
+	name string
+	cfg  struct{ path string }
+	db   *DB
+}
+
+func (s *Store) Name() string { return s.name }
+
+func (s *Store) Path() string { return s.cfg.path }
+
+func (s *Store) Get(key string) (string, error) { return s.db.Get(key) }
+
+func (s *Store) Close() { s.db.Close() }
+
+func (s *Store) Upper() string { return strings.ToUpper(s.name) }
+
+func Parse(s string) (int, error) { return strconv.Atoi(strings.TrimSpace(s)) }
+
+func Clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	return v
+}
+`
+	f, err := parser.ParseFile(token.NewFileSet(), "store.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Store.Name":  "getter",
+		"Store.Path":  "getter",
+		"Store.Get":   "one-line wrapper",
+		"Store.Close": "one-line wrapper",
+		"Store.Upper": "one-line wrapper",
+		"Parse":       "",
+		"Clamp":       "",
+	}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		if got := trivialReason(fn, isGeneratedFile(f)); got != want[llm.FuncName(fn)] {
+			t.Errorf("trivialReason(%s) = %q, want %q", llm.FuncName(fn), got, want[llm.FuncName(fn)])
+		}
+	}
+
+	generated := "// Code generated by \"stringer -type=Color\"; DO NOT EDIT.\n\npackage color\n\nfunc (i Color) String() string {\n\tif i < 0 {\n\t\treturn \"\"\n\t}\n\treturn names[i]\n}\n"
+	f, err = parser.ParseFile(token.NewFileSet(), "color_string.go", generated, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGeneratedFile(f) || trivialReason(f.Decls[0].(*ast.FuncDecl), true) != "generated code" {
+		t.Error("the stringer is not recognized as generated code")
+	}
+}
+
+func TestTestedFuncs(t *testing.T) {
+	code := `package calc
+
+func Add(a, b int) int { return a + b }
+func AddAll(xs ...int) int { return 0 }
+func Sub(a, b int) int { return a - b }
+func helper() {}
+
+type Store struct{}
+
+func (s *Store) Get(key string) string { return "" }
+func (s *Store) Put(key string) {}
+`
+	dir := t.TempDir()
+	files := map[string]string{
+		"calc_test.go":            "package calc\n\nimport \"testing\"\n\nfunc TestAdd(t *testing.T) {}\nfunc TestAdd_Negative(t *testing.T) {}\nfunc TestStore_Get(t *testing.T) {}\nfunc TestStorePut(t *testing.T) {}\nfunc Test_helper(t *testing.T) {}\n",
+		"generated_draft_test.go": "//go:build " + DraftBuildTag + "\n\npackage calc\n\nimport \"testing\"\n\nfunc TestSub(t *testing.T) {}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := TestedFuncs(dir, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"Add":       {"TestAdd", "TestAdd_Negative"},
+		"Store.Get": {"TestStore_Get"},
+		"Store.Put": {"TestStorePut"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TestedFuncs() = %v, want %v", got, want)
+	}
+
+	in := Input{Dir: dir, Code: code}
+	instructions, err := testedInstructions(in, "Sub and AddAll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(instructions, "- Add (TestAdd, TestAdd_Negative)\n- Store.Get (TestStore_Get)") {
+		t.Errorf("the instructions miss the tested functions:\n%s", instructions)
+	}
+	if _, err := testedInstructions(in, "Add"); !errors.Is(err, ErrAlreadyTested) || !strings.Contains(err.Error(), "Add by TestAdd, TestAdd_Negative") {
+		t.Errorf("expected an error for a tested target, got %v", err)
+	}
+}
+
+func TestStyleInstructions(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"calc_test.go": `package calc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSub(t *testing.T) {
+	require.Equal(t, 1, Sub(2, 1))
+}
+
+// TestAdd checks the sums.
+func TestAdd(t *testing.T) {
+	for _, tc := range []struct{ a, b, want int }{{1, 2, 3}} {
+		require.Equal(t, tc.want, Add(tc.a, tc.b))
+	}
+}
+
+func newCalc(t *testing.T) *Calc {
+	return &Calc{}
+}
+
+func BenchmarkAdd(b *testing.B) {}
+
+func FuzzAdd(f *testing.F) {}
+
+func ExampleAdd() {}
+`,
+		"generated_draft_test.go": "//go:build " + DraftBuildTag + "\n\npackage calc\n\nimport \"testing\"\n\nfunc TestDraft(t *testing.T) {}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, err := StyleFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, "calc_test.go")}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("StyleFiles() = %v, want %v", paths, want)
+	}
+	got, err := StyleInstructions(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"```go\n// TestAdd checks the sums.\nfunc TestAdd(t *testing.T) {",
+		"}\n\nfunc TestSub(t *testing.T) {",
+		"They use github.com/stretchr/testify/require",
+		"Call their helpers (newCalc) instead",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("the instructions miss %q:\n%s", want, got)
+		}
+	}
+	if got, err := StyleInstructions(nil); err != nil || got != "" {
+		t.Errorf("StyleInstructions(nil) = %q, %v, want nothing", got, err)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	store, err := llm.NewArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeProvider{reply: "func TestAdd(t *testing.T) {}\n"}
+	client, err := llm.NewClient(llm.WithProvider(provider), llm.WithParallel(1), llm.WithArtifacts(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := client.Trace("TestAdd"); got != "" {
+		t.Errorf("Trace() = %q before any attempt, want none", got)
+	}
+	code, err := client.GenerateTestCode(context.Background(), llm.Spec{Name: "TestAdd"}, "Add", "package calc", "calc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(store.TraceDir("TestAdd"), "01-code.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a llm.Artifact
+	if err := json.Unmarshal(content, &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Stage != llm.StageCode || a.Target != "TestAdd" || a.Response != provider.reply || len(a.Messages) == 0 {
+		t.Errorf("unexpected artifact %+v", a)
+	}
+
+	trace := client.Trace("TestAdd")
+	if want := "// goptest:trace " + store.TraceID("TestAdd") + " "; !strings.HasPrefix(trace, want) {
+		t.Errorf("Trace() = %q, want prefix %q", trace, want)
+	}
+	draft := DraftFile(aggregator.NewRegistry(), "calc", "", []llm.Spec{{Name: "TestAdd"}}, []string{code}, []string{trace}, false)
+	if !strings.Contains(draft, trace+"func TestAdd(") {
+		t.Errorf("the test is not annotated with its trace:\n%s", draft)
+	}
+}
+
+func TestMergeDraft(t *testing.T) {
+	dir := t.TempDir()
+	specs := []llm.Spec{{Name: "TestAdd"}}
+	responses := []string{"func TestAdd(t *testing.T) {}\n"}
+	outputFilePath := filepath.Join(dir, "calc_test.go")
+
+	commented := filepath.Join(dir, "commented_draft_test.go")
+	if err := llm.WriteToFile(DraftFile(aggregator.NewRegistry(), "calc", "", specs, responses, nil, true), commented); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := MergeDraft(commented, outputFilePath, "calc"); err != nil || got != commented {
+		t.Errorf("MergeDraft() = %s, %v for a commented draft, want the draft kept", got, err)
+	}
+	if _, err := os.Stat(commented); err != nil {
+		t.Errorf("the commented draft was removed: %v", err)
+	}
+	if _, err := os.Stat(outputFilePath); !os.IsNotExist(err) {
+		t.Errorf("the output file was written with nothing merged: %v", err)
+	}
+
+	draft := filepath.Join(dir, "draft_test.go")
+	if err := llm.WriteToFile(DraftFile(aggregator.NewRegistry(), "calc", "", specs, responses, nil, false), draft); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := MergeDraft(draft, outputFilePath, "calc"); err != nil || got != outputFilePath {
+		t.Errorf("MergeDraft() = %s, %v, want %s", got, err, outputFilePath)
+	}
+	if _, err := os.Stat(draft); !os.IsNotExist(err) {
+		t.Errorf("the merged draft was kept: %v", err)
+	}
+	content, err := os.ReadFile(outputFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "func TestAdd(t *testing.T) {}") {
+		t.Errorf("TestAdd was not merged:\n%s", content)
+	}
+}
+
+func TestConventions(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"parse_test.go": `package parse
+
+import (
+	"testing"
+
+	"example.com/m/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse_Empty(t *testing.T) {
+	tests := []struct{ in string }{{in: ""}}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			assert.Equal(t, 0, testutil.Parse(tt.in))
+		})
+	}
+}
+`,
+		"draft_test.go": "//go:build " + DraftBuildTag + "\n\npackage parse\n\nfunc TestDraft(t *testing.T) {}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conv := &Conventions{}
+	for _, p := range []string{"parse_test.go", "draft_test.go", "missing_test.go"} {
+		conv.AddPending(p)
+	}
+	conv.AddPending("parse_test.go")
+	conv.LearnAccepted(dir)
+
+	if want := []string{"parse_test.go"}; !reflect.DeepEqual(conv.Learned, want) {
+		t.Errorf("Learned = %v, want %v", conv.Learned, want)
+	}
+	if want := []string{"draft_test.go", "missing_test.go"}; !reflect.DeepEqual(conv.Pending, want) {
+		t.Errorf("Pending = %v, want %v", conv.Pending, want)
+	}
+	if conv.Tests != 1 || conv.TableTests != 1 || conv.Subtests != 1 {
+		t.Errorf("Tests = %d, TableTests = %d, Subtests = %d, want 1 each", conv.Tests, conv.TableTests, conv.Subtests)
+	}
+
+	want := "Follow the conventions of previously accepted tests in this package:\n" +
+		"- Use github.com/stretchr/testify/assert for assertions.\n" +
+		"- Name tests like TestSubject_Condition.\n" +
+		"- Prefer table-driven tests.\n" +
+		"- Use t.Run subtests.\n" +
+		"- Reuse these helpers: example.com/m/testutil.Parse.\n"
+	if got := conv.Instructions(); got != want {
+		t.Errorf("Instructions() = %q, want %q", got, want)
+	}
+	if got := (&Conventions{}).Instructions(); got != "" {
+		t.Errorf("Instructions() = %q without accepted tests, want none", got)
+	}
+}
+
+func TestFindTestHelpers(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "internal", "testutil")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	src := "package testutil\n\n// NewServer starts a fake server.\nfunc NewServer() string { return \"\" }\n\nfunc helper() {}\n"
+	if err := os.WriteFile(filepath.Join(dir, "server.go"), []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	helpers, err := FindTestHelpers(root, "example.com/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"example.com/m/internal/testutil": {"// NewServer starts a fake server.\nfunc NewServer() string"}}
+	if !reflect.DeepEqual(helpers, want) {
+		t.Errorf("FindTestHelpers() = %v, want %v", helpers, want)
+	}
+
+	if helpers, err := FindTestHelpers(root, ""); err == nil {
+		t.Errorf("FindTestHelpers() = %v without a module path, want an error", helpers)
+	}
+}
+
+func TestStrictChecks(t *testing.T) {
+	code := "package calc\n\nfunc TestAdd(t *testing.T) {}\n"
+	cases := "cases:\n  - name: TestAdd_Zero\n    instructions: Add(0, 0) returns 0\n"
+	testCases := []struct {
+		name    string
+		check   func() error
+		wantErr bool
+	}{
+		{name: "clean code", check: func() error { return StrictCheckCode(code) }},
+		{name: "fenced code", check: func() error { return StrictCheckCode("```go\n" + code + "```\n") }, wantErr: true},
+		{name: "prose-wrapped code", check: func() error { return StrictCheckCode("Here is the test:\n```go\n" + code + "```\nIt covers Add.") }, wantErr: true},
+		{name: "unparseable code", check: func() error { return StrictCheckCode("package calc\n\nfunc TestAdd(t *testing.T) {\n") }, wantErr: true},
+		{name: "prose without fences", check: func() error { return StrictCheckCode("Here is the test: " + code) }, wantErr: true},
+		{name: "clean cases", check: func() error { return strictCheckCases(cases) }},
+		{name: "fenced cases", check: func() error { return strictCheckCases("```yaml\n" + cases + "```") }, wantErr: true},
+		{name: "prose-wrapped cases", check: func() error { return strictCheckCases("The cases:\n```\n" + cases + "```\nDone.") }, wantErr: true},
+		{name: "package", check: func() error { return strictCheckPackage("calc") }},
+		{name: "no package", check: func() error { return strictCheckPackage(" ") }, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.check()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want an error: %v", err, tc.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrHeuristicCleanup) {
+				t.Errorf("error %v is not ErrHeuristicCleanup", err)
+			}
+		})
+	}
+}
+
+func TestLoadIssue(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/acme/calc/issues/42" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q, want the GITHUB_TOKEN", got)
+		}
+		fmt.Fprint(w, `{"title": "Add overflows", "body": "Add must return ErrOverflow."}`)
+	}))
+	defer srv.Close()
+	t.Setenv("GITHUB_API_URL", srv.URL+"/")
+	t.Setenv("GITHUB_TOKEN", "secret")
+
+	issueFile := filepath.Join(t.TempDir(), "issue.md")
+	if err := os.WriteFile(issueFile, []byte("Sub must not overflow."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	issue, err := loadIssue(context.Background(), issueFile, "acme/calc#42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Sub must not overflow.\n\nAdd overflows\n\nAdd must return ErrOverflow."; issue != want {
+		t.Errorf("loadIssue() = %q, want %q", issue, want)
+	}
+
+	for _, ref := range []string{"acme/calc", "acme/calc#7"} {
+		if _, err := loadIssue(context.Background(), "", ref); err == nil {
+			t.Errorf("loadIssue(%q) succeeded, want an error", ref)
+		}
+	}
+
+	want := "The tests must verify the acceptance criteria of this issue. " +
+		"Cover every requirement it states and assert the behavior it asks for:\n\"\"\"\nAdd overflows\n\"\"\"\n"
+	if got := issueInstructions("\nAdd overflows\n"); got != want {
+		t.Errorf("issueInstructions() = %q, want %q", got, want)
+	}
+	if got := issueInstructions(" "); got != "" {
+		t.Errorf("issueInstructions() = %q without an issue, want none", got)
+	}
+}
+
+func TestGitHistory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	commit := func(file string, content string, msg string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", file)
+		git("commit", "-q", "-m", msg)
+	}
+	git("init", "-q")
+	commit("calc.go", "package calc\n", "Add the calc package")
+	commit("README.md", "calc\n", "Document calc")
+	commit("calc.go", "package calc\n\nfunc Add(a, b int) int { return a + b }\n", "Add must not overflow\n\nReturn ErrOverflow instead.")
+
+	history, err := gitHistory(context.Background(), []string{filepath.Join(dir, "calc.go")}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(`^commit \w+\nAdd must not overflow\n\nReturn ErrOverflow instead\.\n\ncommit \w+\nAdd the calc package$`)
+	if !re.MatchString(history) {
+		t.Errorf("gitHistory() = %q, want the two commits of calc.go, newest first", history)
+	}
+	if history, err := gitHistory(context.Background(), []string{filepath.Join(dir, "calc.go")}, 1); err != nil || strings.Count(history, "commit ") != 1 {
+		t.Errorf("gitHistory() = %q, %v, want the last commit only", history, err)
+	}
+
+	want := "Recent commit messages touching this code explain the intended behavior, " +
+		"use them to decide what the tests should expect:\n\"\"\"\n" + history + "\n\"\"\"\n"
+	if got := gitHistoryInstructions(history); got != want {
+		t.Errorf("gitHistoryInstructions() = %q, want %q", got, want)
+	}
+	if got := gitHistoryInstructions(""); got != "" {
+		t.Errorf("gitHistoryInstructions() = %q without history, want none", got)
+	}
+}
@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// filterUnexportedFields removes the unexported fields of the struct types in the file.
+func filterUnexportedFields(f *ast.File) {
+	ast.Inspect(f, func(n ast.Node) bool {
+		st, ok := n.(*ast.StructType)
+		if !ok {
+			return true
+		}
+		var kept []*ast.Field
+		for _, field := range st.Fields.List {
+			if len(field.Names) == 0 {
+				// Embedded fields are exported when their type is.
+				if name := llm.BaseTypeName(field.Type); name == "" || ast.IsExported(name) {
+					kept = append(kept, field)
+				}
+				continue
+			}
+			var names []*ast.Ident
+			for _, n := range field.Names {
+				if n.IsExported() {
+					names = append(names, n)
+				}
+			}
+			if len(names) > 0 {
+				field.Names = names
+				kept = append(kept, field)
+			}
+		}
+		st.Fields.List = kept
+		return true
+	})
+}
+
+// PublicAPI reduces the code to the package's exported surface: the doc comments and
+// signatures of exported declarations, without function bodies and unexported fields.
+func PublicAPI(allCode string) (string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", allCode, parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	filterUnexportedFields(f)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "package %s\n\n", f.Name.Name)
+	for _, decl := range f.Decls {
+		if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			b.WriteString(llm.PrintNode(fset, gd) + "\n\n")
+		}
+	}
+	for _, sig := range exportedSignatures(fset, f) {
+		b.WriteString(sig + "\n\n")
+	}
+	return b.String(), nil
+}
+
+// packageImportPath returns the import path of the package in dir.
+func packageImportPath(dir string) (string, error) {
+	root, modulePath, err := llm.FindModuleRoot(dir)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return modulePath, nil
+	}
+	return modulePath + "/" + filepath.ToSlash(rel), nil
+}
+
+// publicAPIInstructions asks for black-box tests in the external test package.
+func publicAPIInstructions(pkgName string, importPath string) string {
+	instructions := fmt.Sprintf("Write black-box tests in package %s_test using only the exported API shown above, "+
+		"never unexported identifiers, so the tests survive internal refactors.", pkgName)
+	if importPath != "" {
+		instructions += fmt.Sprintf(" Import the tested package as %q and qualify its identifiers with %s.", importPath, pkgName)
+	}
+	return instructions
+}
@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sentiens/goptest/llm"
+	"github.com/sentiens/goptest/spec"
+)
+
+// RunReport collects the results of all stages of a run. It is safe for concurrent use.
+type RunReport struct {
+	Stages     []llm.StageResult
+	OutputPath string
+	// Owner is the team owning the generated tests, for routing their review.
+	Owner string
+	// Renamed are the spec names changed into valid test function names.
+	Renamed []spec.Rename
+	// Ambiguous are the cases the candidate case lists disagree on, see -candidates.
+	Ambiguous []llm.AmbiguousCase
+
+	mu sync.Mutex
+}
+
+// Add appends a stage result.
+func (r *RunReport) Add(result llm.StageResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Stages = append(r.Stages, result)
+}
+
+// AddAmbiguous appends cases the candidates disagree on.
+func (r *RunReport) AddAmbiguous(cases ...llm.AmbiguousCase) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Ambiguous = append(r.Ambiguous, cases...)
+}
+
+// Failed returns the stage results that ended with an error.
+func (r *RunReport) Failed() []llm.StageResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var res []llm.StageResult
+	for _, s := range r.Stages {
+		if s.Err != nil {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// WriteSummary prints one line per stage.
+func (r *RunReport) WriteSummary(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.Stages {
+		status := "ok"
+		if s.Err != nil {
+			status = "failed: " + s.Err.Error()
+		}
+		fmt.Fprintf(w, "%-6s %-40s %8s %s\n", s.Stage, s.Target, s.Duration.Round(time.Millisecond), status)
+	}
+	if r.OutputPath != "" {
+		fmt.Fprintf(w, "Output: %s\n", r.OutputPath)
+	}
+	if r.Owner != "" {
+		fmt.Fprintf(w, "Owner: %s\n", r.Owner)
+	}
+	if len(r.Renamed) > 0 {
+		fmt.Fprintln(w, "Specs renamed to valid test function names:")
+		for _, rn := range r.Renamed {
+			fmt.Fprintf(w, "  %q -> %s\n", rn.From, rn.To)
+		}
+	}
+	if len(r.Ambiguous) > 0 {
+		fmt.Fprintln(w, "Ambiguous behavior, the candidate cases disagree; check the code and the spec file:")
+		for _, a := range r.Ambiguous {
+			fmt.Fprintf(w, "  %s (%s): %s: %s\n", a.Name, a.Target, a.Behavior, strings.Join(a.Expectations, " vs. "))
+		}
+	}
+}
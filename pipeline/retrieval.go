@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// maxEmbeddingInput truncates long declarations before they are embedded.
+const maxEmbeddingInput = 8000
+
+// codeChunk is a top-level declaration of the code with its doc comment.
+type codeChunk struct {
+	code   string
+	target bool
+}
+
+// codeChunks splits the code into its imports and top-level declarations. Declarations of the
+// target functions and of their receiver types are marked as targets.
+func codeChunks(allCode string, whatToTest string) (header string, chunks []codeChunk, err error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", allCode, parser.ParseComments)
+	if err != nil {
+		return "", nil, err
+	}
+	fns, _, _ := llm.FindTargetFuncs(allCode, whatToTest)
+	targets := make(map[string]bool)
+	receivers := make(map[string]bool)
+	for _, fn := range fns {
+		targets[llm.FuncName(fn)] = true
+		if name, _ := llm.ReceiverType(fn.Recv); name != "" {
+			receivers[name] = true
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "package %s\n\n", f.Name.Name)
+	for _, decl := range f.Decls {
+		if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			b.WriteString(llm.PrintNode(fset, gd) + "\n\n")
+			continue
+		}
+		target := false
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			target = targets[llm.FuncName(fn)]
+		}
+		if gd, ok := decl.(*ast.GenDecl); ok && gd.Tok == token.TYPE {
+			for _, spec := range gd.Specs {
+				target = target || receivers[spec.(*ast.TypeSpec).Name.Name]
+			}
+		}
+		chunks = append(chunks, codeChunk{code: llm.PrintNode(fset, decl), target: target})
+	}
+	return b.String(), chunks, nil
+}
+
+// cosineSimilarity returns the cosine of the angle between the vectors.
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		if i >= len(b) {
+			break
+		}
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+func truncateEmbeddingInput(s string) string {
+	if len(s) > maxEmbeddingInput {
+		return s[:maxEmbeddingInput]
+	}
+	return s
+}
+
+// RelevantCode reduces the code to the declarations most relevant to the target within about
+// budget tokens. The declarations of the target and of its receiver types are always kept,
+// the others are ranked by the similarity of their embeddings to the target description.
+// The kept declarations stay in source order.
+func RelevantCode(ctx context.Context, embedder llm.Embedder, allCode string, whatToTest string, budget int) (string, error) {
+	if whatToTest == "" {
+		return "", errors.New("no target to retrieve code for")
+	}
+	header, chunks, err := codeChunks(allCode, whatToTest)
+	if err != nil {
+		return "", err
+	}
+	texts := []string{whatToTest}
+	for _, c := range chunks {
+		texts = append(texts, truncateEmbeddingInput(c.code))
+	}
+	embeddings, err := embedder.Embed(ctx, texts)
+	if err != nil {
+		return "", err
+	}
+	if len(embeddings) != len(texts) {
+		return "", fmt.Errorf("got %d embeddings for %d texts", len(embeddings), len(texts))
+	}
+
+	order := make([]int, len(chunks))
+	scores := make([]float64, len(chunks))
+	for i := range chunks {
+		order[i] = i
+		scores[i] = cosineSimilarity(embeddings[0], embeddings[i+1])
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := chunks[order[i]], chunks[order[j]]
+		if a.target != b.target {
+			return a.target
+		}
+		return scores[order[i]] > scores[order[j]]
+	})
+	keep := make([]bool, len(chunks))
+	used := llm.CountTokens("", header)
+	for _, i := range order {
+		tokens := llm.CountTokens("", chunks[i].code)
+		if !chunks[i].target && used+tokens > budget {
+			continue
+		}
+		keep[i] = true
+		used += tokens
+	}
+
+	var b strings.Builder
+	b.WriteString(header)
+	for i, c := range chunks {
+		if keep[i] {
+			b.WriteString(c.code + "\n\n")
+		}
+	}
+	return b.String(), nil
+}
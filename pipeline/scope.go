@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// ScopeCode reduces the code to the functions and methods named by symbols, e.g. Parse or
+// Store.Get, and their direct dependencies in the package: the types, functions, variables and
+// constants they refer to, the receiver type of the methods and the methods of that type they
+// call, and the types of the receiver's fields. A symbol naming a type selects the type with
+// its methods. The package clause and the imports are kept, the declarations stay in their
+// order with their doc comments.
+func ScopeCode(allCode string, symbols []string) (string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", allCode, parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	// decls maps the names declared at the top level to their declarations, methods as
+	// Type.Method, and methods the types to their methods. objects maps the nodes the
+	// identifiers of the package level objects resolve to to their declarations.
+	decls := make(map[string]ast.Decl)
+	methods := make(map[string][]*ast.FuncDecl)
+	objects := make(map[any]ast.Decl)
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			decls[llm.FuncName(d)] = d
+			if recv, _ := llm.ReceiverType(d.Recv); recv != "" {
+				methods[recv] = append(methods[recv], d)
+			} else {
+				objects[d] = d
+			}
+		case *ast.GenDecl:
+			for _, s := range d.Specs {
+				objects[s] = d
+				switch s := s.(type) {
+				case *ast.TypeSpec:
+					decls[s.Name.Name] = d
+				case *ast.ValueSpec:
+					for _, n := range s.Names {
+						decls[n.Name] = d
+					}
+				}
+			}
+		}
+	}
+
+	selected := make(map[ast.Decl]bool)
+	var targets []*ast.FuncDecl
+	for _, symbol := range symbols {
+		symbol = strings.TrimSpace(symbol)
+		if symbol == "" {
+			continue
+		}
+		decl, ok := decls[symbol]
+		if !ok {
+			return "", fmt.Errorf("no function, method or type %s in the code files", symbol)
+		}
+		selected[decl] = true
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			targets = append(targets, fn)
+			continue
+		}
+		for _, m := range methods[symbol] {
+			selected[m] = true
+			targets = append(targets, m)
+		}
+	}
+	if len(selected) == 0 {
+		return "", errors.New("no symbols to scope the code to")
+	}
+
+	// refs selects the declarations the node refers to.
+	refs := func(node ast.Node, recv string) {
+		ast.Inspect(node, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.SelectorExpr:
+				if d, ok := decls[recv+"."+n.Sel.Name]; ok && recv != "" {
+					selected[d] = true
+				}
+			case *ast.Ident:
+				if n.Obj == nil {
+					break
+				}
+				if d, ok := objects[n.Obj.Decl]; ok {
+					selected[d] = true
+				}
+			}
+			return true
+		})
+	}
+	for _, fn := range targets {
+		recv, _ := llm.ReceiverType(fn.Recv)
+		refs(fn, recv)
+		// The fields of the receiver are dependencies of its methods too.
+		if d, ok := decls[recv]; ok {
+			selected[d] = true
+			refs(d, "")
+		}
+	}
+
+	offset := func(pos token.Pos) int { return fset.Position(pos).Offset }
+	var b strings.Builder
+	fmt.Fprintf(&b, "package %s\n", f.Name.Name)
+	for _, decl := range f.Decls {
+		gen, isGen := decl.(*ast.GenDecl)
+		if !selected[decl] && !(isGen && gen.Tok == token.IMPORT) {
+			continue
+		}
+		start := decl.Pos()
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Doc != nil {
+				start = d.Doc.Pos()
+			}
+		case *ast.GenDecl:
+			if d.Doc != nil {
+				start = d.Doc.Pos()
+			}
+		}
+		b.WriteString("\n" + allCode[offset(start):offset(decl.End())] + "\n")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,52 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// ErrHeuristicCleanup is returned in strict mode when a response could only be used
+// after heuristic cleanup.
+var ErrHeuristicCleanup = errors.New("response required heuristic cleanup")
+
+func hasCodeFence(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			return true
+		}
+	}
+	return false
+}
+
+// StrictCheckCode verifies that a code response is a plain, parseable Go file
+// that aggregation can use without stripping anything.
+func StrictCheckCode(resp string) error {
+	if hasCodeFence(resp) {
+		return fmt.Errorf("%w: markdown code fences", ErrHeuristicCleanup)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "", resp, parser.AllErrors); err != nil {
+		return fmt.Errorf("%w: unparseable snippet: %v", ErrHeuristicCleanup, err)
+	}
+	return nil
+}
+
+// strictCheckCases verifies that a test cases response is plain YAML.
+func strictCheckCases(resp string) error {
+	if llm.RemoveYAMLLines(resp) != resp {
+		return fmt.Errorf("%w: markdown code fences around YAML", ErrHeuristicCleanup)
+	}
+	return nil
+}
+
+// strictCheckPackage verifies that the package name was read from the code files.
+func strictCheckPackage(pkgName string) error {
+	if strings.TrimSpace(pkgName) == "" {
+		return fmt.Errorf("%w: no package clause found in the first code file", ErrHeuristicCleanup)
+	}
+	return nil
+}
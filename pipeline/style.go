@@ -0,0 +1,156 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sentiens/goptest/aggregator"
+	"github.com/sentiens/goptest/llm"
+)
+
+const (
+	// maxStyleTests and maxStyleTokens bound the sample of existing tests shown to the model.
+	maxStyleTests  = 3
+	maxStyleTokens = 1500
+)
+
+// styleTest is a test function of an existing test file.
+type styleTest struct {
+	src   string
+	table bool
+}
+
+// StyleFiles returns the _test.go files of the package in dir, drafts excluded.
+func StyleFiles(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*_test.go"))
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, p := range paths {
+		if !isDraftFile(p) {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+// StyleInstructions shows the model a sample of the tests in the test files, table-driven ones
+// first, with the libraries they import and their helpers, so the generated tests are written
+// the way the team writes them. It returns an empty string when the files have no tests.
+func StyleInstructions(paths []string) (string, error) {
+	var tests []styleTest
+	var helpers []string
+	libs := make(map[string]bool)
+	for _, p := range paths {
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return "", err
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, p, content, parser.ParseComments)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse %s: %v", p, err)
+		}
+		for _, imp := range f.Imports {
+			if path, err := strconv.Unquote(imp.Path.Value); err == nil && !aggregator.IsStdlibImport(path) {
+				libs[path] = true
+			}
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || fn.Body == nil || fn.Name.Name == "TestMain" {
+				continue
+			}
+			if !strings.HasPrefix(fn.Name.Name, "Test") {
+				// Benchmarks, fuzz tests and examples are run by go test, not called.
+				if !isTestingFunc(fn.Name.Name) {
+					helpers = append(helpers, fn.Name.Name)
+				}
+				continue
+			}
+			start := fn.Pos()
+			if fn.Doc != nil {
+				start = fn.Doc.Pos()
+			}
+			src := string(content[fset.Position(start).Offset:fset.Position(fn.End()).Offset])
+			tests = append(tests, styleTest{src: src, table: isTableTest(fn)})
+		}
+	}
+	if len(tests) == 0 {
+		return "", nil
+	}
+	sort.SliceStable(tests, func(i, j int) bool {
+		return tests[i].table && !tests[j].table
+	})
+	var sample []string
+	tokens := 0
+	for _, test := range tests {
+		n := llm.CountTokens("", test.src)
+		// The first test is shown even over the budget, a sample needs one test.
+		if len(sample) > 0 && tokens+n > maxStyleTokens {
+			continue
+		}
+		sample = append(sample, test.src)
+		tokens += n
+		if len(sample) == maxStyleTests {
+			break
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Write the tests the way the existing tests of the package are written: the same table layout, "+
+		"assertion style, naming and setup. A sample of them:\n```go\n%s\n```\n", strings.Join(sample, "\n\n"))
+	if len(libs) > 0 {
+		var paths []string
+		for path := range libs {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		fmt.Fprintf(&b, "They use %s; use them the same way. ", strings.Join(paths, ", "))
+	}
+	if len(helpers) > 0 {
+		fmt.Fprintf(&b, "Call their helpers (%s) instead of declaring your own, and do not redeclare them.", strings.Join(helpers, ", "))
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// isTestingFunc reports whether name is that of a benchmark, fuzz test or example.
+func isTestingFunc(name string) bool {
+	for _, prefix := range []string{"Benchmark", "Fuzz", "Example"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTableTest reports whether the test ranges over a slice or map of struct literals.
+func isTableTest(fn *ast.FuncDecl) bool {
+	table := false
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		lit, ok := n.(*ast.CompositeLit)
+		if !ok {
+			return !table
+		}
+		var elt ast.Expr
+		switch t := lit.Type.(type) {
+		case *ast.ArrayType:
+			elt = t.Elt
+		case *ast.MapType:
+			elt = t.Value
+		}
+		if _, ok := elt.(*ast.StructType); ok {
+			table = true
+		}
+		return !table
+	})
+	return table
+}
@@ -0,0 +1,20 @@
+@auth
+Feature: User login
+  # Authentication against the user store
+
+  Background:
+    Given a user "alice" with password "secret"
+
+  Scenario: Successful login
+    When "alice" logs in with "secret"
+    Then a session token is returned
+
+  Scenario Outline: Rejected credentials
+    When "<user>" logs in with "<password>"
+    Then the error is ErrInvalidCredentials
+    But no session is created
+
+    Examples:
+      | user  | password |
+      | alice | wrong    |
+      | bob   | secret   |
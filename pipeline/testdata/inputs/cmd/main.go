@@ -0,0 +1,8 @@
+package main
+
+import "example.com/date"
+
+func main() {
+	date.ParseDate("1 Apr 2023", date.Layout{Format: "2 Jan 2006"})
+	date.ParseDate("2023-04-01", date.Layout{Format: "2006-01-02", Strict: true})
+}
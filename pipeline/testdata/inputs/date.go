@@ -0,0 +1,10 @@
+package date
+
+type Layout struct {
+	Format string
+	Strict bool
+}
+
+func ParseDate(s string, layout Layout) (int, error) {
+	return ParseDate(s, Layout{})
+}
@@ -0,0 +1,7 @@
+package date
+
+import "testing"
+
+func TestParseDate(t *testing.T) {
+	ParseDate("2023-04-01", Layout{Format: "2006-01-02", Strict: true})
+}
@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sentiens/goptest/llm"
+)
+
+// TestedFuncs returns the exported functions and methods, as Type.Method, of the code that
+// the _test.go files in dir already test, with the names of their tests. A function is tested
+// by TestF or TestF_Xxx, a method by TestType_Method, TestTypeMethod or TestType_Method_Xxx.
+// Drafts are not accepted tests yet and are ignored.
+func TestedFuncs(dir string, allCode string) (map[string][]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*_test.go"))
+	if err != nil {
+		return nil, err
+	}
+	var tests []string
+	for _, p := range paths {
+		if isDraftFile(p) {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), p, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && strings.HasPrefix(fn.Name.Name, "Test") {
+				tests = append(tests, fn.Name.Name)
+			}
+		}
+	}
+	if len(tests) == 0 {
+		return nil, nil
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "", allCode, 0)
+	if err != nil {
+		return nil, err
+	}
+	tested := make(map[string][]string)
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || !fn.Name.IsExported() {
+			continue
+		}
+		name := llm.FuncName(fn)
+		prefixes := []string{"Test" + name}
+		if recv, method, ok := strings.Cut(name, "."); ok {
+			if !ast.IsExported(recv) {
+				continue
+			}
+			prefixes = []string{"Test" + recv + "_" + method, "Test" + recv + method}
+		}
+		for _, test := range tests {
+			for _, prefix := range prefixes {
+				if test == prefix || strings.HasPrefix(test, prefix+"_") {
+					tested[name] = append(tested[name], test)
+					break
+				}
+			}
+		}
+	}
+	return tested, nil
+}
+
+// testedInstructions tells the test list stage to skip the functions of the code that already
+// have tests. It fails when every function the target mentions already has tests.
+func testedInstructions(in Input, whatToTest string) (string, error) {
+	tested, err := TestedFuncs(in.Dir, in.Code)
+	if err != nil || len(tested) == 0 {
+		return "", err
+	}
+	targets, _, err := llm.FindTargetFuncs(in.Code, whatToTest)
+	if err != nil {
+		return "", err
+	}
+	var untested int
+	var testedTargets []string
+	for _, fn := range targets {
+		if tests := tested[llm.FuncName(fn)]; len(tests) > 0 {
+			testedTargets = append(testedTargets, llm.FuncName(fn)+" by "+strings.Join(tests, ", "))
+		} else {
+			untested++
+		}
+	}
+	if len(targets) > 0 && untested == 0 {
+		return "", fmt.Errorf("%w: %s", ErrAlreadyTested, strings.Join(testedTargets, "; "))
+	}
+	names := make([]string, 0, len(tested))
+	for name := range tested {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("These functions already have tests in the package, do not list tests for them:\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "- %s (%s)\n", name, strings.Join(tested[name], ", "))
+	}
+	return b.String(), nil
+}
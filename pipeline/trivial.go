@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"go/ast"
+	"regexp"
+)
+
+// generatedRe matches the comment marking generated files, see go help generate.
+var generatedRe = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// isGeneratedFile reports whether the file is marked as generated before its package clause.
+func isGeneratedFile(f *ast.File) bool {
+	for _, group := range f.Comments {
+		if group.Pos() > f.Package {
+			break
+		}
+		for _, c := range group.List {
+			if generatedRe.MatchString(c.Text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trivialReason returns why the function is too simple to spend model calls on, "" when it
+// is not: the code of generated files (e.g. stringers), getters returning a field of their
+// receiver, and one-line wrappers passing their arguments on to another call.
+func trivialReason(fn *ast.FuncDecl, generated bool) string {
+	switch {
+	case generated:
+		return "generated code"
+	case fn.Body == nil || len(fn.Body.List) != 1:
+		return ""
+	case isGetter(fn):
+		return "getter"
+	case isWrapper(fn.Body.List[0]):
+		return "one-line wrapper"
+	}
+	return ""
+}
+
+// isGetter reports whether the method only returns a field of its receiver.
+func isGetter(fn *ast.FuncDecl) bool {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 || len(fn.Recv.List[0].Names) == 0 || fn.Type.Params.NumFields() > 0 {
+		return false
+	}
+	ret, ok := fn.Body.List[0].(*ast.ReturnStmt)
+	if !ok || len(ret.Results) != 1 {
+		return false
+	}
+	expr := ret.Results[0]
+	for {
+		sel, ok := expr.(*ast.SelectorExpr)
+		if !ok {
+			break
+		}
+		expr = sel.X
+		if id, ok := expr.(*ast.Ident); ok {
+			return id.Name == fn.Recv.List[0].Names[0].Name
+		}
+	}
+	return false
+}
+
+// isWrapper reports whether the statement only calls a function, or returns its results,
+// with arguments that are names, fields or literals.
+func isWrapper(stmt ast.Stmt) bool {
+	var expr ast.Expr
+	switch s := stmt.(type) {
+	case *ast.ReturnStmt:
+		if len(s.Results) != 1 {
+			return false
+		}
+		expr = s.Results[0]
+	case *ast.ExprStmt:
+		expr = s.X
+	default:
+		return false
+	}
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	for _, arg := range call.Args {
+		if !isPlainOperand(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// isPlainOperand reports whether the expression is a name, a field of one or a literal.
+func isPlainOperand(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.Ident, *ast.BasicLit:
+		return true
+	case *ast.SelectorExpr:
+		return isPlainOperand(e.X)
+	}
+	return false
+}
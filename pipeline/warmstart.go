@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+)
+
+// warmStartInstructions asks the model to continue the partially written test file at path:
+// reuse its helpers and setup, follow its naming and leave its declarations alone.
+func warmStartInstructions(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), path, content, parser.SkipObjectResolution)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	var tests, helpers []string
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil && strings.HasPrefix(d.Name.Name, "Test") {
+				tests = append(tests, d.Name.Name)
+			} else if d.Recv == nil {
+				helpers = append(helpers, d.Name.Name)
+			}
+		case *ast.GenDecl:
+			for _, s := range d.Specs {
+				switch s := s.(type) {
+				case *ast.TypeSpec:
+					helpers = append(helpers, s.Name.Name)
+				case *ast.ValueSpec:
+					for _, n := range s.Names {
+						if n.Name != "_" {
+							helpers = append(helpers, n.Name)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "The tests are added to this partially written test file of the package:\n```go\n%s\n```\n", strings.TrimRight(string(content), "\n"))
+	b.WriteString("Write the new test the way its tests are written: the same naming, setup, assertion style and table layout. ")
+	if len(helpers) > 0 {
+		fmt.Fprintf(&b, "Call its helpers, types and fixtures (%s) instead of declaring your own, and do not redeclare them. ", strings.Join(helpers, ", "))
+	}
+	if len(tests) > 0 {
+		fmt.Fprintf(&b, "Do not repeat what %s already cover and give the new test a name none of them has.", strings.Join(tests, ", "))
+	}
+	return strings.TrimSpace(b.String()), nil
+}
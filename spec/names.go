@@ -0,0 +1,122 @@
+package spec
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// transliterations spell the common non-ASCII letters in ASCII. Letters missing here are
+// spelled by their code point, so every name maps to the same identifier on every run.
+var transliterations = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "ae", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i",
+	'ł': "l", 'ľ': "l", 'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "oe", 'ø': "o", 'ō': "o", 'ő': "o", 'œ': "oe",
+	'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ß': "ss", 'ť': "t", 'ţ': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "ue", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh", 'з': "z",
+	'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r",
+	'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya", 'і': "i", 'ї': "yi", 'є': "ye",
+	'α': "a", 'β': "b", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "e", 'θ': "th", 'ι': "i",
+	'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s",
+	'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+}
+
+// transliterate spells the letters and digits of s in ASCII, keeping their case.
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r < unicode.MaxASCII {
+			b.WriteRune(r)
+			continue
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			b.WriteRune(' ')
+			continue
+		}
+		ascii, ok := transliterations[unicode.ToLower(r)]
+		if !ok {
+			ascii = fmt.Sprintf("U%04X", r)
+		} else if unicode.IsUpper(r) && ascii != "" {
+			ascii = strings.ToUpper(ascii[:1]) + ascii[1:]
+		}
+		b.WriteString(ascii)
+	}
+	return b.String()
+}
+
+// FuncName turns a spec name into a valid Go test function name: letters are spelled in
+// ASCII, spaces, dashes and other separators start a new CamelCase word, underscores are kept
+// and the Test prefix is added when missing.
+func FuncName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range transliterate(name) {
+		switch {
+		case r == '_' || r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			if upper {
+				r = unicode.ToUpper(r)
+			}
+			b.WriteRune(r)
+			upper = false
+		default:
+			upper = b.Len() > 0
+		}
+	}
+	ident := b.String()
+	if strings.HasPrefix(strings.ToLower(ident), "test") {
+		if rest := ident[len("test"):]; rest == "" || !unicode.IsLower(rune(rest[0])) {
+			return "Test" + rest
+		}
+	}
+	if ident != "" {
+		ident = strings.ToUpper(ident[:1]) + ident[1:]
+	}
+	return "Test" + ident
+}
+
+// Rename records a spec name changed into a valid test function name.
+type Rename struct {
+	From string
+	To   string
+}
+
+// Normalize renames the specs to valid, unique Go test function names, numbering
+// the duplicates in order, and returns the names changed.
+func Normalize(lists []*List) []Rename {
+	var renames []Rename
+	seen := make(map[string]bool)
+	for _, l := range lists {
+		for i := range l.Specs {
+			s := &l.Specs[i]
+			name := FuncName(s.Name)
+			for n := 2; seen[name]; n++ {
+				name = fmt.Sprintf("%s_%d", FuncName(s.Name), n)
+			}
+			seen[name] = true
+			if name != s.Name {
+				renames = append(renames, Rename{From: s.Name, To: name})
+				s.Name = name
+			}
+		}
+	}
+	return renames
+}
+
+// Identifier turns free text into an ASCII CamelCase identifier fragment.
+func Identifier(text string) string {
+	var b strings.Builder
+	for _, word := range strings.FieldsFunc(transliterate(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		runes := []rune(word)
+		b.WriteRune(unicode.ToUpper(runes[0]))
+		b.WriteString(string(runes[1:]))
+	}
+	return b.String()
+}
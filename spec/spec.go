@@ -0,0 +1,213 @@
+// Package spec loads goptest test specifications from YAML and JSON files and turns their
+// names into valid Go test function names.
+package spec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Spec represents a single test specification.
+type Spec struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"instructions" json:"instructions"`
+}
+
+// List wraps the array of Specs for unmarshalling from YAML
+type List struct {
+	Testing string `yaml:"testing" json:"testing"`
+	Specs   []Spec `yaml:"cases" json:"cases"`
+}
+
+// Error reports which document and field of a spec file could not be loaded.
+type Error struct {
+	Path string
+	// Document is the zero-based index of the document (or JSON array element) that failed,
+	// empty YAML documents included.
+	Document int
+	// Field is the path of the invalid field, e.g. cases[1].name, empty when the document could
+	// not be decoded at all.
+	Field string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s: document %d: %v", e.Path, e.Document, e.Err)
+	}
+	return fmt.Sprintf("%s: document %d: field %s: %v", e.Path, e.Document, e.Field, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Load loads test specifications from a file. YAML files may contain multiple
+// documents and JSON files a single object or an array of objects, one per target.
+func Load(fPath string) ([]*List, error) {
+	file, err := os.Open(fPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		lists []*List
+		docs  []int
+	)
+	if strings.EqualFold(filepath.Ext(fPath), ".json") {
+		lists, docs, err = decodeJSONSpecs(fPath, content)
+	} else {
+		lists, docs, err = decodeYAMLSpecs(fPath, content)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, l := range lists {
+		for j, spec := range l.Specs {
+			if strings.TrimSpace(spec.Name) == "" {
+				return nil, &Error{Path: fPath, Document: docs[i], Field: fmt.Sprintf("cases[%d].name", j), Err: errors.New("missing test name")}
+			}
+		}
+	}
+	return lists, nil
+}
+
+// ValidationError lists the problems that make a list of specs unusable, each naming the
+// field to fix.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// placeholders are instructions left to be written, or their first word.
+var placeholders = map[string]bool{"todo": true, "tbd": true, "fixme": true, "...": true, "…": true}
+
+func isPlaceholder(instructions string) bool {
+	words := strings.Fields(strings.ToLower(instructions))
+	return len(words) > 0 && (placeholders[strings.Join(words, " ")] || placeholders[strings.TrimRight(words[0], ":.!")])
+}
+
+// Validate checks that the list has specs, that their names are unique Go identifiers and
+// that their instructions are written. It returns a *ValidationError.
+func Validate(l *List) error {
+	if len(l.Specs) == 0 {
+		return &ValidationError{Problems: []string{"cases is empty"}}
+	}
+	var problems []string
+	seen := make(map[string]int)
+	for i, s := range l.Specs {
+		name := strings.TrimSpace(s.Name)
+		switch first, dup := seen[name]; {
+		case name == "":
+			problems = append(problems, fmt.Sprintf("cases[%d].name is empty", i))
+		case !token.IsIdentifier(name):
+			problems = append(problems, fmt.Sprintf("cases[%d].name %q is not a valid Go identifier", i, name))
+		case dup:
+			problems = append(problems, fmt.Sprintf("cases[%d].name %s repeats cases[%d].name", i, name, first))
+		}
+		if _, ok := seen[name]; !ok {
+			seen[name] = i
+		}
+		instructions := strings.TrimSpace(s.Description)
+		switch {
+		case instructions == "":
+			problems = append(problems, fmt.Sprintf("cases[%d].instructions is empty", i))
+		case isPlaceholder(instructions):
+			problems = append(problems, fmt.Sprintf("cases[%d].instructions is a placeholder: %q", i, instructions))
+		}
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// decodeYAMLSpecs decodes the documents of a YAML file, skipping empty ones. docs holds the
+// index of the document of every list.
+func decodeYAMLSpecs(fPath string, content []byte) (lists []*List, docs []int, err error) {
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for i := 0; ; i++ {
+		var specList List
+		err := dec.Decode(&specList)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, &Error{Path: fPath, Document: i, Err: err}
+		}
+		if specList.Testing == "" && len(specList.Specs) == 0 {
+			// Empty documents, e.g. between two "---".
+			continue
+		}
+		lists = append(lists, &specList)
+		docs = append(docs, i)
+	}
+	return lists, docs, nil
+}
+
+// decodeJSONSpecs decodes a JSON object or array of objects. docs holds the index of the
+// array element of every list.
+func decodeJSONSpecs(fPath string, content []byte) (lists []*List, docs []int, err error) {
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, nil, &Error{Path: fPath, Err: err}
+		}
+		for i, r := range raw {
+			var specList List
+			if err := json.Unmarshal(r, &specList); err != nil {
+				return nil, nil, &Error{Path: fPath, Document: i, Field: jsonErrorField(err), Err: err}
+			}
+			lists = append(lists, &specList)
+			docs = append(docs, i)
+		}
+		return lists, docs, nil
+	}
+	var specList List
+	if err := json.Unmarshal(trimmed, &specList); err != nil {
+		return nil, nil, &Error{Path: fPath, Field: jsonErrorField(err), Err: err}
+	}
+	return []*List{&specList}, []int{0}, nil
+}
+
+// jsonErrorField returns the field of a JSON type error in the cases[i].name form of the
+// other errors, "" for other errors.
+func jsonErrorField(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		return ""
+	}
+	var b strings.Builder
+	for i, part := range strings.Split(typeErr.Field, ".") {
+		if _, err := strconv.Atoi(part); err == nil && i > 0 {
+			fmt.Fprintf(&b, "[%s]", part)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
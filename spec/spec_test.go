@@ -0,0 +1,141 @@
+package spec
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	testCases := []struct {
+		file      string
+		wantCases map[string]int
+		wantDoc   int
+		wantField string
+	}{
+		{file: "single.yaml", wantCases: map[string]int{"Add function": 2}},
+		{file: "multi.yaml", wantCases: map[string]int{"Add function": 1, "Sub function": 1}},
+		{file: "targets.json", wantCases: map[string]int{"Add function": 1, "Sub function": 1}},
+		{file: "bad_field.json", wantDoc: 1, wantField: "cases[0].name"},
+		{file: "missing_name.yaml", wantDoc: 1, wantField: "cases[1].name"},
+		{file: "missing_name_after_empty.yaml", wantDoc: 2, wantField: "cases[1].name"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.file, func(t *testing.T) {
+			lists, err := Load(filepath.Join("testdata", tc.file))
+			if tc.wantCases == nil {
+				var specErr *Error
+				if !errors.As(err, &specErr) {
+					t.Fatalf("expected a *Error, got %v", err)
+				}
+				if specErr.Document != tc.wantDoc || specErr.Field != tc.wantField {
+					t.Errorf("got document %d field %q, want document %d field %q",
+						specErr.Document, specErr.Field, tc.wantDoc, tc.wantField)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]int)
+			for _, l := range lists {
+				got[l.Testing] += len(l.Specs)
+			}
+			if !reflect.DeepEqual(got, tc.wantCases) {
+				t.Errorf("got cases %v, want %v", got, tc.wantCases)
+			}
+		})
+	}
+}
+
+func TestNames(t *testing.T) {
+	testCases := []struct {
+		name string
+		want string
+	}{
+		{name: "TestAdd_Positive", want: "TestAdd_Positive"},
+		{name: "adds two numbers", want: "TestAddsTwoNumbers"},
+		{name: "test-add negative", want: "TestAddNegative"},
+		{name: "testing mode", want: "TestTestingMode"},
+		{name: "Test Größe prüfen", want: "TestGroessePruefen"},
+		{name: "TestПривет мир", want: "TestPrivetMir"},
+		{name: "Test 日本", want: "TestU65E5U672C"},
+		{name: "test_empty input", want: "Test_emptyInput"},
+		{name: "", want: "Test"},
+	}
+	for _, tc := range testCases {
+		if got := FuncName(tc.name); got != tc.want {
+			t.Errorf("FuncName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	lists := []*List{{Testing: "Add", Specs: []Spec{{Name: "TestAdd"}, {Name: "test add"}, {Name: "adds"}}}}
+	renamed := Normalize(lists)
+	want := []Rename{{From: "test add", To: "TestAdd_2"}, {From: "adds", To: "TestAdds"}}
+	if !reflect.DeepEqual(renamed, want) {
+		t.Errorf("Normalize() = %+v, want %+v", renamed, want)
+	}
+	if lists[0].Specs[1].Name != "TestAdd_2" {
+		t.Errorf("the spec was not renamed: %+v", lists[0].Specs)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name  string
+		specs []Spec
+		want  []string
+	}{
+		{name: "valid", specs: []Spec{{Name: "TestAdd_Positive", Description: "1. Add 1 and 2\n2. Expect 3"}}},
+		{name: "no cases", want: []string{"cases is empty"}},
+		{
+			name: "invalid names",
+			specs: []Spec{
+				{Name: "TestAdd", Description: "add"},
+				{Name: " ", Description: "add"},
+				{Name: "adds two numbers", Description: "add"},
+				{Name: "TestAdd", Description: "add again"},
+			},
+			want: []string{
+				"cases[1].name is empty",
+				`cases[2].name "adds two numbers" is not a valid Go identifier`,
+				"cases[3].name TestAdd repeats cases[0].name",
+			},
+		},
+		{
+			name: "placeholder instructions",
+			specs: []Spec{
+				{Name: "TestA", Description: ""},
+				{Name: "TestB", Description: "TODO: describe the inputs"},
+				{Name: "TestC", Description: " ... "},
+				{Name: "TestD", Description: "Add a todo item and expect it listed"},
+			},
+			want: []string{
+				"cases[0].instructions is empty",
+				`cases[1].instructions is a placeholder: "TODO: describe the inputs"`,
+				`cases[2].instructions is a placeholder: "..."`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Validate(&List{Specs: tc.specs})
+			if tc.want == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var valErr *ValidationError
+			if !errors.As(err, &valErr) {
+				t.Fatalf("expected a *ValidationError, got %v", err)
+			}
+			if !reflect.DeepEqual(valErr.Problems, tc.want) {
+				t.Errorf("got problems %q, want %q", valErr.Problems, tc.want)
+			}
+		})
+	}
+}